@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	"github.com/enmand/quarid-go/pkg/bot"
 	"github.com/enmand/quarid-go/pkg/config"
 	"github.com/enmand/quarid-go/pkg/http"
 	"github.com/enmand/quarid-go/pkg/logger"
@@ -29,5 +30,21 @@ func main() {
 		gin.Logger(),
 		gin.Recovery(),
 	)
+
+	// Adapters that receive webhooks (such as Telegram's) are served by our
+	// router, so the bot runs here, instead of in quaridirc
+	if c.GetBool("telegram.enable") && c.GetString("telegram.webhook.url") != "" {
+		q := bot.New(&c)
+		q.Mount(r)
+
+		go func() {
+			if err := q.Connect(); err != nil {
+				logger.Log.Errorf("%s", err)
+				os.Exit(-1)
+			}
+		}()
+		defer q.Disconnect()
+	}
+
 	r.Run(c.GetString("listen"))
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/enmand/quarid-go/pkg/bot"
@@ -11,7 +12,16 @@ import (
 func main() {
 	c := config.Get()
 
-	logger.Log.Info("Loading IRC bot...")
+	if c.GetString("replay.file") != "" {
+		replay(c)
+		return
+	}
+
+	if c.GetBool("console.enable") {
+		logger.Log.Info("Loading bot on the console...")
+	} else {
+		logger.Log.Info("Loading IRC bot...")
+	}
 
 	q := bot.New(&c)
 
@@ -23,3 +33,28 @@ func main() {
 		q.Disconnect()
 	}()
 }
+
+// replay a recorded session to the bot, and print each difference between
+// what the bot said and what was recorded. If there are any, we exit with 1
+func replay(c config.Config) {
+	logger.Log.Infof("Replaying %s...", c.GetString("replay.file"))
+
+	q := bot.New(&c)
+
+	diffs, err := q.ReplayRecording()
+	q.Disconnect()
+	if err != nil {
+		logger.Log.Errorf("%s", err)
+		os.Exit(-1)
+	}
+
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	if len(diffs) > 0 {
+		logger.Log.Warningf("%d differences from the recording", len(diffs))
+		os.Exit(1)
+	}
+
+	logger.Log.Info("The replay matches the recording")
+}
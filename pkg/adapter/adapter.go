@@ -27,13 +27,28 @@ type EventsHandler interface {
 	Handle(f []Filter, h HandlerFunc)
 }
 
-// An Adapter is an interface for adapting events
+// An Adapter connects to a chat network, and translates between the
+// network's native events and the neutral Updates in this package (see
+// adapter_model.go)
 type Adapter interface {
-	Connect() bool
+	// Name of the adapter, which the Messages it receives are tagged with
+	Name() string
+
+	// Connect to the network
+	Connect() error
+
+	// Disconnect from the network
 	Disconnect() error
 
-	EventsHandler
-	Responder
+	// Wait blocks while connected, and returns the error that disconnected us
+	Wait() error
+
+	// Receive calls f with each Update from the network
+	Receive(f UpdateFunc)
+
+	// Send an Update to the network. If a message was sent, it is returned as
+	// the network delivered it
+	Send(u Update) (*Message, error)
 }
 
 // Filters
@@ -48,6 +63,9 @@ type Filter interface {
 
 // Event represents a single events read from the IRC server
 type Event struct {
+	// Tags sent with the event (for example, IRCv3 message tags)
+	Tags map[string]string
+
 	// The event prefix (optional in spec)
 	Prefix string
 
@@ -59,4 +77,10 @@ type Event struct {
 
 	// The time the Event was recieved
 	Timestamp time.Time
+
+	// Events grouped together with this event (for example, an IRCv3 batch)
+	Batch []*Event
+
+	// Historical events are replayed from history, rather than happening now
+	Historical bool
 }
@@ -0,0 +1,302 @@
+package adapter
+
+// Middleware
+//
+// Middleware sits between a network and whatever handles its events, and
+// between whatever responds and the network, for things that apply to every
+// event: ignore lists, logging, cleaning up what is sent, or not sending
+// anything at all. Each Middleware in a Chain is given an event, and passes
+// it on to the next: unchanged, changed, not at all (dropping it), or more
+// than once (fanning it out). Events pass through a Chain in order, both in
+// and out.
+//
+// Adapters that are not driven by Events (any but IRC's) can be wrapped, so
+// that their messages pass through a Chain as the events IRC would have for
+// them.
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrDropped is returned when an event written was dropped by middleware
+var ErrDropped = errors.New("Dropped by middleware")
+
+// Middleware inspects, changes, drops or fans out events, on their way in
+// from the server, and on their way out to it
+type Middleware interface {
+	// Inbound passes an event read from the server on, to next
+	Inbound(ev *Event, next func(ev *Event))
+
+	// Outbound passes an event being written to the server on, to next
+	Outbound(ev *Event, next func(ev *Event) error) error
+}
+
+// InboundFunc is Middleware for events read from the server only
+type InboundFunc func(ev *Event, next func(ev *Event))
+
+// Inbound calls f
+func (f InboundFunc) Inbound(ev *Event, next func(ev *Event)) {
+	f(ev, next)
+}
+
+// Outbound passes ev on, unchanged
+func (f InboundFunc) Outbound(ev *Event, next func(ev *Event) error) error {
+	return next(ev)
+}
+
+// OutboundFunc is Middleware for events written to the server only
+type OutboundFunc func(ev *Event, next func(ev *Event) error) error
+
+// Inbound passes ev on, unchanged
+func (f OutboundFunc) Inbound(ev *Event, next func(ev *Event)) {
+	next(ev)
+}
+
+// Outbound calls f
+func (f OutboundFunc) Outbound(ev *Event, next func(ev *Event) error) error {
+	return f(ev, next)
+}
+
+// Chain is Middleware, in the order events pass through it
+type Chain []Middleware
+
+// In passes ev through the chain, and calls h with each event that comes out
+// of it
+func (c Chain) In(ev *Event, h func(ev *Event)) {
+	if len(c) == 0 {
+		h(ev)
+		return
+	}
+
+	c[0].Inbound(ev, func(ev *Event) {
+		c[1:].In(ev, h)
+	})
+}
+
+// Out passes ev through the chain, and writes each event that comes out of it
+// with w. If none do, ErrDropped is returned
+func (c Chain) Out(ev *Event, w func(ev *Event) error) error {
+	written := false
+	err := c.out(ev, func(ev *Event) error {
+		written = true
+		return w(ev)
+	})
+	if err == nil && !written {
+		return ErrDropped
+	}
+
+	return err
+}
+
+func (c Chain) out(ev *Event, w func(ev *Event) error) error {
+	if len(c) == 0 {
+		return w(ev)
+	}
+
+	return c[0].Outbound(ev, func(ev *Event) error {
+		return c[1:].out(ev, w)
+	})
+}
+
+// Handler wraps an EventsHandler, so that events pass through the chain
+// (once, however many handlers there are) before they are filtered and
+// handled, and what handlers write passes through it too
+func (c Chain) Handler(h EventsHandler) EventsHandler {
+	return &chainHandler{chain: c, handler: h}
+}
+
+// Responder wraps a Responder, so that what is written passes through the
+// chain
+func (c Chain) Responder(r Responder) Responder {
+	return &chainResponder{chain: c, responder: r}
+}
+
+type chainHandler struct {
+	chain   Chain
+	handler EventsHandler
+
+	// Handlers can be added while events are being handled
+	mu       sync.Mutex
+	handlers []*Handler
+}
+
+// Handle events that match any of the filters f, after they pass through the
+// chain
+func (ch *chainHandler) Handle(f []Filter, h HandlerFunc) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if len(ch.handlers) == 0 {
+		ch.handler.Handle([]Filter{matchAll{}}, ch.handle)
+	}
+
+	ch.handlers = append(ch.handlers, &Handler{Filters: f, Handler: h})
+}
+
+func (ch *chainHandler) handle(ev *Event, r Responder) {
+	r = ch.chain.Responder(r)
+
+	ch.mu.Lock()
+	hs := append([]*Handler(nil), ch.handlers...)
+	ch.mu.Unlock()
+
+	ch.chain.In(ev, func(ev *Event) {
+		for _, h := range hs {
+			for _, f := range h.Filters {
+				if f.Match(ev) {
+					h.Handler(ev, r)
+					break
+				}
+			}
+		}
+	})
+}
+
+type chainResponder struct {
+	chain     Chain
+	responder Responder
+}
+
+func (cr *chainResponder) Write(ev *Event) error {
+	return cr.chain.Out(ev, cr.responder.Write)
+}
+
+// matchAll is a Filter that matches every event
+type matchAll struct{}
+
+func (matchAll) Match(*Event) bool {
+	return true
+}
+
+// Wrap an Adapter, so that the messages it receives and sends pass through
+// the chain, as PRIVMSG or NOTICE events with the room and text as their
+// parameters (as IRC would have them). Other Updates do not pass through it
+func Wrap(a Adapter, c Chain) Adapter {
+	return &wrapped{Adapter: a, chain: c}
+}
+
+type wrapped struct {
+	Adapter
+	chain Chain
+}
+
+// Unwrap returns the wrapped Adapter
+func (w *wrapped) Unwrap() Adapter {
+	return w.Adapter
+}
+
+func (w *wrapped) Receive(f UpdateFunc) {
+	w.Adapter.Receive(func(u Update, _ Adapter) {
+		m, ok := u.(*Message)
+		if !ok {
+			f(u, w)
+			return
+		}
+
+		w.chain.In(MessageEvent(m), func(ev *Event) {
+			if m := EventMessage(m, ev); m != nil {
+				f(m, w)
+			}
+		})
+	})
+}
+
+func (w *wrapped) Send(u Update) (*Message, error) {
+	var m *Message
+	var send func(m *Message) (*Message, error)
+
+	switch u := u.(type) {
+	case *Message:
+		m = u
+		send = func(m *Message) (*Message, error) {
+			return w.Adapter.Send(m)
+		}
+	case *Reply:
+		if u.To == nil {
+			return w.Adapter.Send(u)
+		}
+
+		m = &Message{Room: u.To.Room, Kind: u.Kind, Text: u.Text}
+		send = func(m *Message) (*Message, error) {
+			return w.Adapter.Send(&Reply{To: u.To, Kind: m.Kind, Text: m.Text})
+		}
+	default:
+		return w.Adapter.Send(u)
+	}
+
+	var last *Message
+	err := w.chain.Out(MessageEvent(m), func(ev *Event) error {
+		out := EventMessage(m, ev)
+		if out == nil {
+			return ErrNotSupported
+		}
+
+		d, err := send(out)
+		if d != nil {
+			last = d
+		}
+		return err
+	})
+
+	return last, err
+}
+
+// MessageEvent is the event for a message, as IRC would have it
+func MessageEvent(m *Message) *Event {
+	ev := &Event{
+		Prefix:     m.User.Mask,
+		Command:    "PRIVMSG",
+		Parameters: []string{m.Room.ID, m.Text},
+		Timestamp:  m.Time,
+		Historical: m.Historical,
+	}
+	if ev.Prefix == "" {
+		ev.Prefix = m.User.ID
+	}
+	if m.Raw != nil && len(m.Raw.Tags) > 0 {
+		ev.Tags = make(map[string]string, len(m.Raw.Tags))
+		for k, v := range m.Raw.Tags {
+			ev.Tags[k] = v
+		}
+	}
+	if _, ok := ev.Tags["account"]; !ok && m.User.Account != "" {
+		if ev.Tags == nil {
+			ev.Tags = make(map[string]string)
+		}
+		ev.Tags["account"] = m.User.Account
+	}
+
+	switch m.Kind {
+	case Notice:
+		ev.Command = "NOTICE"
+	case Action:
+		ev.Parameters[1] = "\x01ACTION " + m.Text + "\x01"
+	}
+
+	return ev
+}
+
+// EventMessage is the message m, as changed by the event ev, or nil if ev is
+// not a message
+func EventMessage(m *Message, ev *Event) *Message {
+	if len(ev.Parameters) < 2 || (ev.Command != "PRIVMSG" && ev.Command != "NOTICE") {
+		return nil
+	}
+
+	out := *m
+	if ev.Parameters[0] != m.Room.ID {
+		out.Room = Room{ID: ev.Parameters[0], Name: ev.Parameters[0], Private: m.Room.Private}
+	}
+
+	out.Kind, out.Text = Text, ev.Parameters[1]
+	if ev.Command == "NOTICE" {
+		out.Kind = Notice
+	} else if strings.HasPrefix(out.Text, "\x01ACTION ") {
+		out.Kind = Action
+		out.Text = strings.TrimSuffix(strings.TrimPrefix(out.Text, "\x01ACTION "), "\x01")
+	}
+
+	return &out
+}
@@ -0,0 +1,74 @@
+package adapter_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+type all struct{}
+
+func (all) Match(*adapter.Event) bool { return true }
+
+// events is an EventsHandler that hands out the events it is given
+type events struct {
+	mu sync.Mutex
+	hs []adapter.HandlerFunc
+}
+
+func (e *events) Handle(f []adapter.Filter, h adapter.HandlerFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.hs = append(e.hs, h)
+}
+
+func (e *events) send(ev *adapter.Event) {
+	e.mu.Lock()
+	hs := append([]adapter.HandlerFunc(nil), e.hs...)
+	e.mu.Unlock()
+
+	for _, h := range hs {
+		h(ev, nil)
+	}
+}
+
+func TestChainHandlerConcurrent(t *testing.T) {
+	e := &events{}
+	h := adapter.Chain{}.Handler(e)
+
+	var mu sync.Mutex
+	handled := 0
+	count := func(*adapter.Event, adapter.Responder) {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	}
+	h.Handle([]adapter.Filter{all{}}, count)
+
+	// Handlers are added while events are being handled
+	var wg sync.WaitGroup
+	for n := 0; n < 50; n++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			e.send(&adapter.Event{Command: "PRIVMSG"})
+		}()
+		go func() {
+			defer wg.Done()
+			h.Handle([]adapter.Filter{all{}}, func(*adapter.Event, adapter.Responder) {})
+		}()
+	}
+	wg.Wait()
+
+	if handled != 50 {
+		t.Fatalf("Expected 50 events to be handled, but got %d", handled)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.hs) != 1 {
+		t.Fatalf("Expected the chain to be handled once, but it was %d times", len(e.hs))
+	}
+}
@@ -0,0 +1,227 @@
+package adapter
+
+// Model
+//
+// Every chat network has its own events, but they share a model: users send
+// messages to rooms, messages may be replies, edits or reactions, and users
+// join and leave rooms. Adapters translate their network's native events into
+// these Updates, and back, so that the bot and its plugins can work on any
+// network.
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotSupported is returned when an adapter's network cannot do something,
+// such as editing a message
+var ErrNotSupported = errors.New("Not supported by this network")
+
+// User is someone on a chat network
+type User struct {
+	// The user's ID on the network, which does not change if they rename
+	// themselves (on IRC, this is their nick)
+	ID string
+
+	// The user's name, as it is displayed
+	Name string
+
+	// The account the user is authenticated as, if the network says
+	Account string
+
+	// The user's address on the network, if it has one (e.g. an IRC hostmask)
+	Mask string
+}
+
+// Room is a place messages are sent to: a channel, room, group chat, or a
+// private conversation with a single user
+type Room struct {
+	// The room's ID on the network
+	ID string
+
+	// The room's name, as it is displayed
+	Name string
+
+	// Private rooms are direct conversations with a single user
+	Private bool
+}
+
+// Kind is the kind of a message
+type Kind int
+
+// Kinds of messages
+const (
+	// Text is an ordinary message
+	Text Kind = iota
+
+	// Notice is a message that should not be replied to automatically
+	Notice
+
+	// Action is a message describing the user (e.g. "/me waves")
+	Action
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Notice:
+		return "notice"
+	case Action:
+		return "action"
+	}
+
+	return "text"
+}
+
+// Update is something that happened on a chat network, or that an adapter
+// is asked to do: a *Message, *Reply, *Edit, *Reaction, *Membership or
+// *Topic
+type Update interface {
+	update()
+}
+
+// Message is a message sent by a user to a room
+type Message struct {
+	// The adapter the message came from, or was sent with
+	Adapter string
+
+	// The message's ID on the network, if it has one
+	ID string
+
+	Room Room
+	User User
+	Kind Kind
+
+	// The text of the message
+	Text string
+
+	// The ID of the message this message replies to, if any, and the thread
+	// the message is in, on networks that have threads
+	ReplyTo string
+	Thread  string
+
+	// When the message was sent
+	Time time.Time
+
+	// Historical messages are replayed from history, rather than happening now
+	Historical bool
+
+	// The adapter's native event, if it has one
+	Raw *Event
+}
+
+// Reply is a message replying to another message
+type Reply struct {
+	// The message being replied to
+	To *Message
+
+	Kind Kind
+	Text string
+}
+
+// Edit changes the text of a message
+type Edit struct {
+	// The adapter the edit came from
+	Adapter string
+
+	// The message being edited, and its new text
+	Message *Message
+	Text    string
+
+	// The user who edited the message
+	User User
+
+	Time time.Time
+}
+
+// Reaction is a reaction (usually an emoji) to a message
+type Reaction struct {
+	// The adapter the reaction came from
+	Adapter string
+
+	// The room the message is in, and its ID
+	Room      Room
+	MessageID string
+
+	// The user who reacted
+	User User
+
+	Reaction string
+
+	// Removed reactions were taken back
+	Removed bool
+
+	Time time.Time
+}
+
+// MembershipKind is a change in a room's members
+type MembershipKind int
+
+// Kinds of membership changes
+const (
+	// Join a room
+	Join MembershipKind = iota
+
+	// Leave a room
+	Leave
+
+	// Kick a user from a room
+	Kick
+
+	// Invite a user to a room
+	Invite
+
+	// Quit the network, leaving every room
+	Quit
+
+	// Rename a user
+	Rename
+)
+
+// Membership is a user joining, leaving or being removed from a room
+type Membership struct {
+	// The adapter the membership change came from
+	Adapter string
+
+	Kind MembershipKind
+
+	// The room, if the change is to a single room
+	Room Room
+
+	// The user whose membership changed
+	User User
+
+	// The user who made the change, if it was someone else (e.g. a kick)
+	Actor *User
+
+	// The reason given for the change, and, for renames, the user's new name
+	Reason  string
+	NewName string
+
+	Time time.Time
+}
+
+// Topic is a room's topic being changed
+type Topic struct {
+	// The adapter the topic change came from
+	Adapter string
+
+	Room Room
+
+	// The user who changed the topic
+	User User
+
+	// The new topic
+	Topic string
+
+	Time time.Time
+}
+
+func (*Message) update()    {}
+func (*Reply) update()      {}
+func (*Edit) update()       {}
+func (*Reaction) update()   {}
+func (*Membership) update() {}
+func (*Topic) update()      {}
+
+// UpdateFunc is called with each Update from an adapter
+type UpdateFunc func(u Update, a Adapter)
@@ -3,6 +3,8 @@ package bot
 import (
 	"fmt"
 
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/bus"
 	"github.com/enmand/quarid-go/pkg/config"
 	"github.com/enmand/quarid-go/pkg/plugin"
 	"github.com/enmand/quarid-go/vm"
@@ -24,6 +26,18 @@ type Bot interface {
 
 	// A list of VMs that the bot has available
 	VMs() map[string]vm.VM
+
+	// The bot's event bus, which plugins and crates can publish to, and
+	// subscribe on
+	Bus() *bus.Bus
+
+	// The commands users can call, which Go code can register more of
+	Commands() *Commands
+
+	// Whether an event read from the IRC server, or a message from any
+	// adapter, was sent by one of the configured admins
+	IsAdmin(ev *adapter.Event) bool
+	IsAdminMessage(m *adapter.Message) bool
 }
 
 // New returns a new instance of a Bot
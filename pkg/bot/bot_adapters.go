@@ -0,0 +1,183 @@
+package bot
+
+import (
+	"os"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/console"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/discord"
+	"github.com/enmand/quarid-go/pkg/http"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/enmand/quarid-go/pkg/matrix"
+	"github.com/enmand/quarid-go/pkg/mattermost"
+	"github.com/enmand/quarid-go/pkg/slack"
+	"github.com/enmand/quarid-go/pkg/telegram"
+	"github.com/enmand/quarid-go/pkg/xmpp"
+	"github.com/gin-gonic/gin"
+)
+
+// adapterBuilders build the adapters for networks besides IRC, by the name of
+// their configuration section. Each is only built if "<name>.enable" is set
+var adapterBuilders = map[string]func(q *quarid) (adapter.Adapter, error){
+	matrix.ADAPTER_NAME:     (*quarid).matrixAdapter,
+	xmpp.ADAPTER_NAME:       (*quarid).xmppAdapter,
+	discord.ADAPTER_NAME:    (*quarid).discordAdapter,
+	slack.ADAPTER_NAME:      (*quarid).slackAdapter,
+	telegram.ADAPTER_NAME:   (*quarid).telegramAdapter,
+	mattermost.ADAPTER_NAME: (*quarid).mattermostAdapter,
+	console.ADAPTER_NAME:    (*quarid).consoleAdapter,
+}
+
+// mounter is an adapter that serves HTTP (such as a webhook), on quaridd's
+// router
+type mounter interface {
+	Mount(r *gin.RouterGroup) error
+}
+
+// addAdapters adds an adapter for each network that is enabled, wrapped
+// with its middleware
+func (q *quarid) addAdapters() error {
+	for name, build := range adapterBuilders {
+		if !q.Config.GetBool(name + ".enable") {
+			continue
+		}
+
+		a, err := build(q)
+		if err != nil {
+			return err
+		}
+		if a, err = q.wrap(a); err != nil {
+			return err
+		}
+		q.adapters = append(q.adapters, a)
+	}
+
+	return nil
+}
+
+// Mount the HTTP handlers of each adapter that has them on a router. They
+// must be mounted before connecting
+func (q *quarid) Mount(r http.RouterEngine) {
+	for _, a := range q.adapters {
+		a = unwrap(a)
+
+		m, ok := a.(mounter)
+		if !ok {
+			continue
+		}
+
+		if err := m.Mount(&r.RouterGroup); err != nil {
+			logger.Log.Warningf("Could not mount %s on the router: %s", a.Name(), err)
+		}
+	}
+}
+
+// matrixAdapter builds the Matrix adapter, from the "matrix" configuration
+func (q *quarid) matrixAdapter() (adapter.Adapter, error) {
+	m := matrix.New(q.Config.GetString("matrix.homeserver"), database.GetStore())
+	m.User = q.Config.GetString("matrix.user")
+	m.Password = q.Config.GetString("matrix.password")
+	m.AccessToken = q.Config.GetString("matrix.access_token")
+	m.DeviceID = q.Config.GetString("matrix.device_id")
+	m.Rooms = q.Config.GetStringSlice("matrix.rooms")
+	m.AutoJoin = q.Config.GetBool("matrix.auto_join")
+
+	return m, nil
+}
+
+// xmppAdapter builds the XMPP adapter, from the "xmpp" configuration. Rooms
+// are given as "room@service", or "room@service password"
+func (q *quarid) xmppAdapter() (adapter.Adapter, error) {
+	x := xmpp.New(q.Config.GetString("xmpp.jid"), q.Config.GetString("xmpp.password"))
+	x.Server = q.Config.GetString("xmpp.server")
+	x.DirectTLS = q.Config.GetBool("xmpp.tls.direct")
+	x.TLSVerify = q.Config.GetBool("xmpp.tls.verify")
+	x.AllowPlaintext = q.Config.GetBool("xmpp.tls.allow_plaintext")
+	x.AutoJoin = q.Config.GetBool("xmpp.auto_join")
+	if n := q.Config.GetString("xmpp.nick"); n != "" {
+		x.Nick = n
+	}
+	if q.Config.IsSet("xmpp.history") {
+		x.History = q.Config.GetInt("xmpp.history")
+	}
+
+	for _, r := range q.Config.GetStringSlice("xmpp.rooms") {
+		ts := strings.SplitN(r, " ", 2)
+		password := ""
+		if len(ts) == 2 {
+			password = ts[1]
+		}
+		x.AddRoom(ts[0], password)
+	}
+
+	return x, nil
+}
+
+// discordAdapter builds the Discord adapter, from the "discord" configuration
+func (q *quarid) discordAdapter() (adapter.Adapter, error) {
+	d := discord.New(q.Config.GetString("discord.token"))
+	if u := q.Config.GetString("discord.api_url"); u != "" {
+		d.APIURL = u
+	}
+	d.GatewayURL = q.Config.GetString("discord.gateway_url")
+	if q.Config.IsSet("discord.intents") {
+		d.Intents = q.Config.GetInt("discord.intents")
+	}
+
+	return d, nil
+}
+
+// slackAdapter builds the Slack adapter, from the "slack" configuration
+func (q *quarid) slackAdapter() (adapter.Adapter, error) {
+	s := slack.New(q.Config.GetString("slack.app_token"), q.Config.GetString("slack.bot_token"))
+	if u := q.Config.GetString("slack.api_url"); u != "" {
+		s.APIURL = u
+	}
+
+	return s, nil
+}
+
+// telegramAdapter builds the Telegram adapter, from the "telegram"
+// configuration. If a webhook URL is given, the adapter must be mounted on
+// quaridd's router
+func (q *quarid) telegramAdapter() (adapter.Adapter, error) {
+	t := telegram.New(q.Config.GetString("telegram.token"), database.GetStore())
+	if u := q.Config.GetString("telegram.api_url"); u != "" {
+		t.APIURL = u
+	}
+	t.WebhookURL = q.Config.GetString("telegram.webhook.url")
+	t.WebhookSecret = q.Config.GetString("telegram.webhook.secret")
+
+	return t, nil
+}
+
+// mattermostAdapter builds the Mattermost adapter, from the "mattermost"
+// configuration. Rooms are given as "team/channel"
+func (q *quarid) mattermostAdapter() (adapter.Adapter, error) {
+	m := mattermost.New(q.Config.GetString("mattermost.url"), q.Config.GetString("mattermost.token"))
+	m.Rooms = q.Config.GetStringSlice("mattermost.rooms")
+
+	return m, nil
+}
+
+// consoleAdapter builds the console adapter, from the "console"
+// configuration, to talk to the bot on stdin and stdout
+func (q *quarid) consoleAdapter() (adapter.Adapter, error) {
+	c := console.New(os.Stdin, os.Stdout)
+	if n := q.Config.GetString("irc.nick"); n != "" {
+		c.Nick = n
+	}
+	if u := q.Config.GetString("console.user"); u != "" {
+		c.User = u
+	}
+	if r := q.Config.GetString("console.channel"); r != "" {
+		c.Room = r
+	}
+	if q.Config.IsSet("console.color") {
+		c.Color = q.Config.GetBool("console.color")
+	}
+
+	return c, nil
+}
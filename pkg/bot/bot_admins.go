@@ -0,0 +1,231 @@
+package bot
+
+// Admins
+//
+// Admins are given in "irc.admins" by who they are, rather than by nick, which
+// anyone may take:
+//
+//	"account:enmand"           logged in to services as enmand
+//	"mask:*!*@staff.unerror"   with a nick!user@host matching the pattern
+//	"certfp:8a1c..."           connected with that TLS client certificate
+//
+// Accounts are known from the server's account tags (and extended-join, and
+// account-notify), or looked up with WHOIS, as are certificate fingerprints.
+// Admins are verified on IRC; on other adapters, only the console's user (who
+// is running the bot) is an admin. Messages are only trusted as far as the
+// adapter they came from, so plugins are given a ref for each message, by
+// which the original is found again when they ask whether it is an admin's.
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/console"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/enmand/quarid-go/pkg/middleware"
+	"github.com/enmand/quarid-go/pkg/plugin"
+	"github.com/enmand/quarid-go/pkg/recorder"
+)
+
+// Kinds of admin entries
+const (
+	adminAccount = "account"
+	adminMask    = "mask"
+	adminCertFP  = "certfp"
+)
+
+// admins are who the configured irc.admins are
+type admins struct {
+	accounts []string
+	masks    []string
+	certfps  []string
+}
+
+// parseAdmins parses the entries in irc.admins. Entries without a kind are
+// taken to be accounts
+func parseAdmins(entries []string) *admins {
+	as := &admins{}
+
+	for _, e := range entries {
+		kind, value := adminAccount, e
+		if i := strings.IndexByte(e, ':'); i >= 0 {
+			kind, value = strings.ToLower(e[:i]), strings.TrimSpace(e[i+1:])
+		} else {
+			logger.Log.Warningf(
+				"Admin %s is taken to be an account: give it as \"account:%s\", or as a mask or certfp",
+				e, e,
+			)
+		}
+		if value == "" {
+			continue
+		}
+
+		switch kind {
+		case adminAccount:
+			as.accounts = append(as.accounts, value)
+		case adminMask:
+			as.masks = append(as.masks, value)
+		case adminCertFP:
+			as.certfps = append(as.certfps, normalizeCertFP(value))
+		default:
+			logger.Log.Warningf("Unknown kind of admin %s, in %s", kind, e)
+		}
+	}
+
+	return as
+}
+
+// normalizeCertFP lowercases a fingerprint, without any colons
+func normalizeCertFP(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+// IsAdmin reports whether ev, read from the IRC server, was sent by one of the
+// configured irc.admins. It may block, while the sender is looked up with
+// WHOIS
+func (q *quarid) IsAdmin(ev *adapter.Event) bool {
+	if ev == nil || !strings.Contains(ev.Prefix, "!") {
+		return false
+	}
+
+	as := q.admins
+	nick := irc.ParseHostmask(ev.Prefix).Nick
+
+	for _, m := range as.masks {
+		if middleware.Match(m, ev.Prefix) {
+			return true
+		}
+	}
+
+	if len(as.accounts) > 0 {
+		account, known := ev.Tags["account"]
+		if !known {
+			if id, ok := q.IRC.CachedIdentity(nick); ok {
+				account, known = id.Account, true
+			}
+		}
+		if !known {
+			if id, err := q.IRC.Identify(nick); err == nil {
+				account = id.Account
+			} else {
+				logger.Log.Warningf("Could not look up %s: %s", nick, err)
+			}
+		}
+
+		for _, a := range as.accounts {
+			if account != "" && strings.EqualFold(a, account) {
+				return true
+			}
+		}
+	}
+
+	if len(as.certfps) > 0 {
+		id, err := q.IRC.Identify(nick)
+		if err != nil {
+			logger.Log.Warningf("Could not look up %s: %s", nick, err)
+			return false
+		}
+
+		fp := normalizeCertFP(id.CertFP)
+		for _, c := range as.certfps {
+			if fp != "" && fp == c {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsAdminMessage reports whether m was sent by an admin, from any adapter. m
+// must be one of the messages the bot received most recently: it is only
+// trusted as far as the adapter it came from
+func (q *quarid) IsAdminMessage(m *adapter.Message) bool {
+	a, ok := q.received.source(m)
+	if !ok {
+		return false
+	}
+
+	switch a := unwrap(a); {
+	case a == adapter.Adapter(q.ircAdapter):
+		return q.IsAdmin(m.Raw)
+	case isConsole(a):
+		return true
+	}
+
+	return false
+}
+
+// isConsole reports whether a is the console, or a recording of it
+func isConsole(a adapter.Adapter) bool {
+	switch a := a.(type) {
+	case *console.Console:
+		return true
+	case *recorder.Player:
+		return a.Name() == console.ADAPTER_NAME
+	}
+
+	return false
+}
+
+// isAdminFunc is the "isAdmin" function plugins are given, which takes the
+// message object they were given. The message is found again by its ref, as
+// anything else in the object may have been changed
+func (q *quarid) isAdminFunc(o map[string]interface{}) bool {
+	r, _ := o["ref"].(string)
+	m, ok := plugin.Message(r)
+	if !ok {
+		return false
+	}
+
+	return q.IsAdminMessage(m)
+}
+
+// recentMessages is how many of the messages the bot received most recently
+// are kept, with the adapter each came from
+const recentMessages = 1000
+
+// received are the messages the bot received most recently, and the
+// adapters they came from
+type received struct {
+	mu    sync.Mutex
+	order []*adapter.Message
+	from  map[*adapter.Message]adapter.Adapter
+}
+
+func newReceived() *received {
+	return &received{from: make(map[*adapter.Message]adapter.Adapter)}
+}
+
+// remember messages as they are received from the adapter a
+func (r *received) remember(u adapter.Update, a adapter.Adapter) {
+	m, ok := u.(*adapter.Message)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.from[m]; ok {
+		return
+	}
+	r.from[m] = a
+	r.order = append(r.order, m)
+
+	if len(r.order) > recentMessages {
+		delete(r.from, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// source returns the adapter m came from, if it was received recently
+func (r *received) source(m *adapter.Message) (adapter.Adapter, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.from[m]
+	return a, ok
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/enmand/quarid-go/pkg/bouncer"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+// startBouncer starts a bouncer on addr, for our IRC connection
+func (q *quarid) startBouncer(addr string) error {
+	b := bouncer.New(
+		database.GetStore(),
+		q.Config.GetStringMapString("bouncer.users"),
+	)
+
+	if n := q.Config.GetInt("bouncer.backlog"); n > 0 {
+		b.Backlog = n
+	}
+	if q.Config.IsSet("bouncer.register_timeout") {
+		b.RegisterTimeout = q.Config.GetDuration("bouncer.register_timeout")
+	}
+
+	cert := q.Config.GetString("bouncer.tls.cert")
+	key := q.Config.GetString("bouncer.tls.key")
+	if cert != "" || key != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return fmt.Errorf("Could not load bouncer certificate: %s", err)
+		}
+		b.TLSConfig = &tls.Config{Certificates: []tls.Certificate{c}}
+	}
+
+	b.AddNetwork(q.networkName(), q.IRC)
+
+	if err := b.Listen(addr); err != nil {
+		return err
+	}
+	q.bouncer = b
+
+	return nil
+}
+
+// networkName is the name of our IRC network, as configured with
+// "irc.network", or the hostname of the IRC server
+func (q *quarid) networkName() string {
+	if n := q.Config.GetString("irc.network"); n != "" {
+		return n
+	}
+
+	return irc.Hostname(q.Config.GetString("irc.server"))
+}
@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/bus"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/enmand/quarid-go/pkg/plugin"
+)
+
+// States of the bot's lifecycle, published under "bot"
+const (
+	stateInitialized   = "initialized"
+	stateConnected     = "connected"
+	stateDisconnecting = "disconnecting"
+)
+
+// Bus is the bot's event bus
+func (q *quarid) Bus() *bus.Bus {
+	return q.bus
+}
+
+// startBus creates the bot's event bus, with the timers in "bus.timers",
+// given as {"name": "interval"}
+func (q *quarid) startBus() {
+	q.bus = bus.New()
+	q.bus.Clock = q.clock()
+
+	for name := range q.Config.GetStringMap("bus.timers") {
+		d := q.Config.GetDuration("bus.timers." + name)
+		if d <= 0 {
+			logger.Log.Warningf("Invalid interval for timer %s", name)
+			continue
+		}
+
+		if _, err := q.bus.Every(name, d); err != nil {
+			logger.Log.Warningf("Could not start timer %s: %s", name, err)
+		}
+	}
+
+	q.IRC.Observe(q.publishEvent)
+}
+
+// publish data to a topic, logging (rather than returning) errors
+func (q *quarid) publish(topic string, data interface{}) {
+	if err := q.bus.Publish(topic, data); err != nil && err != bus.ErrClosed {
+		logger.Log.Warningf("Could not publish to %s: %s", topic, err)
+	}
+}
+
+// publishState publishes a change in the bot's lifecycle
+func (q *quarid) publishState(state string) {
+	q.publish(bus.Topic(bus.BOT_TOPIC, state), state)
+}
+
+// publishUpdate publishes an update from an adapter, as
+// "adapter.<adapter>.<update>"
+func (q *quarid) publishUpdate(u adapter.Update, a adapter.Adapter) {
+	var kind string
+	switch u.(type) {
+	case *adapter.Message:
+		kind = "message"
+	case *adapter.Edit:
+		kind = "edit"
+	case *adapter.Reaction:
+		kind = "reaction"
+	case *adapter.Membership:
+		kind = "membership"
+	case *adapter.Topic:
+		kind = "topic"
+	default:
+		return
+	}
+
+	q.publish(bus.Topic(bus.ADAPTER_TOPIC, a.Name(), kind), u)
+}
+
+// publishEvent publishes each event read from the IRC server, as
+// "adapter.irc.raw.<command>"
+func (q *quarid) publishEvent(ev *adapter.Event, sent bool) {
+	if sent || ev.Command == "" {
+		return
+	}
+
+	q.publish(
+		bus.Topic(bus.ADAPTER_TOPIC, irc.ADAPTER_NAME, "raw", strings.ToLower(ev.Command)),
+		ev,
+	)
+}
+
+// publishFunc is the "publish" function plugins are given, to publish to
+// "plugin.<topic>"
+func (q *quarid) publishFunc(topic string, data interface{}) {
+	q.publish(bus.Topic(bus.PLUGIN_TOPIC, topic), data)
+}
+
+// subscribePlugin subscribes a plugin to the topics it asks for, with the
+// queue size and policy in "bus.plugins"
+func (q *quarid) subscribePlugin(p plugin.Plugin) {
+	opts := bus.Options{
+		QueueSize: q.Config.GetInt("bus.plugins.queue_size"),
+		Policy:    bus.ParsePolicy(q.Config.GetString("bus.plugins.policy")),
+	}
+
+	for _, pattern := range p.Subscriptions() {
+		_, err := q.bus.Handle(pattern, opts, func(ev *bus.Event) {
+			if err := p.Event(ev); err != nil {
+				logger.Log.Errorf("Plugin could not handle event %s: %s", ev.Topic, err)
+			}
+		})
+		if err != nil {
+			logger.Log.Warningf("Could not subscribe a plugin to %s: %s", pattern, err)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package bot
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/spf13/cast"
+)
+
+// Join retries start at joinRetry, and double up to joinRetryMax, for at most
+// joinAttempts attempts
+const (
+	joinRetry    = 30 * time.Second
+	joinRetryMax = 15 * time.Minute
+	joinAttempts = 10
+)
+
+// joinLineLength is the most channels and keys, in bytes, to send in a single
+// JOIN line
+const joinLineLength = 400
+
+// transient are the JOIN errors that are worth retrying
+var transient = map[string]bool{
+	irc.IRC_ERR_CHANNELISFULL:   true,
+	irc.IRC_ERR_INVITEONLYCHAN:  true,
+	irc.IRC_ERR_BANNEDFROMCHAN:  true,
+	irc.IRC_ERR_BADCHANNELKEY:   true,
+	irc.IRC_ERR_TOOMANYCHANNELS: true,
+}
+
+// permanent are the JOIN errors that mean a channel can never be joined
+var permanent = map[string]bool{
+	irc.IRC_ERR_NOSUCHCHANNEL: true,
+	irc.IRC_ERR_BADCHANMASK:   true,
+}
+
+// channel is a channel the bot wants to be in
+type channel struct {
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+
+	// Parted channels were left at runtime, and are not joined, even if
+	// they are configured
+	Parted bool `json:"parted,omitempty"`
+
+	attempts int
+	retry    clock.Timer
+}
+
+// channels manages the channels the bot is in. The configured channels are
+// joined once we are registered, and channels joined or parted at runtime are
+// kept in the store, so they are restored after a restart. Joins that fail
+// for a transient reason are retried, with a backoff
+type channels struct {
+	client *irc.Client
+	store  database.Store
+	bucket string
+
+	// Whether an INVITE should be followed
+	invited func(ev *adapter.Event) bool
+
+	mu     sync.Mutex
+	wanted map[string]*channel
+}
+
+func newChannels(
+	client *irc.Client,
+	store database.Store,
+	network string,
+	configured []interface{},
+) *channels {
+	cs := &channels{
+		client:  client,
+		store:   store,
+		bucket:  "channels." + network,
+		invited: func(*adapter.Event) bool { return false },
+		wanted:  make(map[string]*channel),
+	}
+
+	for _, c := range configured {
+		if ch := parseChannel(c); ch != nil {
+			cs.wanted[strings.ToLower(ch.Name)] = ch
+		}
+	}
+
+	err := store.ForEach(cs.bucket, func(key string, v []byte) error {
+		ch := &channel{}
+		if err := json.Unmarshal(v, ch); err != nil {
+			return err
+		}
+
+		if ch.Parted {
+			delete(cs.wanted, key)
+		} else {
+			cs.wanted[key] = ch
+		}
+
+		return nil
+	})
+	if err != nil {
+		logger.Log.Warningf("Could not load channels: %s", err)
+	}
+
+	return cs
+}
+
+// channelList normalizes irc.channels to a list of channels. The config file
+// gives a list, flags give a []string, and the environment a single string,
+// of channels separated by commas
+func channelList(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case string:
+		var l []interface{}
+		for _, c := range strings.Split(v, ",") {
+			l = append(l, c)
+		}
+		return l
+	case []string:
+		var l []interface{}
+		for _, c := range v {
+			l = append(l, c)
+		}
+		return l
+	}
+
+	return cast.ToSlice(v)
+}
+
+// parseChannel parses a configured channel: either a string of the channel
+// name and an optional key ("#channel key"), or an object with "name" and
+// "key"
+func parseChannel(c interface{}) *channel {
+	switch v := c.(type) {
+	case string:
+		ws := strings.Fields(v)
+		if len(ws) == 0 {
+			return nil
+		}
+		ch := &channel{Name: ws[0]}
+		if len(ws) > 1 {
+			ch.Key = ws[1]
+		}
+		return ch
+	case map[string]interface{}:
+		name, _ := v["name"].(string)
+		key, _ := v["key"].(string)
+		if name == "" {
+			return nil
+		}
+		return &channel{Name: name, Key: key}
+	}
+
+	logger.Log.Warningf("Invalid channel in irc.channels: %v", c)
+	return nil
+}
+
+// observe our JOINs and PARTs, join errors, and INVITEs
+func (cs *channels) observe(ev *adapter.Event, sent bool) {
+	if ev.Historical {
+		return
+	}
+
+	if sent {
+		switch ev.Command {
+		case irc.IRC_JOIN:
+			cs.joining(ev)
+		case irc.IRC_PART:
+			cs.parting(ev)
+		}
+		return
+	}
+
+	switch ev.Command {
+	case irc.IRC_RPL_ENDOFMOTD, irc.IRC_ERR_NOMOTD:
+		clock.Go(clock.Or(cs.client.Clock), cs.joinAll)
+	case irc.IRC_JOIN:
+		if len(ev.Parameters) > 0 &&
+			strings.EqualFold(irc.ParseHostmask(ev.Prefix).Nick, cs.client.CurrentNick()) {
+			cs.joined(ev.Parameters[0])
+		}
+	case irc.IRC_INVITE:
+		if len(ev.Parameters) < 2 {
+			return
+		}
+		// Who invited us may need to be looked up, which we cannot wait
+		// for here
+		clock.Go(clock.Or(cs.client.Clock), func() { cs.invite(ev) })
+	case irc.DISCONNECTED:
+		cs.mu.Lock()
+		for _, ch := range cs.wanted {
+			ch.stop()
+		}
+		cs.mu.Unlock()
+	default:
+		if (transient[ev.Command] || permanent[ev.Command]) &&
+			len(ev.Parameters) > 1 {
+			cs.failed(ev.Parameters[1], ev)
+		}
+	}
+}
+
+// invite follows an INVITE, if it should be
+func (cs *channels) invite(ev *adapter.Event) {
+	if !cs.invited(ev) {
+		logger.Log.Infof(
+			"Ignoring invite to %s from %s",
+			ev.Parameters[1],
+			ev.Prefix,
+		)
+		return
+	}
+
+	cs.client.Write(&adapter.Event{
+		Command:    irc.IRC_JOIN,
+		Parameters: []string{ev.Parameters[1]},
+	})
+}
+
+// joinAll joins every channel we want to be in
+func (cs *channels) joinAll() {
+	cs.mu.Lock()
+	var chs []*channel
+	for _, ch := range cs.wanted {
+		ch.attempts = 0
+		chs = append(chs, ch)
+	}
+	cs.mu.Unlock()
+
+	for _, j := range joinLines(chs, cs.client.TargMax(irc.IRC_JOIN)) {
+		if err := cs.client.Write(j); err != nil {
+			logger.Log.Errorf("Could not join channels: %s", err)
+			return
+		}
+	}
+}
+
+// joinLines builds the JOIN events for chs, with at most max channels (if max
+// is not 0) in each. Channels with keys are listed first, so that their keys
+// line up with them
+func joinLines(chs []*channel, max int) []*adapter.Event {
+	sort.SliceStable(chs, func(a, b int) bool {
+		return chs[a].Key != "" && chs[b].Key == ""
+	})
+
+	var evs []*adapter.Event
+	var names, keys []string
+	length := 0
+
+	flush := func() {
+		if len(names) == 0 {
+			return
+		}
+		params := []string{strings.Join(names, ",")}
+		if len(keys) > 0 {
+			params = append(params, strings.Join(keys, ","))
+		}
+		evs = append(evs, &adapter.Event{
+			Command:    irc.IRC_JOIN,
+			Parameters: params,
+		})
+		names, keys, length = nil, nil, 0
+	}
+
+	for _, ch := range chs {
+		if len(names) > 0 &&
+			((max > 0 && len(names) >= max) ||
+				length+len(ch.Name)+len(ch.Key)+2 > joinLineLength) {
+			flush()
+		}
+
+		names = append(names, ch.Name)
+		if ch.Key != "" {
+			keys = append(keys, ch.Key)
+		}
+		length += len(ch.Name) + len(ch.Key) + 2
+	}
+	flush()
+
+	return evs
+}
+
+// joining records channels we sent a JOIN for, so that channels joined at
+// runtime are remembered
+func (cs *channels) joining(ev *adapter.Event) {
+	if len(ev.Parameters) < 1 || ev.Parameters[0] == "0" {
+		return
+	}
+
+	names := strings.Split(ev.Parameters[0], ",")
+	var keys []string
+	if len(ev.Parameters) > 1 {
+		keys = strings.Split(ev.Parameters[1], ",")
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for n, name := range names {
+		var key string
+		if n < len(keys) {
+			key = keys[n]
+		}
+
+		ch, ok := cs.wanted[strings.ToLower(name)]
+		if ok && (key == "" || key == ch.Key) {
+			continue
+		}
+		if !ok {
+			ch = &channel{Name: name}
+			cs.wanted[strings.ToLower(name)] = ch
+		}
+		if key != "" {
+			ch.Key = key
+		}
+
+		cs.save(ch)
+	}
+}
+
+// parting records channels we sent a PART for, so they are not rejoined
+func (cs *channels) parting(ev *adapter.Event) {
+	if len(ev.Parameters) < 1 {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, name := range strings.Split(ev.Parameters[0], ",") {
+		key := strings.ToLower(name)
+		if ch, ok := cs.wanted[key]; ok {
+			ch.stop()
+			delete(cs.wanted, key)
+		}
+
+		cs.save(&channel{Name: name, Parted: true})
+	}
+}
+
+// joined a channel, so any retries can stop
+func (cs *channels) joined(name string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if ch, ok := cs.wanted[strings.ToLower(name)]; ok {
+		ch.stop()
+		ch.attempts = 0
+	}
+}
+
+// failed to join the channel name, because of the error ev. Transient
+// failures are retried, and channels that can never be joined are forgotten
+func (cs *channels) failed(name string, ev *adapter.Event) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	key := strings.ToLower(name)
+	ch, ok := cs.wanted[key]
+	if !ok {
+		return
+	}
+
+	reason := ev.Parameters[len(ev.Parameters)-1]
+
+	if permanent[ev.Command] {
+		logger.Log.Warningf("Could not join %s: %s", name, reason)
+		ch.stop()
+		delete(cs.wanted, key)
+		if err := cs.store.Delete(cs.bucket, key); err != nil {
+			logger.Log.Errorf("Could not forget channel %s: %s", name, err)
+		}
+		return
+	}
+
+	ch.attempts++
+	if ch.attempts >= joinAttempts {
+		logger.Log.Warningf(
+			"Could not join %s after %d attempts: %s",
+			name,
+			ch.attempts,
+			reason,
+		)
+		return
+	}
+
+	wait := joinRetry << uint(ch.attempts-1)
+	if wait > joinRetryMax {
+		wait = joinRetryMax
+	}
+	logger.Log.Infof("Could not join %s (%s), retrying in %s", name, reason, wait)
+
+	ch.stop()
+	ch.retry = clock.Or(cs.client.Clock).AfterFunc(wait, func() {
+		cs.mu.Lock()
+		params := []string{ch.Name}
+		if ch.Key != "" {
+			params = append(params, ch.Key)
+		}
+		cs.mu.Unlock()
+
+		cs.client.Write(&adapter.Event{
+			Command:    irc.IRC_JOIN,
+			Parameters: params,
+		})
+	})
+}
+
+// save ch in the store. cs.mu must be held
+func (cs *channels) save(ch *channel) {
+	err := cs.store.Put(cs.bucket, strings.ToLower(ch.Name), ch)
+	if err != nil {
+		logger.Log.Errorf("Could not save channel %s: %s", ch.Name, err)
+	}
+}
+
+// stop any retry that is waiting
+func (ch *channel) stop() {
+	if ch.retry != nil {
+		ch.retry.Stop()
+		ch.retry = nil
+	}
+}
@@ -0,0 +1,486 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// Errors registering commands
+var (
+	ErrCommandExists = errors.New("Command already exists")
+	ErrNoHandler     = errors.New("Command has no handler, or subcommands")
+)
+
+// CommandFunc runs a command, returning its reply (or "" for no reply)
+type CommandFunc func(c *Context) (string, error)
+
+// Command is something users can ask the bot to do, by name
+type Command struct {
+	Name    string
+	Aliases []string
+
+	// What the command does, for help
+	Help string
+
+	Args        []Arg
+	Subcommands []*Command
+
+	// How long a user must wait between using the command
+	Cooldown time.Duration
+
+	// Only admins may use the command
+	Admin bool
+
+	// Handler runs the command. Commands with subcommands may leave it out,
+	// to be used only with one of them
+	Handler CommandFunc
+}
+
+// Context is a command being run
+type Context struct {
+	Message *adapter.Message
+	Adapter adapter.Adapter
+
+	// The command, and its name with the subcommands it was called with
+	// (for example, "remind in"), whatever aliases were used
+	Command *Command
+	Called  string
+
+	// The command's arguments, by name: ints, time.Durations, or strings
+	Args map[string]interface{}
+}
+
+// Int is the int argument name, or 0
+func (c *Context) Int(name string) int {
+	n, _ := c.Args[name].(int)
+	return n
+}
+
+// Duration is the duration argument name, or 0
+func (c *Context) Duration(name string) time.Duration {
+	d, _ := c.Args[name].(time.Duration)
+	return d
+}
+
+// String is the argument name, as a string, or ""
+func (c *Context) String(name string) string {
+	s, _ := c.Args[name].(string)
+	return s
+}
+
+// usageError is a command used wrongly
+type usageError struct {
+	usage string
+	err   error
+}
+
+func (e *usageError) Error() string {
+	if e.err == nil {
+		return "Usage: " + e.usage
+	}
+
+	return fmt.Sprintf("%s. Usage: %s", e.err, e.usage)
+}
+
+// Commands routes messages to the commands they call. Commands are called
+// with one of the prefixes (such as "!help"), by mentioning the bot's nick
+// ("Quarid: help"), or, in private, with nothing at all
+type Commands struct {
+	// Prefixes commands are called with
+	Prefixes []string
+
+	// Commands may be called by mentioning the bot's nick
+	Mention bool
+
+	// The clock cooldowns are timed by
+	Clock clock.Clock
+
+	// Commands may be called without a prefix in private messages
+	Private bool
+
+	// isAdmin reports whether a message is from an admin
+	isAdmin func(m *adapter.Message) bool
+
+	mu        sync.Mutex
+	commands  map[string]*Command
+	cooldowns map[string]time.Time
+}
+
+// NewCommands returns a router with only the help command
+func NewCommands() *Commands {
+	c := &Commands{
+		Prefixes:  []string{"!"},
+		Mention:   true,
+		Private:   true,
+		Clock:     clock.Real,
+		isAdmin:   func(*adapter.Message) bool { return false },
+		commands:  make(map[string]*Command),
+		cooldowns: make(map[string]time.Time),
+	}
+
+	c.Register(&Command{
+		Name: "help",
+		Help: "Lists the commands, or says how to use one",
+		Args: []Arg{{Name: "command", Type: ARG_REST, Optional: true}},
+		Handler: func(ctx *Context) (string, error) {
+			return c.help(ctx.String("command")), nil
+		},
+	})
+
+	return c
+}
+
+// Register a command, by its name and aliases
+func (c *Commands) Register(cmd *Command) error {
+	if err := validCommand(cmd); err != nil {
+		return fmt.Errorf("Could not register %s: %s", cmd.Name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := append([]string{cmd.Name}, cmd.Aliases...)
+	for _, n := range names {
+		if _, ok := c.commands[strings.ToLower(n)]; ok {
+			return fmt.Errorf("Could not register %s: %s: %s", cmd.Name, ErrCommandExists, n)
+		}
+	}
+	for _, n := range names {
+		c.commands[strings.ToLower(n)] = cmd
+	}
+
+	return nil
+}
+
+// Unregister a command, by its name
+func (c *Commands) Unregister(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cmd, ok := c.commands[strings.ToLower(name)]
+	if !ok {
+		return
+	}
+
+	for n, cc := range c.commands {
+		if cc == cmd {
+			delete(c.commands, n)
+		}
+	}
+}
+
+// Lookup a command by its name, or one of its aliases
+func (c *Commands) Lookup(name string) *Command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.commands[strings.ToLower(name)]
+}
+
+// validCommand reports why cmd (or one of its subcommands) cannot be run,
+// if it cannot
+func validCommand(cmd *Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " \t") {
+		return fmt.Errorf("Invalid command name %q", cmd.Name)
+	}
+	if cmd.Handler == nil && len(cmd.Subcommands) == 0 {
+		return ErrNoHandler
+	}
+
+	for i, a := range cmd.Args {
+		if a.Type == ARG_REST && i != len(cmd.Args)-1 {
+			return fmt.Errorf("%s must be the last argument", a.Name)
+		}
+		if i > 0 && cmd.Args[i-1].Optional && !a.Optional {
+			return fmt.Errorf("%s must be optional, after an optional argument", a.Name)
+		}
+	}
+
+	for _, sub := range cmd.Subcommands {
+		if err := validCommand(sub); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// strip the prefix from text, if it calls a command, for a bot with nick
+func (c *Commands) strip(text, nick string, private bool) (string, bool) {
+	for _, p := range c.Prefixes {
+		if p != "" && strings.HasPrefix(text, p) {
+			return text[len(p):], true
+		}
+	}
+
+	if c.Mention && nick != "" {
+		t := strings.TrimPrefix(text, "@")
+		if len(t) > len(nick) && strings.EqualFold(t[:len(nick)], nick) {
+			switch t[len(nick)] {
+			case ':', ',', ' ':
+				return strings.TrimLeft(t[len(nick)+1:], " "), true
+			}
+		}
+	}
+
+	if c.Private && private {
+		return text, true
+	}
+
+	return "", false
+}
+
+// handle a message, from the adapter a, if it calls a command. The bot's
+// nick on a's network is nick
+func (c *Commands) handle(m *adapter.Message, a adapter.Adapter, nick string) (string, bool) {
+	line, ok := c.strip(m.Text, nick, m.Room.Private)
+	if !ok {
+		return "", false
+	}
+
+	ts := tokenize(line)
+	if len(ts) == 0 {
+		return "", false
+	}
+
+	cmd := c.Lookup(ts[0].text)
+	if cmd == nil {
+		return "", false
+	}
+	called := []string{cmd.Name}
+	ts = ts[1:]
+
+	// Descend into subcommands, by name or alias
+	for len(ts) > 0 {
+		sub := cmd.subcommand(ts[0].text)
+		if sub == nil {
+			break
+		}
+		cmd, called = sub, append(called, sub.Name)
+		ts = ts[1:]
+	}
+
+	ctx := &Context{
+		Message: m,
+		Adapter: a,
+		Command: cmd,
+		Called:  strings.Join(called, " "),
+	}
+
+	if cmd.Admin && !c.isAdmin(m) {
+		return "", true
+	}
+	if cmd.Handler == nil {
+		return c.usage(ctx.Called, cmd).Error(), true
+	}
+	args, err := parseArgs(cmd.Args, line, ts, a.Name())
+	if err != nil {
+		ue := c.usage(ctx.Called, cmd)
+		ue.err = err
+		return ue.Error(), true
+	}
+	ctx.Args = args
+	if wait := c.cooldown(ctx); wait > 0 {
+		return fmt.Sprintf("%s%s is cooling down: try again in %s", c.prefix(), ctx.Called, wait), true
+	}
+
+	reply, err := cmd.Handler(ctx)
+	if err != nil {
+		if ue, ok := err.(*usageError); ok {
+			ue.usage = c.prefix() + ue.usage
+			return ue.Error(), true
+		}
+
+		logger.Log.Errorf("Command %s failed: %s", ctx.Called, err)
+		return fmt.Sprintf("%s%s failed: %s", c.prefix(), ctx.Called, err), true
+	}
+
+	return reply, true
+}
+
+// cooldown is how much longer the user must wait to use the command again.
+// If they need not wait, they must from now
+func (c *Commands) cooldown(ctx *Context) time.Duration {
+	if ctx.Command.Cooldown <= 0 {
+		return 0
+	}
+
+	now := clock.Or(c.Clock).Now()
+	key := strings.Join([]string{ctx.Called, ctx.Message.Adapter, ctx.Message.User.ID}, "\x00")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if until, ok := c.cooldowns[key]; ok && now.Before(until) {
+		return until.Sub(now).Round(time.Second)
+	}
+
+	c.cooldowns[key] = now.Add(ctx.Command.Cooldown)
+	for k, until := range c.cooldowns {
+		if !now.Before(until) {
+			delete(c.cooldowns, k)
+		}
+	}
+
+	return 0
+}
+
+// subcommand of cmd, by name or alias
+func (cmd *Command) subcommand(name string) *Command {
+	for _, sub := range cmd.Subcommands {
+		if strings.EqualFold(sub.Name, name) {
+			return sub
+		}
+		for _, a := range sub.Aliases {
+			if strings.EqualFold(a, name) {
+				return sub
+			}
+		}
+	}
+
+	return nil
+}
+
+// UsageError is an error a CommandFunc returns when it was used wrongly, to
+// reply with how it should be used
+func UsageError(c *Context, reason string) error {
+	var err error
+	if reason != "" {
+		err = errors.New(reason)
+	}
+
+	return &usageError{usage: usage(c.Called, c.Command), err: err}
+}
+
+// usage of cmd, called as called, with the prefix commands are called with
+func (c *Commands) usage(called string, cmd *Command) *usageError {
+	return &usageError{usage: c.prefix() + usage(called, cmd)}
+}
+
+func usage(called string, cmd *Command) string {
+	ws := []string{called}
+	if len(cmd.Subcommands) > 0 {
+		var subs []string
+		for _, sub := range cmd.Subcommands {
+			subs = append(subs, sub.Name)
+		}
+		ws = append(ws, "<"+strings.Join(subs, "|")+">")
+	}
+	for _, a := range cmd.Args {
+		ws = append(ws, a.usage())
+	}
+
+	return strings.Join(ws, " ")
+}
+
+// prefix commands are shown with, in help
+func (c *Commands) prefix() string {
+	if len(c.Prefixes) > 0 {
+		return c.Prefixes[0]
+	}
+
+	return ""
+}
+
+// help lists the commands, or says how to use the command named
+func (c *Commands) help(name string) string {
+	if name == "" {
+		c.mu.Lock()
+		var names []string
+		for n, cmd := range c.commands {
+			if strings.EqualFold(n, cmd.Name) {
+				names = append(names, n)
+			}
+		}
+		c.mu.Unlock()
+		sort.Strings(names)
+
+		return fmt.Sprintf(
+			"Commands: %s. Use %shelp <command> for more",
+			strings.Join(names, ", "),
+			c.prefix(),
+		)
+	}
+
+	ws := strings.Fields(name)
+	cmd := c.Lookup(ws[0])
+	if cmd == nil {
+		return fmt.Sprintf("There is no %s command", ws[0])
+	}
+
+	called := []string{cmd.Name}
+	for _, w := range ws[1:] {
+		sub := cmd.subcommand(w)
+		if sub == nil {
+			break
+		}
+		cmd, called = sub, append(called, sub.Name)
+	}
+
+	h := c.usage(strings.Join(called, " "), cmd).Error()
+	if cmd.Help != "" {
+		h += " - " + cmd.Help
+	}
+	if len(cmd.Aliases) > 0 {
+		h += fmt.Sprintf(" (also %s)", strings.Join(cmd.Aliases, ", "))
+	}
+	if cmd.Cooldown > 0 {
+		h += fmt.Sprintf(" (once every %s)", cmd.Cooldown)
+	}
+	if cmd.Admin {
+		h += " (admins only)"
+	}
+
+	return h
+}
+
+// Commands are the bot's commands, which Go code can register more of
+func (q *quarid) Commands() *Commands {
+	return q.commands
+}
+
+// startCommands routes messages to commands, with the prefixes in
+// "commands"
+func (q *quarid) startCommands() {
+	q.commands = NewCommands()
+	q.commands.Clock = q.clock()
+	q.commands.isAdmin = q.IsAdminMessage
+
+	if q.Config.IsSet("commands.prefixes") {
+		q.commands.Prefixes = q.Config.GetStringSlice("commands.prefixes")
+	}
+	if q.Config.IsSet("commands.mention") {
+		q.commands.Mention = q.Config.GetBool("commands.mention")
+	}
+	if q.Config.IsSet("commands.private") {
+		q.commands.Private = q.Config.GetBool("commands.private")
+	}
+}
+
+// command runs the command a message calls, if it calls one, and replies
+// with what it returns. Notices, and messages from history, do not call
+// commands
+func (q *quarid) command(u adapter.Update, a adapter.Adapter) {
+	m, ok := u.(*adapter.Message)
+	if !ok || m.Kind != adapter.Text || m.Historical {
+		return
+	}
+
+	nick := q.Config.GetString("irc.nick")
+	if unwrap(a) == adapter.Adapter(q.ircAdapter) {
+		nick = q.IRC.CurrentNick()
+	}
+
+	reply, ok := q.commands.handle(m, a, nick)
+	if ok && reply != "" {
+		clock.Go(q.clock(), func() { q.reply(a, m, reply) })
+	}
+}
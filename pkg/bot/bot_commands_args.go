@@ -0,0 +1,254 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+// ArgType is the type of a command's argument
+type ArgType int
+
+// Types of arguments
+const (
+	// A single word (or quoted string)
+	ARG_WORD ArgType = iota
+
+	// A whole number
+	ARG_INT
+
+	// A duration, such as "90s" or "1h30m"
+	ARG_DURATION
+
+	// A user's nick
+	ARG_NICK
+
+	// A channel, such as "#ops"
+	ARG_CHANNEL
+
+	// The rest of the line, as it was given. It must be the last argument
+	ARG_REST
+)
+
+var argTypes = map[string]ArgType{
+	"word":     ARG_WORD,
+	"string":   ARG_WORD,
+	"int":      ARG_INT,
+	"duration": ARG_DURATION,
+	"nick":     ARG_NICK,
+	"channel":  ARG_CHANNEL,
+	"rest":     ARG_REST,
+}
+
+// ParseArgType parses the name of an ArgType, such as "int"
+func ParseArgType(name string) (ArgType, error) {
+	t, ok := argTypes[strings.ToLower(name)]
+	if !ok && name != "" {
+		return ARG_WORD, fmt.Errorf("Unknown argument type %s", name)
+	}
+
+	return t, nil
+}
+
+func (t ArgType) String() string {
+	switch t {
+	case ARG_INT:
+		return "int"
+	case ARG_DURATION:
+		return "duration"
+	case ARG_NICK:
+		return "nick"
+	case ARG_CHANNEL:
+		return "channel"
+	case ARG_REST:
+		return "rest"
+	}
+
+	return "word"
+}
+
+// Arg is an argument a command takes
+type Arg struct {
+	Name string
+	Type ArgType
+
+	// Optional arguments may be left out. Only the last arguments may be
+	Optional bool
+}
+
+// usage of the argument, such as "<count:int>", "[reason...]"
+func (a Arg) usage() string {
+	s := a.Name
+	switch a.Type {
+	case ARG_WORD:
+	case ARG_REST:
+		s += "..."
+	default:
+		s += ":" + a.Type.String()
+	}
+
+	if a.Optional {
+		return "[" + s + "]"
+	}
+
+	return "<" + s + ">"
+}
+
+// parse a value of the argument's type, from the adapter named
+func (a Arg) parse(s, adapterName string) (interface{}, error) {
+	switch a.Type {
+	case ARG_INT:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a whole number", a.Name)
+		}
+		return n, nil
+	case ARG_DURATION:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a duration, such as 90s or 1h30m", a.Name)
+		}
+		return d, nil
+	case ARG_NICK:
+		if adapterName == irc.ADAPTER_NAME && !validNick(s) {
+			return nil, fmt.Errorf("%s must be a nick", a.Name)
+		}
+	case ARG_CHANNEL:
+		if adapterName == irc.ADAPTER_NAME && (s == "" || !strings.ContainsAny(s[:1], "#&")) {
+			return nil, fmt.Errorf("%s must be a channel", a.Name)
+		}
+	}
+
+	return s, nil
+}
+
+// validNick reports whether s can be an IRC nick
+func validNick(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', strings.ContainsRune("[]\\`_^{|}", r):
+		case (r >= '0' && r <= '9') || r == '-':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// token is a word of a command line, and where it starts in the line
+type token struct {
+	text  string
+	start int
+}
+
+// tokenize splits a command line into words, on spaces. Words may be quoted
+// with double or single quotes, to keep their spaces; within double quotes,
+// a backslash escapes the character after it. A quote only opens if a
+// matching quote closes it, at the end of a word, so other quotes (such as an
+// apostrophe) are kept as they are
+func tokenize(line string) []token {
+	var ts []token
+	var b strings.Builder
+
+	in, escaped := false, false
+	start, end := 0, -1
+
+	for i, r := range line {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case end >= 0:
+			switch {
+			case i == end:
+				end = -1
+			case r == '\\' && line[end] == '"':
+				escaped = true
+			default:
+				b.WriteRune(r)
+			}
+		case (r == '"' || r == '\'') && !in:
+			in, start = true, i
+			if end = closing(line, i); end < 0 {
+				b.WriteRune(r)
+			}
+		case unicode.IsSpace(r):
+			if in {
+				ts = append(ts, token{text: b.String(), start: start})
+				b.Reset()
+				in = false
+			}
+		default:
+			if !in {
+				in, start = true, i
+			}
+			b.WriteRune(r)
+		}
+	}
+
+	if in {
+		ts = append(ts, token{text: b.String(), start: start})
+	}
+
+	return ts
+}
+
+// closing returns the index of the quote that closes the one at open in line,
+// or -1 if none does. It must end a word: be followed by a space, or the end
+// of the line
+func closing(line string, open int) int {
+	q := line[open]
+
+	for i := open + 1; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && q == '"':
+			i++
+		case line[i] == q:
+			if i+1 == len(line) || unicode.IsSpace(rune(line[i+1])) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// parseArgs parses the arguments of a command, from what follows it on the
+// line, given as its words (ts) and the line itself
+func parseArgs(args []Arg, line string, ts []token, adapterName string) (map[string]interface{}, error) {
+	parsed := make(map[string]interface{}, len(args))
+
+	for i, a := range args {
+		if i >= len(ts) {
+			if a.Optional {
+				break
+			}
+			return nil, fmt.Errorf("%s is missing", a.Name)
+		}
+
+		if a.Type == ARG_REST {
+			parsed[a.Name] = strings.TrimSpace(line[ts[i].start:])
+			return parsed, nil
+		}
+
+		v, err := a.parse(ts[i].text, adapterName)
+		if err != nil {
+			return nil, err
+		}
+		parsed[a.Name] = v
+	}
+
+	if len(ts) > len(args) {
+		return nil, fmt.Errorf("Too many arguments")
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+func TestTokenize(t *testing.T) {
+	for line, want := range map[string][]string{
+		`kick bob`:                {"kick", "bob"},
+		`  kick   bob  `:          {"kick", "bob"},
+		`say "hello there" bob`:   {"say", "hello there", "bob"},
+		`say 'hello there'`:       {"say", "hello there"},
+		`say "a \"quote\""`:       {"say", `a "quote"`},
+		`say ""`:                  {"say", ""},
+		`tell bob 'sup`:           {"tell", "bob", "'sup"},
+		`say 'tis fine`:           {"say", "'tis", "fine"},
+		`say 'tis fine, isn't it`: {"say", "'tis", "fine,", "isn't", "it"},
+		`say don't "stop me" now`: {"say", "don't", "stop me", "now"},
+		`say 'it isn't so' truly`: {"say", "it isn't so", "truly"},
+	} {
+		var got []string
+		for _, tk := range tokenize(line) {
+			got = append(got, tk.text)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %q, but got %q", line, want, got)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	args := []Arg{
+		{Name: "nick", Type: ARG_NICK},
+		{Name: "for", Type: ARG_DURATION, Optional: true},
+		{Name: "reason", Type: ARG_REST, Optional: true},
+	}
+
+	for line, want := range map[string]map[string]interface{}{
+		`bob`:     {"nick": "bob"},
+		`bob 90s`: {"nick": "bob", "for": 90 * time.Second},
+		`bob 1m  'sup, "it's"  spam `: {
+			"nick":   "bob",
+			"for":    time.Minute,
+			"reason": `'sup, "it's"  spam`,
+		},
+		`bob 1h "quoted reason"`: {
+			"nick":   "bob",
+			"for":    time.Hour,
+			"reason": `"quoted reason"`,
+		},
+	} {
+		got, err := parseArgs(args, line, tokenize(line), irc.ADAPTER_NAME)
+		if err != nil {
+			t.Errorf("%s: %s", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, but got %v", line, want, got)
+		}
+	}
+
+	for _, line := range []string{``, `b@d`, `bob soon`, `bob 'sup`} {
+		if _, err := parseArgs(args[:2], line, tokenize(line), irc.ADAPTER_NAME); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
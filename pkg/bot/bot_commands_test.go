@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"testing"
+)
+
+func TestStrip(t *testing.T) {
+	c := NewCommands()
+	c.Prefixes = []string{"!", "quarid "}
+
+	for _, tt := range []struct {
+		text    string
+		private bool
+		line    string
+		ok      bool
+	}{
+		{text: "!help", line: "help", ok: true},
+		{text: "quarid help", line: "help", ok: true},
+		{text: "Quarid: help me", line: "help me", ok: true},
+		{text: "@quarid,  help", line: "help", ok: true},
+		{text: "quarid2: help"},
+		{text: "quarid"},
+		{text: "help"},
+		{text: "help", private: true, line: "help", ok: true},
+		{text: "!help", private: true, line: "help", ok: true},
+	} {
+		line, ok := c.strip(tt.text, "quarid", tt.private)
+		if line != tt.line || ok != tt.ok {
+			t.Errorf("%q: expected %q, %t, but got %q, %t", tt.text, tt.line, tt.ok, line, ok)
+		}
+	}
+
+	c.Mention, c.Private = false, false
+	for _, text := range []string{"quarid: help", "help"} {
+		if _, ok := c.strip(text, "quarid", true); ok {
+			t.Errorf("%q: expected no command without mentions, or in private", text)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// How often the time a channel was last seen is saved
+const seenInterval = 30 * time.Second
+
+// history tracks when we last saw a message in each channel, so that messages
+// missed while we were disconnected can be replayed to plugins
+type history struct {
+	store  database.Store
+	bucket string
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	saved map[string]time.Time
+}
+
+func newHistory(store database.Store, network string) *history {
+	return &history{
+		store:  store,
+		bucket: "history." + network,
+		seen:   make(map[string]time.Time),
+		saved:  make(map[string]time.Time),
+	}
+}
+
+// observe messages from the server, to record when each channel was last seen
+func (h *history) observe(ev *adapter.Event, sent bool) {
+	if sent || ev.Historical || ev.Command != irc.IRC_PRIVMSG ||
+		len(ev.Parameters) < 1 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.ToLower(ev.Parameters[0])
+	if ev.Timestamp.After(h.seen[key]) {
+		h.seen[key] = ev.Timestamp
+	}
+
+	if h.seen[key].Sub(h.saved[key]) > seenInterval {
+		h.save(key)
+	}
+}
+
+// last returns when we last saw a message in channel
+func (h *history) last(channel string) (time.Time, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.ToLower(channel)
+	if t, ok := h.seen[key]; ok {
+		return t, true
+	}
+
+	var t time.Time
+	if err := h.store.Get(h.bucket, key, &t); err != nil {
+		return t, false
+	}
+	h.seen[key], h.saved[key] = t, t
+
+	return t, true
+}
+
+// flush saves when every channel was last seen
+func (h *history) flush() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range h.seen {
+		h.save(key)
+	}
+}
+
+func (h *history) save(key string) {
+	if err := h.store.Put(h.bucket, key, h.seen[key]); err != nil {
+		logger.Log.Errorf("Could not save history for %s: %s", key, err)
+		return
+	}
+	h.saved[key] = h.seen[key]
+}
+
+// replay messages we missed in a channel when we join it, to plugins
+func (q *quarid) replay(ev *adapter.Event, r adapter.Responder) {
+	nick := q.IRC.CurrentNick()
+	if len(ev.Parameters) < 1 ||
+		!strings.EqualFold(irc.ParseHostmask(ev.Prefix).Nick, nick) {
+		return
+	}
+
+	channel := ev.Parameters[0]
+	since, ok := q.history.last(channel)
+	if !ok {
+		return
+	}
+
+	evs, err := q.IRC.ChatHistory(channel, since, 0)
+	if err != nil {
+		logger.Log.Debugf("Not replaying history for %s: %s", channel, err)
+		return
+	}
+
+	logger.Log.Infof("Replaying %d missed events in %s", len(evs), channel)
+	for _, h := range evs {
+		if strings.EqualFold(irc.ParseHostmask(h.Prefix).Nick, nick) {
+			continue
+		}
+
+		q.history.observe(&adapter.Event{
+			Command:    h.Command,
+			Parameters: h.Parameters,
+			Timestamp:  h.Timestamp,
+		}, false)
+
+		if h.Command == irc.IRC_PRIVMSG {
+			if u := q.ircAdapter.Update(h); u != nil {
+				q.received.remember(u, q.ircAdapter)
+				q.dispatch(u, q.ircAdapter)
+			}
+		}
+	}
+}
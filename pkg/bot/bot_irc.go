@@ -5,10 +5,14 @@ import (
 	"io/ioutil"
 
 	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/bouncer"
+	"github.com/enmand/quarid-go/pkg/bus"
 	"github.com/enmand/quarid-go/pkg/config"
+	"github.com/enmand/quarid-go/pkg/database"
 	"github.com/enmand/quarid-go/pkg/irc"
 	"github.com/enmand/quarid-go/pkg/logger"
 	"github.com/enmand/quarid-go/pkg/plugin"
+	"github.com/enmand/quarid-go/pkg/recorder"
 	"github.com/enmand/quarid-go/vm"
 	"github.com/enmand/quarid-go/vm/js"
 )
@@ -17,6 +21,13 @@ type quarid struct {
 	// Connection to the IRC server
 	IRC *irc.Client
 
+	// The adapters for each network we connect to, including IRC's
+	ircAdapter *irc.Adapter
+	adapters   []adapter.Adapter
+
+	// Bouncer for IRC clients to attach to our IRC connection, if enabled
+	bouncer *bouncer.Bouncer
+
 	// Configuration from the user
 	Config *config.Config
 
@@ -25,21 +36,113 @@ type quarid struct {
 
 	// The VM for our Plugins
 	vms map[string]vm.VM
+
+	// When we last saw messages in each channel
+	history *history
+
+	// The channels we join, and keep
+	channels *channels
+
+	// The event bus, for adapters, the bot, plugins and crates
+	bus *bus.Bus
+
+	// The commands users can call
+	commands *Commands
+
+	// Who the configured admins are
+	admins *admins
+
+	// The messages received most recently, and where they came from
+	received *received
+
+	// Where the session is recorded to, or the recording being replayed
+	recorder  *recorder.Recorder
+	replaying *recorder.Replay
 }
 
 func (q *quarid) initialize() error {
+	if err := q.loadReplay(); err != nil {
+		return err
+	}
+	if err := q.startRecording(); err != nil {
+		return err
+	}
+
 	q.IRC = irc.NewClient(
 		q.Config.GetString("irc.nick"),
 		q.Config.GetString("irc.user"),
 		q.Config.GetBool("irc.tls.verify"),
 		q.Config.GetBool("irc.tls.enable"),
 	)
+	if d := q.Config.GetString("irc.dialect"); d != "" {
+		q.IRC.Dialect = irc.Dialect(d)
+	}
+	q.IRC.AltNicks = q.Config.GetStringSlice("irc.alt_nicks")
+	q.IRC.Password = q.Config.GetString("irc.password")
+	q.IRC.SASLUser = q.Config.GetString("irc.sasl.user")
+	q.IRC.SASLPassword = q.Config.GetString("irc.sasl.password")
+	q.IRC.Store = database.GetStore()
+	q.IRC.Clock = q.clock()
+
+	mw, err := q.middleware(irc.ADAPTER_NAME, q.networkName())
+	if err != nil {
+		return err
+	}
+	q.IRC.Middleware = mw
+	q.record(q.IRC, q.networkName())
+	q.startBus()
+
+	// On the console, the bot talks to the console instead of IRC
+	q.ircAdapter = irc.NewAdapter(
+		q.IRC,
+		q.ircAddress(q.networkName(), q.Config.GetString("irc.server")),
+	)
+	if !q.Config.GetBool("console.enable") && q.replayed(irc.ADAPTER_NAME, q.networkName()) {
+		q.adapters = append(q.adapters, q.ircAdapter)
+	}
+	if q.replaying != nil {
+		err = q.addPlayers()
+	} else {
+		err = q.addAdapters()
+	}
+	if err != nil {
+		return err
+	}
+
+	addr := q.Config.GetString("bouncer.listen")
+	if addr != "" && !q.Config.GetBool("console.enable") && q.replaying == nil {
+		if err := q.startBouncer(addr); err != nil {
+			return err
+		}
+	}
 
 	// Initialize our VMs
 	q.vms = map[string]vm.VM{
 		vm.JS: js.NewVM(),
 	}
 
+	// Channels linked by the relay are joined with the configured channels
+	links := q.relayLinks()
+	configured := channelList(q.Config.Get("irc.channels"))
+	configured = append(configured, q.linkedChannels(links)...)
+	q.channels = newChannels(
+		q.IRC,
+		database.GetStore(),
+		q.networkName(),
+		configured,
+	)
+	q.admins = parseAdmins(q.Config.GetStringSlice("irc.admins"))
+	q.received = newReceived()
+	q.channels.invited = q.IsAdmin
+	q.IRC.Observe(q.channels.observe)
+
+	q.history = newHistory(database.GetStore(), q.networkName())
+	q.IRC.Observe(q.history.observe)
+	q.IRC.Handle(
+		[]adapter.Filter{irc.CommandFilter{Command: irc.IRC_JOIN}},
+		q.replay,
+	)
+
 	var errs []error
 	q.plugins, errs = q.LoadPlugins(q.Config.GetStringSlice("plugins_dirs"))
 	if errs != nil {
@@ -52,6 +155,16 @@ func (q *quarid) initialize() error {
 			logger.Log.Warning(e)
 		}
 	}
+	q.startCommands()
+	q.runPlugins()
+
+	if links != nil {
+		if err := q.startRelay(links); err != nil {
+			return err
+		}
+	}
+
+	q.publishState(stateInitialized)
 
 	return nil
 }
@@ -85,34 +198,51 @@ func (q *quarid) LoadPlugins(dirs []string) ([]plugin.Plugin, []error) {
 	return ps, errs
 }
 
+// Connect each adapter, and block until one is disconnected
 func (q *quarid) Connect() error {
-	go q.IRC.Loop()
-
-	err := q.IRC.Connect(q.Config.GetString("irc.server"))
-	if err != nil {
-		return err
+	for _, a := range q.adapters {
+		if err := a.Connect(); err != nil {
+			return err
+		}
 	}
+	q.publishState(stateConnected)
 
-	q.IRC.Handle(
-		[]adapter.Filter{irc.CommandFilter{Command: irc.IRC_RPL_MYINFO}},
-		q.joinChan,
-	)
-
-	rCh := make(chan error)
-	go func(ch chan error) {
-		ch <- q.IRC.Read()
-	}(rCh)
+	errs := make(chan error, len(q.adapters))
+	for _, a := range q.adapters {
+		go func(a adapter.Adapter) {
+			errs <- a.Wait()
+		}(a)
+	}
 
-	if readErr := <-rCh; readErr != nil {
-		logger.Log.Errorf(err.Error())
-		return err
+	err := <-errs
+	if err != nil {
+		logger.Log.Error(err)
 	}
 
 	return err
 }
 
 func (q *quarid) Disconnect() {
-	q.IRC.Disconnect()
+	q.publishState(stateDisconnecting)
+
+	if q.bouncer != nil {
+		q.bouncer.Close()
+	}
+
+	q.history.flush()
+	for _, a := range q.adapters {
+		if err := a.Disconnect(); err != nil {
+			logger.Log.Warningf("Could not disconnect %s: %s", a.Name(), err)
+		}
+	}
+
+	if q.recorder != nil {
+		if err := q.recorder.Close(); err != nil {
+			logger.Log.Warningf("Could not close the recording: %s", err)
+		}
+	}
+
+	q.bus.Close()
 }
 
 func (q *quarid) Plugins() []plugin.Plugin {
@@ -122,16 +252,3 @@ func (q *quarid) Plugins() []plugin.Plugin {
 func (q *quarid) VMs() map[string]vm.VM {
 	return q.vms
 }
-
-func (q *quarid) joinChan(
-	ev *adapter.Event,
-	c adapter.Responder,
-) {
-	chans := q.Config.GetStringSlice("irc.channels")
-
-	joinCmd := &adapter.Event{
-		Command:    irc.IRC_JOIN,
-		Parameters: chans,
-	}
-	c.Write(joinCmd)
-}
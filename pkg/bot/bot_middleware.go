@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/middleware"
+)
+
+// unwrapper is an adapter wrapped with middleware, or for recording
+type unwrapper interface {
+	Unwrap() adapter.Adapter
+}
+
+// middleware builds the middleware configured for an adapter, followed by the
+// middleware configured for the network it is on, from "middleware", which
+// is keyed by "adapter" and "adapter/network"
+func (q *quarid) middleware(adapterName, network string) (adapter.Chain, error) {
+	configured := q.Config.GetStringMap("middleware")
+
+	keys := []string{adapterName}
+	if network != adapterName {
+		keys = append(keys, adapterName+"/"+network)
+	}
+
+	var c adapter.Chain
+	for _, k := range keys {
+		specs, _ := configured[strings.ToLower(k)].([]interface{})
+
+		chain, err := middleware.Chain(specs)
+		if err != nil {
+			return nil, fmt.Errorf("Could not configure middleware for %s: %s", k, err)
+		}
+		c = append(c, chain...)
+	}
+
+	return c, nil
+}
+
+// wrap an adapter with its middleware, if it has any. If the session is
+// recorded, the adapter is recorded inside its middleware
+func (q *quarid) wrap(a adapter.Adapter) (adapter.Adapter, error) {
+	if q.recorder != nil {
+		a = q.recorder.Wrap(a)
+	}
+
+	c, err := q.middleware(a.Name(), a.Name())
+	if err != nil || len(c) == 0 {
+		return a, err
+	}
+
+	return adapter.Wrap(a, c), nil
+}
@@ -0,0 +1,140 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/enmand/quarid-go/pkg/plugin"
+)
+
+// runPlugins runs each loaded plugin, so they can set themselves up, and
+// sends them messages from every adapter, and the events on the bus they
+// subscribe to. Plugins publish to the bus with "publish", and check whether
+// a message is from an admin with "isAdmin"
+func (q *quarid) runPlugins() {
+	for name, v := range q.vms {
+		if err := v.Set("publish", q.publishFunc); err != nil {
+			logger.Log.Warningf("Plugins in the %s VM cannot publish: %s", name, err)
+		}
+		if err := v.Set("isAdmin", q.isAdminFunc); err != nil {
+			logger.Log.Warningf("Plugins in the %s VM cannot check admins: %s", name, err)
+		}
+	}
+
+	for _, p := range q.plugins {
+		if err := p.Run(); err != nil {
+			logger.Log.Errorf("Could not run plugin: %s", err)
+		}
+		q.subscribePlugin(p)
+
+		for _, c := range p.Commands() {
+			cmd, err := pluginCommand(p, c)
+			if err == nil {
+				err = q.commands.Register(cmd)
+			}
+			if err != nil {
+				logger.Log.Warningf("Plugin command %s was not registered: %s", c.Name, err)
+			}
+		}
+	}
+
+	for _, a := range q.adapters {
+		a.Receive(q.receive(q.publishUpdate))
+		a.Receive(q.receive(q.command))
+		a.Receive(q.receive(q.dispatch))
+	}
+}
+
+// receive updates with f, remembering where each message came from first.
+// Adapters may give each function its own copy of a message
+func (q *quarid) receive(f adapter.UpdateFunc) adapter.UpdateFunc {
+	return func(u adapter.Update, a adapter.Adapter) {
+		q.received.remember(u, a)
+		f(u, a)
+	}
+}
+
+// pluginCommand is the command a plugin describes. Commands without
+// subcommands are run by the plugin
+func pluginCommand(p plugin.Plugin, c plugin.Command) (*Command, error) {
+	cmd := &Command{
+		Name:    c.Name,
+		Aliases: c.Aliases,
+		Help:    c.Help,
+		Admin:   c.Admin,
+	}
+
+	if c.Cooldown != "" {
+		d, err := time.ParseDuration(c.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cooldown %q", c.Cooldown)
+		}
+		cmd.Cooldown = d
+	}
+
+	for _, a := range c.Args {
+		t, err := ParseArgType(a.Type)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Args = append(cmd.Args, Arg{Name: a.Name, Type: t, Optional: a.Optional})
+	}
+
+	for _, sc := range c.Subcommands {
+		sub, err := pluginCommand(p, sc)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Subcommands = append(cmd.Subcommands, sub)
+	}
+
+	if len(cmd.Subcommands) == 0 {
+		cmd.Handler = func(ctx *Context) (string, error) {
+			return p.Command(ctx.Called, ctx.Args, ctx.Message)
+		}
+	}
+
+	return cmd, nil
+}
+
+// dispatch a message to our plugins, and send their replies. Notices are not
+// dispatched, as they should not be replied to
+func (q *quarid) dispatch(u adapter.Update, a adapter.Adapter) {
+	m, ok := u.(*adapter.Message)
+	if !ok || m.Kind == adapter.Notice {
+		return
+	}
+
+	for _, p := range q.plugins {
+		if m.Historical && !p.Historical() {
+			continue
+		}
+
+		reply, err := p.Handle(m)
+		if err != nil {
+			logger.Log.Errorf("Plugin could not handle message: %s", err)
+			continue
+		}
+
+		if reply != "" {
+			clock.Go(q.clock(), func() { q.reply(a, m, reply) })
+		}
+	}
+}
+
+// reply to the message m, in the room it came from
+func (q *quarid) reply(a adapter.Adapter, m *adapter.Message, text string) {
+	d, err := a.Send(&adapter.Reply{To: m, Text: text})
+	if err != nil {
+		logger.Log.Warningf("Reply to %s was not delivered: %s", m.Room.Name, err)
+		return
+	}
+
+	if d != nil && !strings.HasSuffix(d.Text, text) {
+		logger.Log.Infof("Reply to %s was delivered as %q", m.Room.Name, d.Text)
+	}
+}
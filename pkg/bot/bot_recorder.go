@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/enmand/quarid-go/pkg/recorder"
+)
+
+// ErrNotReplaying is returned when replaying without a recording to replay
+var ErrNotReplaying = errors.New("No recording to replay")
+
+// startRecording records the session to "record.file", if it is set. A
+// session being replayed is not recorded
+func (q *quarid) startRecording() error {
+	path := q.Config.GetString("record.file")
+	if path == "" || q.replaying != nil {
+		return nil
+	}
+
+	rec, err := recorder.Open(path)
+	if err != nil {
+		return err
+	}
+	q.recorder = rec
+	logger.Log.Infof("Recording the session to %s", path)
+
+	return nil
+}
+
+// loadReplay loads the recording in "replay.file" to replay, if it is set.
+// The networks in it are replayed instead of being connected to
+func (q *quarid) loadReplay() error {
+	path := q.Config.GetString("replay.file")
+	if path == "" {
+		return nil
+	}
+
+	r, err := recorder.Load(path)
+	if err != nil {
+		return err
+	}
+	if q.Config.IsSet("replay.timeout") {
+		r.Timeout = q.Config.GetDuration("replay.timeout")
+	}
+	q.replaying = r
+
+	return nil
+}
+
+// clock is the clock the bot runs on: the recording's, when it is being
+// replayed
+func (q *quarid) clock() clock.Clock {
+	if q.replaying != nil {
+		return q.replaying
+	}
+
+	return clock.Real
+}
+
+// record an IRC client's events on network, if the session is recorded
+func (q *quarid) record(c *irc.Client, network string) {
+	if q.recorder != nil {
+		c.Tap = q.recorder.Tap(network)
+	}
+}
+
+// ircAddress is the address of the server for the IRC network, or the
+// address to replay it from
+func (q *quarid) ircAddress(network, server string) string {
+	if q.replaying != nil {
+		return recorder.Address(network)
+	}
+
+	return server
+}
+
+// replayed reports whether the adapter on network should be used, when
+// replaying: it must have been recorded
+func (q *quarid) replayed(adapterName, network string) bool {
+	return q.replaying == nil || q.replaying.Has(adapterName, network)
+}
+
+// addPlayers adds the adapters (other than IRC) being replayed, in place of
+// those configured
+func (q *quarid) addPlayers() error {
+	for _, p := range q.replaying.Players() {
+		a, err := q.wrap(p)
+		if err != nil {
+			return err
+		}
+		q.adapters = append(q.adapters, a)
+	}
+
+	return nil
+}
+
+// ReplayRecording connects the bot to the recording being replayed, plays
+// it, and returns how what the bot said differs from what it said when it
+// was recorded
+func (q *quarid) ReplayRecording() ([]recorder.Difference, error) {
+	if q.replaying == nil {
+		return nil, ErrNotReplaying
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- q.Connect()
+	}()
+
+	if err := q.replaying.Run(); err != nil {
+		select {
+		case cerr := <-errs:
+			if cerr != nil {
+				return nil, fmt.Errorf("Could not replay: %s", cerr)
+			}
+		default:
+		}
+		return nil, err
+	}
+
+	return q.replaying.Diff(), nil
+}
+
+// unwrap an adapter wrapped with middleware, or recorded, to the adapter
+// itself
+func unwrap(a adapter.Adapter) adapter.Adapter {
+	for {
+		w, ok := a.(unwrapper)
+		if !ok {
+			return a
+		}
+		a = w.Unwrap()
+	}
+}
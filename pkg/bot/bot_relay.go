@@ -0,0 +1,238 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/enmand/quarid-go/pkg/relay"
+)
+
+// puppetNickLength is the longest a puppet's nick is, before its suffix
+const puppetNickLength = 16
+
+// relayLinks are the configured "relay.links": lists of rooms, each given as
+// {"adapter": "irc", "network": "libera", "room": "#ops"}
+func (q *quarid) relayLinks() [][]relay.Endpoint {
+	if !q.Config.GetBool("relay.enable") {
+		return nil
+	}
+
+	configured, _ := q.Config.Get("relay.links").([]interface{})
+
+	var links [][]relay.Endpoint
+	for _, l := range configured {
+		rooms, _ := l.([]interface{})
+
+		var link []relay.Endpoint
+		for _, r := range rooms {
+			m, _ := r.(map[string]interface{})
+			ep := relay.Endpoint{}
+			ep.Adapter, _ = m["adapter"].(string)
+			ep.Network, _ = m["network"].(string)
+			ep.Room, _ = m["room"].(string)
+
+			if ep.Adapter == "" || ep.Room == "" {
+				logger.Log.Warningf("Invalid room in relay.links: %v", r)
+				continue
+			}
+			link = append(link, ep)
+		}
+		links = append(links, link)
+	}
+
+	return links
+}
+
+// linkedChannels are the channels linked on our IRC network, which the bot
+// joins as it joins its configured channels
+func (q *quarid) linkedChannels(links [][]relay.Endpoint) []interface{} {
+	var chs []interface{}
+	for _, l := range links {
+		for _, ep := range l {
+			if ep.Adapter == irc.ADAPTER_NAME &&
+				(ep.Network == "" || ep.Network == q.networkName()) {
+				chs = append(chs, ep.Room)
+			}
+		}
+	}
+
+	return chs
+}
+
+// startRelay relays between the configured links. Each adapter is on the
+// network named for it, except IRC, which is on our network, and the IRC
+// networks in "relay.networks", which are connected to only for relaying.
+// Plugins do not hear from those networks, so the relay must be started after
+// plugins are
+func (q *quarid) startRelay(links [][]relay.Endpoint) error {
+	r := relay.New()
+	r.Memberships = q.Config.GetBool("relay.memberships")
+	if q.Config.IsSet("relay.topics") {
+		r.Topics = q.Config.GetBool("relay.topics")
+	}
+
+	for _, a := range q.adapters {
+		name := a.Name()
+		if a == adapter.Adapter(q.ircAdapter) {
+			name = q.networkName()
+		}
+		r.Add(name, a)
+	}
+
+	for name := range q.Config.GetStringMap("relay.networks") {
+		if !q.replayed(irc.ADAPTER_NAME, name) {
+			continue
+		}
+
+		a, err := q.relayNetwork(name, links)
+		if err != nil {
+			return err
+		}
+		q.adapters = append(q.adapters, a)
+		r.Add(name, a)
+	}
+
+	// Puppets are not recorded, so they are not replayed
+	puppeted := q.Config.GetStringSlice("relay.puppets.networks")
+	if q.replaying != nil {
+		puppeted = nil
+	}
+
+	suffix := q.Config.GetString("relay.puppets.suffix")
+	idle := q.Config.GetDuration("relay.puppets.idle")
+	for _, name := range puppeted {
+
+		server, tls, verify := q.ircServer(name)
+		if server == "" {
+			logger.Log.Warningf("Cannot puppet on %s, which is not an IRC network", name)
+			continue
+		}
+
+		if err := r.Puppet(irc.ADAPTER_NAME, name, puppets(server, tls, verify, suffix), idle); err != nil {
+			return fmt.Errorf("Could not puppet on %s: %s", name, err)
+		}
+	}
+
+	for _, l := range links {
+		if err := r.Link(l...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relayNetwork builds an IRC connection to the network name, from
+// "relay.networks", which joins the channels linked on it
+func (q *quarid) relayNetwork(name string, links [][]relay.Endpoint) (adapter.Adapter, error) {
+	key := func(k string) string {
+		return "relay.networks." + name + "." + k
+	}
+
+	server, tls, verify := q.ircServer(name)
+	if server == "" {
+		return nil, fmt.Errorf("No server given for relay network %s", name)
+	}
+
+	nick := q.Config.GetString(key("nick"))
+	if nick == "" {
+		nick = q.Config.GetString("irc.nick")
+	}
+	user := q.Config.GetString(key("user"))
+	if user == "" {
+		user = q.Config.GetString("irc.user")
+	}
+
+	c := irc.NewClient(nick, user, verify, tls)
+	c.Password = q.Config.GetString(key("password"))
+	c.SASLUser = q.Config.GetString(key("sasl.user"))
+	c.SASLPassword = q.Config.GetString(key("sasl.password"))
+	c.Store = database.GetStore()
+	c.Clock = q.clock()
+
+	mw, err := q.middleware(irc.ADAPTER_NAME, name)
+	if err != nil {
+		return nil, err
+	}
+	c.Middleware = mw
+	q.record(c, name)
+
+	var rooms []interface{}
+	for _, l := range links {
+		for _, ep := range l {
+			if ep.Adapter == irc.ADAPTER_NAME && ep.Network == name {
+				rooms = append(rooms, ep.Room)
+			}
+		}
+	}
+	cs := newChannels(c, database.GetStore(), name, rooms)
+	c.Observe(cs.observe)
+
+	return irc.NewAdapter(c, q.ircAddress(name, server)), nil
+}
+
+// ircServer is the server of the IRC network name (ours, or one of
+// "relay.networks"), and whether to connect with TLS, and verify it
+func (q *quarid) ircServer(name string) (string, bool, bool) {
+	if name == q.networkName() {
+		return q.Config.GetString("irc.server"),
+			q.Config.GetBool("irc.tls.enable"),
+			q.Config.GetBool("irc.tls.verify")
+	}
+
+	key := "relay.networks." + name + "."
+	return q.Config.GetString(key + "server"),
+		q.Config.GetBool(key + "tls.enable"),
+		q.Config.GetBool(key + "tls.verify")
+}
+
+// puppets connects a puppet to server, for each user relayed to it, with a
+// nick of the user's name and suffix
+func puppets(server string, tls, verify bool, suffix string) relay.PuppetFunc {
+	return func(u adapter.User) (adapter.Adapter, adapter.User, error) {
+		nick := puppetNick(u.Name, suffix)
+
+		c := irc.NewClient(nick, "relay", verify, tls)
+		c.AltNicks = []string{nick + "_", nick + "__"}
+
+		a := irc.NewAdapter(c, server)
+		if err := a.Connect(); err != nil {
+			return nil, adapter.User{}, err
+		}
+
+		nick = c.CurrentNick()
+		return a, adapter.User{ID: nick, Name: nick}, nil
+	}
+}
+
+// puppetNick is a nick for name, which IRC allows: other characters are
+// dropped, and it may not start with a digit or dash
+func puppetNick(name, suffix string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', strings.ContainsRune("[]\\`_^{|}", r):
+		case (r >= '0' && r <= '9') || r == '-':
+			if b.Len() == 0 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		b.WriteRune(r)
+		if b.Len() == puppetNickLength {
+			break
+		}
+	}
+
+	if b.Len() == 0 {
+		b.WriteString("relay")
+	}
+
+	return b.String() + suffix
+}
@@ -0,0 +1,172 @@
+package bot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/bot"
+	"github.com/enmand/quarid-go/pkg/config"
+	"github.com/enmand/quarid-go/pkg/irc/irctest"
+	"github.com/spf13/viper"
+)
+
+const timeout = 2 * time.Second
+
+const echoPlugin = `{
+	"name": "echo",
+	"vm": "js",
+	"main": "main.js"
+}`
+
+const echoMain = `
+module.exports.handle = function(message) {
+	if (message.text === "admin?") {
+		var forged = {adapter: "console", prefix: "admin!admin@staff.example"};
+		var changed = JSON.parse(JSON.stringify(message));
+		changed.adapter = "console";
+		changed.prefix = "admin!admin@staff.example";
+
+		return "admin: " + isAdmin(message) +
+			", forged: " + isAdmin(forged) +
+			", changed: " + isAdmin(changed);
+	}
+
+	return "You said: " + message.text;
+};
+`
+
+// plugins writes the echo plugin to a new plugins directory
+func plugins(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "quarid-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(dir, "echo")
+	if err := os.Mkdir(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "plugin.json"), []byte(echoPlugin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "main.js"), []byte(echoMain), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// connect a new bot to s, configured with channels (which must include #test),
+// with the echo plugin loaded. It returns once the bot has joined #test
+func connect(t *testing.T, s *irctest.Server, channels interface{}) (bot.Bot, func()) {
+	addr, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := plugins(t)
+
+	v := viper.New()
+	v.Set("irc.nick", "quarid")
+	v.Set("irc.user", "quarid")
+	v.Set("irc.server", addr)
+	v.Set("irc.channels", channels)
+	v.Set("irc.admins", []string{"mask:admin!*@staff.example"})
+	v.Set("plugins_dirs", []string{dir})
+
+	c := config.Config{Viper: v}
+	config.Set(c)
+
+	q := bot.New(&c)
+	go q.Connect()
+
+	if _, err := s.ExpectSent(` 366 quarid #test `, timeout); err != nil {
+		t.Fatalf("The bot did not join: %s", err)
+	}
+
+	return q, func() {
+		q.Disconnect()
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	s := irctest.NewServer()
+	_, done := connect(t, s, "#test")
+	defer done()
+
+	for _, l := range []string{`^NICK quarid$`, `^USER quarid `} {
+		if _, err := s.Expect(l, timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	s := irctest.NewServer()
+	_, done := connect(t, s, "#test")
+	defer done()
+
+	if _, err := s.Expect(`^JOIN #test$`, timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if ms := s.Members("#test"); len(ms) != 1 || ms[0] != "quarid" {
+		t.Fatalf("Expected quarid in #test, but it has %q", ms)
+	}
+}
+
+func TestJoinConfigured(t *testing.T) {
+	// The forms irc.channels takes from the config file, flags, and the
+	// environment
+	for _, channels := range []interface{}{
+		[]interface{}{"#test", "#keyed key"},
+		[]string{"#test", "#keyed key"},
+		"#test,#keyed key",
+	} {
+		s := irctest.NewServer()
+		_, done := connect(t, s, channels)
+
+		if _, err := s.Expect(`^JOIN #keyed,#test :?key$`, timeout); err != nil {
+			t.Errorf("%#v: %s", channels, err)
+		}
+
+		done()
+	}
+}
+
+func TestPluginReply(t *testing.T) {
+	s := irctest.NewServer()
+	_, done := connect(t, s, "#test")
+	defer done()
+
+	if !s.Privmsg("alice!alice@example.com", "#test", "hello there") {
+		t.Fatal("Could not send to #test")
+	}
+	if _, err := s.Expect(`^PRIVMSG #test :alice: You said: hello there$`, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPluginIsAdmin(t *testing.T) {
+	s := irctest.NewServer()
+	_, done := connect(t, s, "#test")
+	defer done()
+
+	// Plugins are only told what is true of the message itself, whatever they
+	// change in the object they were given
+	for from, want := range map[string]string{
+		"alice!alice@example.com":   "admin: false, forged: false, changed: false",
+		"admin!admin@staff.example": "admin: true, forged: false, changed: true",
+	} {
+		if !s.Privmsg(from, "#test", "admin?") {
+			t.Fatal("Could not send to #test")
+		}
+		if _, err := s.Expect(`^PRIVMSG #test :\w+: `+want+`$`, timeout); err != nil {
+			t.Errorf("%s: %s", from, err)
+		}
+	}
+}
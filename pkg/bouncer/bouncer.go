@@ -0,0 +1,164 @@
+// Package bouncer lets IRC clients attach to the bot's IRC connections
+//
+// About
+//
+// The Bouncer listens for standard IRC clients. Once a client authenticates,
+// it is attached to one of the bot's upstream networks: it is sent the
+// channels the bot is in, any backlog it missed since it was last attached,
+// and then every event from the network as it happens. Messages the client
+// sends are forwarded upstream under the bot's identity.
+//
+// Clients authenticate with PASS, using a login of the form
+//
+//	user[@client][/network]:password
+//
+// Logins cannot contain a colon, so the password is everything after the first
+// one. The login may also be sent as the USER username, with only the password
+// (which then cannot contain a colon) in PASS. The optional client name keeps
+// separate backlog positions for each of a user's clients, and the network may
+// be left out if there is only one.
+package bouncer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// DefaultBacklog is the number of lines kept for each network, if no other
+// size is configured
+const DefaultBacklog = 1000
+
+// DefaultRegisterTimeout is how long a client has to register, and
+// authenticate, before it is disconnected
+const DefaultRegisterTimeout = time.Minute
+
+// Bouncer accepts IRC clients, and attaches them to upstream networks
+type Bouncer struct {
+	// Users that may connect, and their passwords
+	Users map[string]string
+
+	// The number of lines of backlog kept for each network
+	Backlog int
+
+	// How long a client has to register before it is disconnected
+	RegisterTimeout time.Duration
+
+	// If set, clients must connect with TLS
+	TLSConfig *tls.Config
+
+	store    database.Store
+	mu       sync.Mutex
+	networks map[string]*network
+	listener net.Listener
+}
+
+// New returns a new Bouncer, that keeps backlog in store
+func New(store database.Store, users map[string]string) *Bouncer {
+	return &Bouncer{
+		Users:           users,
+		Backlog:         DefaultBacklog,
+		RegisterTimeout: DefaultRegisterTimeout,
+		store:           store,
+		networks:        make(map[string]*network),
+	}
+}
+
+// AddNetwork makes the upstream IRC client c available to attach to, as the
+// network name
+func (b *Bouncer) AddNetwork(name string, c *irc.Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := newNetwork(b, name, c)
+	b.networks[name] = n
+	c.Observe(n.observe)
+}
+
+// Listen accepts clients on addr, until the Bouncer is closed
+func (b *Bouncer) Listen(addr string) error {
+	var l net.Listener
+	var err error
+
+	if b.TLSConfig != nil {
+		l, err = tls.Listen("tcp", addr, b.TLSConfig)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("Bouncer could not listen on %s: %s", addr, err)
+	}
+
+	b.mu.Lock()
+	b.listener = l
+	b.mu.Unlock()
+
+	logger.Log.Infof("Bouncer listening on %s", l.Addr())
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				logger.Log.Infof("Bouncer stopped listening: %s", err)
+				return
+			}
+
+			go newConn(b, nc).serve()
+		}
+	}()
+
+	return nil
+}
+
+// Close stops accepting clients, and detaches every attached client
+func (b *Bouncer) Close() error {
+	b.mu.Lock()
+	l := b.listener
+	var ns []*network
+	for _, n := range b.networks {
+		ns = append(ns, n)
+	}
+	b.mu.Unlock()
+
+	for _, n := range ns {
+		for _, c := range n.attached() {
+			c.close()
+		}
+	}
+
+	if l != nil {
+		return l.Close()
+	}
+
+	return nil
+}
+
+// network returns the network named name. If name is empty, and there is only
+// one network, that network is returned
+func (b *Bouncer) network(name string) (*network, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if name == "" {
+		if len(b.networks) == 1 {
+			for _, n := range b.networks {
+				return n, nil
+			}
+		}
+
+		return nil, fmt.Errorf("No network given, and %d are available", len(b.networks))
+	}
+
+	n, ok := b.networks[name]
+	if !ok {
+		return nil, fmt.Errorf("No network named %s", name)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,143 @@
+package bouncer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// entry is a single line of backlog
+type entry struct {
+	// When the line was read from (or sent to) the server
+	Time time.Time
+
+	// The line, as it would be sent to a client
+	Line string
+}
+
+func (e *entry) event() *adapter.Event {
+	ev, err := irc.ParseLine(e.Line)
+	if err != nil {
+		return &adapter.Event{}
+	}
+	ev.Timestamp = e.Time
+
+	return ev
+}
+
+// buffer is the persisted backlog of a network
+type buffer struct {
+	store  database.Store
+	bucket string
+	size   int
+
+	mu   sync.Mutex
+	keys []string
+	seq  int
+}
+
+func newBuffer(store database.Store, network string, size int) *buffer {
+	if size <= 0 {
+		size = DefaultBacklog
+	}
+
+	b := &buffer{
+		store:  store,
+		bucket: fmt.Sprintf("bouncer.backlog.%s", network),
+		size:   size,
+	}
+
+	err := store.ForEach(b.bucket, func(k string, v []byte) error {
+		b.keys = append(b.keys, k)
+		return nil
+	})
+	if err != nil {
+		logger.Log.Errorf("Could not load backlog for %s: %s", network, err)
+	}
+
+	return b
+}
+
+// append ev to the backlog, removing the oldest lines if the backlog is full
+func (b *buffer) append(t time.Time, ev *adapter.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Keys sort in time order, and seq keeps lines at the same time in order
+	b.seq++
+	key := fmt.Sprintf("%020d-%06d", t.UnixNano(), b.seq%1000000)
+
+	out := *ev
+	out.Tags = nil
+	err := b.store.Put(b.bucket, key, &entry{
+		Time: t,
+		Line: irc.FormatLine(&out),
+	})
+	if err != nil {
+		logger.Log.Errorf("Could not save backlog: %s", err)
+		return
+	}
+	b.keys = append(b.keys, key)
+
+	for len(b.keys) > b.size {
+		if err := b.store.Delete(b.bucket, b.keys[0]); err != nil {
+			logger.Log.Errorf("Could not trim backlog: %s", err)
+			return
+		}
+		b.keys = b.keys[1:]
+	}
+}
+
+// since returns the backlog after t, oldest first
+func (b *buffer) since(t time.Time) []*entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var es []*entry
+	after := fmt.Sprintf("%020d-999999", t.UnixNano())
+
+	for _, k := range b.keys {
+		if k <= after {
+			continue
+		}
+
+		e := &entry{}
+		if err := b.store.Get(b.bucket, k, e); err != nil {
+			logger.Log.Errorf("Could not read backlog %s: %s", k, err)
+			continue
+		}
+		es = append(es, e)
+	}
+
+	return es
+}
+
+// position is where in a network's backlog a client last read to
+type position struct {
+	Time time.Time
+}
+
+const positionBucket = "bouncer.positions"
+
+func loadPosition(s database.Store, key string) time.Time {
+	p := &position{}
+	if err := s.Get(positionBucket, key, p); err != nil {
+		if err != database.ErrNotFound {
+			logger.Log.Errorf("Could not load backlog position %s: %s", key, err)
+		}
+		return time.Time{}
+	}
+
+	return p.Time
+}
+
+func savePosition(s database.Store, key string, t time.Time) {
+	if err := s.Put(positionBucket, key, &position{Time: t}); err != nil {
+		logger.Log.Errorf("Could not save backlog position %s: %s", key, err)
+	}
+}
@@ -0,0 +1,474 @@
+package bouncer
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+const (
+	// The name the bouncer uses as the prefix of its own messages
+	serverName = "quarid.bouncer"
+
+	// The most lines that may be waiting to be sent to a client, before the
+	// client is disconnected for being too slow
+	maxQueue = 10000
+
+	// How long a write to a client may take
+	writeTimeout = 30 * time.Second
+
+	capServerTime  = "server-time"
+	capEchoMessage = "echo-message"
+)
+
+// caps are the capabilities the bouncer offers to clients
+var caps = []string{capServerTime, capEchoMessage}
+
+// conn is a client connected to the bouncer
+type conn struct {
+	b  *Bouncer
+	nc net.Conn
+
+	// Registration
+	nick       string
+	login      string
+	pass       string
+	negotiate  bool
+	registered bool
+
+	// The network the client is attached to, and where the client's backlog
+	// position is kept
+	network  *network
+	position string
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []string
+	caps   map[string]bool
+	seen   time.Time
+	closed bool
+}
+
+func newConn(b *Bouncer, nc net.Conn) *conn {
+	c := &conn{
+		b:    b,
+		nc:   nc,
+		caps: make(map[string]bool),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	return c
+}
+
+// serve the client until it disconnects
+func (c *conn) serve() {
+	logger.Log.Infof("Bouncer client connected from %s", c.nc.RemoteAddr())
+
+	go c.writeLoop()
+	defer c.close()
+
+	// Clients that never register are not kept waiting for
+	if c.b.RegisterTimeout > 0 {
+		c.nc.SetReadDeadline(time.Now().Add(c.b.RegisterTimeout))
+	}
+
+	r := bufio.NewReader(c.nc)
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !c.registered {
+				c.reply(irc.IRC_ERROR, "Registration timed out")
+			}
+			return
+		}
+
+		l = strings.TrimRight(l, "\r\n")
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+
+		ev, err := irc.ParseLine(l)
+		if err != nil {
+			logger.Log.Debugf("Bouncer client sent an invalid line: %s", err)
+			continue
+		}
+		ev.Prefix = ""
+		ev.Command = strings.ToUpper(ev.Command)
+
+		if !c.handle(ev) {
+			return
+		}
+	}
+}
+
+// handle a single event from the client, returning false if the client
+// should be disconnected
+func (c *conn) handle(ev *adapter.Event) bool {
+	switch ev.Command {
+	case irc.IRC_CAP:
+		return c.handleCap(ev)
+	case irc.IRC_PING:
+		c.reply(irc.IRC_PONG, serverName, param(ev, 0))
+	case irc.IRC_PONG:
+	case irc.IRC_QUIT:
+		return false
+	case irc.IRC_PASS:
+		if c.registered {
+			c.numeric(irc.IRC_ERR_ALREADYREGISTRED, "You may not reregister")
+			break
+		}
+		c.pass = param(ev, 0)
+	case irc.IRC_USER:
+		if c.registered {
+			c.numeric(irc.IRC_ERR_ALREADYREGISTRED, "You may not reregister")
+			break
+		}
+		c.login = param(ev, 0)
+		return c.register()
+	case irc.IRC_NICK:
+		if c.registered {
+			// The client shares the bot's nick, which it may not change
+			break
+		}
+		c.nick = param(ev, 0)
+		return c.register()
+	default:
+		if !c.registered {
+			c.numeric(irc.IRC_ERR_NOTREGISTERED, "You have not registered")
+			break
+		}
+
+		if ev.Command == irc.IRC_AUTHENTICATE {
+			// The client is already authenticated, as the bot
+			break
+		}
+
+		out := &adapter.Event{
+			Command:    ev.Command,
+			Parameters: ev.Parameters,
+		}
+		if err := c.network.write(c, out); err != nil {
+			logger.Log.Errorf("Could not forward %s upstream: %s", ev.Command, err)
+		}
+	}
+
+	return true
+}
+
+// handleCap negotiates capabilities with the client. It returns false if the
+// client failed to authenticate, once negotiation ended
+func (c *conn) handleCap(ev *adapter.Event) bool {
+	switch strings.ToUpper(param(ev, 0)) {
+	case "LS":
+		if !c.registered {
+			c.negotiate = true
+		}
+		c.reply(irc.IRC_CAP, c.target(), "LS", strings.Join(caps, " "))
+	case "LIST":
+		var enabled []string
+		for _, cp := range caps {
+			if c.hasCap(cp) {
+				enabled = append(enabled, cp)
+			}
+		}
+		c.reply(irc.IRC_CAP, c.target(), "LIST", strings.Join(enabled, " "))
+	case "REQ":
+		if !c.registered {
+			c.negotiate = true
+		}
+
+		req := strings.Fields(param(ev, 1))
+		for _, r := range req {
+			if !offered(strings.TrimPrefix(r, "-")) {
+				c.reply(irc.IRC_CAP, c.target(), "NAK", param(ev, 1))
+				return true
+			}
+		}
+
+		c.mu.Lock()
+		for _, r := range req {
+			if strings.HasPrefix(r, "-") {
+				delete(c.caps, r[1:])
+			} else {
+				c.caps[r] = true
+			}
+		}
+		c.mu.Unlock()
+
+		c.reply(irc.IRC_CAP, c.target(), "ACK", param(ev, 1))
+	case "END":
+		if !c.registered {
+			c.negotiate = false
+			return c.register()
+		}
+	}
+
+	return true
+}
+
+// register the client, if it has sent everything needed to register. It
+// returns false if the client failed to authenticate
+func (c *conn) register() bool {
+	if c.registered || c.negotiate || c.nick == "" || c.login == "" {
+		return true
+	}
+
+	// Logins cannot contain a colon, but passwords can
+	login, pass := c.login, c.pass
+	if i := strings.Index(pass, ":"); i >= 0 {
+		login, pass = pass[:i], pass[i+1:]
+	}
+
+	user, client, name := parseLogin(login)
+	want, ok := c.b.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(want), []byte(pass)) != 1 {
+		logger.Log.Warningf("Bouncer login failed for %q from %s", user, c.nc.RemoteAddr())
+		c.numeric(irc.IRC_ERR_PASSWDMISMATCH, "Password incorrect")
+		c.reply(irc.IRC_ERROR, "Invalid username or password")
+		return false
+	}
+
+	n, err := c.b.network(name)
+	if err != nil {
+		c.reply(irc.IRC_ERROR, err.Error())
+		return false
+	}
+
+	c.registered = true
+	c.network = n
+	c.nc.SetReadDeadline(time.Time{})
+	c.position = strings.Join([]string{user, client, n.name}, "/")
+
+	logger.Log.Infof("Bouncer client %s attached to %s", c.position, n.name)
+
+	c.welcome()
+	n.attach(c, loadPosition(c.b.store, c.position))
+
+	return true
+}
+
+// welcome the client to the network, and send it the state of every channel
+// the bot is in
+func (c *conn) welcome() {
+	client := c.network.client
+	nick := client.CurrentNick()
+
+	c.numeric(irc.IRC_RPL_WELCOME, fmt.Sprintf("Welcome to %s, %s", c.network.name, nick))
+	c.numeric(irc.IRC_RPL_YOURHOST, fmt.Sprintf("Your host is %s, via %s", client.Server, serverName))
+	c.numeric(irc.IRC_RPL_CREATED, "This bouncer is part of quarid")
+	c.numeric(irc.IRC_RPL_MYINFO, serverName, "quarid", "o", "o")
+	c.numeric(irc.IRC_ERR_NOMOTD, "MOTD File is missing")
+
+	if c.nick != nick {
+		c.write(&adapter.Event{
+			Prefix:     c.nick,
+			Command:    irc.IRC_NICK,
+			Parameters: []string{nick},
+		})
+		c.nick = nick
+	}
+
+	me := irc.Hostmask{Nick: nick, User: client.Ident, Host: client.Host}
+	for _, ch := range client.State().Channels() {
+		c.write(&adapter.Event{
+			Prefix:     me.String(),
+			Command:    irc.IRC_JOIN,
+			Parameters: []string{ch.Name},
+		})
+
+		if ch.Topic != "" {
+			c.numeric(irc.IRC_RPL_TOPIC, ch.Name, ch.Topic)
+		}
+
+		var names []string
+		for n, p := range ch.Members {
+			names = append(names, p+n)
+			if len(names) == 20 {
+				c.numeric(irc.IRC_RPL_NAMREPLY, "=", ch.Name, strings.Join(names, " "))
+				names = nil
+			}
+		}
+		if len(names) > 0 {
+			c.numeric(irc.IRC_RPL_NAMREPLY, "=", ch.Name, strings.Join(names, " "))
+		}
+		c.numeric(irc.IRC_RPL_ENDOFNAMES, ch.Name, "End of /NAMES list")
+	}
+}
+
+// send an event from the network to the client, read from the server at t
+func (c *conn) send(t time.Time, ev *adapter.Event) {
+	out := *ev
+	out.Tags = nil
+	if out.Command == irc.IRC_JOIN && len(out.Parameters) > 1 {
+		// Clients are not offered extended-join
+		out.Parameters = out.Parameters[:1]
+	}
+	if c.hasCap(capServerTime) {
+		out.Tags = map[string]string{
+			"time": t.UTC().Format("2006-01-02T15:04:05.000Z"),
+		}
+	}
+
+	c.mu.Lock()
+	if t.After(c.seen) {
+		c.seen = t
+	}
+	c.mu.Unlock()
+
+	c.write(&out)
+}
+
+// write an event to the client, without blocking
+func (c *conn) write(ev *adapter.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	if len(c.queue) >= maxQueue {
+		logger.Log.Warningf("Bouncer client %s is too slow, disconnecting", c.position)
+		c.queue = nil
+		c.nc.Close()
+
+		// The network may be sending to us, so it is detached from once
+		// that is done
+		seen := c.shut()
+		go c.detach(seen)
+		return
+	}
+
+	c.queue = append(c.queue, irc.FormatLine(ev)+"\r\n")
+	c.cond.Broadcast()
+}
+
+// writeLoop writes queued lines to the client, until the client is closed and
+// every queued line has been written
+func (c *conn) writeLoop() {
+	defer c.nc.Close()
+
+	for {
+		c.mu.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		q := c.queue
+		c.queue = nil
+		c.mu.Unlock()
+
+		for _, l := range q {
+			c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.nc.Write([]byte(l)); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close the client connection, detaching it from its network and saving its
+// backlog position. Lines already queued for the client are still written
+func (c *conn) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	seen := c.shut()
+	c.mu.Unlock()
+
+	c.detach(seen)
+}
+
+// shut marks the client closed, with c.mu held, and returns when it was last
+// sent an event
+func (c *conn) shut() time.Time {
+	c.closed = true
+	c.cond.Broadcast()
+
+	return c.seen
+}
+
+// detach the client from its network, saving its backlog position as seen
+func (c *conn) detach(seen time.Time) {
+	logger.Log.Infof("Bouncer client %s disconnected", c.nc.RemoteAddr())
+
+	if c.network != nil {
+		c.network.detach(c)
+		if !seen.IsZero() {
+			savePosition(c.b.store, c.position, seen)
+		}
+	}
+}
+
+func (c *conn) hasCap(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.caps[name]
+}
+
+// reply with a command from the bouncer itself
+func (c *conn) reply(command string, params ...string) {
+	c.write(&adapter.Event{
+		Prefix:     serverName,
+		Command:    command,
+		Parameters: params,
+	})
+}
+
+// numeric replies with a numeric from the bouncer itself
+func (c *conn) numeric(numeric string, params ...string) {
+	c.reply(numeric, append([]string{c.target()}, params...)...)
+}
+
+func (c *conn) target() string {
+	if c.nick == "" {
+		return "*"
+	}
+
+	return c.nick
+}
+
+// parseLogin splits a user[@client][/network] login
+func parseLogin(login string) (user, client, network string) {
+	if i := strings.Index(login, "/"); i >= 0 {
+		login, network = login[:i], login[i+1:]
+	}
+	if i := strings.Index(login, "@"); i >= 0 {
+		login, client = login[:i], login[i+1:]
+	}
+
+	return login, client, network
+}
+
+func offered(name string) bool {
+	for _, cp := range caps {
+		if cp == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func param(ev *adapter.Event, n int) string {
+	if n < len(ev.Parameters) {
+		return ev.Parameters[n]
+	}
+
+	return ""
+}
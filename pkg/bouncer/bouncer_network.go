@@ -0,0 +1,159 @@
+package bouncer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+// buffered are the commands kept in a network's backlog
+var buffered = map[string]bool{
+	irc.IRC_PRIVMSG: true,
+	irc.IRC_NOTICE:  true,
+	irc.IRC_JOIN:    true,
+	irc.IRC_PART:    true,
+	irc.IRC_KICK:    true,
+	irc.IRC_QUIT:    true,
+	irc.IRC_NICK:    true,
+	irc.IRC_TOPIC:   true,
+	irc.IRC_MODE:    true,
+}
+
+// private are commands read from upstream that are never sent to clients
+var private = map[string]bool{
+	irc.IRC_PING:     true,
+	irc.IRC_PONG:     true,
+	irc.IRC_CAP:      true,
+	irc.IRC_ACCOUNT:  true,
+	irc.CONNECTED:    true,
+	irc.DISCONNECTED: true,
+	irc.ONLINE:       true,
+	irc.OFFLINE:      true,
+}
+
+// network is an upstream connection clients can attach to
+type network struct {
+	name   string
+	client *irc.Client
+	buffer *buffer
+
+	mu      sync.Mutex
+	conns   []*conn
+	origins map[*adapter.Event]*conn
+}
+
+func newNetwork(b *Bouncer, name string, c *irc.Client) *network {
+	return &network{
+		name:    name,
+		client:  c,
+		buffer:  newBuffer(b.store, name, b.Backlog),
+		origins: make(map[*adapter.Event]*conn),
+	}
+}
+
+// observe events from the upstream client: buffer what should be kept, and
+// send everything else on to attached clients
+func (n *network) observe(ev *adapter.Event, sent bool) {
+	if private[ev.Command] || ev.Historical {
+		return
+	}
+
+	// Clients are not offered batches, so they are sent the batched events
+	if ev.Command == irc.IRC_BATCH {
+		for _, b := range ev.Batch {
+			n.observe(b, sent)
+		}
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	origin, fromClient := n.origins[ev]
+	delete(n.origins, ev)
+
+	if sent {
+		if !buffered[ev.Command] {
+			return
+		}
+
+		// Events the bot sends won't be echoed back to us, so they are sent
+		// to clients as though they came from the server
+		out := *ev
+		out.Prefix = irc.Hostmask{
+			Nick: n.client.CurrentNick(),
+			User: n.client.Ident,
+			Host: n.client.Host,
+		}.String()
+		ev = &out
+	}
+
+	t := ev.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	if buffered[ev.Command] {
+		n.buffer.append(t, ev)
+	}
+
+	for _, c := range n.conns {
+		if fromClient && c == origin && !c.hasCap(capEchoMessage) {
+			continue
+		}
+		c.send(t, ev)
+	}
+}
+
+// write an event upstream, on behalf of the client c. It is written as the
+// client sent it, without the bot's middleware, so that the event observed as
+// sent is ev itself
+func (n *network) write(c *conn, ev *adapter.Event) error {
+	n.mu.Lock()
+	n.origins[ev] = c
+	n.mu.Unlock()
+
+	err := n.client.WriteDirect(ev)
+	if err != nil {
+		n.mu.Lock()
+		delete(n.origins, ev)
+		n.mu.Unlock()
+	}
+
+	return err
+}
+
+// attach c to the network, sending it the backlog it missed since it was
+// last attached
+func (n *network) attach(c *conn, since time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, e := range n.buffer.since(since) {
+		c.send(e.Time, e.event())
+	}
+
+	n.conns = append(n.conns, c)
+}
+
+// detach c from the network
+func (n *network) detach(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, o := range n.conns {
+		if o == c {
+			n.conns = append(n.conns[:i], n.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *network) attached() []*conn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]*conn(nil), n.conns...)
+}
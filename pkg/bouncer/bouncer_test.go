@@ -0,0 +1,223 @@
+package bouncer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/irc/irctest"
+	"github.com/enmand/quarid-go/pkg/middleware"
+)
+
+const timeout = 2 * time.Second
+
+func newBouncer() *Bouncer {
+	return New(database.NewMemoryStore(), map[string]string{"alice": "secret"})
+}
+
+// lines reads lines from a client's connection, until it is closed
+func lines(nc net.Conn) <-chan string {
+	ls := make(chan string, 100)
+	go func() {
+		defer close(ls)
+
+		r := bufio.NewReader(nc)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			ls <- strings.TrimRight(l, "\r\n")
+		}
+	}()
+
+	return ls
+}
+
+// expect a line from ls containing want, skipping any others
+func expect(t *testing.T, ls <-chan string, want string) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case l, ok := <-ls:
+			if !ok {
+				t.Fatalf("Expected %q, but the connection was closed", want)
+			}
+			if strings.Contains(l, want) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Expected %q", want)
+		}
+	}
+}
+
+// closed waits for ls to be closed
+func closed(t *testing.T, ls <-chan string) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-ls:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("Expected the connection to be closed")
+		}
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	b := newBouncer()
+	b.RegisterTimeout = 50 * time.Millisecond
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConn(b, server).serve()
+
+	ls := lines(client)
+	expect(t, ls, " ERROR :Registration timed out")
+	closed(t, ls)
+}
+
+func TestSlowClient(t *testing.T) {
+	b := newBouncer()
+	b.AddNetwork("test", irc.NewClient("quarid", "quarid", false, false))
+	n, err := b.network("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client never reads what it is sent
+	client, server := net.Pipe()
+	defer client.Close()
+
+	c := newConn(b, server)
+	c.registered = true
+	c.network = n
+	go c.writeLoop()
+	n.attach(c, time.Time{})
+
+	ev := &adapter.Event{
+		Prefix:     "alice!alice@example.com",
+		Command:    irc.IRC_PRIVMSG,
+		Parameters: []string{"#test", "hello"},
+	}
+	for i := 0; i < 2*maxQueue; i++ {
+		c.write(ev)
+	}
+
+	c.mu.Lock()
+	shut, queued := c.closed, len(c.queue)
+	c.mu.Unlock()
+	if !shut {
+		t.Fatal("Expected a client that is too slow to be closed")
+	}
+	if queued != 0 {
+		t.Fatalf("Expected nothing to be queued once closed, but %d lines are", queued)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for len(n.attached()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to be detached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// attach a registered client to n, and return it with the lines it is sent
+func attach(b *Bouncer, n *network) (*conn, <-chan string, func()) {
+	client, server := net.Pipe()
+
+	c := newConn(b, server)
+	c.registered = true
+	c.network = n
+	go c.writeLoop()
+	n.attach(c, time.Time{})
+
+	return c, lines(client), func() { client.Close() }
+}
+
+func TestClientMessages(t *testing.T) {
+	s := irctest.NewServer()
+	defer s.Close()
+	addr, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bot's middleware changes, or drops, what the bot sends, but not what
+	// clients send through it
+	mw, err := middleware.Chain([]interface{}{"sanitize", "dryrun"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := irc.NewClient("quarid", "quarid", false, false)
+	ic.Middleware = mw
+
+	b := newBouncer()
+	b.AddNetwork("test", ic)
+	n, err := b.network("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ic.Loop()
+	if err := ic.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer ic.Disconnect()
+
+	alice, aliceLines, done := attach(b, n)
+	defer done()
+	bob, bobLines, done := attach(b, n)
+	defer done()
+
+	if err := n.write(alice, &adapter.Event{
+		Command:    irc.IRC_PRIVMSG,
+		Parameters: []string{"#test", "hello"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Expect(`^PRIVMSG #test :?hello$`, timeout); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, bobLines, "PRIVMSG #test :hello")
+
+	// Alice did not enable echo-message, so the first message she is sent is
+	// Bob's
+	if err := n.write(bob, &adapter.Event{
+		Command:    irc.IRC_PRIVMSG,
+		Parameters: []string{"#test", "hi"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(timeout)
+	for sent := false; !sent; {
+		select {
+		case l := <-aliceLines:
+			if !strings.Contains(l, " PRIVMSG ") {
+				continue
+			}
+			if !strings.Contains(l, "PRIVMSG #test :hi") {
+				t.Fatalf("Expected Bob's message, but Alice was sent %q", l)
+			}
+			sent = true
+		case <-deadline:
+			t.Fatal("Expected Alice to be sent Bob's message")
+		}
+	}
+
+	n.mu.Lock()
+	origins := len(n.origins)
+	n.mu.Unlock()
+	if origins != 0 {
+		t.Fatalf("Expected the messages' origins to be forgotten, but %d are kept", origins)
+	}
+}
@@ -0,0 +1,209 @@
+// Package bus is an in-process publish/subscribe event bus
+//
+// About
+//
+// Anything in the bot can publish an event to a topic, and anything can
+// subscribe to the topics it wants, so that features can be put together
+// without knowing about each other. Topics are names made of segments
+// separated by dots, such as "adapter.irc.message". The bot publishes:
+//
+//	adapter.<adapter>.<update>	Updates from each adapter (message, edit,
+//					reaction, membership or topic)
+//	adapter.irc.raw.<command>	Events read from the IRC server
+//	bot.<state>			The bot's lifecycle (initialized,
+//					connected, disconnecting)
+//	plugin.<...>			Events published by plugins
+//	crate.<crate>.<...>		Events published by crates
+//	timer.<name>			Timers, as they fire
+//
+// A subscription's pattern may have wildcards: "*" matches any one segment,
+// and a trailing ">" matches one or more. Each subscription has a queue of
+// its own, so that publishing does not wait on subscribers, and a policy for
+// what to do when a subscriber falls behind and its queue is full: drop the
+// event for it, block the publisher until there is room, or disconnect it.
+package bus
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/clock"
+)
+
+// Topics the bot publishes under
+const (
+	ADAPTER_TOPIC = "adapter"
+	BOT_TOPIC     = "bot"
+	PLUGIN_TOPIC  = "plugin"
+	CRATE_TOPIC   = "crate"
+	TIMER_TOPIC   = "timer"
+)
+
+// Errors publishing and subscribing
+var (
+	ErrInvalidTopic   = errors.New("Invalid topic")
+	ErrInvalidPattern = errors.New("Invalid topic pattern")
+	ErrClosed         = errors.New("Bus is closed")
+)
+
+// Event is something published to a topic
+type Event struct {
+	Topic string
+	Data  interface{}
+	Time  time.Time
+}
+
+// Bus passes events published to its topics to their subscribers
+type Bus struct {
+	// The clock events are timed by, and timers run on. If nil, it is the
+	// Real clock
+	Clock clock.Clock
+
+	mu     sync.RWMutex
+	subs   []*Subscription
+	timers []*Timer
+	closed bool
+}
+
+// New returns an empty Bus
+func New() *Bus {
+	return &Bus{}
+}
+
+// Topic joins segments into a topic
+func Topic(segments ...string) string {
+	return strings.Join(segments, ".")
+}
+
+// Publish data to a topic, which may not have wildcards
+func (b *Bus) Publish(topic string, data interface{}) error {
+	if !validTopic(topic, false) {
+		return ErrInvalidTopic
+	}
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return ErrClosed
+	}
+	subs := append([]*Subscription(nil), b.subs...)
+	b.mu.RUnlock()
+
+	ev := &Event{Topic: topic, Data: data, Time: clock.Or(b.Clock).Now()}
+	for _, s := range subs {
+		if Match(s.Pattern, topic) {
+			s.deliver(ev)
+		}
+	}
+
+	return nil
+}
+
+// Subscribe to the topics matching pattern. Events are read from the
+// subscription's C, which is closed when it is
+func (b *Bus) Subscribe(pattern string, opts Options) (*Subscription, error) {
+	if !validTopic(pattern, true) {
+		return nil, ErrInvalidPattern
+	}
+
+	s := newSubscription(b, pattern, opts)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+	b.subs = append(b.subs, s)
+
+	return s, nil
+}
+
+// Handle subscribes to the topics matching pattern, and calls f with each
+// event, in order, from a goroutine of the subscription's own
+func (b *Bus) Handle(pattern string, opts Options, f func(ev *Event)) (*Subscription, error) {
+	s, err := b.Subscribe(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for ev := range s.C {
+			f(ev)
+		}
+	}()
+
+	return s, nil
+}
+
+// Close the bus, stopping its timers, and closing each subscription
+func (b *Bus) Close() {
+	b.mu.Lock()
+	b.closed = true
+	subs, timers := b.subs, b.timers
+	b.subs, b.timers = nil, nil
+	b.mu.Unlock()
+
+	for _, t := range timers {
+		t.Stop()
+	}
+	for _, s := range subs {
+		s.close(nil)
+	}
+}
+
+// remove a subscription that has been closed
+func (b *Bus) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, bs := range b.subs {
+		if bs == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Match reports whether topic matches pattern, where "*" in the pattern
+// matches any one segment of the topic, and a trailing ">" one or more
+func Match(pattern, topic string) bool {
+	ps, ts := strings.Split(pattern, "."), strings.Split(topic, ".")
+
+	for i, p := range ps {
+		if p == ">" {
+			return len(ts) > i
+		}
+		if i >= len(ts) || (p != "*" && p != ts[i]) {
+			return false
+		}
+	}
+
+	return len(ps) == len(ts)
+}
+
+// validTopic reports whether a topic (or, with wildcards, a pattern) has no
+// empty segments, and wildcards only where they are allowed
+func validTopic(topic string, wildcards bool) bool {
+	if topic == "" {
+		return false
+	}
+
+	ss := strings.Split(topic, ".")
+	for i, s := range ss {
+		switch {
+		case s == "":
+			return false
+		case s == "*" || s == ">":
+			if !wildcards || (s == ">" && i != len(ss)-1) {
+				return false
+			}
+		case strings.ContainsAny(s, "*>"):
+			return false
+		}
+	}
+
+	return true
+}
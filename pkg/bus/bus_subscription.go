@@ -0,0 +1,175 @@
+package bus
+
+// Subscriptions
+//
+// Each subscription queues the events published to it, so that a slow
+// subscriber holds up no one but itself. When its queue is full, its Policy
+// decides: DROP the event (for this subscriber only, counting it), BLOCK the
+// publisher until there is room, or DISCONNECT the subscriber, closing the
+// subscription with ErrSlowConsumer.
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// QUEUE_SIZE is how many events a subscription queues, by default
+const QUEUE_SIZE = 64
+
+// ErrSlowConsumer is why a subscriber was disconnected, when it fell behind
+var ErrSlowConsumer = errors.New("Subscriber fell behind, and was disconnected")
+
+// Policy is what to do with an event, when a subscriber's queue is full
+type Policy int
+
+// Policies for slow subscribers
+const (
+	// Drop the event, for this subscriber
+	DROP Policy = iota
+
+	// Block the publisher until there is room for the event
+	BLOCK
+
+	// Disconnect the subscriber, closing its subscription
+	DISCONNECT
+)
+
+func (p Policy) String() string {
+	switch p {
+	case BLOCK:
+		return "block"
+	case DISCONNECT:
+		return "disconnect"
+	}
+
+	return "drop"
+}
+
+// ParsePolicy parses the name of a Policy, which is DROP if it is not known
+func ParsePolicy(name string) Policy {
+	switch name {
+	case "block":
+		return BLOCK
+	case "disconnect":
+		return DISCONNECT
+	}
+
+	return DROP
+}
+
+// Options for a subscription
+type Options struct {
+	// How many events may be queued for the subscriber. If it is 0, the
+	// queue has QUEUE_SIZE events
+	QueueSize int
+
+	// What to do when the queue is full
+	Policy Policy
+}
+
+// Subscription is a subscriber's interest in the topics matching a pattern
+type Subscription struct {
+	Pattern string
+	Policy  Policy
+
+	// The events published to the subscription's topics. C is closed when
+	// the subscription is
+	C <-chan *Event
+
+	bus    *Bus
+	events chan *Event
+
+	// How many events were dropped
+	dropped uint64
+
+	mu     sync.RWMutex
+	once   sync.Once
+	done   chan struct{}
+	closed bool
+	err    error
+}
+
+func newSubscription(b *Bus, pattern string, opts Options) *Subscription {
+	size := opts.QueueSize
+	if size <= 0 {
+		size = QUEUE_SIZE
+	}
+
+	events := make(chan *Event, size)
+	return &Subscription{
+		Pattern: pattern,
+		Policy:  opts.Policy,
+		C:       events,
+		bus:     b,
+		events:  events,
+		done:    make(chan struct{}),
+	}
+}
+
+// Close the subscription
+func (s *Subscription) Close() {
+	s.close(nil)
+}
+
+// Dropped is how many events were dropped, because the queue was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Err is why the subscription was closed, if it was not closed by the
+// subscriber (or the bus)
+func (s *Subscription) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.err
+}
+
+// deliver ev to the subscription, as its policy says to if its queue is full
+func (s *Subscription) deliver(ev *Event) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return
+	}
+
+	select {
+	case s.events <- ev:
+		s.mu.RUnlock()
+		return
+	default:
+	}
+
+	switch s.Policy {
+	case BLOCK:
+		select {
+		case s.events <- ev:
+		case <-s.done:
+		}
+		s.mu.RUnlock()
+	case DISCONNECT:
+		s.mu.RUnlock()
+		s.close(ErrSlowConsumer)
+	default:
+		s.mu.RUnlock()
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// close the subscription, because of err, if it is not nil
+func (s *Subscription) close(err error) {
+	s.once.Do(func() {
+		// Publishers blocked on the queue give up, so that we can take the
+		// lock
+		close(s.done)
+
+		s.mu.Lock()
+		s.closed = true
+		s.err = err
+		close(s.events)
+		s.mu.Unlock()
+
+		s.bus.remove(s)
+	})
+}
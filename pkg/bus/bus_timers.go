@@ -0,0 +1,112 @@
+package bus
+
+// Timers
+//
+// Timers publish to "timer.<name>" as they fire, once (After), or every
+// interval (Every), with the time they fired as the event's data, until they
+// are stopped or the bus is closed. They run on the bus's Clock.
+
+import (
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/clock"
+)
+
+// Timer publishes to its topic as it fires
+type Timer struct {
+	Topic string
+
+	bus  *Bus
+	once sync.Once
+
+	mu      sync.Mutex
+	timer   clock.Timer
+	stopped bool
+}
+
+// After publishes to "timer.<name>" once, after d
+func (b *Bus) After(name string, d time.Duration) (*Timer, error) {
+	return b.timer(name, d, false)
+}
+
+// Every publishes to "timer.<name>" every interval d
+func (b *Bus) Every(name string, d time.Duration) (*Timer, error) {
+	return b.timer(name, d, true)
+}
+
+// Stop the timer
+func (t *Timer) Stop() {
+	t.once.Do(func() {
+		t.mu.Lock()
+		t.stopped = true
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		t.mu.Unlock()
+
+		t.bus.removeTimer(t)
+	})
+}
+
+func (b *Bus) timer(name string, d time.Duration, repeat bool) (*Timer, error) {
+	topic := Topic(TIMER_TOPIC, name)
+	if !validTopic(topic, false) {
+		return nil, ErrInvalidTopic
+	}
+
+	t := &Timer{Topic: topic, bus: b}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrClosed
+	}
+	b.timers = append(b.timers, t)
+	b.mu.Unlock()
+
+	b.schedule(t, d, repeat)
+
+	return t, nil
+}
+
+// schedule t to fire after d, on the bus's clock, and again every d after
+// that if it repeats
+func (b *Bus) schedule(t *Timer, d time.Duration, repeat bool) {
+	c := clock.Or(b.Clock)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+
+	t.timer = c.AfterFunc(d, func() {
+		t.mu.Lock()
+		stopped := t.stopped
+		t.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		b.Publish(t.Topic, c.Now())
+		if repeat {
+			b.schedule(t, d, repeat)
+		} else {
+			t.Stop()
+		}
+	})
+}
+
+func (b *Bus) removeTimer(t *Timer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, bt := range b.timers {
+		if bt == t {
+			b.timers = append(b.timers[:i], b.timers[i+1:]...)
+			return
+		}
+	}
+}
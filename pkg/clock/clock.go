@@ -0,0 +1,70 @@
+// Package clock tells the time, and keeps track of work being done, for the
+// parts of the bot a replayed session has to control
+//
+// About
+//
+// The Real clock is the system's. A session being replayed has a virtual
+// clock instead (see the recorder package), which is at the time the event
+// being replayed was recorded at, and fires timers as that time passes them.
+//
+// Work started for an event (handling it, or replying to it) is marked
+// Busy, so that a replay can wait for it to finish before playing the next
+// event. The Real clock does not keep track of it.
+package clock
+
+import (
+	"time"
+)
+
+// Clock tells the time, runs timers, and keeps track of work being done
+type Clock interface {
+	// Now is the current time
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine, once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// Busy marks work being done, until the func it returns is called
+	Busy() func()
+}
+
+// Timer is a timer started with AfterFunc
+type Timer interface {
+	// Stop the timer, if it has not fired. It reports whether it stopped it
+	Stop() bool
+}
+
+// Real is the system's clock
+var Real Clock = real{}
+
+type real struct{}
+
+func (real) Now() time.Time {
+	return time.Now()
+}
+
+func (real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (real) Busy() func() {
+	return func() {}
+}
+
+// Or returns c, or the Real clock if c is nil
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+
+	return c
+}
+
+// Go calls f in a new goroutine, with c busy until it returns
+func Go(c Clock, f func()) {
+	done := c.Busy()
+	go func() {
+		defer done()
+		f()
+	}()
+}
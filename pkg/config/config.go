@@ -2,10 +2,13 @@ package config
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 
+	"github.com/enmand/quarid-go/pkg/logger"
 	"github.com/spf13/viper"
 )
 
@@ -16,16 +19,24 @@ type Config struct {
 
 var configFile string
 var config *viper.Viper
+var once sync.Once
+var mu sync.RWMutex
 
-func init() {
+func load() {
 	c := viper.New()
 
 	c.SetEnvPrefix("Q")
 	c.AutomaticEnv()
 
 	flag.StringVar(&configFile, "config", "", "")
+	flag.Bool("console", false, "Talk to the bot on the console, instead of IRC")
+	flag.String("record", "", "Record the session's events to a file")
+	flag.String("replay", "", "Replay a recorded session, and show how the bot's responses differ")
 	flag.Parse()
 	c.BindPFlag("config", flag.Lookup("config"))
+	c.BindPFlag("console.enable", flag.Lookup("console"))
+	c.BindPFlag("record.file", flag.Lookup("record"))
+	c.BindPFlag("replay.file", flag.Lookup("replay"))
 
 	if c.GetString("config") == "" {
 		// Read from "default" configuration path
@@ -48,10 +59,30 @@ func init() {
 		c.Set("timezone", time.UTC)
 	}
 
+	logger.Log.Level = log.Level(c.GetInt("log.level"))
+
+	mu.Lock()
 	config = c
+	mu.Unlock()
 }
 
-// Get returns the global configuration object
+// Get returns the global configuration object. It is read from the flags and
+// the configuration file the first time it is asked for, unless it was Set
 func Get() Config {
+	once.Do(load)
+
+	mu.RLock()
+	defer mu.RUnlock()
+
 	return Config{config}
 }
+
+// Set the global configuration object, instead of reading it. Tests use this
+// to run without flags, or a configuration file
+func Set(c Config) {
+	once.Do(func() {})
+
+	mu.Lock()
+	config = c.Viper
+	mu.Unlock()
+}
@@ -0,0 +1,262 @@
+// Package console adapts a terminal to the adapter package
+//
+// About
+//
+// The console adapter lets the bot be talked to without a chat network, for
+// trying out and debugging plugins. Each line read (usually from stdin) is a
+// message from a made-up user, to a made-up channel, and what the bot sends
+// is written out (usually to stdout), with its formatting rendered as ANSI.
+//
+// Lines starting with a slash are commands, which act out what would happen
+// on a network: joining and leaving channels, changing nick, actions, and
+// private messages. /help lists them.
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// ADAPTER_NAME is the name of the console adapter
+const ADAPTER_NAME = "console"
+
+// Defaults for the bot's nick, and the user and channel lines are from
+const (
+	DEFAULT_NICK = "Quarid"
+	DEFAULT_USER = "you"
+	DEFAULT_ROOM = "#console"
+)
+
+// Console is a conversation with the bot on a terminal
+type Console struct {
+	// Where lines are read from, and the bot's messages written to
+	In  io.Reader
+	Out io.Writer
+
+	// The bot's nick, as its messages are shown
+	Nick string
+
+	// The user lines are sent by, and the channel they are sent to
+	User string
+	Room string
+
+	// Render formatting as ANSI. Without it, formatting is stripped
+	Color bool
+
+	mu       sync.Mutex
+	user     adapter.User
+	room     adapter.Room
+	joined   map[string]bool
+	ids      int
+	handlers []adapter.UpdateFunc
+
+	wmu sync.Mutex
+
+	stop chan struct{}
+	done chan error
+}
+
+// New returns a console adapter, that reads lines from in, and writes to out
+func New(in io.Reader, out io.Writer) *Console {
+	return &Console{
+		In:     in,
+		Out:    out,
+		Nick:   DEFAULT_NICK,
+		User:   DEFAULT_USER,
+		Room:   DEFAULT_ROOM,
+		Color:  true,
+		joined: make(map[string]bool),
+	}
+}
+
+// Name of the adapter
+func (c *Console) Name() string {
+	return ADAPTER_NAME
+}
+
+// Connect starts reading lines. The user joins the channel first
+func (c *Console) Connect() error {
+	c.mu.Lock()
+	c.user = adapter.User{ID: c.User, Name: c.User, Mask: mask(c.User)}
+	c.room = adapter.Room{ID: c.Room, Name: c.Room}
+	c.mu.Unlock()
+
+	c.printf("%s, talking to %s as %s. /help lists commands", format.Bold("Console"), c.Nick, c.User)
+	c.join(c.Room)
+
+	c.stop = make(chan struct{})
+	c.done = make(chan error, 1)
+	go c.run(c.stop)
+
+	return nil
+}
+
+// Disconnect stops reading lines
+func (c *Console) Disconnect() error {
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+
+	return nil
+}
+
+// Wait blocks while reading lines, and returns when there are no more, or we
+// are disconnected
+func (c *Console) Wait() error {
+	return <-c.done
+}
+
+// Receive calls f with each Update from the console
+func (c *Console) Receive(f adapter.UpdateFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handlers = append(c.handlers, f)
+}
+
+func (c *Console) dispatch(u adapter.Update) {
+	c.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), c.handlers...)
+	c.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, c)
+	}
+}
+
+// run reads lines until there are no more, or stop is closed. Reading cannot
+// be interrupted, so lines are read apart from handling them
+func (c *Console) run(stop chan struct{}) {
+	lines := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		s := bufio.NewScanner(c.In)
+		for s.Scan() {
+			select {
+			case lines <- s.Text():
+			case <-stop:
+				return
+			}
+		}
+		errs <- s.Err()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			c.done <- nil
+			return
+		case err := <-errs:
+			c.done <- err
+			return
+		case l := <-lines:
+			c.line(l)
+		}
+	}
+}
+
+// line handles a line read: a command, or a message to the current channel
+func (c *Console) line(l string) {
+	if l == "" {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(l, "//"):
+		// "//" sends a line starting with a slash
+		l = l[1:]
+	case l[0] == '/':
+		c.command(l[1:])
+		return
+	}
+
+	c.mu.Lock()
+	rm := c.room
+	c.mu.Unlock()
+
+	c.message(rm, adapter.Text, l)
+}
+
+// message sends a message from the user to a room
+func (c *Console) message(rm adapter.Room, kind adapter.Kind, text string) {
+	c.mu.Lock()
+	if !rm.Private && !c.joined[rm.ID] {
+		c.mu.Unlock()
+		c.printf("You are not in %s; /join it first", rm.Name)
+		return
+	}
+	u := c.user
+	id := c.id()
+	c.mu.Unlock()
+
+	t := time.Now()
+	target, raw := rm.ID, text
+	if rm.Private {
+		target = c.Nick
+	}
+	if kind == adapter.Action {
+		raw = "\x01ACTION " + text + "\x01"
+	}
+
+	c.dispatch(&adapter.Message{
+		Adapter: c.Name(),
+		ID:      id,
+		Room:    rm,
+		User:    u,
+		Kind:    kind,
+		Text:    text,
+		Time:    t,
+		Raw: &adapter.Event{
+			Tags:       map[string]string{"msgid": id},
+			Prefix:     u.Mask,
+			Command:    ircCommand(kind),
+			Parameters: []string{target, raw},
+			Timestamp:  t,
+		},
+	})
+}
+
+// id returns the next message's ID. It is called with mu locked
+func (c *Console) id() string {
+	c.ids++
+	return strconv.Itoa(c.ids)
+}
+
+// printf writes a line out
+func (c *Console) printf(f string, args ...interface{}) {
+	s := fmt.Sprintf(f, args...)
+	if c.Color {
+		s = format.ANSI(s)
+	} else {
+		s = format.Strip(s)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	fmt.Fprintln(c.Out, s)
+}
+
+// mask is a made-up hostmask for a user, so that their messages look as they
+// would on IRC
+func mask(nick string) string {
+	return nick + "!" + nick + "@console"
+}
+
+// ircCommand is the IRC command for a kind of message
+func ircCommand(k adapter.Kind) string {
+	if k == adapter.Notice {
+		return "NOTICE"
+	}
+
+	return "PRIVMSG"
+}
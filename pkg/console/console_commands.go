@@ -0,0 +1,209 @@
+package console
+
+// Commands
+//
+// Commands act out what would happen on a chat network, so that plugins can
+// be tried against it: the user joining and leaving channels, changing their
+// nick or a channel's topic, sending actions and notices, and private
+// messages to the bot. Each is dispatched as the Update a network's adapter
+// would dispatch.
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// commands are the commands, and how they are used
+var commands = map[string]string{
+	"join":   "/join <#channel>: join a channel, and send lines to it",
+	"part":   "/part [#channel] [reason]: leave a channel (the current one, if none is given)",
+	"nick":   "/nick <nick>: change your nick",
+	"me":     "/me <action>: send an action to the current channel",
+	"notice": "/notice <text>: send a notice to the current channel",
+	"msg":    "/msg <#channel or nick> <text>: send a message to a channel, or privately to the bot",
+	"topic":  "/topic <topic>: change the current channel's topic",
+	"quit":   "/quit [reason]: quit, and stop the bot",
+	"help":   "/help: list the commands",
+}
+
+// command handles a command (without its slash)
+func (c *Console) command(l string) {
+	ts := strings.SplitN(l, " ", 2)
+	name, args := strings.ToLower(ts[0]), ""
+	if len(ts) == 2 {
+		args = strings.TrimSpace(ts[1])
+	}
+
+	c.mu.Lock()
+	rm := c.room
+	c.mu.Unlock()
+
+	switch name {
+	case "join":
+		if args == "" {
+			c.usage(name)
+			return
+		}
+		c.join(strings.Fields(args)[0])
+	case "part":
+		room, reason := rm.ID, args
+		if strings.HasPrefix(args, "#") {
+			ts := strings.SplitN(args, " ", 2)
+			room, reason = ts[0], ""
+			if len(ts) == 2 {
+				reason = ts[1]
+			}
+		}
+		c.part(room, reason)
+	case "nick":
+		if args == "" {
+			c.usage(name)
+			return
+		}
+		c.nick(strings.Fields(args)[0])
+	case "me":
+		c.message(rm, adapter.Action, args)
+	case "notice":
+		c.message(rm, adapter.Notice, args)
+	case "msg":
+		ts := strings.SplitN(args, " ", 2)
+		if len(ts) != 2 {
+			c.usage(name)
+			return
+		}
+
+		if strings.HasPrefix(ts[0], "#") {
+			c.message(adapter.Room{ID: ts[0], Name: ts[0]}, adapter.Text, ts[1])
+			return
+		}
+
+		// Private messages are in a room named for the user, as on IRC
+		c.mu.Lock()
+		u := c.user
+		c.mu.Unlock()
+		c.message(adapter.Room{ID: u.ID, Name: u.Name, Private: true}, adapter.Text, ts[1])
+	case "topic":
+		if args == "" {
+			c.usage(name)
+			return
+		}
+
+		c.mu.Lock()
+		u := c.user
+		c.mu.Unlock()
+
+		c.printf("%s changed the topic of %s to: %s", u.Name, format.Bold(rm.Name), args)
+		c.dispatch(&adapter.Topic{
+			Adapter: c.Name(),
+			Room:    rm,
+			User:    u,
+			Topic:   args,
+			Time:    time.Now(),
+		})
+	case "quit":
+		c.mu.Lock()
+		u := c.user
+		c.mu.Unlock()
+
+		c.dispatch(&adapter.Membership{
+			Adapter: c.Name(),
+			Kind:    adapter.Quit,
+			User:    u,
+			Reason:  args,
+			Time:    time.Now(),
+		})
+		c.Disconnect()
+	case "help":
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			c.printf("%s", commands[n])
+		}
+		c.printf("Lines starting with // are sent with a single slash")
+	default:
+		c.printf("Unknown command /%s; /help lists commands", name)
+	}
+}
+
+// usage shows how a command is used
+func (c *Console) usage(name string) {
+	c.printf("Usage: %s", commands[name])
+}
+
+// join a channel, and make it the one lines are sent to
+func (c *Console) join(room string) {
+	if !strings.HasPrefix(room, "#") {
+		room = "#" + room
+	}
+	rm := adapter.Room{ID: room, Name: room}
+
+	c.mu.Lock()
+	joined := c.joined[room]
+	c.joined[room] = true
+	c.room = rm
+	u := c.user
+	c.mu.Unlock()
+
+	if joined {
+		c.printf("Now talking in %s", format.Bold(room))
+		return
+	}
+
+	c.printf("%s joined %s", u.Name, format.Bold(room))
+	c.dispatch(&adapter.Membership{
+		Adapter: c.Name(),
+		Kind:    adapter.Join,
+		Room:    rm,
+		User:    u,
+		Time:    time.Now(),
+	})
+}
+
+// part leaves a channel
+func (c *Console) part(room, reason string) {
+	c.mu.Lock()
+	joined := c.joined[room]
+	delete(c.joined, room)
+	u := c.user
+	c.mu.Unlock()
+
+	if !joined {
+		c.printf("You are not in %s", room)
+		return
+	}
+
+	c.printf("%s left %s", u.Name, format.Bold(room))
+	c.dispatch(&adapter.Membership{
+		Adapter: c.Name(),
+		Kind:    adapter.Leave,
+		Room:    adapter.Room{ID: room, Name: room},
+		User:    u,
+		Reason:  reason,
+		Time:    time.Now(),
+	})
+}
+
+// nick changes the user's nick
+func (c *Console) nick(n string) {
+	c.mu.Lock()
+	old := c.user
+	c.user = adapter.User{ID: n, Name: n, Mask: mask(n)}
+	c.mu.Unlock()
+
+	c.printf("%s is now known as %s", old.Name, n)
+	c.dispatch(&adapter.Membership{
+		Adapter: c.Name(),
+		Kind:    adapter.Rename,
+		User:    old,
+		NewName: n,
+		Time:    time.Now(),
+	})
+}
@@ -0,0 +1,120 @@
+package console
+
+// Sending
+//
+// What the bot sends is written out as a chat client would show it: messages
+// as "[#channel] <Nick> text", actions as "* Nick text", and notices as
+// "-Nick- text". Private messages are shown in a room named for the user.
+// Replies, edits and reactions name the message they are to, by its ID.
+
+import (
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// Send an Update to the console, by writing it out
+func (c *Console) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		return c.show(u.Room, u.Kind, u.Text, u.ReplyTo), nil
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+		return c.show(u.To.Room, u.Kind, u.Text, u.To.ID), nil
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+		c.printf("%s %s edited #%s: %s", label(u.Message.Room), c.Nick, u.Message.ID, u.Text)
+
+		e := *u.Message
+		e.Text, e.Time = u.Text, time.Now()
+		return &e, nil
+	case *adapter.Reaction:
+		verb := "reacted with"
+		if u.Removed {
+			verb = "took back"
+		}
+		c.printf("%s * %s %s %s to #%s", label(u.Room), c.Nick, verb, u.Reaction, u.MessageID)
+		return nil, nil
+	case *adapter.Membership:
+		return nil, c.membership(u)
+	case *adapter.Topic:
+		c.printf("%s changed the topic of %s to: %s", c.Nick, format.Bold(u.Room.Name), u.Topic)
+		return nil, nil
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// show a message from the bot, replying to replyTo (if not empty)
+func (c *Console) show(rm adapter.Room, kind adapter.Kind, text, replyTo string) *adapter.Message {
+	c.mu.Lock()
+	id := c.id()
+	c.mu.Unlock()
+
+	prefix := label(rm)
+	if replyTo != "" {
+		prefix += " (re #" + replyTo + ")"
+	}
+
+	switch kind {
+	case adapter.Action:
+		c.printf("%s * %s %s", prefix, format.Bold(c.Nick), text)
+	case adapter.Notice:
+		c.printf("%s -%s- %s", prefix, format.Bold(c.Nick), text)
+	default:
+		c.printf("%s <%s> %s", prefix, format.Bold(c.Nick), text)
+	}
+
+	return &adapter.Message{
+		Adapter: c.Name(),
+		ID:      id,
+		Room:    rm,
+		User:    adapter.User{ID: c.Nick, Name: c.Nick, Mask: mask(c.Nick)},
+		Kind:    kind,
+		Text:    text,
+		ReplyTo: replyTo,
+		Time:    time.Now(),
+	}
+}
+
+// membership shows the bot joining or leaving a channel, or acting on the
+// user
+func (c *Console) membership(u *adapter.Membership) error {
+	switch u.Kind {
+	case adapter.Join:
+		c.printf("%s joined %s", c.Nick, format.Bold(u.Room.Name))
+	case adapter.Leave:
+		c.printf("%s left %s", c.Nick, format.Bold(u.Room.Name))
+	case adapter.Kick:
+		c.printf("%s kicked %s from %s (%s)", c.Nick, u.User.Name, format.Bold(u.Room.Name), u.Reason)
+
+		c.mu.Lock()
+		if u.User.ID == c.user.ID {
+			delete(c.joined, u.Room.ID)
+		}
+		c.mu.Unlock()
+	case adapter.Invite:
+		c.printf("%s invited %s to %s", c.Nick, u.User.Name, format.Bold(u.Room.Name))
+	case adapter.Rename:
+		c.printf("%s is now known as %s", c.Nick, u.NewName)
+		c.Nick = u.NewName
+	default:
+		return adapter.ErrNotSupported
+	}
+
+	return nil
+}
+
+// label is how a room is shown
+func label(rm adapter.Room) string {
+	if rm.Private {
+		return "[" + rm.Name + "]"
+	}
+
+	return "[" + rm.ID + "]"
+}
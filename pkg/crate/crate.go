@@ -2,6 +2,7 @@ package crate
 
 import (
 	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/bus"
 	"github.com/enmand/quarid-go/pkg/database"
 	"github.com/enmand/quarid-go/pkg/plugin"
 	"github.com/satori/go.uuid"
@@ -23,6 +24,9 @@ type Crate struct {
 
 	Adapter adapter.Adapter
 
+	// The bus the crate publishes to, and subscribes on
+	Bus *bus.Bus
+
 	plugins map[string]plugin.Plugin
 	db      database.VMDatabase
 }
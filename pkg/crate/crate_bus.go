@@ -0,0 +1,29 @@
+package crate
+
+import (
+	"errors"
+
+	"github.com/enmand/quarid-go/pkg/bus"
+)
+
+// ErrNoBus is returned when publishing or subscribing from a Crate without a
+// Bus
+var ErrNoBus = errors.New("Crate has no bus")
+
+// Publish data to a topic of the crate's own, "crate.<name>.<topic>"
+func (c *Crate) Publish(topic string, data interface{}) error {
+	if c.Bus == nil {
+		return ErrNoBus
+	}
+
+	return c.Bus.Publish(bus.Topic(bus.CRATE_TOPIC, c.Name, topic), data)
+}
+
+// Subscribe to the topics on the bus matching pattern
+func (c *Crate) Subscribe(pattern string, opts bus.Options) (*bus.Subscription, error) {
+	if c.Bus == nil {
+		return nil, ErrNoBus
+	}
+
+	return c.Bus.Subscribe(pattern, opts)
+}
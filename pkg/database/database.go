@@ -8,7 +8,6 @@ import (
 	"upper.io/db"
 
 	"github.com/enmand/quarid-go/pkg/config"
-	"github.com/enmand/quarid-go/pkg/crate"
 	"github.com/enmand/quarid-go/pkg/logger"
 )
 
@@ -48,14 +47,14 @@ func Get() Database {
 	return d
 }
 
-// GetCrate returns a database for the given Crate
-func GetCrate(c *crate.Crate) VMDatabase {
+// GetCrate returns a database for the Crate with the given ID
+func GetCrate(id string) VMDatabase {
 	cfg := config.Get()
 	dbConfig := cfg.GetString("vm.database")
 
 	uri := strings.Split(dbConfig, "://") // uri[0] is proto, uri[1] is uri
 
-	uri[1] = fmt.Sprintf("%s/%s", uri, c.ID)
+	uri[1] = fmt.Sprintf("%s/%s", uri, id)
 
 	d, err := openBolt(uri[0])
 	if err != nil {
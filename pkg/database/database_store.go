@@ -0,0 +1,231 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/enmand/quarid-go/pkg/config"
+)
+
+// ErrNotFound is returned when a key does not exist in a Store
+var ErrNotFound = errors.New("Key not found")
+
+// Store is a bucketed key/value store, for state the bot needs to keep
+// between restarts. Values are stored as JSON
+type Store interface {
+	// Get the value of key in bucket, into v
+	Get(bucket, key string, v interface{}) error
+
+	// Put the value v for key in bucket
+	Put(bucket, key string, v interface{}) error
+
+	// Delete key from bucket. Deleting a key that does not exist is not an
+	// error
+	Delete(bucket, key string) error
+
+	// ForEach calls fn for every key in bucket, in key order, with the raw
+	// JSON value of the key. If fn returns an error, iteration stops and the
+	// error is returned
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+}
+
+var (
+	store     Store
+	storeOnce sync.Once
+)
+
+// GetStore returns the bot's Store, from the "bot.database" configuration.
+// If no database is configured (or it cannot be opened), an in-memory Store
+// is used and nothing will be kept between restarts
+func GetStore() Store {
+	storeOnce.Do(func() {
+		c := config.Get()
+		uri := c.GetString("bot.database")
+
+		if uri == "" {
+			l.Warning("No bot.database configured; state will not be persisted")
+			store = NewMemoryStore()
+			return
+		}
+
+		s, err := OpenStore(strings.TrimPrefix(uri, "boltdb://"))
+		if err != nil {
+			l.Errorf("Cannot open bot database %s: %s", uri, err)
+			store = NewMemoryStore()
+			return
+		}
+
+		store = s
+	})
+
+	return store
+}
+
+type boltStore struct {
+	*bolt.DB
+}
+
+// OpenStore opens (or creates) a Bolt-backed Store at path
+func OpenStore(path string) (Store, error) {
+	file, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create '%s': %s", file, err)
+	}
+
+	d, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open '%s': %s", file, err)
+	}
+
+	return &boltStore{d}, nil
+}
+
+func (s *boltStore) Get(bucket, key string, v interface{}) error {
+	return s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+
+		d := b.Get([]byte(key))
+		if d == nil {
+			return ErrNotFound
+		}
+
+		return json.Unmarshal(d, v)
+	})
+}
+
+func (s *boltStore) Put(bucket, key string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), d)
+	})
+}
+
+func (s *boltStore) Delete(bucket, key string) error {
+	return s.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) ForEach(
+	bucket string,
+	fn func(key string, value []byte) error,
+) error {
+	return s.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStore returns a Store that is kept in memory only
+func NewMemoryStore() Store {
+	return &memoryStore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *memoryStore) Get(bucket, key string, v interface{}) error {
+	s.mu.RLock()
+	d, ok := s.buckets[bucket][key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	return json.Unmarshal(d, v)
+}
+
+func (s *memoryStore) Put(bucket, key string, v interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.buckets[bucket][key] = d
+
+	return nil
+}
+
+func (s *memoryStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.buckets[bucket], key)
+
+	return nil
+}
+
+func (s *memoryStore) ForEach(
+	bucket string,
+	fn func(key string, value []byte) error,
+) error {
+	s.mu.RLock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.mu.RLock()
+		v, ok := s.buckets[bucket][k]
+		s.mu.RUnlock()
+
+		if !ok {
+			continue
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,230 @@
+// Package discord adapts the Discord gateway and REST API to the adapter
+// package
+//
+// About
+//
+// The Discord adapter connects to the gateway over a WebSocket as a bot: it
+// identifies with the bot's token, keeps the connection alive with heartbeats,
+// and resumes its session when the connection is lost, so that the events sent
+// meanwhile are not missed. Messages, edits, reactions and joins in guild
+// channels and direct messages are translated into adapter Updates. Each
+// channel is a room, and threads are threads of their channel.
+//
+// Updates are sent with the REST API, which limits how often each route may be
+// used. Requests wait for their route's rate limit bucket, rather than being
+// refused.
+//
+// Mentions of users, roles and channels are shown by their names, and
+// Discord's Markdown is translated to and from formatted text.
+//
+// See also: https://discord.com/developers/docs/topics/gateway
+// See also: https://discord.com/developers/docs/topics/rate-limits
+package discord
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/gorilla/websocket"
+)
+
+// ADAPTER_NAME is the name of the Discord adapter
+const ADAPTER_NAME = "discord"
+
+// API_URL is the base URL of Discord's REST API
+const API_URL = "https://discord.com/api/v10"
+
+// TIMEOUT is the timeout of requests to the REST API, and of connecting to
+// the gateway
+const TIMEOUT = 30 * time.Second
+
+// Gateway intents, which choose the events the gateway sends
+const (
+	INTENT_GUILDS                   = 1 << 0
+	INTENT_GUILD_MEMBERS            = 1 << 1
+	INTENT_GUILD_MESSAGES           = 1 << 9
+	INTENT_GUILD_MESSAGE_REACTIONS  = 1 << 10
+	INTENT_DIRECT_MESSAGES          = 1 << 12
+	INTENT_DIRECT_MESSAGE_REACTIONS = 1 << 13
+	INTENT_MESSAGE_CONTENT          = 1 << 15
+)
+
+// DEFAULT_INTENTS are the intents a bot needs to see messages and reactions.
+// INTENT_MESSAGE_CONTENT must be enabled for the bot in Discord's developer
+// portal
+const DEFAULT_INTENTS = INTENT_GUILDS | INTENT_GUILD_MESSAGES |
+	INTENT_GUILD_MESSAGE_REACTIONS | INTENT_DIRECT_MESSAGES |
+	INTENT_DIRECT_MESSAGE_REACTIONS | INTENT_MESSAGE_CONTENT
+
+// How long to wait before reconnecting, doubling up to the maximum
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// ErrNoToken is returned when connecting without a bot token
+var ErrNoToken = errors.New("No Discord bot token")
+
+// Discord is a connection to Discord, as a bot
+type Discord struct {
+	// The bot's token
+	Token string
+
+	// The base URL of the REST API, and the URL of the gateway. If the gateway
+	// URL is empty, it is asked for from the REST API
+	APIURL     string
+	GatewayURL string
+
+	// The gateway intents to identify with
+	Intents int
+
+	// The HTTP client for requests to the REST API
+	HTTPClient *http.Client
+
+	// Ourselves, once we have identified
+	self *user
+
+	mu       sync.Mutex
+	guilds   map[string]*guild
+	channels map[string]*channel
+	dms      map[string]string
+	handlers []adapter.UpdateFunc
+
+	// The gateway connection, how often it is sent heartbeats, and whether
+	// the last one was acknowledged
+	wmu      sync.Mutex
+	conn     *websocket.Conn
+	interval time.Duration
+	acked    bool
+
+	// The session to resume if the connection is lost, and the sequence
+	// number of the last event we were sent
+	session   string
+	resumeURL string
+	seq       int64
+
+	limiter *rateLimiter
+
+	stop chan struct{}
+	done chan error
+}
+
+// guild is what we know of a guild (a server): its roles, custom emoji, and
+// the names of the members we have seen
+type guild struct {
+	id    string
+	name  string
+	roles map[string]string
+	emoji map[string]string
+	names map[string]string
+}
+
+// New returns a Discord adapter, that connects as the bot with the token given
+func New(token string) *Discord {
+	return &Discord{
+		Token:      token,
+		APIURL:     API_URL,
+		Intents:    DEFAULT_INTENTS,
+		HTTPClient: &http.Client{Timeout: TIMEOUT},
+		guilds:     make(map[string]*guild),
+		channels:   make(map[string]*channel),
+		dms:        make(map[string]string),
+		limiter:    newRateLimiter(),
+	}
+}
+
+// Name of the adapter
+func (d *Discord) Name() string {
+	return ADAPTER_NAME
+}
+
+// UserID returns the bot's user ID, once we are connected
+func (d *Discord) UserID() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.self == nil {
+		return ""
+	}
+	return d.self.ID
+}
+
+// Connect to the gateway, and identify
+func (d *Discord) Connect() error {
+	if d.Token == "" {
+		return ErrNoToken
+	}
+
+	if d.GatewayURL == "" {
+		var r struct {
+			URL string `json:"url"`
+		}
+		if err := d.request("GET", "/gateway/bot", nil, &r); err != nil {
+			return err
+		}
+		d.GatewayURL = r.URL
+	}
+
+	if err := d.connect(); err != nil {
+		return err
+	}
+
+	d.stop = make(chan struct{})
+	d.done = make(chan error, 1)
+	go d.run(d.stop)
+
+	return nil
+}
+
+// Disconnect from the gateway. The session is ended, and is not resumed
+func (d *Discord) Disconnect() error {
+	if d.stop == nil {
+		return nil
+	}
+	close(d.stop)
+	d.stop = nil
+
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	d.session = ""
+	if d.conn == nil {
+		return nil
+	}
+
+	err := d.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	d.conn.Close()
+
+	return err
+}
+
+// Wait blocks while connected (or reconnecting), and returns the error that
+// stopped us
+func (d *Discord) Wait() error {
+	return <-d.done
+}
+
+// Receive calls f with each Update from Discord
+func (d *Discord) Receive(f adapter.UpdateFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers = append(d.handlers, f)
+}
+
+func (d *Discord) dispatch(u adapter.Update) {
+	d.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), d.handlers...)
+	d.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, d)
+	}
+}
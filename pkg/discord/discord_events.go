@@ -0,0 +1,596 @@
+package discord
+
+// Events
+//
+// Dispatched events keep what we know of guilds, channels and members up to
+// date, and messages, edits and reactions are translated into adapter
+// Updates. A guild channel is a room; a thread is a room of its own, and its
+// messages are in the thread. Direct messages are private rooms. Members
+// joining a guild are seen as the join message Discord posts in the guild's
+// system channel.
+//
+// See also: https://discord.com/developers/docs/topics/gateway-events#receive-events
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// Gateway events
+const (
+	EVENT_READY               = "READY"
+	EVENT_RESUMED             = "RESUMED"
+	EVENT_GUILD_CREATE        = "GUILD_CREATE"
+	EVENT_GUILD_UPDATE        = "GUILD_UPDATE"
+	EVENT_GUILD_DELETE        = "GUILD_DELETE"
+	EVENT_GUILD_ROLE_CREATE   = "GUILD_ROLE_CREATE"
+	EVENT_GUILD_ROLE_UPDATE   = "GUILD_ROLE_UPDATE"
+	EVENT_GUILD_MEMBER_UPDATE = "GUILD_MEMBER_UPDATE"
+	EVENT_CHANNEL_CREATE      = "CHANNEL_CREATE"
+	EVENT_CHANNEL_UPDATE      = "CHANNEL_UPDATE"
+	EVENT_CHANNEL_DELETE      = "CHANNEL_DELETE"
+	EVENT_THREAD_CREATE       = "THREAD_CREATE"
+	EVENT_THREAD_UPDATE       = "THREAD_UPDATE"
+	EVENT_THREAD_DELETE       = "THREAD_DELETE"
+	EVENT_MESSAGE_CREATE      = "MESSAGE_CREATE"
+	EVENT_MESSAGE_UPDATE      = "MESSAGE_UPDATE"
+	EVENT_REACTION_ADD        = "MESSAGE_REACTION_ADD"
+	EVENT_REACTION_REMOVE     = "MESSAGE_REACTION_REMOVE"
+)
+
+// Channel types
+const (
+	CHANNEL_GUILD_TEXT          = 0
+	CHANNEL_DM                  = 1
+	CHANNEL_GROUP_DM            = 3
+	CHANNEL_ANNOUNCEMENT_THREAD = 10
+	CHANNEL_PUBLIC_THREAD       = 11
+	CHANNEL_PRIVATE_THREAD      = 12
+)
+
+// Message types
+const (
+	MESSAGE_DEFAULT   = 0
+	MESSAGE_USER_JOIN = 7
+	MESSAGE_REPLY     = 19
+)
+
+// mentionPattern matches mentions of users, roles and channels, and custom
+// emoji, in a message's content
+var mentionPattern = regexp.MustCompile(`<(@!?|@&|#)(\d+)>|<a?:(\w+):\d+>`)
+
+type user struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Bot        bool   `json:"bot"`
+}
+
+type member struct {
+	User *user  `json:"user"`
+	Nick string `json:"nick"`
+}
+
+type channel struct {
+	ID         string  `json:"id"`
+	Type       int     `json:"type"`
+	GuildID    string  `json:"guild_id"`
+	Name       string  `json:"name"`
+	ParentID   string  `json:"parent_id"`
+	Recipients []*user `json:"recipients"`
+}
+
+type role struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type emoji struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type message struct {
+	ID              string     `json:"id"`
+	ChannelID       string     `json:"channel_id"`
+	GuildID         string     `json:"guild_id"`
+	Author          *user      `json:"author"`
+	Member          *member    `json:"member"`
+	Content         string     `json:"content"`
+	Timestamp       string     `json:"timestamp"`
+	EditedTimestamp string     `json:"edited_timestamp"`
+	Type            int        `json:"type"`
+	Mentions        []*mention `json:"mentions"`
+
+	MessageReference *struct {
+		MessageID string `json:"message_id"`
+	} `json:"message_reference"`
+}
+
+// mention is a user mentioned in a message, with their membership of the
+// guild
+type mention struct {
+	user
+	Member *member `json:"member"`
+}
+
+// thread reports whether the channel is a thread
+func (c *channel) thread() bool {
+	switch c.Type {
+	case CHANNEL_ANNOUNCEMENT_THREAD, CHANNEL_PUBLIC_THREAD, CHANNEL_PRIVATE_THREAD:
+		return true
+	}
+
+	return false
+}
+
+// event handles an event dispatched by the gateway
+func (d *Discord) event(t string, data json.RawMessage) {
+	switch t {
+	case EVENT_READY:
+		var r struct {
+			SessionID        string `json:"session_id"`
+			ResumeGatewayURL string `json:"resume_gateway_url"`
+			User             *user  `json:"user"`
+		}
+		if d.decode(t, data, &r) {
+			d.ready(r.SessionID, r.ResumeGatewayURL, r.User)
+		}
+	case EVENT_RESUMED:
+		logger.Log.Infof("Resumed Discord session")
+	case EVENT_GUILD_CREATE, EVENT_GUILD_UPDATE:
+		var g struct {
+			ID       string     `json:"id"`
+			Name     string     `json:"name"`
+			Roles    []*role    `json:"roles"`
+			Emojis   []*emoji   `json:"emojis"`
+			Channels []*channel `json:"channels"`
+			Threads  []*channel `json:"threads"`
+			Members  []*member  `json:"members"`
+		}
+		if d.decode(t, data, &g) {
+			d.guildCreate(g.ID, g.Name, g.Roles, g.Emojis, append(g.Channels, g.Threads...), g.Members)
+		}
+	case EVENT_GUILD_DELETE:
+		var g struct {
+			ID          string `json:"id"`
+			Unavailable bool   `json:"unavailable"`
+		}
+		if d.decode(t, data, &g) && !g.Unavailable {
+			d.guildDelete(g.ID)
+		}
+	case EVENT_GUILD_ROLE_CREATE, EVENT_GUILD_ROLE_UPDATE:
+		var r struct {
+			GuildID string `json:"guild_id"`
+			Role    *role  `json:"role"`
+		}
+		if d.decode(t, data, &r) && r.Role != nil {
+			d.mu.Lock()
+			d.guild(r.GuildID).roles[r.Role.ID] = r.Role.Name
+			d.mu.Unlock()
+		}
+	case EVENT_GUILD_MEMBER_UPDATE:
+		var m struct {
+			GuildID string `json:"guild_id"`
+			member
+		}
+		if d.decode(t, data, &m) && m.User != nil {
+			d.memberUpdate(m.GuildID, &m.member)
+		}
+	case EVENT_CHANNEL_CREATE, EVENT_CHANNEL_UPDATE, EVENT_THREAD_CREATE, EVENT_THREAD_UPDATE:
+		c := &channel{}
+		if d.decode(t, data, c) {
+			d.mu.Lock()
+			d.addChannel(c)
+			d.mu.Unlock()
+		}
+	case EVENT_CHANNEL_DELETE, EVENT_THREAD_DELETE:
+		c := &channel{}
+		if d.decode(t, data, c) {
+			d.mu.Lock()
+			delete(d.channels, c.ID)
+			d.mu.Unlock()
+		}
+	case EVENT_MESSAGE_CREATE:
+		m := &message{}
+		if d.decode(t, data, m) {
+			d.messageCreate(m)
+		}
+	case EVENT_MESSAGE_UPDATE:
+		m := &message{}
+		if d.decode(t, data, m) {
+			d.messageUpdate(m)
+		}
+	case EVENT_REACTION_ADD, EVENT_REACTION_REMOVE:
+		var r struct {
+			UserID    string  `json:"user_id"`
+			ChannelID string  `json:"channel_id"`
+			MessageID string  `json:"message_id"`
+			GuildID   string  `json:"guild_id"`
+			Member    *member `json:"member"`
+			Emoji     emoji   `json:"emoji"`
+		}
+		if d.decode(t, data, &r) {
+			d.reaction(r.GuildID, r.ChannelID, r.MessageID, r.UserID, r.Member, r.Emoji, t == EVENT_REACTION_REMOVE)
+		}
+	}
+}
+
+// decode an event's data, logging it if it cannot be
+func (d *Discord) decode(t string, data json.RawMessage, v interface{}) bool {
+	if err := json.Unmarshal(data, v); err != nil {
+		logger.Log.Warningf("Could not decode Discord %s event: %s", t, err)
+		return false
+	}
+
+	return true
+}
+
+// ready starts a new session
+func (d *Discord) ready(session, resumeURL string, self *user) {
+	d.wmu.Lock()
+	d.session, d.resumeURL = session, resumeURL
+	d.wmu.Unlock()
+
+	d.mu.Lock()
+	d.self = self
+	d.mu.Unlock()
+
+	if self != nil {
+		logger.Log.Infof("Connected to Discord as %s (%s)", self.Username, self.ID)
+	}
+}
+
+// guild returns what we know of a guild; d.mu must be held
+func (d *Discord) guild(id string) *guild {
+	g, ok := d.guilds[id]
+	if !ok {
+		g = &guild{
+			id:    id,
+			roles: make(map[string]string),
+			emoji: make(map[string]string),
+			names: make(map[string]string),
+		}
+		d.guilds[id] = g
+	}
+
+	return g
+}
+
+// guildCreate learns about a guild, when we join it or it becomes available
+func (d *Discord) guildCreate(id, name string, roles []*role, emojis []*emoji, channels []*channel, members []*member) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g := d.guild(id)
+	if name != "" {
+		g.name = name
+	}
+	for _, r := range roles {
+		g.roles[r.ID] = r.Name
+	}
+	for _, e := range emojis {
+		g.emoji[e.Name] = e.ID
+	}
+	for _, c := range channels {
+		c.GuildID = id
+		d.addChannel(c)
+	}
+	for _, m := range members {
+		if m.User != nil {
+			g.names[m.User.ID] = displayName(m.User, m)
+		}
+	}
+}
+
+// guildDelete forgets a guild we left, and its channels
+func (d *Discord) guildDelete(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.guilds, id)
+	for cid, c := range d.channels {
+		if c.GuildID == id {
+			delete(d.channels, cid)
+		}
+	}
+}
+
+// addChannel keeps a channel, and the user a direct message channel is with;
+// d.mu must be held
+func (d *Discord) addChannel(c *channel) {
+	d.channels[c.ID] = c
+	if c.Type == CHANNEL_DM && len(c.Recipients) == 1 {
+		d.dms[c.Recipients[0].ID] = c.ID
+	}
+}
+
+// memberUpdate notices members changing their names
+func (d *Discord) memberUpdate(guildID string, m *member) {
+	name := displayName(m.User, m)
+
+	d.mu.Lock()
+	g := d.guild(guildID)
+	old, known := g.names[m.User.ID]
+	g.names[m.User.ID] = name
+	d.mu.Unlock()
+
+	if !known || old == name {
+		return
+	}
+
+	d.dispatch(&adapter.Membership{
+		Adapter: d.Name(),
+		Kind:    adapter.Rename,
+		User:    adapter.User{ID: m.User.ID, Name: old, Account: m.User.Username},
+		NewName: name,
+		Time:    time.Now(),
+	})
+}
+
+// messageCreate handles a new message
+func (d *Discord) messageCreate(m *message) {
+	if m.Author == nil || m.Author.ID == d.UserID() {
+		return
+	}
+
+	rm, thread := d.room(m.ChannelID, m.GuildID, m.Author)
+	user := d.user(m.GuildID, m.Author, m.Member)
+	t := timestamp(m.Timestamp)
+
+	switch m.Type {
+	case MESSAGE_USER_JOIN:
+		d.dispatch(&adapter.Membership{
+			Adapter: d.Name(),
+			Kind:    adapter.Join,
+			Room:    rm,
+			User:    user,
+			Time:    t,
+		})
+		return
+	case MESSAGE_DEFAULT, MESSAGE_REPLY:
+	default:
+		return
+	}
+
+	msg := &adapter.Message{
+		Adapter: d.Name(),
+		ID:      m.ID,
+		Room:    rm,
+		User:    user,
+		Text:    d.text(m),
+		Thread:  thread,
+		Time:    t,
+		Raw: &adapter.Event{
+			Tags:       map[string]string{"msgid": m.ID},
+			Prefix:     m.Author.ID,
+			Command:    EVENT_MESSAGE_CREATE,
+			Parameters: []string{m.ChannelID, m.Content},
+			Timestamp:  t,
+		},
+	}
+	if m.Type == MESSAGE_REPLY && m.MessageReference != nil {
+		msg.ReplyTo = m.MessageReference.MessageID
+	}
+
+	// Discord's /me sends the message in italics, with underscores
+	if c := m.Content; len(c) > 2 && c[0] == '_' && c[len(c)-1] == '_' &&
+		!strings.HasPrefix(c, "__") && !strings.HasSuffix(c, "__") {
+		msg.Kind = adapter.Action
+		msg.Text = d.mentionNames(m.GuildID, format.ParseMarkdown(c[1:len(c)-1]), m.Mentions)
+	}
+
+	d.dispatch(msg)
+}
+
+// messageUpdate handles an edited message. Updates without an edit time are
+// Discord adding embeds to the message
+func (d *Discord) messageUpdate(m *message) {
+	if m.Author == nil || m.EditedTimestamp == "" || m.Author.ID == d.UserID() {
+		return
+	}
+
+	rm, thread := d.room(m.ChannelID, m.GuildID, m.Author)
+	user := d.user(m.GuildID, m.Author, m.Member)
+
+	d.dispatch(&adapter.Edit{
+		Adapter: d.Name(),
+		Message: &adapter.Message{
+			Adapter: d.Name(),
+			ID:      m.ID,
+			Room:    rm,
+			User:    user,
+			Thread:  thread,
+		},
+		Text: d.text(m),
+		User: user,
+		Time: timestamp(m.EditedTimestamp),
+	})
+}
+
+// reaction handles a reaction being added to, or removed from, a message.
+// Custom emoji are named as :name:
+func (d *Discord) reaction(guildID, channelID, messageID, userID string, m *member, e emoji, removed bool) {
+	if userID == d.UserID() {
+		return
+	}
+
+	r := e.Name
+	if e.ID != "" {
+		r = ":" + e.Name + ":"
+		if guildID != "" {
+			d.mu.Lock()
+			d.guild(guildID).emoji[e.Name] = e.ID
+			d.mu.Unlock()
+		}
+	}
+
+	var u adapter.User
+	if m != nil && m.User != nil {
+		u = d.user(guildID, m.User, m)
+	} else {
+		u = adapter.User{ID: userID, Name: d.name(guildID, userID)}
+	}
+
+	rm, _ := d.room(channelID, guildID, nil)
+	d.dispatch(&adapter.Reaction{
+		Adapter:   d.Name(),
+		Room:      rm,
+		MessageID: messageID,
+		User:      u,
+		Reaction:  r,
+		Removed:   removed,
+		Time:      time.Now(),
+	})
+}
+
+// room describes the channel a message was sent to, and the thread, if the
+// channel is one. Direct messages from someone are in a channel we may not
+// have seen yet
+func (d *Discord) room(channelID, guildID string, author *user) (adapter.Room, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.channels[channelID]
+	if !ok {
+		if guildID != "" || author == nil {
+			return adapter.Room{ID: channelID, Name: channelID, Private: guildID == ""}, ""
+		}
+
+		c = &channel{ID: channelID, Type: CHANNEL_DM, Recipients: []*user{author}}
+		d.addChannel(c)
+	}
+
+	rm := adapter.Room{ID: c.ID, Name: c.Name}
+	switch c.Type {
+	case CHANNEL_DM, CHANNEL_GROUP_DM:
+		rm.Private = true
+		if rm.Name == "" {
+			var names []string
+			for _, r := range c.Recipients {
+				names = append(names, displayName(r, nil))
+			}
+			rm.Name = strings.Join(names, ", ")
+		}
+	}
+
+	if c.thread() {
+		return rm, c.ID
+	}
+	return rm, ""
+}
+
+// user describes a user, and remembers their name in the guild
+func (d *Discord) user(guildID string, u *user, m *member) adapter.User {
+	name := displayName(u, m)
+
+	if guildID != "" {
+		d.mu.Lock()
+		d.guild(guildID).names[u.ID] = name
+		d.mu.Unlock()
+	}
+
+	return adapter.User{ID: u.ID, Name: name, Account: u.Username}
+}
+
+// name returns the name of a user in a guild, if we have seen it
+func (d *Discord) name(guildID, userID string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if g, ok := d.guilds[guildID]; ok {
+		if n, ok := g.names[userID]; ok {
+			return n
+		}
+	}
+	for _, c := range d.channels {
+		for _, r := range c.Recipients {
+			if r.ID == userID {
+				return displayName(r, nil)
+			}
+		}
+	}
+
+	return userID
+}
+
+// displayName is the name a user is shown with: their nickname in the guild,
+// their display name, or their username
+func displayName(u *user, m *member) string {
+	switch {
+	case m != nil && m.Nick != "":
+		return m.Nick
+	case u.GlobalName != "":
+		return u.GlobalName
+	}
+
+	return u.Username
+}
+
+// text is the formatted text of a message, with mentions shown by name
+func (d *Discord) text(m *message) string {
+	return d.mentionNames(m.GuildID, format.ParseMarkdown(m.Content), m.Mentions)
+}
+
+// mentionNames replaces mentions in text with the names of who, or what, is
+// mentioned
+func (d *Discord) mentionNames(guildID, text string, mentions []*mention) string {
+	for _, m := range mentions {
+		if guildID != "" {
+			d.user(guildID, &m.user, m.Member)
+		}
+	}
+
+	return mentionPattern.ReplaceAllStringFunc(text, func(s string) string {
+		ms := mentionPattern.FindStringSubmatch(s)
+		if ms[3] != "" {
+			return ":" + ms[3] + ":"
+		}
+
+		id := ms[2]
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		switch ms[1] {
+		case "#":
+			if c, ok := d.channels[id]; ok && c.Name != "" {
+				return "#" + c.Name
+			}
+		case "@&":
+			if g, ok := d.guilds[guildID]; ok {
+				if r, ok := g.roles[id]; ok {
+					return "@" + r
+				}
+			}
+		default:
+			if g, ok := d.guilds[guildID]; ok {
+				if n, ok := g.names[id]; ok {
+					return "@" + n
+				}
+			}
+			for _, m := range mentions {
+				if m.ID == id {
+					return "@" + displayName(&m.user, m.Member)
+				}
+			}
+		}
+
+		return s
+	})
+}
+
+// timestamp parses a Discord timestamp
+func timestamp(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Now()
+	}
+
+	return t
+}
@@ -0,0 +1,407 @@
+package discord
+
+// Gateway
+//
+// The gateway sends Hello with the interval to send heartbeats at. A new
+// session is started by identifying, and Discord answers with Ready; a lost
+// session is resumed with its ID and the sequence number of the last event we
+// were sent, and Discord sends the events we missed. A heartbeat that is not
+// acknowledged means the connection is dead, and it is resumed on a new one.
+//
+// See also: https://discord.com/developers/docs/topics/gateway#connection-lifecycle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"runtime"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// GATEWAY_VERSION is the version of the gateway we speak
+const GATEWAY_VERSION = "10"
+
+// Gateway opcodes
+const (
+	OP_DISPATCH        = 0
+	OP_HEARTBEAT       = 1
+	OP_IDENTIFY        = 2
+	OP_RESUME          = 6
+	OP_RECONNECT       = 7
+	OP_INVALID_SESSION = 9
+	OP_HELLO           = 10
+	OP_HEARTBEAT_ACK   = 11
+)
+
+// Gateway close codes
+const (
+	CLOSE_AUTHENTICATION_FAILED = 4004
+	CLOSE_INVALID_SEQUENCE      = 4007
+	CLOSE_SESSION_TIMED_OUT     = 4009
+	CLOSE_INVALID_SHARD         = 4010
+	CLOSE_SHARDING_REQUIRED     = 4011
+	CLOSE_INVALID_API_VERSION   = 4012
+	CLOSE_INVALID_INTENTS       = 4013
+	CLOSE_DISALLOWED_INTENTS    = 4014
+)
+
+var (
+	// ErrNotConnected is returned when sending to the gateway while
+	// disconnected
+	ErrNotConnected = errors.New("Not connected to the Discord gateway")
+
+	// ErrReconnect is returned when the gateway asks us to reconnect
+	ErrReconnect = errors.New("The Discord gateway asked us to reconnect")
+
+	// ErrInvalidSession is returned when the session could not be started or
+	// resumed
+	ErrInvalidSession = errors.New("Invalid Discord session")
+
+	// ErrZombie means a heartbeat was not acknowledged, and the connection
+	// is dead
+	ErrZombie = errors.New("Discord did not acknowledge our heartbeat")
+)
+
+// payload is a message from the gateway
+type payload struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+	Seq  *int64          `json:"s"`
+	Type string          `json:"t"`
+}
+
+// gatewayCommand is a message to the gateway
+type gatewayCommand struct {
+	Op   int         `json:"op"`
+	Data interface{} `json:"d"`
+}
+
+// connect to the gateway, and start a session, or resume the last one
+func (d *Discord) connect() error {
+	d.wmu.Lock()
+	u, session, seq := d.GatewayURL, d.session, d.seq
+	if session != "" && d.resumeURL != "" {
+		u = d.resumeURL
+	}
+	d.wmu.Unlock()
+
+	dialer := &websocket.Dialer{HandshakeTimeout: TIMEOUT}
+	conn, _, err := dialer.Dial(gatewayURL(u), nil)
+	if err != nil {
+		return fmt.Errorf("Could not connect to the Discord gateway: %s", err)
+	}
+
+	var hello struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	p, err := next(conn)
+	if err == nil && p.Op != OP_HELLO {
+		err = fmt.Errorf("Expected Hello from the Discord gateway, got opcode %d", p.Op)
+	}
+	if err == nil {
+		err = json.Unmarshal(p.Data, &hello)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	d.wmu.Lock()
+	d.conn = conn
+	d.interval = time.Duration(hello.HeartbeatInterval) * time.Millisecond
+	d.wmu.Unlock()
+
+	if session != "" {
+		// The events we missed, and Resumed, are read by run
+		logger.Log.Debugf("Resuming Discord session %s from %d", session, seq)
+		err = d.command(OP_RESUME, map[string]interface{}{
+			"token":      d.Token,
+			"session_id": session,
+			"seq":        seq,
+		})
+	} else {
+		err = d.identify(conn)
+	}
+
+	if err != nil {
+		d.wmu.Lock()
+		d.conn = nil
+		d.wmu.Unlock()
+		conn.Close()
+	}
+
+	return err
+}
+
+// identify starts a new session, and waits until it is ready
+func (d *Discord) identify(conn *websocket.Conn) error {
+	err := d.command(OP_IDENTIFY, map[string]interface{}{
+		"token":   d.Token,
+		"intents": d.Intents,
+		"properties": map[string]string{
+			"os":      runtime.GOOS,
+			"browser": "quarid",
+			"device":  "quarid",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		p, err := next(conn)
+		if err != nil {
+			return err
+		}
+
+		switch p.Op {
+		case OP_DISPATCH:
+			d.sequence(p)
+			d.event(p.Type, p.Data)
+			if p.Type == EVENT_READY {
+				return nil
+			}
+		case OP_HEARTBEAT:
+			d.heartbeat()
+		case OP_INVALID_SESSION:
+			return ErrInvalidSession
+		}
+	}
+}
+
+// next reads the next message from the gateway
+func next(conn *websocket.Conn) (*payload, error) {
+	conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+
+	p := &payload{}
+	if err := conn.ReadJSON(p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// gatewayURL adds the gateway version, and encoding, to the URL u
+func gatewayURL(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+
+	q := pu.Query()
+	q.Set("v", GATEWAY_VERSION)
+	q.Set("encoding", "json")
+	pu.RawQuery = q.Encode()
+
+	return pu.String()
+}
+
+// run reads from the gateway, reconnecting whenever the connection is lost,
+// until stop is closed
+func (d *Discord) run(stop chan struct{}) {
+	for {
+		err := d.read(stop)
+
+		select {
+		case <-stop:
+			d.done <- nil
+			return
+		default:
+		}
+
+		d.wmu.Lock()
+		d.conn = nil
+		d.wmu.Unlock()
+
+		if fatal(err) {
+			d.done <- err
+			return
+		}
+		logger.Log.Warningf("Lost the Discord gateway connection: %s", err)
+
+		wait := retryMin
+		for {
+			select {
+			case <-stop:
+				d.done <- nil
+				return
+			case <-time.After(wait):
+			}
+
+			err := d.connect()
+			if err == nil {
+				break
+			}
+			if fatal(err) {
+				d.done <- err
+				return
+			}
+
+			logger.Log.Warningf("Could not reconnect to Discord, retrying in %s: %s", wait, err)
+			if wait *= 2; wait > retryMax {
+				wait = retryMax
+			}
+		}
+	}
+}
+
+// read events from the gateway, until the connection fails
+func (d *Discord) read(stop chan struct{}) error {
+	d.wmu.Lock()
+	conn, interval := d.conn, d.interval
+	d.acked = true
+	d.wmu.Unlock()
+
+	alive := make(chan struct{})
+	defer close(alive)
+	go d.heartbeats(conn, interval, alive, stop)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2*interval + TIMEOUT))
+
+		p := &payload{}
+		if err := conn.ReadJSON(p); err != nil {
+			conn.Close()
+			d.closed(err)
+			return err
+		}
+
+		switch p.Op {
+		case OP_DISPATCH:
+			d.sequence(p)
+			d.event(p.Type, p.Data)
+		case OP_HEARTBEAT:
+			d.heartbeat()
+		case OP_HEARTBEAT_ACK:
+			d.wmu.Lock()
+			d.acked = true
+			d.wmu.Unlock()
+		case OP_RECONNECT:
+			conn.Close()
+			return ErrReconnect
+		case OP_INVALID_SESSION:
+			// The session may be resumed, or else a new one is started
+			var resumable bool
+			json.Unmarshal(p.Data, &resumable)
+			if !resumable {
+				d.endSession()
+			}
+
+			conn.Close()
+			return ErrInvalidSession
+		}
+	}
+}
+
+// sequence keeps the sequence number of an event, to resume from
+func (d *Discord) sequence(p *payload) {
+	if p.Seq == nil {
+		return
+	}
+
+	d.wmu.Lock()
+	d.seq = *p.Seq
+	d.wmu.Unlock()
+}
+
+// endSession forgets the session, so that the next connection starts a new
+// one
+func (d *Discord) endSession() {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	d.session, d.resumeURL, d.seq = "", "", 0
+}
+
+// closed handles the gateway closing the connection. Some close codes mean
+// the session cannot be resumed
+func (d *Discord) closed(err error) {
+	if e, ok := err.(*websocket.CloseError); ok {
+		switch e.Code {
+		case CLOSE_INVALID_SEQUENCE, CLOSE_SESSION_TIMED_OUT:
+			d.endSession()
+		}
+	}
+}
+
+// fatal reports whether err means we should not reconnect, such as our token
+// being refused
+func fatal(err error) bool {
+	switch e := err.(type) {
+	case *websocket.CloseError:
+		switch e.Code {
+		case CLOSE_AUTHENTICATION_FAILED, CLOSE_INVALID_SHARD,
+			CLOSE_SHARDING_REQUIRED, CLOSE_INVALID_API_VERSION,
+			CLOSE_INVALID_INTENTS, CLOSE_DISALLOWED_INTENTS:
+			return true
+		}
+	case *Error:
+		return e.Status == 401
+	}
+
+	return false
+}
+
+// heartbeats sends heartbeats at the interval the gateway asked for, while
+// the connection is alive. The first is sent after a random part of the
+// interval, so that clients that reconnect together do not heartbeat together
+func (d *Discord) heartbeats(conn *websocket.Conn, interval time.Duration, alive, stop chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	wait := time.Duration(rand.Int63n(int64(interval)))
+
+	for {
+		select {
+		case <-alive:
+			return
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		wait = interval
+
+		d.wmu.Lock()
+		acked := d.acked
+		d.acked = false
+		d.wmu.Unlock()
+
+		if !acked {
+			logger.Log.Warningf("%s; reconnecting", ErrZombie)
+			conn.Close()
+			return
+		}
+
+		d.heartbeat()
+	}
+}
+
+// heartbeat sends a heartbeat, with the sequence number of the last event we
+// were sent
+func (d *Discord) heartbeat() error {
+	d.wmu.Lock()
+	var seq interface{}
+	if d.seq > 0 {
+		seq = d.seq
+	}
+	d.wmu.Unlock()
+
+	return d.command(OP_HEARTBEAT, seq)
+}
+
+// command sends a command to the gateway
+func (d *Discord) command(op int, data interface{}) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+
+	if d.conn == nil {
+		return ErrNotConnected
+	}
+
+	return d.conn.WriteJSON(&gatewayCommand{Op: op, Data: data})
+}
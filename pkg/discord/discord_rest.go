@@ -0,0 +1,257 @@
+package discord
+
+// REST API
+//
+// Requests are JSON, authenticated with the bot's token. Each route has a
+// rate limit, and routes share the buckets Discord names in the
+// X-RateLimit-Bucket header; a bucket is separate for each channel, guild or
+// webhook (the route's major parameter). Requests in a bucket are made one at
+// a time, waiting when the bucket is empty until it resets. Requests that are
+// rate limited anyway (including by the global limit) are retried once
+// Discord allows it.
+//
+// See also: https://discord.com/developers/docs/topics/rate-limits
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// maxRetries is how many times a rate limited request is retried
+const maxRetries = 5
+
+// Error is an error response from the REST API
+type Error struct {
+	Status  int    `json:"-"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Discord error %d (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// request sends a request to the REST API, with the JSON body in (if not
+// nil), and decodes the response into out (if not nil)
+func (d *Discord) request(method, path string, in, out interface{}) error {
+	return d.do(method, path, "", in, out)
+}
+
+// do sends a request to the REST API, once its rate limit allows. The
+// reason, if given, is kept in the guild's audit log
+func (d *Discord) do(method, path, reason string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	rt, major := route(method, path)
+	b := d.limiter.bucket(rt, major)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for n := 0; ; n++ {
+		d.limiter.wait(b)
+
+		req, err := http.NewRequest(method, strings.TrimRight(d.APIURL, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bot "+d.Token)
+		req.Header.Set("User-Agent", "DiscordBot (https://github.com/enmand/quarid-go, "+pkg.VERSION+")")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if reason != "" {
+			req.Header.Set("X-Audit-Log-Reason", url.PathEscape(reason))
+		}
+
+		resp, err := d.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		rb, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		d.limiter.update(rt, major, b, resp.Header)
+
+		if resp.StatusCode == http.StatusTooManyRequests && n < maxRetries {
+			var r struct {
+				RetryAfter float64 `json:"retry_after"`
+				Global     bool    `json:"global"`
+			}
+			json.Unmarshal(rb, &r)
+
+			wait := time.Duration(r.RetryAfter * float64(time.Second))
+			if wait <= 0 {
+				wait = time.Second
+			}
+			if r.Global || resp.Header.Get("X-RateLimit-Global") != "" {
+				d.limiter.block(wait)
+			} else {
+				b.remaining, b.reset = 0, time.Now().Add(wait)
+			}
+
+			logger.Log.Debugf("Rate limited by Discord on %s; retrying in %s", rt, wait)
+			continue
+		}
+
+		if resp.StatusCode >= 400 {
+			e := &Error{Status: resp.StatusCode}
+			if err := json.Unmarshal(rb, e); err != nil || e.Message == "" {
+				e.Message = http.StatusText(resp.StatusCode)
+			}
+			return e
+		}
+
+		if out == nil || len(rb) == 0 {
+			return nil
+		}
+		return json.Unmarshal(rb, out)
+	}
+}
+
+// route returns the route of a request, with its IDs left out, and its major
+// parameter
+func route(method, path string) (string, string) {
+	parts := strings.Split(strings.SplitN(path, "?", 2)[0], "/")
+	major := ""
+
+	for n := 1; n < len(parts); n++ {
+		switch prev := parts[n-1]; {
+		case n == 2 && (prev == "channels" || prev == "guilds" || prev == "webhooks"):
+			major = parts[n]
+			parts[n] = ":id"
+		case n == 3 && parts[1] == "webhooks":
+			// A webhook's token is part of its major parameter
+			major += "/" + parts[n]
+			parts[n] = ":token"
+		case prev == "reactions":
+			parts[n] = ":emoji"
+		case snowflake(parts[n]):
+			parts[n] = ":id"
+		}
+	}
+
+	return method + " " + strings.Join(parts, "/"), major
+}
+
+// snowflake reports whether s is a Discord ID
+func snowflake(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil && s != ""
+}
+
+// rateLimiter keeps the REST API's rate limit buckets
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// The bucket each route is in, as Discord names it, and the buckets, by
+	// that name (or the route, until Discord names it) and major parameter
+	hashes  map[string]string
+	buckets map[string]*bucket
+
+	// When the global rate limit is over
+	global time.Time
+}
+
+// bucket is a rate limit bucket, which is locked while a request is made in
+// it
+type bucket struct {
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		hashes:  make(map[string]string),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// bucket returns the bucket for the route and major parameter
+func (l *rateLimiter) bucket(rt, major string) *bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := rt + ":" + major
+	if h, ok := l.hashes[rt]; ok {
+		key = h + ":" + major
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{remaining: 1}
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+// wait until a request can be made in the bucket b
+func (l *rateLimiter) wait(b *bucket) {
+	if b.remaining <= 0 {
+		if d := time.Until(b.reset); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	l.mu.Lock()
+	global := l.global
+	l.mu.Unlock()
+
+	if d := time.Until(global); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// block every request until the global rate limit is over
+func (l *rateLimiter) block(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.global = time.Now().Add(d)
+}
+
+// update the bucket b from the rate limit headers of a response
+func (l *rateLimiter) update(rt, major string, b *bucket, h http.Header) {
+	if hash := h.Get("X-RateLimit-Bucket"); hash != "" {
+		l.mu.Lock()
+		l.hashes[rt] = hash
+		if _, ok := l.buckets[hash+":"+major]; !ok {
+			l.buckets[hash+":"+major] = b
+		}
+		l.mu.Unlock()
+	}
+
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		// Routes without headers have no limit we know of
+		b.remaining, b.reset = 1, time.Time{}
+		return
+	}
+	b.remaining = remaining
+
+	if after, err := strconv.ParseFloat(h.Get("X-RateLimit-Reset-After"), 64); err == nil {
+		b.reset = time.Now().Add(time.Duration(after * float64(time.Second)))
+	}
+}
@@ -0,0 +1,342 @@
+package discord
+
+// Sending
+//
+// Messages are sent as Markdown, with mentions of the users and channels of
+// the guild (@name and #name) turned into Discord's mentions. Only users are
+// pinged, so that messages relayed from other networks cannot ping @everyone
+// or a role. Messages longer than Discord allows are split at line breaks.
+// Replies are message references, and direct messages to a user open a DM
+// channel with them.
+//
+// See also: https://discord.com/developers/docs/resources/message#create-message
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// MAX_MESSAGE_LENGTH is the most characters a message can have
+const MAX_MESSAGE_LENGTH = 2000
+
+// allowedMentions are the mentions in our messages that ping
+var allowedMentions = map[string]interface{}{
+	"parse":        []string{"users"},
+	"replied_user": true,
+}
+
+// Send an Update to Discord
+func (d *Discord) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		return d.send(u.Room, u.Thread, u.Kind, u.Text, u.ReplyTo)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+		return d.send(u.To.Room, u.To.Thread, u.Kind, u.Text, u.To.ID)
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+		return d.edit(u.Message, u.Text)
+	case *adapter.Reaction:
+		return nil, d.react(u)
+	case *adapter.Membership:
+		return nil, d.setMembership(u)
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// send a message to a room, or a thread, as a reply to the message replyTo
+// (if not empty)
+func (d *Discord) send(rm adapter.Room, thread string, kind adapter.Kind, text, replyTo string) (*adapter.Message, error) {
+	ch, err := d.channelID(rm, thread)
+	if err != nil {
+		return nil, err
+	}
+
+	var first *adapter.Message
+	for n, part := range split(d.content(d.guildOf(ch), kind, text)) {
+		body := map[string]interface{}{
+			"content":          part,
+			"allowed_mentions": allowedMentions,
+		}
+		if replyTo != "" && n == 0 {
+			body["message_reference"] = map[string]interface{}{
+				"message_id":         replyTo,
+				"fail_if_not_exists": false,
+			}
+		}
+
+		var r message
+		if err := d.request("POST", "/channels/"+ch+"/messages", body, &r); err != nil {
+			return first, err
+		}
+
+		if first == nil {
+			first = d.sent(&r, rm, thread, kind, text)
+			first.ReplyTo = replyTo
+		}
+	}
+
+	return first, nil
+}
+
+// edit one of our messages
+func (d *Discord) edit(m *adapter.Message, text string) (*adapter.Message, error) {
+	ch, err := d.channelID(m.Room, m.Thread)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"content":          d.content(d.guildOf(ch), m.Kind, text),
+		"allowed_mentions": allowedMentions,
+	}
+
+	var r message
+	if err := d.request("PATCH", "/channels/"+ch+"/messages/"+m.ID, body, &r); err != nil {
+		return nil, err
+	}
+
+	return d.sent(&r, m.Room, m.Thread, m.Kind, text), nil
+}
+
+// sent describes a message we sent
+func (d *Discord) sent(r *message, rm adapter.Room, thread string, kind adapter.Kind, text string) *adapter.Message {
+	d.mu.Lock()
+	self := adapter.User{}
+	if d.self != nil {
+		self = adapter.User{ID: d.self.ID, Name: displayName(d.self, nil), Account: d.self.Username}
+	}
+	d.mu.Unlock()
+
+	return &adapter.Message{
+		Adapter: d.Name(),
+		ID:      r.ID,
+		Room:    rm,
+		User:    self,
+		Kind:    kind,
+		Text:    text,
+		Thread:  thread,
+		Time:    time.Now(),
+	}
+}
+
+// content is the Markdown content of a message. Actions are sent as Discord's
+// /me sends them, in italics
+func (d *Discord) content(guildID string, kind adapter.Kind, text string) string {
+	c := format.Markdown(d.mentionIDs(guildID, text))
+	if kind == adapter.Action {
+		c = "_" + c + "_"
+	}
+
+	return c
+}
+
+// mentionIDs turns @name and #name in text into mentions of the guild's
+// members and channels with those names
+func (d *Discord) mentionIDs(guildID, text string) string {
+	if guildID == "" || !strings.ContainsAny(text, "@#") {
+		return text
+	}
+
+	d.mu.Lock()
+	names := make(map[string]string)
+	if g, ok := d.guilds[guildID]; ok {
+		for id, n := range g.names {
+			names["@"+n] = "<@" + id + ">"
+		}
+	}
+	for _, c := range d.channels {
+		if c.GuildID == guildID && c.Name != "" {
+			names["#"+c.Name] = "<#" + c.ID + ">"
+		}
+	}
+	d.mu.Unlock()
+
+	// Longer names first, so that @Alice Smith is not taken as @Alice
+	var keys []string
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	for _, k := range keys {
+		var b strings.Builder
+		rest := text
+		for {
+			n := strings.Index(rest, k)
+			if n < 0 {
+				break
+			}
+
+			// The name must be a whole word, and not part of an address
+			end := n + len(k)
+			r, _ := utf8.DecodeRuneInString(rest[end:])
+			p, _ := utf8.DecodeLastRuneInString(rest[:n])
+			whole := (end == len(rest) || !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_') &&
+				(n == 0 || !unicode.IsLetter(p) && !unicode.IsDigit(p))
+
+			b.WriteString(rest[:n])
+			if whole {
+				b.WriteString(names[k])
+			} else {
+				b.WriteString(k)
+			}
+			rest = rest[end:]
+		}
+		b.WriteString(rest)
+		text = b.String()
+	}
+
+	return text
+}
+
+// split content into messages Discord allows, at line breaks where it can
+func split(content string) []string {
+	var parts []string
+	var cur []rune
+
+	for n, line := range strings.Split(content, "\n") {
+		l := []rune(line)
+		if n > 0 {
+			if len(cur)+1+len(l) <= MAX_MESSAGE_LENGTH {
+				cur = append(cur, '\n')
+			} else {
+				parts = append(parts, string(cur))
+				cur = nil
+			}
+		}
+
+		for len(cur)+len(l) > MAX_MESSAGE_LENGTH {
+			k := MAX_MESSAGE_LENGTH - len(cur)
+			parts = append(parts, string(append(cur, l[:k]...)))
+			cur, l = nil, l[k:]
+		}
+		cur = append(cur, l...)
+	}
+
+	if len(cur) > 0 || len(parts) == 0 {
+		parts = append(parts, string(cur))
+	}
+
+	return parts
+}
+
+// channelID returns the channel to send to a room, or thread, in. Private
+// rooms may be a user, to open a DM channel with
+func (d *Discord) channelID(rm adapter.Room, thread string) (string, error) {
+	if thread != "" {
+		return thread, nil
+	}
+	if !rm.Private {
+		return rm.ID, nil
+	}
+
+	d.mu.Lock()
+	_, known := d.channels[rm.ID]
+	dm := d.dms[rm.ID]
+	d.mu.Unlock()
+
+	switch {
+	case known:
+		return rm.ID, nil
+	case dm != "":
+		return dm, nil
+	}
+
+	c := &channel{}
+	if err := d.request("POST", "/users/@me/channels", map[string]string{"recipient_id": rm.ID}, c); err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	d.addChannel(c)
+	d.mu.Unlock()
+
+	return c.ID, nil
+}
+
+// guildOf returns the guild a channel is in
+func (d *Discord) guildOf(channelID string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.channelGuild(channelID)
+}
+
+// react to a message, or take back our reaction. Custom emoji are given as
+// :name:
+func (d *Discord) react(u *adapter.Reaction) error {
+	e := u.Reaction
+	if len(e) > 2 && strings.HasPrefix(e, ":") && strings.HasSuffix(e, ":") {
+		name := e[1 : len(e)-1]
+
+		d.mu.Lock()
+		if g, ok := d.guilds[d.channelGuild(u.Room.ID)]; ok {
+			if id, ok := g.emoji[name]; ok {
+				e = name + ":" + id
+			}
+		}
+		d.mu.Unlock()
+	}
+
+	method := "PUT"
+	if u.Removed {
+		method = "DELETE"
+	}
+
+	return d.request(method, "/channels/"+u.Room.ID+"/messages/"+u.MessageID+
+		"/reactions/"+url.PathEscape(e)+"/@me", nil, nil)
+}
+
+// channelGuild returns the guild a channel is in; d.mu must be held
+func (d *Discord) channelGuild(channelID string) string {
+	if c, ok := d.channels[channelID]; ok {
+		return c.GuildID
+	}
+	return ""
+}
+
+// setMembership kicks a member from the guild of a room, or changes our
+// nickname, in the guild of a room or in every guild
+func (d *Discord) setMembership(u *adapter.Membership) error {
+	switch u.Kind {
+	case adapter.Kick:
+		g := d.guildOf(u.Room.ID)
+		if g == "" {
+			return adapter.ErrNotSupported
+		}
+		return d.do("DELETE", "/guilds/"+g+"/members/"+u.User.ID, u.Reason, nil, nil)
+	case adapter.Rename:
+		var gs []string
+		if g := d.guildOf(u.Room.ID); g != "" {
+			gs = append(gs, g)
+		} else {
+			d.mu.Lock()
+			for id := range d.guilds {
+				gs = append(gs, id)
+			}
+			d.mu.Unlock()
+		}
+
+		for _, g := range gs {
+			if err := d.request("PATCH", "/guilds/"+g+"/members/@me", map[string]string{"nick": u.NewName}, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return adapter.ErrNotSupported
+}
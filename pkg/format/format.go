@@ -0,0 +1,321 @@
+// Package format translates message formatting between chat networks
+//
+// About
+//
+// The text of an adapter.Message carries its formatting as IRC formatting
+// codes: bold, italic, underline, strikethrough, monospace, and colors from
+// the 16 color IRC palette. Each adapter translates these to and from its
+// network's own formatting (HTML for Matrix, for example), so that formatted
+// text can be passed between networks.
+//
+// Parse splits formatted text into Spans of a single Style, which the
+// renderers walk, and Format joins Spans back into formatted text.
+//
+// See also: https://modern.ircdocs.horse/formatting.html
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Formatting codes
+const (
+	BOLD          = '\x02'
+	COLOR         = '\x03'
+	HEX_COLOR     = '\x04'
+	RESET         = '\x0f'
+	MONOSPACE     = '\x11'
+	REVERSE       = '\x16'
+	ITALIC        = '\x1d'
+	STRIKETHROUGH = '\x1e'
+	UNDERLINE     = '\x1f'
+)
+
+// Color is a color from the IRC palette, from 0 to 15
+type Color int
+
+// NoColor is the network's default color
+const NoColor Color = -1
+
+// Colors in the IRC palette
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// palette is the RGB value of each Color
+var palette = [...]int{
+	0xffffff, 0x000000, 0x00007f, 0x009300, 0xff0000, 0x7f0000, 0x9c009c,
+	0xfc7f00, 0xffff00, 0x00fc00, 0x009393, 0x00ffff, 0x0000fc, 0xff00ff,
+	0x7f7f7f, 0xd2d2d2,
+}
+
+// Hex returns the color as an HTML hex color, such as "#ff0000"
+func (c Color) Hex() string {
+	if c < 0 || int(c) >= len(palette) {
+		return ""
+	}
+
+	return fmt.Sprintf("#%06x", palette[c])
+}
+
+// ParseHex returns the palette Color nearest to the hex color h (such as
+// "#ff0000"), or NoColor if h is not a color
+func ParseHex(h string) Color {
+	v, err := strconv.ParseUint(strings.TrimPrefix(h, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(h, "#")) != 6 {
+		return NoColor
+	}
+
+	r, g, b := int(v>>16&0xff), int(v>>8&0xff), int(v&0xff)
+	nearest, distance := NoColor, -1
+	for n, p := range palette {
+		dr, dg, db := r-(p>>16&0xff), g-(p>>8&0xff), b-(p&0xff)
+		if d := dr*dr + dg*dg + db*db; distance < 0 || d < distance {
+			nearest, distance = Color(n), d
+		}
+	}
+
+	return nearest
+}
+
+// Style is the formatting of a span of text
+type Style struct {
+	Bold      bool
+	Italic    bool
+	Underline bool
+	Strike    bool
+	Monospace bool
+
+	Color      Color
+	Background Color
+}
+
+// Plain is text with no formatting
+var Plain = Style{Color: NoColor, Background: NoColor}
+
+// Span is text with a single Style
+type Span struct {
+	Style
+	Text string
+}
+
+// Parse splits formatted text into Spans
+func Parse(s string) []Span {
+	var spans []Span
+	var text strings.Builder
+	st := Plain
+
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, Span{Style: st, Text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for n := 0; n < len(s); n++ {
+		c := s[n]
+		switch c {
+		case BOLD, ITALIC, UNDERLINE, STRIKETHROUGH, MONOSPACE, RESET, COLOR,
+			HEX_COLOR, REVERSE:
+			flush()
+		default:
+			text.WriteByte(c)
+			continue
+		}
+
+		switch c {
+		case BOLD:
+			st.Bold = !st.Bold
+		case ITALIC:
+			st.Italic = !st.Italic
+		case UNDERLINE:
+			st.Underline = !st.Underline
+		case STRIKETHROUGH:
+			st.Strike = !st.Strike
+		case MONOSPACE:
+			st.Monospace = !st.Monospace
+		case RESET:
+			st = Plain
+		case REVERSE:
+			st.Color, st.Background = st.Background, st.Color
+		case COLOR:
+			fg, l := digits(s[n+1:])
+			if l == 0 {
+				st.Color, st.Background = NoColor, NoColor
+				continue
+			}
+			n += l
+			st.Color = color(fg)
+
+			if n+2 < len(s) && s[n+1] == ',' {
+				if bg, l := digits(s[n+2:]); l > 0 {
+					n += l + 1
+					st.Background = color(bg)
+				}
+			}
+		case HEX_COLOR:
+			// Hex colors are mapped to the nearest color in the palette
+			if n+7 > len(s) {
+				st.Color, st.Background = NoColor, NoColor
+				continue
+			}
+			st.Color = ParseHex(s[n+1 : n+7])
+			n += 6
+
+			if n+8 <= len(s) && s[n+1] == ',' {
+				if bg := ParseHex(s[n+2 : n+8]); bg != NoColor {
+					st.Background = bg
+					n += 7
+				}
+			}
+		}
+	}
+	flush()
+
+	return spans
+}
+
+// digits returns the number at the start of s, of up to 2 digits, and its
+// length
+func digits(s string) (int, int) {
+	l := 0
+	for l < len(s) && l < 2 && s[l] >= '0' && s[l] <= '9' {
+		l++
+	}
+
+	n, _ := strconv.Atoi(s[:l])
+	return n, l
+}
+
+func color(n int) Color {
+	if n >= len(palette) {
+		// 99 is the default color, and other colors have no common values
+		return NoColor
+	}
+
+	return Color(n)
+}
+
+// Format joins Spans into formatted text
+func Format(spans []Span) string {
+	var b strings.Builder
+	st := Plain
+
+	toggle := func(was, is bool, code byte) {
+		if was != is {
+			b.WriteByte(code)
+		}
+	}
+
+	for _, sp := range spans {
+		if sp.Text == "" {
+			continue
+		}
+
+		toggle(st.Bold, sp.Bold, BOLD)
+		toggle(st.Italic, sp.Italic, ITALIC)
+		toggle(st.Underline, sp.Underline, UNDERLINE)
+		toggle(st.Strike, sp.Strike, STRIKETHROUGH)
+		toggle(st.Monospace, sp.Monospace, MONOSPACE)
+
+		if st.Color != sp.Color || st.Background != sp.Background {
+			// Text that starts with a digit or a comma would be read as
+			// part of a shorter color code, so the full code is written
+			switch {
+			case sp.Color == NoColor && sp.Background == NoColor &&
+				!colorLike(sp.Text):
+				b.WriteByte(COLOR)
+			case sp.Background == NoColor && st.Background == NoColor &&
+				!strings.HasPrefix(sp.Text, ","):
+				fmt.Fprintf(&b, "%c%02d", COLOR, colorCode(sp.Color))
+			default:
+				fmt.Fprintf(&b, "%c%02d,%02d", COLOR, colorCode(sp.Color), colorCode(sp.Background))
+			}
+		}
+
+		b.WriteString(sp.Text)
+		st = sp.Style
+	}
+
+	if st != Plain {
+		b.WriteByte(RESET)
+	}
+
+	return b.String()
+}
+
+// colorLike reports whether s starts with what could be read as part of a
+// color code
+func colorLike(s string) bool {
+	return s != "" && (s[0] == ',' || s[0] >= '0' && s[0] <= '9')
+}
+
+func colorCode(c Color) int {
+	if c == NoColor {
+		return 99
+	}
+
+	return int(c)
+}
+
+// Strip removes all formatting from s
+func Strip(s string) string {
+	var b strings.Builder
+	for _, sp := range Parse(s) {
+		b.WriteString(sp.Text)
+	}
+
+	return b.String()
+}
+
+// Bold formats s as bold
+func Bold(s string) string {
+	return string(BOLD) + s + string(BOLD)
+}
+
+// Italic formats s as italic
+func Italic(s string) string {
+	return string(ITALIC) + s + string(ITALIC)
+}
+
+// Underline formats s as underlined
+func Underline(s string) string {
+	return string(UNDERLINE) + s + string(UNDERLINE)
+}
+
+// Strike formats s as struck through
+func Strike(s string) string {
+	return string(STRIKETHROUGH) + s + string(STRIKETHROUGH)
+}
+
+// Monospace formats s as monospace
+func Monospace(s string) string {
+	return string(MONOSPACE) + s + string(MONOSPACE)
+}
+
+// Colored formats s in the color c. The color is ended with the full code for
+// the default colors, so that text after it is not read as part of the code
+func Colored(s string, c Color) string {
+	if strings.HasPrefix(s, ",") {
+		return fmt.Sprintf("%c%02d,99%s%c99,99", COLOR, colorCode(c), s, COLOR)
+	}
+
+	return fmt.Sprintf("%c%02d%s%c99,99", COLOR, colorCode(c), s, COLOR)
+}
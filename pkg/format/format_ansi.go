@@ -0,0 +1,79 @@
+package format
+
+// ANSI
+//
+// Formatted text is rendered for terminals with ANSI (SGR) escape sequences:
+// bold, italic, underline, strikethrough, and colors, as 24-bit colors from
+// the IRC palette. Terminals are monospace already, so monospace is left as
+// it is. Other control characters are dropped, so that text cannot control
+// the terminal.
+//
+// See also: https://en.wikipedia.org/wiki/ANSI_escape_code#SGR
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ANSI_RESET resets a terminal's formatting
+const ANSI_RESET = "\x1b[0m"
+
+// ANSI renders formatted text with ANSI escape sequences
+func ANSI(s string) string {
+	var b strings.Builder
+	styled := false
+
+	for _, sp := range Parse(s) {
+		var codes []string
+		if sp.Bold {
+			codes = append(codes, "1")
+		}
+		if sp.Italic {
+			codes = append(codes, "3")
+		}
+		if sp.Underline {
+			codes = append(codes, "4")
+		}
+		if sp.Strike {
+			codes = append(codes, "9")
+		}
+		if c := ansiColor(sp.Color); c != "" {
+			codes = append(codes, "38;2;"+c)
+		}
+		if c := ansiColor(sp.Background); c != "" {
+			codes = append(codes, "48;2;"+c)
+		}
+
+		if styled {
+			b.WriteString(ANSI_RESET)
+		}
+		if styled = len(codes) > 0; styled {
+			b.WriteString("\x1b[" + strings.Join(codes, ";") + "m")
+		}
+
+		b.WriteString(strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' && r != '\t' {
+				return -1
+			}
+			return r
+		}, sp.Text))
+	}
+
+	if styled {
+		b.WriteString(ANSI_RESET)
+	}
+
+	return b.String()
+}
+
+// ansiColor returns a Color as the red, green and blue of an ANSI 24-bit
+// color, or "" for NoColor
+func ansiColor(c Color) string {
+	if c < 0 || int(c) >= len(palette) {
+		return ""
+	}
+
+	p := palette[c]
+	return fmt.Sprintf("%d;%d;%d", p>>16&0xff, p>>8&0xff, p&0xff)
+}
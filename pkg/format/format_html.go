@@ -0,0 +1,203 @@
+package format
+
+// HTML
+//
+// Formatted text is rendered as the subset of HTML chat networks (such as
+// Matrix) allow, and parsed from it. Links are kept as their text, followed by
+// their address if it is different. Matrix's reply fallbacks (<mx-reply>) are
+// dropped.
+//
+// See also: https://spec.matrix.org/latest/client-server-api/#mroommessage-msgtypes
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// HTML renders formatted text as HTML
+func HTML(s string) string {
+	var b strings.Builder
+
+	for _, sp := range Parse(s) {
+		var open, close []string
+		tag := func(o, c string) {
+			open = append(open, o)
+			close = append([]string{c}, close...)
+		}
+
+		if sp.Color != NoColor || sp.Background != NoColor {
+			attrs := ""
+			if sp.Color != NoColor {
+				attrs += ` color="` + sp.Color.Hex() + `" data-mx-color="` + sp.Color.Hex() + `"`
+			}
+			if sp.Background != NoColor {
+				attrs += ` data-mx-bg-color="` + sp.Background.Hex() + `"`
+			}
+			tag("<font"+attrs+">", "</font>")
+		}
+		if sp.Bold {
+			tag("<b>", "</b>")
+		}
+		if sp.Italic {
+			tag("<i>", "</i>")
+		}
+		if sp.Underline {
+			tag("<u>", "</u>")
+		}
+		if sp.Strike {
+			tag("<del>", "</del>")
+		}
+		if sp.Monospace {
+			tag("<code>", "</code>")
+		}
+
+		text := html.EscapeString(sp.Text)
+		text = strings.Replace(text, "\n", "<br>", -1)
+
+		b.WriteString(strings.Join(open, ""))
+		b.WriteString(text)
+		b.WriteString(strings.Join(close, ""))
+	}
+
+	return b.String()
+}
+
+var (
+	htmlToken = regexp.MustCompile(`(?s)<!--.*?-->|<(/?)([a-zA-Z][a-zA-Z0-9-]*)([^>]*)>|[^<]+|<`)
+	htmlAttr  = regexp.MustCompile(`([a-zA-Z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// htmlElement is an element that is open while parsing HTML
+type htmlElement struct {
+	tag   string
+	style Style
+	href  string
+	text  strings.Builder
+}
+
+// ParseHTML parses HTML into formatted text
+func ParseHTML(h string) string {
+	var spans []Span
+	var stack []*htmlElement
+	st := Plain
+	skip := 0
+
+	write := func(text string) {
+		if skip > 0 || text == "" {
+			return
+		}
+		for _, e := range stack {
+			e.text.WriteString(text)
+		}
+
+		if n := len(spans); n > 0 && spans[n-1].Style == st {
+			spans[n-1].Text += text
+		} else {
+			spans = append(spans, Span{Style: st, Text: text})
+		}
+	}
+
+	newline := func() {
+		if n := len(spans); n > 0 && !strings.HasSuffix(spans[n-1].Text, "\n") {
+			write("\n")
+		}
+	}
+
+	for _, m := range htmlToken.FindAllStringSubmatch(h, -1) {
+		if m[2] == "" {
+			if !strings.HasPrefix(m[0], "<!--") {
+				write(html.UnescapeString(m[0]))
+			}
+			continue
+		}
+
+		tag := strings.ToLower(m[2])
+		if m[1] == "/" {
+			// Close the most recent element with this tag, and any left open
+			// inside it
+			for n := len(stack) - 1; n >= 0; n-- {
+				if stack[n].tag != tag {
+					continue
+				}
+
+				e := stack[n]
+				stack = stack[:n]
+				st = e.style
+
+				switch tag {
+				case "mx-reply":
+					skip--
+				case "a":
+					text := e.text.String()
+					if e.href != "" && e.href != text &&
+						!strings.HasPrefix(e.href, "mailto:") &&
+						!strings.HasPrefix(e.href, "https://matrix.to/") {
+						write(" (" + e.href + ")")
+					}
+				case "p", "div", "pre", "blockquote", "li", "h1", "h2", "h3", "h4", "h5", "h6":
+					newline()
+				}
+				break
+			}
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for _, a := range htmlAttr.FindAllStringSubmatch(m[3], -1) {
+			attrs[strings.ToLower(a[1])] = html.UnescapeString(a[2] + a[3] + a[4])
+		}
+
+		switch tag {
+		case "br":
+			write("\n")
+			continue
+		case "hr", "img":
+			if alt := attrs["alt"]; alt != "" {
+				write(alt)
+			}
+			continue
+		case "p", "div", "pre", "blockquote", "ul", "ol", "h1", "h2", "h3", "h4", "h5", "h6":
+			newline()
+		case "li":
+			newline()
+			write("- ")
+		}
+
+		e := &htmlElement{tag: tag, style: st, href: attrs["href"]}
+		if strings.HasSuffix(m[3], "/") {
+			continue
+		}
+		stack = append(stack, e)
+
+		switch tag {
+		case "b", "strong", "h1", "h2", "h3", "h4", "h5", "h6":
+			st.Bold = true
+		case "i", "em":
+			st.Italic = true
+		case "u", "ins":
+			st.Underline = true
+		case "s", "del", "strike":
+			st.Strike = true
+		case "code", "pre", "tt":
+			st.Monospace = true
+		case "mx-reply":
+			skip++
+		case "font", "span":
+			if c, ok := attrs["data-mx-color"]; ok {
+				st.Color = ParseHex(c)
+			} else if c, ok := attrs["color"]; ok {
+				st.Color = ParseHex(c)
+			}
+			if c, ok := attrs["data-mx-bg-color"]; ok {
+				st.Background = ParseHex(c)
+			}
+		}
+	}
+
+	if n := len(spans); n > 0 {
+		spans[n-1].Text = strings.TrimRight(spans[n-1].Text, "\n")
+	}
+
+	return Format(spans)
+}
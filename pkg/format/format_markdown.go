@@ -0,0 +1,317 @@
+package format
+
+// Markdown
+//
+// Formatted text is rendered as the Markdown chat networks (such as Discord
+// and Mattermost) use: **bold**, *italic*, __underline__, ~~strikethrough~~
+// and `code`, and parsed from it. Colors cannot be written in Markdown, and
+// are dropped. Characters Markdown would interpret are escaped, except in
+// links, and masked links ([text](address)) are kept as their text, followed
+// by their address.
+//
+// See also: https://support.discord.com/hc/en-us/articles/210298617
+// See also: https://spec.commonmark.org/
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// markdownMarkers are the Markdown delimiters for each style, in the order
+// they are opened
+var markdownMarkers = []struct {
+	marker string
+	is     func(Style) bool
+}{
+	{"**", func(st Style) bool { return st.Bold }},
+	{"*", func(st Style) bool { return st.Italic }},
+	{"__", func(st Style) bool { return st.Underline }},
+	{"~~", func(st Style) bool { return st.Strike }},
+}
+
+var (
+	markdownEscapes = strings.NewReplacer(
+		`\`, `\\`, `*`, `\*`, `_`, `\_`, `~`, `\~`, "`", "\\`", `|`, `\|`,
+	)
+	markdownLink = regexp.MustCompile(`^\[([^\]]*)\]\(<?([^)\s>]+)>?\)`)
+	markdownURL  = regexp.MustCompile(`(?i)\bhttps?://[^\s<]+`)
+	markdownBare = regexp.MustCompile(`(?i)^<(https?://[^\s>]+)>`)
+)
+
+// Markdown renders formatted text as Markdown
+func Markdown(s string) string {
+	var b strings.Builder
+	var open []string
+
+	// Whitespace at the edges of a span goes outside its delimiters, as
+	// Markdown does not see delimiters next to whitespace
+	pending := ""
+
+	for _, sp := range Parse(s) {
+		text := sp.Text
+		core := strings.TrimSpace(text)
+		if core == "" {
+			pending += text
+			continue
+		}
+		lead := text[:strings.Index(text, core)]
+		trail := text[len(lead)+len(core):]
+
+		var want []string
+		for _, m := range markdownMarkers {
+			if m.is(sp.Style) {
+				want = append(want, m.marker)
+			}
+		}
+
+		// Keep the delimiters that are open, and still wanted, and close
+		// those after them
+		keep := 0
+		for keep < len(open) && contains(want, open[keep]) {
+			keep++
+		}
+		for n := len(open) - 1; n >= keep; n-- {
+			b.WriteString(open[n])
+		}
+		open = open[:keep]
+
+		b.WriteString(pending + lead)
+		pending = trail
+
+		for _, m := range want {
+			if !contains(open, m) {
+				b.WriteString(m)
+				open = append(open, m)
+			}
+		}
+
+		if sp.Monospace {
+			b.WriteString(markdownCode(core))
+		} else {
+			b.WriteString(markdownEscape(core))
+		}
+	}
+
+	for n := len(open) - 1; n >= 0; n-- {
+		b.WriteString(open[n])
+	}
+	b.WriteString(pending)
+
+	return b.String()
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if s == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markdownCode writes text as inline code, with enough backticks to enclose
+// the backticks it has
+func markdownCode(text string) string {
+	ticks := "`"
+	for strings.Contains(text, ticks) {
+		ticks += "`"
+	}
+
+	if len(ticks) > 1 {
+		return ticks + " " + text + " " + ticks
+	}
+	return ticks + text + ticks
+}
+
+// markdownEscape escapes the characters Markdown would interpret in text,
+// leaving links as they are
+func markdownEscape(text string) string {
+	var b strings.Builder
+
+	last := 0
+	for _, l := range markdownURL.FindAllStringIndex(text, -1) {
+		b.WriteString(markdownEscapeLines(text[last:l[0]]))
+		b.WriteString(text[l[0]:l[1]])
+		last = l[1]
+	}
+	b.WriteString(markdownEscapeLines(text[last:]))
+
+	return b.String()
+}
+
+// markdownEscapeLines escapes text, and quotes and headings at the start of
+// its lines
+func markdownEscapeLines(text string) string {
+	lines := strings.Split(markdownEscapes.Replace(text), "\n")
+	for n, l := range lines {
+		if strings.HasPrefix(l, ">") || strings.HasPrefix(l, "#") {
+			lines[n] = `\` + l
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ParseMarkdown parses Markdown into formatted text
+func ParseMarkdown(md string) string {
+	var spans []Span
+	var text strings.Builder
+	st := Plain
+
+	// The delimiter italic text was opened with, as both * and _ are used
+	italic := ""
+
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, Span{Style: st, Text: text.String()})
+			text.Reset()
+		}
+	}
+
+	// opens reports whether the delimiter at n starts a span: it must be
+	// followed by text, and closed later on
+	opens := func(n int, delim string) bool {
+		if n+len(delim) >= len(md) {
+			return false
+		}
+
+		rest := md[n+len(delim):]
+		if unicode.IsSpace(rune(rest[0])) {
+			return false
+		}
+
+		return strings.Contains(rest, delim)
+	}
+
+	heading, spoiler := false, false
+	for n := 0; n < len(md); n++ {
+		lineStart := n == 0 || md[n-1] == '\n'
+		rest := md[n:]
+
+		if lineStart {
+			if heading {
+				flush()
+				st.Bold, heading = false, false
+			}
+
+			switch {
+			case strings.HasPrefix(rest, "> "):
+				n++
+				continue
+			case strings.HasPrefix(rest, "# "), strings.HasPrefix(rest, "## "),
+				strings.HasPrefix(rest, "### "):
+				flush()
+				st.Bold, heading = true, true
+				n += strings.Index(rest, " ")
+				continue
+			}
+		}
+
+		switch {
+		case md[n] == '\\' && n+1 < len(md) && unicode.IsPunct(rune(md[n+1])) ||
+			md[n] == '\\' && n+1 < len(md) && unicode.IsSymbol(rune(md[n+1])):
+			n++
+			text.WriteByte(md[n])
+		case strings.HasPrefix(rest, "```"):
+			end := strings.Index(rest[3:], "```")
+			if end < 0 {
+				text.WriteString(rest)
+				n = len(md)
+				continue
+			}
+
+			code := rest[3 : 3+end]
+			// The first line may name the code's language
+			if nl := strings.Index(code, "\n"); nl >= 0 && !strings.ContainsAny(code[:nl], " \t") {
+				code = code[nl+1:]
+			}
+
+			flush()
+			st.Monospace = true
+			text.WriteString(strings.TrimSuffix(code, "\n"))
+			flush()
+			st.Monospace = false
+			n += 3 + end + 2
+		case md[n] == '`':
+			ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+			delim := rest[:ticks]
+			end := strings.Index(rest[ticks:], delim)
+			if end < 0 {
+				text.WriteString(delim)
+				n += ticks - 1
+				continue
+			}
+
+			code := rest[ticks : ticks+end]
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+
+			flush()
+			st.Monospace = true
+			text.WriteString(code)
+			flush()
+			st.Monospace = false
+			n += 2*ticks + end - 1
+		case md[n] == '[' && markdownLink.MatchString(rest):
+			m := markdownLink.FindStringSubmatch(rest)
+			text.WriteString(m[1])
+			if m[2] != m[1] {
+				text.WriteString(" (" + m[2] + ")")
+			}
+			n += len(m[0]) - 1
+		case md[n] == '<' && markdownBare.MatchString(rest):
+			// Links in angle brackets are not embedded
+			m := markdownBare.FindStringSubmatch(rest)
+			text.WriteString(m[1])
+			n += len(m[0]) - 1
+		case markdownToggle(rest, "**", st.Bold, opens(n, "**")):
+			flush()
+			st.Bold = !st.Bold
+			n++
+		case markdownToggle(rest, "__", st.Underline, opens(n, "__")):
+			flush()
+			st.Underline = !st.Underline
+			n++
+		case markdownToggle(rest, "~~", st.Strike, opens(n, "~~")):
+			flush()
+			st.Strike = !st.Strike
+			n++
+		case strings.HasPrefix(rest, "||") && (spoiler || opens(n, "||")):
+			// Spoilers have no formatting of their own
+			spoiler = !spoiler
+			n++
+		case md[n] == '*' || md[n] == '_':
+			delim := md[n : n+1]
+			// _ only delimits at the edges of words, so that snake_case is
+			// left alone
+			word := func(i int) bool {
+				return i >= 0 && i < len(md) && (unicode.IsLetter(rune(md[i])) || unicode.IsDigit(rune(md[i])))
+			}
+
+			switch {
+			case st.Italic && italic == delim && (delim == "*" || !word(n+1)):
+				flush()
+				st.Italic, italic = false, ""
+			case !st.Italic && opens(n, delim) && (delim == "*" || !word(n-1)):
+				flush()
+				st.Italic, italic = true, delim
+			default:
+				text.WriteByte(md[n])
+			}
+		default:
+			text.WriteByte(md[n])
+		}
+	}
+	flush()
+
+	return Format(spans)
+}
+
+// markdownToggle reports whether the delimiter at the start of rest turns a
+// style on or off
+func markdownToggle(rest, delim string, on, opens bool) bool {
+	return strings.HasPrefix(rest, delim) && (on || opens)
+}
@@ -0,0 +1,202 @@
+package format
+
+// mrkdwn
+//
+// Slack formats messages with mrkdwn: *bold*, _italic_, ~strikethrough~ and
+// `code`. Only &, < and > are escaped, as entities; mrkdwn has no other
+// escapes. Links are <address|text>, and are kept as their text, followed by
+// their address. Mentions (<@U123>, <#C123|name>, <!here>) are kept as they
+// are, for the Slack adapter to name. Underlines and colors cannot be written
+// in mrkdwn, and are dropped.
+//
+// See also: https://api.slack.com/reference/surfaces/formatting
+
+import (
+	"strings"
+	"unicode"
+)
+
+// mrkdwnMarkers are the mrkdwn delimiters for each style, in the order they
+// are opened
+var mrkdwnMarkers = []struct {
+	marker string
+	is     func(Style) bool
+}{
+	{"*", func(st Style) bool { return st.Bold }},
+	{"_", func(st Style) bool { return st.Italic }},
+	{"~", func(st Style) bool { return st.Strike }},
+}
+
+var (
+	mrkdwnEscapes   = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	mrkdwnUnescapes = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+)
+
+// Mrkdwn renders formatted text as Slack mrkdwn
+func Mrkdwn(s string) string {
+	var b strings.Builder
+	var open []string
+
+	// Whitespace at the edges of a span goes outside its delimiters, as
+	// Slack does not see delimiters next to whitespace
+	pending := ""
+
+	for _, sp := range Parse(s) {
+		text := sp.Text
+		core := strings.TrimSpace(text)
+		if core == "" {
+			pending += text
+			continue
+		}
+		lead := text[:strings.Index(text, core)]
+		trail := text[len(lead)+len(core):]
+
+		var want []string
+		for _, m := range mrkdwnMarkers {
+			if m.is(sp.Style) {
+				want = append(want, m.marker)
+			}
+		}
+
+		keep := 0
+		for keep < len(open) && contains(want, open[keep]) {
+			keep++
+		}
+		for n := len(open) - 1; n >= keep; n-- {
+			b.WriteString(open[n])
+		}
+		open = open[:keep]
+
+		b.WriteString(pending + lead)
+		pending = trail
+
+		for _, m := range want {
+			if !contains(open, m) {
+				b.WriteString(m)
+				open = append(open, m)
+			}
+		}
+
+		core = mrkdwnEscapes.Replace(core)
+		if sp.Monospace {
+			if strings.Contains(core, "\n") {
+				core = "```" + core + "```"
+			} else {
+				core = "`" + core + "`"
+			}
+		}
+		b.WriteString(core)
+	}
+
+	for n := len(open) - 1; n >= 0; n-- {
+		b.WriteString(open[n])
+	}
+	b.WriteString(pending)
+
+	return b.String()
+}
+
+// ParseMrkdwn parses Slack mrkdwn into formatted text
+func ParseMrkdwn(md string) string {
+	var spans []Span
+	var text strings.Builder
+	st := Plain
+
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, Span{Style: st, Text: mrkdwnUnescapes.Replace(text.String())})
+			text.Reset()
+		}
+	}
+
+	// Delimiters are only seen at the edges of words
+	word := func(i int) bool {
+		return i >= 0 && i < len(md) && (unicode.IsLetter(rune(md[i])) || unicode.IsDigit(rune(md[i])))
+	}
+	opens := func(n int, delim byte) bool {
+		if word(n-1) || n+1 >= len(md) || unicode.IsSpace(rune(md[n+1])) {
+			return false
+		}
+
+		end := strings.IndexByte(md[n+1:], delim)
+		return end > 0 && !strings.Contains(md[n+1:n+1+end], "\n")
+	}
+
+	for n := 0; n < len(md); n++ {
+		rest := md[n:]
+
+		switch {
+		case strings.HasPrefix(rest, "```"):
+			end := strings.Index(rest[3:], "```")
+			if end < 0 {
+				text.WriteString(rest)
+				n = len(md)
+				continue
+			}
+
+			flush()
+			st.Monospace = true
+			text.WriteString(rest[3 : 3+end])
+			flush()
+			st.Monospace = false
+			n += 3 + end + 2
+		case md[n] == '`':
+			end := strings.IndexByte(rest[1:], '`')
+			if end < 0 {
+				text.WriteByte('`')
+				continue
+			}
+
+			flush()
+			st.Monospace = true
+			text.WriteString(rest[1 : 1+end])
+			flush()
+			st.Monospace = false
+			n += end + 1
+		case md[n] == '<':
+			end := strings.IndexByte(rest, '>')
+			if end < 0 {
+				text.WriteByte('<')
+				continue
+			}
+
+			ref := rest[1:end]
+			switch {
+			case ref == "":
+				text.WriteString("<>")
+			case ref[0] == '@' || ref[0] == '#' || ref[0] == '!':
+				text.WriteString(rest[:end+1])
+			default:
+				link, label := ref, ""
+				if bar := strings.IndexByte(ref, '|'); bar >= 0 {
+					link, label = ref[:bar], ref[bar+1:]
+				}
+				link = strings.TrimPrefix(link, "mailto:")
+
+				if label == "" || label == link {
+					text.WriteString(link)
+				} else {
+					text.WriteString(label + " (" + link + ")")
+				}
+			}
+			n += end
+		case md[n] == '*' || md[n] == '_' || md[n] == '~':
+			on := map[byte]*bool{'*': &st.Bold, '_': &st.Italic, '~': &st.Strike}[md[n]]
+			switch {
+			case *on && !word(n+1):
+				flush()
+				*on = false
+			case !*on && opens(n, md[n]):
+				flush()
+				*on = true
+			default:
+				text.WriteByte(md[n])
+			}
+		default:
+			text.WriteByte(md[n])
+		}
+	}
+	flush()
+
+	return Format(spans)
+}
@@ -0,0 +1,79 @@
+package format_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+func red(bg format.Color) format.Style {
+	st := format.Plain
+	st.Color, st.Background = format.Red, bg
+	return st
+}
+
+func bold() format.Style {
+	st := format.Plain
+	st.Bold = true
+	return st
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, spans := range [][]format.Span{
+		{{Style: bold(), Text: "bold"}, {Style: format.Plain, Text: " plain"}},
+		{{Style: red(format.NoColor), Text: "red"}, {Style: format.Plain, Text: "5 apples"}},
+		{{Style: red(format.NoColor), Text: "red"}, {Style: format.Plain, Text: ",12 things"}},
+		{{Style: format.Plain, Text: "a"}, {Style: red(format.NoColor), Text: ",5"}},
+		{{Style: red(format.Blue), Text: "on blue"}, {Style: format.Plain, Text: "99"}},
+		{{Style: red(format.Blue), Text: "on blue"}, {Style: red(format.NoColor), Text: "42"}},
+	} {
+		s := format.Format(spans)
+		if p := format.Parse(s); !reflect.DeepEqual(p, spans) {
+			t.Errorf("Expected %q to parse as %+v, but got %+v", s, spans, p)
+		}
+	}
+}
+
+func TestColored(t *testing.T) {
+	s := format.Colored("red", format.Red) + "5 apples"
+	expected := []format.Span{
+		{Style: red(format.NoColor), Text: "red"},
+		{Style: format.Plain, Text: "5 apples"},
+	}
+	if p := format.Parse(s); !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %q to parse as %+v, but got %+v", s, expected, p)
+	}
+
+	s = format.Colored(",5", format.Red)
+	expected = []format.Span{{Style: red(format.NoColor), Text: ",5"}}
+	if p := format.Parse(s); !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %q to parse as %+v, but got %+v", s, expected, p)
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	// A background at the very end of the text
+	p := format.Parse("\x04ff0000,0000fc")
+	if len(p) != 0 {
+		t.Fatalf("Expected no spans, but got %+v", p)
+	}
+
+	p = format.Parse("\x04ff0000,0000fcblue")
+	if len(p) != 1 || p[0].Background != format.LightBlue || p[0].Text != "blue" {
+		t.Fatalf("Expected blue text on light blue, but got %+v", p)
+	}
+}
+
+func TestHTMLRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"\x02bold\x02 and \x1ditalic\x1d",
+		"\x1funderline\x1f \x1estrike\x1e \x11code\x11",
+		"\x0304red\x0399,99 and plain",
+		"\x0304,12red on blue\x0f",
+	} {
+		if r := format.ParseHTML(format.HTML(s)); format.Format(format.Parse(r)) != format.Format(format.Parse(s)) {
+			t.Errorf("Expected %q to round-trip through HTML, but got %q", s, r)
+		}
+	}
+}
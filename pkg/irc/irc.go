@@ -9,13 +9,12 @@
 package irc
 
 import (
-	"fmt"
-	"net"
+	"sync"
 	"time"
 
 	"github.com/enmand/quarid-go/pkg/adapter"
-	"github.com/enmand/quarid-go/pkg/logger"
-	"github.com/renstrom/shortuuid"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/database"
 )
 
 // TIMEOUT is the connection timeout to the IRC server
@@ -23,7 +22,8 @@ const TIMEOUT = 1 * time.Minute
 
 // IRC is the IRC client interface
 type IRC interface {
-	// Connect to an IRC server. Use the form address:port
+	// Connect to an IRC server. Use the form address:port, or a URL such as
+	// ircs://address:port or wss://address/path
 	Connect(server string) error
 
 	// Disconnect from an IRC server
@@ -59,90 +59,164 @@ type Client struct {
 	// Should this client verify the server's SSL certs
 	TLSVerify bool
 
+	// The dialect of IRC the server speaks
+	Dialect Dialect
+
+	// The IRCv3 capabilities to request, if the server offers them
+	Caps []string
+
+	// The server password, if the server needs one
+	Password string
+
+	// Nicks to try, in order, if our nick is unavailable when we register
+	AltNicks []string
+
+	// The account to authenticate as with SASL, if any
+	SASLUser     string
+	SASLPassword string
+
+	// Store keeps state between restarts, such as timed bans. If it is nil,
+	// that state is only kept in memory
+	Store database.Store
+
+	// Middleware for events read from the server, before they are handled
+	// (observers, which track the client's state, see every event), and for
+	// every event written to it (except with WriteDirect)
+	Middleware adapter.Chain
+
+	// Tap, if set, is called with every event as it is read from the server
+	// (before batches are put together, or middleware sees it), and as it is
+	// written to it
+	Tap func(ev *adapter.Event, sent bool)
+
+	// The clock timed bans run on, and that is kept busy while events are
+	// handled. If nil, it is the Real clock
+	Clock clock.Clock
+
 	// handlers for filtered events
 	handlers []*adapter.Handler
 
+	// observers for every event read from, or written to the server
+	observers []ObserverFunc
+
+	// The channels the client is in
+	state *State
+
+	// The nicks being watched, and whether they are online
+	presence *Presence
+
+	// What the server has told us about users' accounts, by lowercased nick
+	identities map[string]*Identity
+
+	// Timed bans, waiting to be lifted
+	bans map[string]*timedBan
+
+	// State for the Twitch dialect
+	twitch *twitch
+
+	// The RPL_ISUPPORT tokens the server sent
+	isupport map[string]string
+
+	// IRCv3 capabilities the server offers, and that have been enabled
+	available map[string]string
+	enabled   map[string]bool
+
+	// Registration with the server: the nick we want, how many others we
+	// have tried, and where to send the result
+	registration RegistrationState
+	wantNick     string
+	nicks        int
+	regDone      chan error
+	capsListed   chan struct{}
+
+	// Open batches, and anything waiting for a response from the server
+	batches map[string]*adapter.Event
+	waiters []*waiter
+	label   int
+
+	mu sync.Mutex
+
 	// Events broadcasted from the server
-	events chan *adapter.Event
+	events chan queued
+
+	// The error that stopped reading from the server, and a channel closed
+	// once reading has stopped
+	readErr chan error
+	reading chan struct{}
+
+	// The connection this client has to the server, the address it was made
+	// to, and whether it uses TLS
+	transport Transport
+	addr      string
+	secure    bool
 
-	// The network connection this client has to the server
-	conn net.Conn
+	// The port to upgrade to TLS on, if the server's STS policy asked us to
+	upgrade int
 }
 
 // NewClient returns a new IRC client
 func NewClient(nick, ident string, tlsverify, tls bool) *Client {
 	c := &Client{
-		Nick:      nick,
-		Ident:     ident,
-		TLSVerify: tlsverify,
-		TLS:       tls,
+		Nick:       nick,
+		Dialect:    DIALECT_RFC,
+		Ident:      ident,
+		TLSVerify:  tlsverify,
+		TLS:        tls,
+		Caps:       DefaultCaps,
+		state:      newState(),
+		isupport:   make(map[string]string),
+		available:  make(map[string]string),
+		enabled:    make(map[string]bool),
+		batches:    make(map[string]*adapter.Event),
+		events:     make(chan queued),
+		bans:       make(map[string]*timedBan),
+		twitch:     newTwitch(),
+		identities: make(map[string]*Identity),
 	}
 
-	c.Handle(
-		[]adapter.Filter{CommandFilter{Command: IRC_PING}},
-		func(ev *adapter.Event, c adapter.Responder) {
-			ev.Command = IRC_PONG
-			c.Write(ev)
-		},
-	)
+	c.Observe(c.track)
+	c.Observe(c.registering)
+	c.Observe(c.negotiate)
+	c.Observe(c.parseISupport)
+	c.Observe(c.trackIdentities)
 
-	c.Handle(
-		[]adapter.Filter{CommandFilter{Command: CONNECTED}},
-		func(ev *adapter.Event, r adapter.Responder) {
-			c.authenticate(r)
-		},
-	)
+	c.presence = newPresence(c)
+	c.Observe(c.presence.observe)
+	c.Observe(c.timedBans)
+	c.Observe(c.observeTwitch)
 
 	c.Handle(
-		[]adapter.Filter{CommandFilter{Command: IRC_ERR_NICKNAMEINUSE}},
-		func(ev *adapter.Event, r adapter.Responder) {
-			c.Nick = fixNick(c.Nick, r)
-			writeNick(c.Nick, r)
+		[]adapter.Filter{CommandFilter{Command: IRC_PING}},
+		func(ev *adapter.Event, c adapter.Responder) {
+			c.Write(&adapter.Event{
+				Command:    IRC_PONG,
+				Parameters: ev.Parameters,
+			})
 		},
 	)
 
 	return c
 }
 
-func (i *Client) authenticate(c adapter.Responder) {
-	logger.Log.Infof("Authenticating for nick %s!%s", i.Nick, i.Ident)
-
-	writeNick(i.Nick, c)
-
-	// RFC 2812 USER command
-	c.Write(&adapter.Event{
-		Command: IRC_USER,
-		Parameters: []string{
-			i.Ident,
-			"0",
-			"*",
-			i.Nick,
-		},
-	})
+// State returns the channel state tracked for this client
+func (i *Client) State() *State {
+	return i.state
 }
 
-func fixNick(nick string, c adapter.Responder) string {
-	uniq := shortuuid.UUID()
-
-	newNick := fmt.Sprintf("%s_%s", nick, uniq)
-	logger.Log.Debugf("Fixing nick to %s", nick)
+// CurrentNick returns the nick we have on the server, or are registering
+// with. Nick changes while the client is connected, so it should only be read
+// through this once the client is connected
+func (i *Client) CurrentNick() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-	return newNick[:9] // minimum max length in 9
+	return i.Nick
 }
 
-func writeNick(nick string, c adapter.Responder) {
-	c.Write(&adapter.Event{
-		Command: IRC_NICK,
-		Parameters: []string{
-			nick,
-		},
-	})
-
-	timeout := make(chan bool)
-	go func() {
-		// Wait 400ms for an error
-		time.Sleep(400 * time.Millisecond)
-		timeout <- true
-	}()
-	<-timeout
+// setNick changes the nick we have on the server
+func (i *Client) setNick(nick string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.Nick = nick
 }
@@ -0,0 +1,206 @@
+package irc
+
+// Accounts
+//
+// The services account each user is logged in to is tracked as the server
+// tells us, from the account tag on their messages (account-tag), their JOINs
+// (extended-join), and ACCOUNT changes (account-notify). Users we know nothing
+// about can be looked up with WHOIS, which is cached for IDENTITY_TTL, along
+// with their TLS certificate fingerprint, if the server shows it.
+//
+// See also: https://ircv3.net/specs/extensions/account-tag
+// See also: https://ircv3.net/specs/extensions/extended-join
+// See also: https://ircv3.net/specs/extensions/account-notify
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// IDENTITY_TTL is how long an identity is trusted, after the server last told
+// us about it
+const IDENTITY_TTL = 5 * time.Minute
+
+// ErrUnknownNick is returned when a nick could not be looked up, because no
+// one is using it
+var ErrUnknownNick = errors.New("No one is using that nick")
+
+// Identity is who the user with a nick is, as far as the server has told us
+type Identity struct {
+	Nick string
+
+	// The user's nick!user@host, if we have seen it
+	Mask string
+
+	// The services account the user is logged in to, or "" if they are not
+	// logged in
+	Account string
+
+	// The fingerprint of the user's TLS client certificate, if the server
+	// showed it in a WHOIS reply
+	CertFP string
+
+	// When the server last told us about the user, and whether it was in a
+	// WHOIS reply
+	at    time.Time
+	whois bool
+}
+
+// Identify returns the identity of the user with nick, from a WHOIS (which is
+// cached, for IDENTITY_TTL). It blocks until the server replies
+func (i *Client) Identify(nick string) (*Identity, error) {
+	if id := i.identity(nick); id != nil && id.whois {
+		return id, nil
+	}
+
+	start := time.Now()
+	ch, cancel := i.await(func(r *adapter.Event) bool {
+		return r.Command == IRC_RPL_ENDOFWHOIS &&
+			len(r.Parameters) > 1 &&
+			strings.EqualFold(r.Parameters[1], nick)
+	})
+
+	if err := i.Write(&adapter.Event{
+		Command:    IRC_WHOIS,
+		Parameters: []string{nick},
+	}); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if _, err := i.response(ch, cancel); err != nil {
+		return nil, err
+	}
+
+	// The rest of the WHOIS reply was observed before its end
+	id := i.identity(nick)
+	if id == nil || !id.whois || id.at.Before(start) {
+		return nil, ErrUnknownNick
+	}
+
+	return id, nil
+}
+
+// CachedIdentity returns the identity of the user with nick, if the server has
+// told us about it within IDENTITY_TTL, without asking it
+func (i *Client) CachedIdentity(nick string) (*Identity, bool) {
+	id := i.identity(nick)
+	return id, id != nil
+}
+
+// identity returns a copy of the identity of nick, if it is fresh
+func (i *Client) identity(nick string) *Identity {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	id, ok := i.identities[strings.ToLower(nick)]
+	if !ok || time.Since(id.at) > IDENTITY_TTL {
+		return nil
+	}
+
+	c := *id
+	return &c
+}
+
+// trackIdentities observes what the server tells us about users' accounts
+func (i *Client) trackIdentities(ev *adapter.Event, sent bool) {
+	if sent || ev.Historical {
+		return
+	}
+
+	hm := ParseHostmask(ev.Prefix)
+	param := func(n int) string {
+		if n < len(ev.Parameters) {
+			return ev.Parameters[n]
+		}
+		return ""
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	switch ev.Command {
+	case DISCONNECTED:
+		i.identities = make(map[string]*Identity)
+		return
+	case IRC_QUIT:
+		delete(i.identities, strings.ToLower(hm.Nick))
+		return
+	case IRC_NICK:
+		key := strings.ToLower(hm.Nick)
+		if id, ok := i.identities[key]; ok && param(0) != "" {
+			delete(i.identities, key)
+			id.Nick = param(0)
+			id.Mask = Hostmask{Nick: param(0), User: hm.User, Host: hm.Host}.String()
+			i.identities[strings.ToLower(id.Nick)] = id
+		}
+		return
+	case IRC_RPL_WHOISUSER:
+		// A WHOIS reply starts over what we know about the user
+		if len(ev.Parameters) > 3 {
+			nick := param(1)
+			i.identities[strings.ToLower(nick)] = &Identity{
+				Nick:  nick,
+				Mask:  Hostmask{Nick: nick, User: param(2), Host: param(3)}.String(),
+				at:    time.Now(),
+				whois: true,
+			}
+		}
+		return
+	case IRC_RPL_WHOISACCOUNT:
+		if id, ok := i.identities[strings.ToLower(param(1))]; ok {
+			id.Account = param(2)
+		}
+		return
+	case IRC_RPL_WHOISCERTFP:
+		// The fingerprint is the last word of the reply
+		fp := strings.Fields(param(len(ev.Parameters) - 1))
+		if id, ok := i.identities[strings.ToLower(param(1))]; ok && len(fp) > 0 {
+			id.CertFP = fp[len(fp)-1]
+		}
+		return
+	}
+
+	if hm.User == "" || hm.Host == "" {
+		return
+	}
+
+	account, known := ev.Tags["account"]
+	switch ev.Command {
+	case IRC_ACCOUNT:
+		account, known = param(0), true
+	case IRC_JOIN:
+		if len(ev.Parameters) > 2 && i.enabled[CAP_EXTENDED_JOIN] {
+			account, known = param(1), true
+		}
+	case IRC_PRIVMSG, IRC_NOTICE, IRC_TAGMSG:
+		// Messages from users who are not logged in have no account tag
+		known = known || i.enabled[CAP_ACCOUNT_TAG]
+	}
+	if account == "*" {
+		account = ""
+	}
+
+	key := strings.ToLower(hm.Nick)
+	id, ok := i.identities[key]
+
+	// A different user@host is likely someone else, using the nick since
+	same := ok && strings.EqualFold(id.Mask, ev.Prefix)
+	if !known {
+		if ok && !same {
+			delete(i.identities, key)
+		}
+		return
+	}
+
+	if !same || id.Account != account {
+		// What a WHOIS told us about the user may no longer be true
+		id = &Identity{Nick: hm.Nick, Mask: ev.Prefix}
+		i.identities[key] = id
+	}
+	id.Account = account
+	id.at = time.Now()
+}
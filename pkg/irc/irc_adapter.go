@@ -0,0 +1,394 @@
+package irc
+
+// Adapter
+//
+// The IRC adapter translates IRC events into the adapter package's neutral
+// Updates (messages, reactions, membership and topic changes), and Updates back into
+// IRC commands, so that anything written against the neutral model, such as
+// plugins, runs on IRC as on any other network.
+//
+// IRC has no way to edit messages. Replies and reactions use the
+// +draft/reply and +draft/react client tags, where the server allows them.
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// ADAPTER_NAME is the name of the IRC adapter
+const ADAPTER_NAME = "irc"
+
+// ctcpAction is the CTCP command for actions ("/me")
+const ctcpAction = "ACTION"
+
+// Adapter adapts an IRC Client to the adapter.Adapter interface
+type Adapter struct {
+	Client *Client
+
+	// The server to connect to
+	server string
+
+	loop sync.Once
+}
+
+// NewAdapter returns an adapter for c, which connects to server
+func NewAdapter(c *Client, server string) *Adapter {
+	return &Adapter{Client: c, server: server}
+}
+
+// Name of the adapter
+func (a *Adapter) Name() string {
+	return ADAPTER_NAME
+}
+
+// Connect to the IRC server
+func (a *Adapter) Connect() error {
+	a.loop.Do(func() {
+		go a.Client.Loop()
+	})
+
+	return a.Client.Connect(a.server)
+}
+
+// Disconnect from the IRC server
+func (a *Adapter) Disconnect() error {
+	return a.Client.Disconnect()
+}
+
+// Wait blocks while reading from the server
+func (a *Adapter) Wait() error {
+	return a.Client.Read()
+}
+
+// Receive calls f with each Update from the server. Our own messages, echoed
+// back by the server, are not Updates
+func (a *Adapter) Receive(f adapter.UpdateFunc) {
+	a.Client.Handle(
+		[]adapter.Filter{CommandFilter{Command: "*"}},
+		func(ev *adapter.Event, r adapter.Responder) {
+			if a.Client.isEcho(ev) {
+				return
+			}
+
+			if u := a.Update(ev); u != nil {
+				f(u, a)
+			}
+		},
+	)
+}
+
+// Update translates ev into a neutral Update, or returns nil if it is not one
+func (a *Adapter) Update(ev *adapter.Event) adapter.Update {
+	user := a.user(ev.Prefix, ev)
+	t := ev.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	param := func(n int) string {
+		if len(ev.Parameters) > n {
+			return ev.Parameters[n]
+		}
+		return ""
+	}
+
+	switch ev.Command {
+	case IRC_PRIVMSG, IRC_NOTICE:
+		if len(ev.Parameters) < 2 {
+			return nil
+		}
+
+		m := &adapter.Message{
+			Adapter:    a.Name(),
+			ID:         MsgID(ev),
+			Room:       a.room(ev),
+			User:       user,
+			Text:       ev.Parameters[1],
+			ReplyTo:    ev.Tags[TAG_REPLY],
+			Time:       t,
+			Historical: ev.Historical,
+			Raw:        ev,
+		}
+		if id, ok := ev.Tags["reply-parent-msg-id"]; ok {
+			m.ReplyTo = id
+		}
+
+		if ev.Command == IRC_NOTICE {
+			m.Kind = adapter.Notice
+		}
+
+		if cmd, text, ok := parseCTCP(m.Text); ok {
+			// Other CTCP messages are requests for the client, not messages
+			if cmd != ctcpAction || ev.Command != IRC_PRIVMSG {
+				return nil
+			}
+			m.Kind, m.Text = adapter.Action, text
+		}
+
+		return m
+	case IRC_TAGMSG:
+		if len(ev.Parameters) < 1 {
+			return nil
+		}
+
+		reaction, ok := ev.Tags[TAG_REACT]
+		if !ok || ev.Tags[TAG_REPLY] == "" {
+			return nil
+		}
+
+		return &adapter.Reaction{
+			Adapter:   a.Name(),
+			Room:      a.room(ev),
+			MessageID: ev.Tags[TAG_REPLY],
+			User:      user,
+			Reaction:  reaction,
+			Time:      t,
+		}
+	case IRC_JOIN, IRC_PART, IRC_QUIT, IRC_NICK:
+		m := &adapter.Membership{
+			Adapter: a.Name(),
+			User:    user,
+			Time:    t,
+		}
+
+		switch ev.Command {
+		case IRC_JOIN:
+			m.Kind = adapter.Join
+			m.Room = a.channel(param(0))
+		case IRC_PART:
+			m.Kind = adapter.Leave
+			m.Room = a.channel(param(0))
+			m.Reason = param(1)
+		case IRC_QUIT:
+			m.Kind = adapter.Quit
+			m.Reason = param(0)
+		case IRC_NICK:
+			m.Kind = adapter.Rename
+			m.NewName = param(0)
+		}
+
+		return m
+	case IRC_KICK, IRC_INVITE:
+		m := &adapter.Membership{
+			Adapter: a.Name(),
+			Actor:   &user,
+			Time:    t,
+		}
+
+		if ev.Command == IRC_KICK {
+			m.Kind = adapter.Kick
+			m.Room = a.channel(param(0))
+			m.User = a.user(param(1), nil)
+			m.Reason = param(2)
+		} else {
+			m.Kind = adapter.Invite
+			m.User = a.user(param(0), nil)
+			m.Room = a.channel(param(1))
+		}
+
+		return m
+	case IRC_TOPIC:
+		if len(ev.Parameters) < 2 {
+			return nil
+		}
+
+		return &adapter.Topic{
+			Adapter: a.Name(),
+			Room:    a.channel(param(0)),
+			User:    user,
+			Topic:   param(1),
+			Time:    t,
+		}
+	}
+
+	return nil
+}
+
+// user describes the user with the prefix (or nick) given, from the tags of
+// ev, if there is one
+func (a *Adapter) user(prefix string, ev *adapter.Event) adapter.User {
+	hm := ParseHostmask(prefix)
+	u := adapter.User{ID: hm.Nick, Name: hm.Nick}
+	if strings.Contains(prefix, "@") {
+		u.Mask = prefix
+	}
+
+	if ev != nil {
+		u.Account = ev.Tags["account"]
+		if n := ev.Tags["display-name"]; n != "" {
+			u.Name = n
+		}
+	}
+	if id, ok := a.Client.CachedIdentity(hm.Nick); ok && u.Account == "" {
+		u.Account = id.Account
+	}
+
+	return u
+}
+
+// room is the room a message was sent to: the channel, or a private
+// conversation with its sender
+func (a *Adapter) room(ev *adapter.Event) adapter.Room {
+	target := ev.Parameters[0]
+	if a.Client.IsChannel(target) {
+		return a.channel(target)
+	}
+
+	nick := ParseHostmask(ev.Prefix).Nick
+	return adapter.Room{ID: nick, Name: nick, Private: true}
+}
+
+func (a *Adapter) channel(name string) adapter.Room {
+	return adapter.Room{ID: name, Name: name}
+}
+
+// Send an Update to the server
+func (a *Adapter) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		return a.send(u.Room, u.Kind, u.Text, u.ReplyTo)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+
+		if u.Kind == adapter.Text && u.To.Raw != nil && !strings.Contains(u.Text, "\n") {
+			d, err := a.Client.Reply(u.To.Raw, u.Text)
+			if err != nil {
+				return nil, err
+			}
+			return a.sent(u.To.Room, u.Kind, d), nil
+		}
+
+		return a.send(u.To.Room, u.Kind, u.Text, u.To.ID)
+	case *adapter.Reaction:
+		if u.Removed {
+			return nil, adapter.ErrNotSupported
+		}
+		return nil, a.Client.react(u.Room.ID, u.MessageID, u.Reaction)
+	case *adapter.Membership:
+		return nil, a.membership(u)
+	case *adapter.Topic:
+		return nil, a.Client.Write(&adapter.Event{
+			Command:    IRC_TOPIC,
+			Parameters: []string{u.Room.ID, u.Topic},
+		})
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// send text to room, a line at a time, returning the last line as it was
+// delivered
+func (a *Adapter) send(room adapter.Room, kind adapter.Kind, text, replyTo string) (*adapter.Message, error) {
+	cmd := IRC_PRIVMSG
+	if kind == adapter.Notice {
+		cmd = IRC_NOTICE
+	}
+
+	var m *adapter.Message
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l == "" {
+			continue
+		}
+		if kind == adapter.Action {
+			l = "\x01" + ctcpAction + " " + l + "\x01"
+		}
+
+		ev := &adapter.Event{
+			Command:    cmd,
+			Parameters: []string{room.ID, l},
+		}
+		if replyTo != "" && a.Client.ClientTag(TAG_REPLY) {
+			ev.Tags = map[string]string{TAG_REPLY: replyTo}
+		}
+
+		d, err := a.Client.Deliver(ev)
+		if err != nil {
+			return m, err
+		}
+		m = a.sent(room, kind, d)
+	}
+
+	return m, nil
+}
+
+// sent is the message we sent, as ev was delivered
+func (a *Adapter) sent(room adapter.Room, kind adapter.Kind, ev *adapter.Event) *adapter.Message {
+	m := &adapter.Message{
+		Adapter: a.Name(),
+		ID:      MsgID(ev),
+		Room:    room,
+		User:    adapter.User{ID: a.Client.CurrentNick(), Name: a.Client.CurrentNick()},
+		Kind:    kind,
+		Time:    ev.Timestamp,
+		Raw:     ev,
+	}
+	if len(ev.Parameters) > 1 {
+		m.Text = ev.Parameters[1]
+		if _, text, ok := parseCTCP(m.Text); ok {
+			m.Text = text
+		}
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+
+	return m
+}
+
+// membership changes our membership of a room, or someone else's
+func (a *Adapter) membership(m *adapter.Membership) error {
+	switch m.Kind {
+	case adapter.Join:
+		return a.Client.Write(&adapter.Event{
+			Command:    IRC_JOIN,
+			Parameters: []string{m.Room.ID},
+		})
+	case adapter.Leave:
+		params := []string{m.Room.ID}
+		if m.Reason != "" {
+			params = append(params, m.Reason)
+		}
+		return a.Client.Write(&adapter.Event{
+			Command:    IRC_PART,
+			Parameters: params,
+		})
+	case adapter.Kick:
+		return a.Client.Kick(m.Room.ID, m.User.ID, m.Reason)
+	case adapter.Invite:
+		return a.Client.Invite(m.User.ID, m.Room.ID)
+	case adapter.Rename:
+		return a.Client.Write(&adapter.Event{
+			Command:    IRC_NICK,
+			Parameters: []string{m.NewName},
+		})
+	case adapter.Quit:
+		return a.Client.Write(&adapter.Event{
+			Command:    IRC_QUIT,
+			Parameters: []string{m.Reason},
+		})
+	}
+
+	return adapter.ErrNotSupported
+}
+
+// parseCTCP parses a CTCP message ("\x01COMMAND text\x01") into its command
+// and text
+func parseCTCP(text string) (string, string, bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+
+	text = strings.TrimSuffix(text[1:], "\x01")
+	ts := strings.SplitN(text, " ", 2)
+	if len(ts) < 2 {
+		return ts[0], "", true
+	}
+
+	return ts[0], ts[1], true
+}
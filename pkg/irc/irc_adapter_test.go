@@ -0,0 +1,37 @@
+package irc_test
+
+import (
+	"testing"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+func TestUpdateReaction(t *testing.T) {
+	a := irc.NewAdapter(irc.NewClient("quarid", "quarid", false, false), "irc.example.com")
+	tags := map[string]string{irc.TAG_REACT: "👍", irc.TAG_REPLY: "abc"}
+
+	u := a.Update(&adapter.Event{
+		Tags:       tags,
+		Prefix:     "alice!alice@example.com",
+		Command:    irc.IRC_TAGMSG,
+		Parameters: []string{"#test"},
+	})
+	r, ok := u.(*adapter.Reaction)
+	if !ok {
+		t.Fatalf("Expected a reaction, but got %#v", u)
+	}
+	if r.Room.ID != "#test" || r.Reaction != "👍" || r.MessageID != "abc" {
+		t.Fatalf("Expected 👍 to abc in #test, but got %#v", r)
+	}
+
+	// TAGMSG without a target is not an update
+	u = a.Update(&adapter.Event{
+		Tags:    tags,
+		Prefix:  "alice!alice@example.com",
+		Command: irc.IRC_TAGMSG,
+	})
+	if u != nil {
+		t.Fatalf("Expected no update without a target, but got %#v", u)
+	}
+}
@@ -0,0 +1,84 @@
+package irc
+
+// Batches
+//
+// IRCv3 batches group events that belong together, such as the QUITs of a
+// netsplit or the messages of a chathistory reply. Events in a batch are held
+// until the batch ends, and then handled as a single BATCH event: its
+// Parameters are the batch type and parameters, and its Batch holds the
+// events in the batch, in order.
+//
+// See also: https://ircv3.net/specs/extensions/batch
+
+import (
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// Batch types the client knows about
+const (
+	BATCH_CHATHISTORY      = "chathistory"
+	BATCH_LABELED_RESPONSE = "labeled-response"
+	BATCH_NETJOIN          = "netjoin"
+	BATCH_NETSPLIT         = "netsplit"
+)
+
+// batch collects events into open batches. It returns the event that is ready
+// to be handled, or nil if the event is held in a batch
+func (i *Client) batch(ev *adapter.Event) *adapter.Event {
+	if ev.Command == IRC_BATCH && len(ev.Parameters) > 0 {
+		ref := ev.Parameters[0]
+
+		switch {
+		case strings.HasPrefix(ref, "+"):
+			i.batches[ref[1:]] = &adapter.Event{
+				Tags:       ev.Tags,
+				Prefix:     ev.Prefix,
+				Command:    IRC_BATCH,
+				Parameters: ev.Parameters[1:],
+				Timestamp:  ev.Timestamp,
+			}
+
+			return nil
+		case strings.HasPrefix(ref, "-"):
+			b, ok := i.batches[ref[1:]]
+			if !ok {
+				return nil
+			}
+			delete(i.batches, ref[1:])
+
+			if len(b.Parameters) > 0 && b.Parameters[0] == BATCH_CHATHISTORY {
+				markHistorical(b)
+			}
+
+			// Batches may be nested in other batches
+			return i.batch(b)
+		}
+	}
+
+	if ref, ok := ev.Tags["batch"]; ok {
+		if b, ok := i.batches[ref]; ok {
+			b.Batch = append(b.Batch, ev)
+			return nil
+		}
+	}
+
+	return ev
+}
+
+// BatchType returns the type of a BATCH event, or "" if ev is not a batch
+func BatchType(ev *adapter.Event) string {
+	if ev.Command != IRC_BATCH || len(ev.Parameters) < 1 {
+		return ""
+	}
+
+	return ev.Parameters[0]
+}
+
+func markHistorical(ev *adapter.Event) {
+	ev.Historical = true
+	for _, b := range ev.Batch {
+		markHistorical(b)
+	}
+}
@@ -0,0 +1,174 @@
+package irc
+
+// Capabilities
+//
+// IRCv3 capability negotiation. The client asks for the capabilities it wants
+// with CAP LS, requests those the server offers, and ends negotiation once
+// the server has acknowledged them.
+//
+// See also: https://ircv3.net/specs/extensions/capability-negotiation
+
+import (
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// IRCv3 capabilities the client understands
+const (
+	CAP_ACCOUNT_NOTIFY   = "account-notify"
+	CAP_ACCOUNT_TAG      = "account-tag"
+	CAP_BATCH            = "batch"
+	CAP_CHATHISTORY      = "draft/chathistory"
+	CAP_ECHO_MESSAGE     = "echo-message"
+	CAP_EXTENDED_JOIN    = "extended-join"
+	CAP_LABELED_RESPONSE = "labeled-response"
+	CAP_MESSAGE_TAGS     = "message-tags"
+	CAP_SERVER_TIME      = "server-time"
+)
+
+// DefaultCaps are the capabilities requested by a new Client, if the server
+// offers them
+var DefaultCaps = []string{
+	CAP_ACCOUNT_NOTIFY,
+	CAP_ACCOUNT_TAG,
+	CAP_BATCH,
+	CAP_CHATHISTORY,
+	CAP_ECHO_MESSAGE,
+	CAP_EXTENDED_JOIN,
+	CAP_LABELED_RESPONSE,
+	CAP_MESSAGE_TAGS,
+	CAP_SERVER_TIME,
+}
+
+// HasCap reports whether the capability name has been enabled on the server
+func (i *Client) HasCap(name string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.enabled[name]
+}
+
+// Available returns the value the server advertised for the capability name,
+// and whether it advertised the capability at all
+func (i *Client) Available(name string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	v, ok := i.available[name]
+	return v, ok
+}
+
+// negotiate capabilities with the server, as CAP replies are read
+func (i *Client) negotiate(ev *adapter.Event, sent bool) {
+	if sent {
+		return
+	}
+
+	switch ev.Command {
+	case CONNECTED, DISCONNECTED:
+		i.resetCaps()
+		return
+	case IRC_CAP:
+	default:
+		return
+	}
+
+	if len(ev.Parameters) < 3 {
+		return
+	}
+
+	sub := strings.ToUpper(ev.Parameters[1])
+	more := len(ev.Parameters) > 3 && ev.Parameters[2] == "*"
+	list := ev.Parameters[len(ev.Parameters)-1]
+
+	switch sub {
+	case "LS", "NEW":
+		i.mu.Lock()
+		var req []string
+		for _, c := range strings.Fields(list) {
+			kv := strings.SplitN(c, "=", 2)
+			if len(kv) == 2 {
+				i.available[kv[0]] = kv[1]
+			} else {
+				i.available[kv[0]] = ""
+			}
+		}
+		if !more {
+			for _, c := range i.wantCaps() {
+				if _, ok := i.available[c]; ok && !i.enabled[c] {
+					req = append(req, c)
+				}
+			}
+		}
+		i.mu.Unlock()
+
+		if more {
+			return
+		}
+		if sub == "LS" {
+			if i.sts() {
+				// We are reconnecting with TLS
+				return
+			}
+			i.listed()
+		}
+		if len(req) == 0 {
+			i.endCaps()
+			return
+		}
+
+		i.Write(&adapter.Event{
+			Command:    IRC_CAP,
+			Parameters: []string{"REQ", strings.Join(req, " ")},
+		})
+	case "ACK":
+		i.mu.Lock()
+		for _, c := range strings.Fields(list) {
+			if strings.HasPrefix(c, "-") {
+				delete(i.enabled, c[1:])
+			} else {
+				i.enabled[c] = true
+			}
+		}
+		i.mu.Unlock()
+
+		// SASL ends negotiation itself, once we are authenticated
+		if !i.startSASL() {
+			i.endCaps()
+		}
+	case "NAK":
+		i.endCaps()
+	case "DEL":
+		i.mu.Lock()
+		for _, c := range strings.Fields(list) {
+			delete(i.available, c)
+			delete(i.enabled, c)
+		}
+		i.mu.Unlock()
+	}
+}
+
+// endCaps ends capability negotiation, if we are still registering
+func (i *Client) endCaps() {
+	switch i.Registration() {
+	case RegCaps, RegSASL:
+		i.setRegistration(RegNick)
+	case RegNick:
+	default:
+		return
+	}
+
+	i.Write(&adapter.Event{
+		Command:    IRC_CAP,
+		Parameters: []string{"END"},
+	})
+}
+
+func (i *Client) resetCaps() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.available = make(map[string]string)
+	i.enabled = make(map[string]bool)
+}
@@ -0,0 +1,109 @@
+package irc
+
+// Chat history
+//
+// The IRCv3 chathistory extension lets the client fetch messages it missed,
+// for example while it was disconnected.
+//
+// See also: https://ircv3.net/specs/extensions/chathistory
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// ErrNoChatHistory is returned when the server does not support chathistory
+var ErrNoChatHistory = errors.New("The server does not support chathistory")
+
+// DEFAULT_HISTORY_LIMIT is the number of messages fetched, if the server does
+// not advertise a limit
+const DEFAULT_HISTORY_LIMIT = 100
+
+// ChatHistory fetches the messages sent to target (a channel or nick) after
+// t, up to limit messages, oldest first. The events returned are marked as
+// Historical
+func (i *Client) ChatHistory(
+	target string,
+	t time.Time,
+	limit int,
+) ([]*adapter.Event, error) {
+	if !i.HasCap(CAP_CHATHISTORY) {
+		return nil, ErrNoChatHistory
+	}
+
+	if max := i.historyLimit(); limit <= 0 || (max > 0 && limit > max) {
+		limit = max
+	}
+
+	ev := &adapter.Event{
+		Command: IRC_CHATHISTORY,
+		Parameters: []string{
+			"AFTER",
+			target,
+			fmt.Sprintf("timestamp=%s", t.UTC().Format("2006-01-02T15:04:05.000Z")),
+			strconv.Itoa(limit),
+		},
+	}
+
+	var ch <-chan *adapter.Event
+	var cancel func()
+	var err error
+
+	if i.HasCap(CAP_LABELED_RESPONSE) {
+		ch, cancel, err = i.Label(ev)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ch, cancel = i.await(func(r *adapter.Event) bool {
+			if r.Command == IRC_FAIL {
+				return len(r.Parameters) > 0 && r.Parameters[0] == IRC_CHATHISTORY
+			}
+
+			return BatchType(r) == BATCH_CHATHISTORY &&
+				len(r.Parameters) > 1 &&
+				strings.EqualFold(r.Parameters[1], target)
+		})
+
+		if err := i.Write(ev); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	r, err := i.response(ch, cancel)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(r); err != nil {
+		return nil, err
+	}
+
+	// A labeled response has the chathistory batch inside a labeled batch
+	for BatchType(r) == BATCH_LABELED_RESPONSE && len(r.Batch) == 1 {
+		r = r.Batch[0]
+	}
+
+	if BatchType(r) != BATCH_CHATHISTORY {
+		return nil, nil
+	}
+
+	return r.Batch, nil
+}
+
+// historyLimit returns the most messages the server will send for a
+// chathistory request
+func (i *Client) historyLimit() int {
+	if v, ok := i.ISupport("CHATHISTORY"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+
+	return DEFAULT_HISTORY_LIMIT
+}
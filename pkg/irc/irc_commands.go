@@ -4,7 +4,9 @@ package irc
 
 //- Commands
 const IRC_ADMIN = "ADMIN"
+const IRC_AUTHENTICATE = "AUTHENTICATE"
 const IRC_AWAY = "AWAY"
+const IRC_CAP = "CAP"
 const IRC_CONNECT = "CONNECT"
 const IRC_DIE = "DIE"
 const IRC_ERROR = "ERROR"
@@ -52,6 +54,15 @@ const IRC_WHO = "WHO"
 const IRC_WHOIS = "WHOIS"
 const IRC_WHOWAS = "WHOWAS"
 
+//- IRCv3 Commands
+const IRC_ACCOUNT = "ACCOUNT"
+const IRC_ACK = "ACK"
+const IRC_BATCH = "BATCH"
+const IRC_CHATHISTORY = "CHATHISTORY"
+const IRC_FAIL = "FAIL"
+const IRC_MONITOR = "MONITOR"
+const IRC_TAGMSG = "TAGMSG"
+
 //- Command responses
 //
 const IRC_RPL_WELCOME = "001"
@@ -59,6 +70,7 @@ const IRC_RPL_YOURHOST = "002"
 const IRC_RPL_CREATED = "003"
 const IRC_RPL_MYINFO = "004"
 const IRC_RPL_BOUNCE = "005"
+const IRC_RPL_ISUPPORT = "005" // Replaces RPL_BOUNCE in practice
 
 const IRC_RPL_TRACELINK = "200"
 const IRC_RPL_TRACECONNECTING = "201"
@@ -91,6 +103,7 @@ const IRC_RPL_ADMINEMAIL = "259"
 const IRC_RPL_TRACELOG = "261"
 const IRC_RPL_TRACEEND = "262"
 const IRC_RPL_TRYAGAIN = "263"
+const IRC_RPL_WHOISCERTFP = "276"
 const IRC_RPL_AWAY = "301"
 const IRC_RPL_USERHOST = "302"
 const IRC_RPL_ISON = "303"
@@ -109,6 +122,7 @@ const IRC_RPL_LIST = "322"
 const IRC_RPL_LISTEND = "323"
 const IRC_RPL_CHANNELMODEIS = "324"
 const IRC_RPL_UNIQOPIS = "325"
+const IRC_RPL_WHOISACCOUNT = "330"
 const IRC_RPL_NOTOPIC = "331"
 const IRC_RPL_TOPIC = "332"
 const IRC_RPL_INVITING = "341"
@@ -193,3 +207,19 @@ const IRC_ERR_UNIQOPPRIVSNEEDED = "485"
 const IRC_ERR_NOOPERHOST = "491"
 const IRC_ERR_UMODEUNKNOWNFLAG = "501"
 const IRC_ERR_USERSDONTMATCH = "502"
+
+//- IRCv3 Command responses
+const IRC_RPL_LOGGEDIN = "900"
+const IRC_RPL_LOGGEDOUT = "901"
+const IRC_ERR_NICKLOCKED = "902"
+const IRC_RPL_SASLSUCCESS = "903"
+const IRC_ERR_SASLFAIL = "904"
+const IRC_ERR_SASLTOOLONG = "905"
+const IRC_ERR_SASLABORTED = "906"
+const IRC_ERR_SASLALREADY = "907"
+const IRC_RPL_SASLMECHS = "908"
+const IRC_RPL_MONONLINE = "730"
+const IRC_RPL_MONOFFLINE = "731"
+const IRC_RPL_MONLIST = "732"
+const IRC_RPL_ENDOFMONLIST = "733"
+const IRC_ERR_MONLISTFULL = "734"
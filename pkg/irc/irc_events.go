@@ -6,15 +6,14 @@ package irc
 // and any actions that should be handled for those events, based on a Filter.
 
 import (
-	"bufio"
 	"fmt"
 	"io"
-	"net/textproto"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
 	"github.com/enmand/quarid-go/pkg/logger"
 )
 
@@ -22,19 +21,36 @@ const (
 	InvalidLineSize = "Could not parse line: %d parameter given, %d expected"
 )
 
-// Read reads the data from the server, and handles events that happen
+// Read blocks while the data from the server is read and handled, once we are
+// connected, and returns the error that stopped it
 func (i *Client) Read() error {
-	return i.read()
+	return <-i.readErr
 }
 
 func (i *Client) Loop() {
-	for m := range i.events {
-		go i.handleEvent(m)
+	for q := range i.events {
+		if ev := i.batch(q.ev); ev != nil {
+			i.dispatch(ev)
+		}
+		q.done()
 	}
 
 	fmt.Println("Done reading events")
 }
 
+// queued is an event waiting to be dispatched, and what to call once it has
+// been
+type queued struct {
+	ev   *adapter.Event
+	done func()
+}
+
+// queue an event for Loop to dispatch. The client's clock is busy until it
+// has been
+func (i *Client) queue(ev *adapter.Event) {
+	i.events <- queued{ev: ev, done: clock.Or(i.Clock).Busy()}
+}
+
 // Handle defines events that should be filtered to preform a handler function.
 // Using "*" or "" for a filter, will cause all events to be passed to the
 // HandlerFunc.
@@ -47,8 +63,51 @@ func (i *Client) Handle(fs []adapter.Filter, hf adapter.HandlerFunc) {
 	i.handlers = append(i.handlers, h)
 }
 
-// handleEvent will forward events to the proper handlers
+// dispatch an event read from the server to anything waiting on it, the
+// observers, and the handlers
+func (i *Client) dispatch(ev *adapter.Event) {
+	if i.resolve(ev) {
+		// The event was a response for a waiter only
+		return
+	}
+
+	i.observe(ev, false)
+	clock.Go(clock.Or(i.Clock), func() {
+		i.handleEvent(ev)
+	})
+}
+
+// ObserverFunc is called with every event read from (or sent, if sent is true,
+// to) the server
+type ObserverFunc func(ev *adapter.Event, sent bool)
+
+// Observe calls o, in order, for every event read from or written to the
+// server. Observers are called before any handlers, and from the goroutine
+// reading events, so they must not block
+func (i *Client) Observe(o ObserverFunc) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.observers = append(i.observers, o)
+}
+
+func (i *Client) observe(ev *adapter.Event, sent bool) {
+	i.mu.Lock()
+	os := append([]ObserverFunc(nil), i.observers...)
+	i.mu.Unlock()
+
+	for _, o := range os {
+		o(ev, sent)
+	}
+}
+
+// handleEvent passes events through our middleware, and forwards them to
+// the proper handlers
 func (i *Client) handleEvent(ev *adapter.Event) {
+	i.Middleware.In(ev, i.handle)
+}
+
+func (i *Client) handle(ev *adapter.Event) {
 	log.Infof("Handling event: %#v", ev)
 
 	for _, h := range i.handlers {
@@ -65,40 +124,55 @@ func (i *Client) handleEvent(ev *adapter.Event) {
 
 // read n lines from the server. if n is 0, continue reading until we can't
 func (i *Client) read() error {
-	r := bufio.NewReader(i.conn)
-	tp := textproto.NewReader(r)
-
 	for {
-		l, err := tp.ReadLine()
+		l, err := i.transport.ReadLine()
 		switch err {
 		case io.EOF:
-			continue
+			return fmt.Errorf("The server closed the connection")
 		case nil:
-			ev, err := parseLine(l)
+			ev, err := ParseLine(l)
 			if err != nil {
-				logger.Log.Errorf(err.Error())
+				logger.Log.Error(err)
 				continue
 			}
-			i.events <- ev
+			if i.Tap != nil {
+				i.Tap(ev, false)
+			}
+			i.queue(ev)
 		default:
 			return fmt.Errorf("Error reading from server: %s", err)
 		}
 	}
 }
 
-// parseLine read from the IRC server
-func parseLine(l string) (*adapter.Event, error) {
+// ParseLine parses a line read from an IRC server (or client)
+func ParseLine(l string) (*adapter.Event, error) {
 	ev := &adapter.Event{}
+	l = strings.TrimLeft(l, " ")
+
+	if strings.HasPrefix(l, "@") {
+		ws := strings.SplitN(l, " ", 2)
+		ev.Tags = parseTags(ws[0][1:])
+		if len(ws) < 2 {
+			return nil, fmt.Errorf(InvalidLineSize, 0, 1)
+		}
+		l = strings.TrimLeft(ws[1], " ")
+	}
+
 	ws := strings.Split(l, " ") // split args on " "
 	var paramIndex int          // the argument index where the parameters are
 
-	// Make sure we have at least two params (PREFIX and COMMAND)
-	if len(ws) < 1 {
-		return nil, fmt.Errorf(InvalidLineSize, len(ws), 2)
+	// Make sure we have at least a COMMAND
+	if len(ws) < 1 || ws[0] == "" {
+		return nil, fmt.Errorf(InvalidLineSize, 0, 1)
 	}
 
 	// Check if our "prefix" has ":"
 	if ws[0][0] == ':' {
+		if len(ws) < 2 {
+			return nil, fmt.Errorf(InvalidLineSize, len(ws), 2)
+		}
+
 		// Server sent a prefix
 		ev.Prefix = ws[0][1:]
 		ev.Command = ws[1]
@@ -115,6 +189,13 @@ func parseLine(l string) (*adapter.Event, error) {
 	ev.Parameters = readParams(ws, paramIndex)
 	ev.Timestamp = time.Now()
 
+	// Prefer the time the server says the event happened (IRCv3 server-time)
+	if t, ok := ev.Tags["time"]; ok {
+		if st, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			ev.Timestamp = st
+		}
+	}
+
 	return ev, nil
 }
 
@@ -125,12 +206,41 @@ func readParams(ws []string, index int) []string {
 
 	for i, p := range ws[index:wsSize] {
 		if len(p) > 0 && p[0] == ':' {
-			params = append(params, strings.Join(ws[index+i:wsSize], " "))
+			trailing := strings.Join(ws[index+i:wsSize], " ")
+			params = append(params, trailing[1:])
 			break
-		} else {
+		} else if len(p) > 0 {
 			params = append(params, p)
 		}
 	}
 
 	return params
 }
+
+// parseTags parses IRCv3 message tags, without the leading "@"
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, t := range strings.Split(raw, ";") {
+		if t == "" {
+			continue
+		}
+
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = tagUnescaper.Replace(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+
+	return tags
+}
+
+var tagUnescaper = strings.NewReplacer(
+	`\:`, ";",
+	`\s`, " ",
+	`\\`, `\`,
+	`\r`, "\r",
+	`\n`, "\n",
+)
@@ -0,0 +1,44 @@
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Hostmask is the nick!user@host prefix of a user on the server
+type Hostmask struct {
+	Nick string
+	User string
+	Host string
+}
+
+// ParseHostmask parses a nick!user@host prefix. Missing parts of the prefix
+// are left empty, so a server name parses as a Hostmask with only a Nick
+func ParseHostmask(prefix string) Hostmask {
+	var h Hostmask
+
+	if i := strings.IndexByte(prefix, '@'); i >= 0 {
+		h.Host = prefix[i+1:]
+		prefix = prefix[:i]
+	}
+	if i := strings.IndexByte(prefix, '!'); i >= 0 {
+		h.User = prefix[i+1:]
+		prefix = prefix[:i]
+	}
+	h.Nick = prefix
+
+	return h
+}
+
+// String formats the Hostmask as nick!user@host
+func (h Hostmask) String() string {
+	s := h.Nick
+	if h.User != "" {
+		s = fmt.Sprintf("%s!%s", s, h.User)
+	}
+	if h.Host != "" {
+		s = fmt.Sprintf("%s@%s", s, h.Host)
+	}
+
+	return s
+}
@@ -0,0 +1,121 @@
+package irc
+
+// ISUPPORT
+//
+// Servers advertise the features and limits they support with RPL_ISUPPORT
+// (005) after registration, as a list of NAME or NAME=value tokens.
+//
+// See also: https://modern.ircdocs.horse/#rplisupport-005
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// ISupport returns the value of the RPL_ISUPPORT token name, and whether the
+// server sent the token at all
+func (i *Client) ISupport(name string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	v, ok := i.isupport[strings.ToUpper(name)]
+	return v, ok
+}
+
+// parseISupport records the RPL_ISUPPORT tokens sent by the server
+func (i *Client) parseISupport(ev *adapter.Event, sent bool) {
+	if sent {
+		return
+	}
+
+	switch ev.Command {
+	case CONNECTED:
+		i.mu.Lock()
+		i.isupport = make(map[string]string)
+		i.mu.Unlock()
+	case IRC_RPL_ISUPPORT:
+		// The first parameter is our nick, and the last is a description
+		if len(ev.Parameters) < 3 {
+			return
+		}
+
+		i.mu.Lock()
+		defer i.mu.Unlock()
+
+		for _, t := range ev.Parameters[1 : len(ev.Parameters)-1] {
+			if strings.HasPrefix(t, "-") {
+				delete(i.isupport, strings.ToUpper(t[1:]))
+				continue
+			}
+
+			kv := strings.SplitN(t, "=", 2)
+			if len(kv) == 2 {
+				i.isupport[strings.ToUpper(kv[0])] = kv[1]
+			} else {
+				i.isupport[strings.ToUpper(kv[0])] = ""
+			}
+		}
+	}
+}
+
+// IsChannel reports whether name is a channel name, based on the channel types
+// the server supports
+func (i *Client) IsChannel(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	types, ok := i.ISupport("CHANTYPES")
+	if !ok {
+		types = "#&"
+	}
+
+	return strings.IndexByte(types, name[0]) >= 0
+}
+
+// TargMax returns the most targets the server accepts for command, from the
+// TARGMAX token, or 0 if there is no limit
+func (i *Client) TargMax(command string) int {
+	v, ok := i.ISupport("TARGMAX")
+	if !ok {
+		return 0
+	}
+
+	for _, t := range strings.Split(v, ",") {
+		kv := strings.SplitN(t, ":", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], command) {
+			continue
+		}
+
+		n, _ := strconv.Atoi(kv[1])
+		return n
+	}
+
+	return 0
+}
+
+// chanModes returns the channel modes the server supports, by type, from the
+// CHANMODES token: list modes (A), modes that always take a parameter (B),
+// modes that take one only when set (C), and modes that never do (D)
+func (i *Client) chanModes() (a, b, c, d string) {
+	v, ok := i.ISupport("CHANMODES")
+	ts := strings.Split(v, ",")
+	if !ok || len(ts) < 4 {
+		return "beIq", "k", "flj", "imnpst"
+	}
+
+	return ts[0], ts[1], ts[2], ts[3]
+}
+
+// modeTakesArg reports whether the channel mode m takes a parameter, when it
+// is set (add) or unset
+func (i *Client) modeTakesArg(m rune, add bool) bool {
+	if _, ok := i.prefixModes()[m]; ok {
+		return true
+	}
+
+	a, b, c, _ := i.chanModes()
+	return strings.ContainsRune(a+b, m) || (add && strings.ContainsRune(c, m))
+}
@@ -0,0 +1,217 @@
+package irc
+
+// Responses
+//
+// Some commands need to wait for the server's response to them. With the
+// IRCv3 labeled-response capability, a command is sent with a label that the
+// server includes on its response; with echo-message, the server echoes the
+// messages we send back to us, as they were delivered.
+//
+// See also: https://ircv3.net/specs/extensions/labeled-response
+// See also: https://ircv3.net/specs/extensions/echo-message
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// RESPONSE_TIMEOUT is how long to wait for a response from the server
+const RESPONSE_TIMEOUT = 30 * time.Second
+
+var (
+	// ErrNoLabels is returned when labeled-response is needed, but has not been
+	// enabled on the server
+	ErrNoLabels = errors.New("The server does not support labeled-response")
+
+	// ErrNoResponse is returned when the server did not respond in time
+	ErrNoResponse = errors.New("No response from the server")
+)
+
+// waiter waits for an event matching match
+type waiter struct {
+	match func(ev *adapter.Event) bool
+	ch    chan *adapter.Event
+}
+
+// await returns a channel that will receive the next event read from the
+// server that matches match, and a function to stop waiting
+func (i *Client) await(match func(ev *adapter.Event) bool) (<-chan *adapter.Event, func()) {
+	w := &waiter{
+		match: match,
+		ch:    make(chan *adapter.Event, 1),
+	}
+
+	i.mu.Lock()
+	i.waiters = append(i.waiters, w)
+	i.mu.Unlock()
+
+	return w.ch, func() {
+		i.mu.Lock()
+		defer i.mu.Unlock()
+
+		for n, o := range i.waiters {
+			if o == w {
+				i.waiters = append(i.waiters[:n], i.waiters[n+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// resolve sends ev to the first waiter it matches. It returns true if ev was
+// only a response to something we sent, and should not be handled further
+func (i *Client) resolve(ev *adapter.Event) bool {
+	i.mu.Lock()
+	var w *waiter
+	for n, o := range i.waiters {
+		if o.match(ev) {
+			w = o
+			i.waiters = append(i.waiters[:n], i.waiters[n+1:]...)
+			break
+		}
+	}
+	echo := i.enabled[CAP_ECHO_MESSAGE]
+	i.mu.Unlock()
+
+	if w != nil {
+		w.ch <- ev
+	}
+
+	if ev.Command == IRC_ACK {
+		return true
+	}
+
+	// Our own messages, echoed back to us, were already seen as they were sent
+	return echo && i.isEcho(ev)
+}
+
+func (i *Client) isEcho(ev *adapter.Event) bool {
+	return echoes(ev, i.CurrentNick())
+}
+
+// echoes reports whether ev is a message sent by nick
+func echoes(ev *adapter.Event, nick string) bool {
+	switch ev.Command {
+	case IRC_PRIVMSG, IRC_NOTICE, IRC_TAGMSG:
+		return strings.EqualFold(ParseHostmask(ev.Prefix).Nick, nick)
+	}
+
+	return false
+}
+
+// Label sends ev with a label, and returns a channel that receives the
+// server's response: a single event, a BATCH event of all of the events in the
+// response, or an ACK if the server had nothing to say
+func (i *Client) Label(ev *adapter.Event) (<-chan *adapter.Event, func(), error) {
+	if !i.HasCap(CAP_LABELED_RESPONSE) {
+		return nil, nil, ErrNoLabels
+	}
+
+	i.mu.Lock()
+	i.label++
+	label := fmt.Sprintf("q%d", i.label)
+	i.mu.Unlock()
+
+	if ev.Tags == nil {
+		ev.Tags = make(map[string]string)
+	}
+	ev.Tags["label"] = label
+
+	ch, cancel := i.await(func(r *adapter.Event) bool {
+		return r.Tags["label"] == label
+	})
+
+	if err := i.Write(ev); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return ch, cancel, nil
+}
+
+// Deliver sends a PRIVMSG, NOTICE or TAGMSG, and waits for the server to echo
+// it back. The event returned is the message as the server delivered it. If
+// the server does not support echo-message, the message cannot be confirmed,
+// and ev is returned as soon as it is sent
+func (i *Client) Deliver(ev *adapter.Event) (*adapter.Event, error) {
+	if !i.HasCap(CAP_ECHO_MESSAGE) {
+		return ev, i.Write(ev)
+	}
+
+	var ch <-chan *adapter.Event
+	var cancel func()
+	var err error
+
+	if i.HasCap(CAP_LABELED_RESPONSE) {
+		ch, cancel, err = i.Label(ev)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Waiters are matched under i.mu, so the nick is read beforehand
+		nick := i.CurrentNick()
+		ch, cancel = i.await(func(r *adapter.Event) bool {
+			return echoes(r, nick) &&
+				r.Command == ev.Command &&
+				len(r.Parameters) > 0 && len(ev.Parameters) > 0 &&
+				strings.EqualFold(r.Parameters[0], ev.Parameters[0])
+		})
+
+		if err := i.Write(ev); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	r, err := i.response(ch, cancel)
+	if err != nil {
+		return nil, err
+	}
+
+	// A labeled response may be a batch, with the echo and anything else
+	if r.Command == IRC_BATCH {
+		for _, b := range r.Batch {
+			if i.isEcho(b) {
+				return b, nil
+			}
+		}
+		if len(r.Batch) > 0 {
+			return nil, responseError(r.Batch[0])
+		}
+	}
+
+	return r, responseError(r)
+}
+
+// response waits for a response on ch, until RESPONSE_TIMEOUT
+func (i *Client) response(
+	ch <-chan *adapter.Event,
+	cancel func(),
+) (*adapter.Event, error) {
+	select {
+	case r := <-ch:
+		return r, nil
+	case <-time.After(RESPONSE_TIMEOUT):
+		cancel()
+		return nil, ErrNoResponse
+	}
+}
+
+// responseError returns an error if the response r is an error from the
+// server
+func responseError(r *adapter.Event) error {
+	if r.Command == IRC_FAIL ||
+		(len(r.Command) == 3 && (r.Command[0] == '4' || r.Command[0] == '5')) {
+		return fmt.Errorf(
+			"The server replied %s: %s",
+			r.Command,
+			strings.Join(r.Parameters, " "),
+		)
+	}
+
+	return nil
+}
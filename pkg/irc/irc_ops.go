@@ -0,0 +1,445 @@
+package irc
+
+// Channel operators
+//
+// Helpers for channel operators to change membership modes, kick, ban, quiet
+// and invite. Mode changes are sent in as few MODE lines as the server's
+// MODES limit allows.
+//
+// Timed bans are kept in the client's Store (if it has one), and lifted once
+// they expire, even if the client was restarted in between. An expired ban is
+// lifted as soon as we are an operator in its channel.
+//
+// See also: https://modern.ircdocs.horse/#channel-modes
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// DEFAULT_MODES is how many modes with a parameter may be sent in a single
+// MODE line, if the server does not say
+const DEFAULT_MODES = 3
+
+// modeLineLength is the most mode parameters, in bytes, to send in a single
+// MODE line
+const modeLineLength = 400
+
+// ErrNoQuiet is returned when the server has no way to quiet users
+var ErrNoQuiet = errors.New("The server does not support quieting users")
+
+// ModeChange is a change to a single channel mode
+type ModeChange struct {
+	// Whether the mode is being set (+) or unset (-)
+	Add bool
+
+	// The mode being changed
+	Mode rune
+
+	// The mode's parameter, if it has one
+	Arg string
+}
+
+// Mode changes the modes of channel, batching the changes into as few MODE
+// lines as the server allows
+func (i *Client) Mode(channel string, changes ...ModeChange) error {
+	max := DEFAULT_MODES
+	if v, ok := i.ISupport("MODES"); ok {
+		// MODES without a value means there is no limit
+		max, _ = strconv.Atoi(v)
+	}
+
+	var modes, args []string
+	var add *bool
+	length := 0
+
+	flush := func() error {
+		if len(modes) == 0 {
+			return nil
+		}
+
+		err := i.Write(&adapter.Event{
+			Command:    IRC_MODE,
+			Parameters: append([]string{channel, strings.Join(modes, "")}, args...),
+		})
+		modes, args, add, length = nil, nil, nil, 0
+
+		return err
+	}
+
+	for _, c := range changes {
+		if len(args) > 0 && c.Arg != "" &&
+			((max > 0 && len(args) >= max) ||
+				length+len(c.Arg)+1 > modeLineLength) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		m := string(c.Mode)
+		if add == nil || *add != c.Add {
+			sign := c.Add
+			add = &sign
+			if c.Add {
+				m = "+" + m
+			} else {
+				m = "-" + m
+			}
+		}
+
+		modes = append(modes, m)
+		if c.Arg != "" {
+			args = append(args, c.Arg)
+			length += len(c.Arg) + 1
+		}
+	}
+
+	return flush()
+}
+
+// Op gives channel operator status to nicks
+func (i *Client) Op(channel string, nicks ...string) error {
+	return i.Mode(channel, changes(true, 'o', nicks)...)
+}
+
+// Deop takes channel operator status from nicks
+func (i *Client) Deop(channel string, nicks ...string) error {
+	return i.Mode(channel, changes(false, 'o', nicks)...)
+}
+
+// Voice gives voice to nicks
+func (i *Client) Voice(channel string, nicks ...string) error {
+	return i.Mode(channel, changes(true, 'v', nicks)...)
+}
+
+// Devoice takes voice from nicks
+func (i *Client) Devoice(channel string, nicks ...string) error {
+	return i.Mode(channel, changes(false, 'v', nicks)...)
+}
+
+// Ban masks from channel
+func (i *Client) Ban(channel string, masks ...string) error {
+	return i.Mode(channel, changes(true, 'b', masks)...)
+}
+
+// Unban masks from channel
+func (i *Client) Unban(channel string, masks ...string) error {
+	return i.Mode(channel, changes(false, 'b', masks)...)
+}
+
+// Quiet masks in channel, so they can stay but not speak. This uses the +q
+// mode, or a quiet extban, depending on what the server supports
+func (i *Client) Quiet(channel string, masks ...string) error {
+	return i.quiet(channel, true, masks)
+}
+
+// Unquiet masks in channel
+func (i *Client) Unquiet(channel string, masks ...string) error {
+	return i.quiet(channel, false, masks)
+}
+
+func (i *Client) quiet(channel string, add bool, masks []string) error {
+	var cs []ModeChange
+	for _, m := range masks {
+		mode, arg, err := i.quietMode(m)
+		if err != nil {
+			return err
+		}
+		cs = append(cs, ModeChange{Add: add, Mode: mode, Arg: arg})
+	}
+
+	return i.Mode(channel, cs...)
+}
+
+// quietMode returns the mode, and its parameter, that quiets mask
+func (i *Client) quietMode(mask string) (rune, string, error) {
+	a, _, _, _ := i.chanModes()
+	if _, prefix := i.prefixModes()['q']; !prefix && strings.ContainsRune(a, 'q') {
+		return 'q', mask, nil
+	}
+
+	// EXTBAN is a prefix, and the extban types the server supports
+	v, ok := i.ISupport("EXTBAN")
+	if ok {
+		ts := strings.SplitN(v, ",", 2)
+		if len(ts) == 2 {
+			for _, t := range "qm" {
+				if strings.ContainsRune(ts[1], t) {
+					return 'b', ts[0] + string(t) + ":" + mask, nil
+				}
+			}
+		}
+	}
+
+	return 0, "", ErrNoQuiet
+}
+
+// Kick nick from channel, with reason
+func (i *Client) Kick(channel, nick, reason string) error {
+	params := []string{channel, nick}
+	if reason != "" {
+		params = append(params, reason)
+	}
+
+	return i.Write(&adapter.Event{
+		Command:    IRC_KICK,
+		Parameters: params,
+	})
+}
+
+// Invite nick to channel
+func (i *Client) Invite(nick, channel string) error {
+	return i.Write(&adapter.Event{
+		Command:    IRC_INVITE,
+		Parameters: []string{nick, channel},
+	})
+}
+
+func changes(add bool, mode rune, args []string) []ModeChange {
+	cs := make([]ModeChange, len(args))
+	for n, a := range args {
+		cs[n] = ModeChange{Add: add, Mode: mode, Arg: a}
+	}
+
+	return cs
+}
+
+// MaskStyle is a way of building a ban mask from a hostmask
+type MaskStyle int
+
+// Ban mask styles, for nick!user@host.example.com
+const (
+	// *!*@host.example.com
+	MaskHost MaskStyle = iota
+
+	// *!*user@host.example.com
+	MaskUserHost
+
+	// *!*@*.example.com (or 192.0.2.*, for addresses)
+	MaskDomain
+
+	// nick!*@*
+	MaskNick
+
+	// nick!user@host.example.com
+	MaskExact
+)
+
+// BanMask builds a ban mask for hm, in the given style
+func BanMask(hm Hostmask, style MaskStyle) string {
+	nick, user, host := orStar(hm.Nick), orStar(hm.User), orStar(hm.Host)
+
+	// Idents that were not verified are prefixed with "~", which may change
+	user = "*" + strings.TrimLeft(user, "~*")
+
+	switch style {
+	case MaskUserHost:
+		return "*!" + user + "@" + host
+	case MaskDomain:
+		return "*!*@" + domain(host)
+	case MaskNick:
+		return nick + "!*@*"
+	case MaskExact:
+		return nick + "!" + orStar(hm.User) + "@" + host
+	}
+
+	return "*!*@" + host
+}
+
+// domain masks the most specific part of host
+func domain(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return host[:strings.LastIndex(host, ".")] + ".*"
+		}
+
+		// The /64 is the first four groups of the expanded address, which
+		// may have been compressed away in host
+		ip = ip.To16()
+		gs := make([]string, 4)
+		for n := range gs {
+			gs[n] = strconv.FormatUint(uint64(ip[2*n])<<8|uint64(ip[2*n+1]), 16)
+		}
+		return strings.Join(gs, ":") + ":*"
+	}
+
+	// Cloaks (e.g. user/name) are not domains
+	if strings.Contains(host, "/") {
+		return host
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 {
+		return host
+	}
+
+	return "*." + strings.Join(labels[1:], ".")
+}
+
+func orStar(s string) string {
+	if s == "" {
+		return "*"
+	}
+
+	return s
+}
+
+// timedBan is a ban that is lifted once it expires
+type timedBan struct {
+	Channel string    `json:"channel"`
+	Mask    string    `json:"mask"`
+	Expires time.Time `json:"expires"`
+
+	timer clock.Timer
+}
+
+func (b *timedBan) key() string {
+	return strings.ToLower(b.Channel) + " " + b.Mask
+}
+
+// TimedBan bans mask from channel, and lifts the ban after d
+func (i *Client) TimedBan(channel, mask string, d time.Duration) error {
+	if err := i.Ban(channel, mask); err != nil {
+		return err
+	}
+
+	b := &timedBan{
+		Channel: channel,
+		Mask:    mask,
+		Expires: clock.Or(i.Clock).Now().Add(d),
+	}
+
+	if i.Store != nil {
+		if err := i.Store.Put(i.bansBucket(), b.key(), b); err != nil {
+			logger.Log.Errorf("Could not save ban of %s in %s: %s", mask, channel, err)
+		}
+	}
+
+	i.scheduleBan(b)
+	return nil
+}
+
+func (i *Client) bansBucket() string {
+	return "bans." + Hostname(i.Server)
+}
+
+// scheduleBan lifts the ban b when it expires
+func (i *Client) scheduleBan(b *timedBan) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if o, ok := i.bans[b.key()]; ok && o.timer != nil {
+		o.timer.Stop()
+	}
+
+	c := clock.Or(i.Clock)
+	i.bans[b.key()] = b
+	b.timer = c.AfterFunc(b.Expires.Sub(c.Now()), func() {
+		i.liftBans(b.Channel)
+	})
+}
+
+// liftBans lifts the expired bans in channel, if we are an operator there
+func (i *Client) liftBans(channel string) {
+	if !i.isOp(channel) {
+		return
+	}
+
+	var keys, masks []string
+	now := clock.Or(i.Clock).Now()
+
+	i.mu.Lock()
+	for k, b := range i.bans {
+		if strings.EqualFold(b.Channel, channel) && !now.Before(b.Expires) {
+			keys = append(keys, k)
+			masks = append(masks, b.Mask)
+			delete(i.bans, k)
+		}
+	}
+	i.mu.Unlock()
+
+	if i.Store != nil {
+		for _, k := range keys {
+			if err := i.Store.Delete(i.bansBucket(), k); err != nil {
+				logger.Log.Errorf("Could not forget ban %s: %s", k, err)
+			}
+		}
+	}
+
+	if len(masks) > 0 {
+		i.Unban(channel, masks...)
+	}
+}
+
+// isOp reports whether we are a channel operator (or higher) in channel
+func (i *Client) isOp(channel string) bool {
+	ch, ok := i.state.Channel(channel)
+	if !ok {
+		return false
+	}
+
+	p, ok := ch.member(i.CurrentNick())
+	if !ok {
+		return false
+	}
+
+	// Prefixes are ordered from the highest status to the lowest
+	prefixes := i.prefixes()
+	op := strings.IndexByte(prefixes, '@')
+	for _, r := range p {
+		if n := strings.IndexRune(prefixes, r); n >= 0 && n <= op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// timedBans loads the timed bans once we are registered, and lifts expired
+// bans when we become an operator in their channel. Bans that expire while we
+// are disconnected are lifted once we are back
+func (i *Client) timedBans(ev *adapter.Event, sent bool) {
+	if sent || ev.Historical {
+		return
+	}
+
+	switch ev.Command {
+	case IRC_RPL_WELCOME:
+		if i.Store == nil {
+			return
+		}
+
+		var bans []*timedBan
+		err := i.Store.ForEach(i.bansBucket(), func(key string, v []byte) error {
+			b := &timedBan{}
+			if err := json.Unmarshal(v, b); err != nil {
+				return err
+			}
+			bans = append(bans, b)
+			return nil
+		})
+		if err != nil {
+			logger.Log.Errorf("Could not load timed bans: %s", err)
+		}
+
+		for _, b := range bans {
+			i.scheduleBan(b)
+		}
+	case IRC_RPL_ENDOFNAMES:
+		if len(ev.Parameters) > 1 {
+			clock.Go(clock.Or(i.Clock), func() { i.liftBans(ev.Parameters[1]) })
+		}
+	case IRC_MODE:
+		if len(ev.Parameters) > 0 && i.IsChannel(ev.Parameters[0]) {
+			clock.Go(clock.Or(i.Clock), func() { i.liftBans(ev.Parameters[0]) })
+		}
+	}
+}
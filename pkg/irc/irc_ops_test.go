@@ -0,0 +1,25 @@
+package irc_test
+
+import (
+	"testing"
+
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+func TestBanMaskDomain(t *testing.T) {
+	for host, mask := range map[string]string{
+		"host.example.com":          "*!*@*.example.com",
+		"example.com":               "*!*@example.com",
+		"user/name":                 "*!*@user/name",
+		"192.0.2.1":                 "*!*@192.0.2.*",
+		"2001:db8:1:2:3:4:5:6":      "*!*@2001:db8:1:2:*",
+		"2001:db8::1":               "*!*@2001:db8:0:0:*",
+		"2001:db8:0:0:1::":          "*!*@2001:db8:0:0:*",
+		"2001:0DB8:00a0:0001::abcd": "*!*@2001:db8:a0:1:*",
+	} {
+		hm := irc.Hostmask{Nick: "nick", User: "user", Host: host}
+		if m := irc.BanMask(hm, irc.MaskDomain); m != mask {
+			t.Errorf("Expected the mask of %s to be %s, but got %s", host, mask, m)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package irc
+
+// Presence
+//
+// Presence watches a set of nicks, and emits ONLINE and OFFLINE events as they
+// connect to and disconnect from the server. Nicks are watched with MONITOR
+// when the server supports it, up to the server's limit, and any others are
+// polled with ISON.
+//
+// The watch set is shared: a nick watched more than once is only sent to the
+// server once, and stays watched until it has been unwatched as many times.
+//
+// See also: https://ircv3.net/specs/extensions/monitor
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// Events emitted when a watched nick comes online, or goes offline. The
+// event's first parameter is the nick, and its Prefix is the nick's hostmask,
+// when the server sent it
+const (
+	ONLINE  = "online"
+	OFFLINE = "offline"
+)
+
+// ISON_INTERVAL is how often nicks that are not monitored are polled
+const ISON_INTERVAL = 1 * time.Minute
+
+// presenceLineLength is the most nicks, in bytes, to send in a single MONITOR
+// or ISON line
+const presenceLineLength = 400
+
+// Presence tracks whether watched nicks are online
+type Presence struct {
+	c *Client
+
+	mu      sync.Mutex
+	watched map[string]*watched
+
+	// Whether MONITOR is being used, and the most nicks it can be sent
+	// (0 if there is no limit)
+	monitor bool
+	limit   int
+
+	// ISON queries waiting for a reply, in the order they were sent
+	sending sync.Mutex
+	queries [][]string
+
+	// Closed to stop polling, when we disconnect
+	stop chan struct{}
+}
+
+type watched struct {
+	nick      string
+	refs      int
+	online    bool
+	monitored bool
+}
+
+func newPresence(c *Client) *Presence {
+	return &Presence{
+		c:       c,
+		watched: make(map[string]*watched),
+	}
+}
+
+// Presence returns the presence service for this client
+func (i *Client) Presence() *Presence {
+	return i.presence
+}
+
+// Watch nicks, emitting ONLINE and OFFLINE events when they come and go
+func (p *Presence) Watch(nicks ...string) {
+	var added []string
+
+	p.mu.Lock()
+	for _, n := range nicks {
+		key := strings.ToLower(n)
+		if w, ok := p.watched[key]; ok {
+			w.refs++
+			continue
+		}
+
+		p.watched[key] = &watched{nick: n, refs: 1}
+		added = append(added, n)
+	}
+	running := p.stop != nil
+	p.mu.Unlock()
+
+	if running && len(added) > 0 {
+		p.add(added)
+	}
+}
+
+// Unwatch nicks that were watched with Watch
+func (p *Presence) Unwatch(nicks ...string) {
+	var removed []string
+
+	p.mu.Lock()
+	for _, n := range nicks {
+		key := strings.ToLower(n)
+		w, ok := p.watched[key]
+		if !ok {
+			continue
+		}
+
+		w.refs--
+		if w.refs > 0 {
+			continue
+		}
+
+		delete(p.watched, key)
+		if w.monitored {
+			removed = append(removed, w.nick)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, targets := range joinNicks(removed, ",") {
+		p.c.Write(&adapter.Event{
+			Command:    IRC_MONITOR,
+			Parameters: []string{"-", targets},
+		})
+	}
+}
+
+// Watching returns the nicks being watched
+func (p *Presence) Watching() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var nicks []string
+	for _, w := range p.watched {
+		nicks = append(nicks, w.nick)
+	}
+
+	return nicks
+}
+
+// Online reports whether the watched nick is online
+func (p *Presence) Online(nick string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w, ok := p.watched[strings.ToLower(nick)]
+	return ok && w.online
+}
+
+// observe replies to MONITOR and ISON, and starts watching once the server
+// has told us what it supports
+func (p *Presence) observe(ev *adapter.Event, sent bool) {
+	if sent || ev.Historical {
+		return
+	}
+
+	switch ev.Command {
+	case IRC_RPL_ENDOFMOTD, IRC_ERR_NOMOTD:
+		p.start()
+	case DISCONNECTED:
+		p.reset()
+	case IRC_RPL_MONONLINE, IRC_RPL_MONOFFLINE:
+		if len(ev.Parameters) < 2 {
+			return
+		}
+		for _, t := range strings.Split(ev.Parameters[1], ",") {
+			if t != "" {
+				p.set(ParseHostmask(t), ev.Command == IRC_RPL_MONONLINE, ev)
+			}
+		}
+	case IRC_ERR_MONLISTFULL:
+		if len(ev.Parameters) < 3 {
+			return
+		}
+		// These nicks did not fit, so they are polled instead
+		p.mu.Lock()
+		for _, n := range strings.Split(ev.Parameters[2], ",") {
+			if w, ok := p.watched[strings.ToLower(n)]; ok {
+				w.monitored = false
+			}
+		}
+		p.mu.Unlock()
+	case IRC_RPL_ISON:
+		if len(ev.Parameters) < 2 {
+			return
+		}
+
+		p.sending.Lock()
+		if len(p.queries) == 0 {
+			p.sending.Unlock()
+			return
+		}
+		query := p.queries[0]
+		p.queries = p.queries[1:]
+		p.sending.Unlock()
+
+		online := make(map[string]bool)
+		for _, n := range strings.Fields(ev.Parameters[1]) {
+			online[strings.ToLower(n)] = true
+		}
+		for _, n := range query {
+			p.set(Hostmask{Nick: n}, online[strings.ToLower(n)], ev)
+		}
+	}
+}
+
+// start watching, after registration
+func (p *Presence) start() {
+	p.mu.Lock()
+	if p.stop != nil {
+		p.mu.Unlock()
+		return
+	}
+
+	v, ok := p.c.ISupport("MONITOR")
+	p.monitor = ok
+	p.limit, _ = strconv.Atoi(v)
+	p.stop = make(chan struct{})
+	stop := p.stop
+
+	var nicks []string
+	for _, w := range p.watched {
+		nicks = append(nicks, w.nick)
+	}
+	p.mu.Unlock()
+
+	go func() {
+		p.add(nicks)
+		p.poll(stop)
+	}()
+}
+
+// reset stops watching, and forgets who was online, when we disconnect
+func (p *Presence) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+
+	for _, w := range p.watched {
+		w.online = false
+		w.monitored = false
+	}
+
+	p.sending.Lock()
+	p.queries = nil
+	p.sending.Unlock()
+}
+
+// add nicks to the server's MONITOR list, while they fit, and poll the rest
+func (p *Presence) add(nicks []string) {
+	var monitor, poll []string
+
+	p.mu.Lock()
+	n := 0
+	for _, w := range p.watched {
+		if w.monitored {
+			n++
+		}
+	}
+	for _, nick := range nicks {
+		w, ok := p.watched[strings.ToLower(nick)]
+		if !ok {
+			continue
+		}
+
+		if p.monitor && (p.limit == 0 || n < p.limit) {
+			w.monitored = true
+			monitor = append(monitor, w.nick)
+			n++
+		} else {
+			poll = append(poll, w.nick)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, targets := range joinNicks(monitor, ",") {
+		p.c.Write(&adapter.Event{
+			Command:    IRC_MONITOR,
+			Parameters: []string{"+", targets},
+		})
+	}
+
+	p.ison(poll)
+}
+
+// poll the nicks that are not monitored with ISON, until stop is closed
+func (p *Presence) poll(stop chan struct{}) {
+	t := time.NewTicker(ISON_INTERVAL)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		var nicks []string
+		p.mu.Lock()
+		for _, w := range p.watched {
+			if !w.monitored {
+				nicks = append(nicks, w.nick)
+			}
+		}
+		p.mu.Unlock()
+
+		p.ison(nicks)
+	}
+}
+
+// ison asks the server which of nicks are online
+func (p *Presence) ison(nicks []string) {
+	p.sending.Lock()
+	defer p.sending.Unlock()
+
+	for _, targets := range joinNicks(nicks, " ") {
+		// The reply only lists the nicks that are online, so we remember
+		// what was asked
+		p.queries = append(p.queries, strings.Split(targets, " "))
+
+		err := p.c.Write(&adapter.Event{
+			Command:    IRC_ISON,
+			Parameters: strings.Split(targets, " "),
+		})
+		if err != nil {
+			p.queries = p.queries[:len(p.queries)-1]
+			return
+		}
+	}
+}
+
+// set whether the nick in hm is online, emitting an event if it changed
+func (p *Presence) set(hm Hostmask, online bool, ev *adapter.Event) {
+	p.mu.Lock()
+	w, ok := p.watched[strings.ToLower(hm.Nick)]
+	if !ok || w.online == online {
+		p.mu.Unlock()
+		return
+	}
+	w.online = online
+	p.mu.Unlock()
+
+	e := &adapter.Event{
+		Command:    OFFLINE,
+		Parameters: []string{w.nick},
+		Timestamp:  ev.Timestamp,
+	}
+	if online {
+		e.Command = ONLINE
+	}
+	if hm.User != "" || hm.Host != "" {
+		e.Prefix = hm.String()
+	}
+
+	p.c.dispatch(e)
+}
+
+// joinNicks joins nicks with sep, into lines no longer than presenceLineLength
+func joinNicks(nicks []string, sep string) []string {
+	var lines []string
+	var cur string
+
+	for _, n := range nicks {
+		if cur != "" && len(cur)+len(sep)+len(n) > presenceLineLength {
+			lines = append(lines, cur)
+			cur = ""
+		}
+
+		if cur != "" {
+			cur += sep
+		}
+		cur += n
+	}
+	if cur != "" {
+		lines = append(lines, cur)
+	}
+
+	return lines
+}
@@ -1,9 +1,7 @@
 package irc
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net"
 
 	"github.com/enmand/quarid-go/pkg/adapter"
 	"github.com/enmand/quarid-go/pkg/logger"
@@ -14,38 +12,63 @@ const (
 	DISCONNECTED = "disconnected"
 )
 
-// Connect connects this client to the server given
+// Connect connects this client to the server given, and registers with it.
+// If registration fails, the connection is closed, and the error is one of
+// the registration errors (such as ErrNickUnavailable or *ServerError)
 func (i *Client) Connect(server string) error {
 	i.Server = server
+	i.upgrade = 0
 
 	return i.connect()
 }
 
 func (i *Client) connect() error {
 	var err error
-	i.events = make(chan *adapter.Event)
 	logger.Log.Infof("Connecting to %s", i.Server)
+	i.setRegistration(RegConnecting)
 
-	if !i.TLS {
-		i.conn, err = net.DialTimeout("tcp", i.Server, TIMEOUT)
-	} else {
-		i.conn, err = tls.DialWithDialer(&net.Dialer{
-			Timeout: TIMEOUT,
-		}, "tcp", i.Server, &tls.Config{
-			InsecureSkipVerify: i.TLSVerify,
-		})
-	}
+	i.transport, err = i.dial()
 	if err != nil {
+		i.setRegistration(RegDisconnected)
 		return fmt.Errorf("Could not connect to server: %s", err)
 	}
 
-	i.events <- &adapter.Event{
+	done := i.startRegistration()
+	i.queue(&adapter.Event{
 		Command: CONNECTED,
-	}
-	logger.Log.Infof("Connecting to %s", i.Server)
+	})
+
+	i.readErr = make(chan error, 1)
+	i.reading = make(chan struct{})
+	go func(ch chan error, reading chan struct{}) {
+		defer close(reading)
+
+		err := i.read()
+		i.registered(&ConnectionError{Err: err})
+		ch <- err
+	}(i.readErr, i.reading)
+
+	err = i.register(done)
+	if u, ok := err.(*stsUpgrade); ok && i.upgrade == 0 {
+		logger.Log.Infof("Reconnecting to %s with TLS: %s", i.Server, u)
+		i.disconnect()
+
+		// The old connection must stop reading before we register again, or
+		// its error could be taken as the result of the new registration
+		<-i.reading
+		<-i.readErr
 
-	return err
+		i.upgrade = u.port
+		return i.connect()
+	}
+	if err != nil {
+		logger.Log.Errorf("Could not register with %s: %s", i.Server, err)
+		i.disconnect()
+		return err
+	}
+	logger.Log.Infof("Connected to %s as %s", i.Server, i.CurrentNick())
 
+	return nil
 }
 
 // Disconnect disconnects this client from the server it's connected to
@@ -62,15 +85,22 @@ func (i *Client) Disconnect() error {
 		return err
 	}
 
+	// Nothing more can be read once reading has stopped, so that the events
+	// can be closed
+	if i.reading != nil {
+		<-i.reading
+	}
 	close(i.events)
 
 	return nil
 }
 
 func (i *Client) disconnect() {
-	i.conn.Close()
+	i.refreshSTS()
+	i.transport.Close()
+	i.setRegistration(RegDisconnected)
 
-	i.events <- &adapter.Event{
+	i.queue(&adapter.Event{
 		Command: DISCONNECTED,
-	}
+	})
 }
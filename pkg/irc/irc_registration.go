@@ -0,0 +1,419 @@
+package irc
+
+// Registration
+//
+// Registration moves through a series of states, from connecting to the
+// server until it welcomes us:
+//
+//	RegConnecting  the connection is being made
+//	RegCaps        capabilities are being negotiated
+//	RegSASL        authenticating with SASL, if configured
+//	RegNick        waiting for the server to accept our NICK and USER
+//	RegWelcomed    registered, once the server sent RPL_WELCOME
+//
+// NICK and USER are sent along with CAP LS, as servers without capabilities
+// never reply to it; servers that do hold registration until CAP END. If our
+// nick is refused, each of AltNicks is tried, then the nick with a suffix.
+// Connect returns one of the errors below if registration fails.
+//
+// See also: https://modern.ircdocs.horse/#connection-registration
+// See also: https://ircv3.net/specs/extensions/sasl-3.1
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// REGISTRATION_TIMEOUT is how long the server has to welcome us, once we are
+// connected
+const REGISTRATION_TIMEOUT = 1 * time.Minute
+
+// DEFAULT_NICKLEN is the longest nick we assume the server allows, when it
+// refuses our nick as erroneous before telling us its NICKLEN
+const DEFAULT_NICKLEN = 9
+
+// CAP_TIMEOUT is how long to wait for the server to list its capabilities,
+// before registering without them
+const CAP_TIMEOUT = 5 * time.Second
+
+// MAX_NICK_SUFFIXES is how many suffixed nicks are tried, after AltNicks
+const MAX_NICK_SUFFIXES = 10
+
+// CAP_SASL is the capability for SASL authentication
+const CAP_SASL = "sasl"
+
+// RegistrationState is a step in registering with the server
+type RegistrationState int
+
+// Registration states, in the order they happen
+const (
+	RegDisconnected RegistrationState = iota
+	RegConnecting
+	RegCaps
+	RegSASL
+	RegNick
+	RegWelcomed
+)
+
+func (s RegistrationState) String() string {
+	switch s {
+	case RegConnecting:
+		return "connecting"
+	case RegCaps:
+		return "negotiating capabilities"
+	case RegSASL:
+		return "authenticating"
+	case RegNick:
+		return "registering"
+	case RegWelcomed:
+		return "registered"
+	}
+
+	return "disconnected"
+}
+
+var (
+	// ErrNickUnavailable is returned when none of the nicks we tried were
+	// accepted
+	ErrNickUnavailable = errors.New("No nick could be registered")
+
+	// ErrBadPassword is returned when the server rejected our PASS
+	ErrBadPassword = errors.New("The server rejected the password")
+
+	// ErrBanned is returned when we are banned from the server
+	ErrBanned = errors.New("Banned from the server")
+
+	// ErrSASLFailed is returned when SASL authentication failed
+	ErrSASLFailed = errors.New("SASL authentication failed")
+
+	// ErrRegistrationTimeout is returned when the server did not welcome us
+	// within REGISTRATION_TIMEOUT
+	ErrRegistrationTimeout = errors.New("Registration timed out")
+)
+
+// ServerError is returned when the server closes the connection with an
+// ERROR while we are registering
+type ServerError struct {
+	Reason string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("The server closed the connection: %s", e.Reason)
+}
+
+// ConnectionError is returned when the connection is lost while we are
+// registering
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("Connection lost while registering: %s", e.Err)
+}
+
+// Registration returns the client's registration state
+func (i *Client) Registration() RegistrationState {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.registration
+}
+
+func (i *Client) setRegistration(s RegistrationState) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.registration != s {
+		logger.Log.Debugf("Registration: %s", s)
+	}
+	i.registration = s
+}
+
+// startRegistration prepares to register, before anything is read from the
+// server, and returns the channel the result will be sent on
+func (i *Client) startRegistration() chan error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wantNick == "" {
+		i.wantNick = i.Nick
+	}
+	i.Nick = i.wantNick
+	i.nicks = 0
+	i.regDone = make(chan error, 1)
+	i.capsListed = make(chan struct{})
+
+	return i.regDone
+}
+
+// register with the server, once we are connected, and wait for the result
+// on done
+func (i *Client) register(done chan error) error {
+	i.setRegistration(RegCaps)
+	nick := i.CurrentNick()
+	logger.Log.Infof("Registering as %s!%s", nick, i.Ident)
+	timeout := time.After(REGISTRATION_TIMEOUT)
+
+	if i.Dialect == DIALECT_TWITCH {
+		// Twitch does not list its capabilities, so they are requested
+		i.Write(&adapter.Event{
+			Command:    IRC_CAP,
+			Parameters: []string{"REQ", strings.Join(i.wantCaps(), " ")},
+		})
+	} else {
+		// Servers without IRCv3 capabilities will ignore this
+		i.Write(&adapter.Event{
+			Command:    IRC_CAP,
+			Parameters: []string{"LS", "302"},
+		})
+	}
+
+	password := i.Password
+	if i.Dialect == DIALECT_TWITCH && password != "" &&
+		!strings.HasPrefix(password, "oauth:") {
+		password = "oauth:" + password
+	}
+
+	i.mu.Lock()
+	secure, listed := i.secure, i.capsListed
+	i.mu.Unlock()
+
+	// Over plaintext, the password is held back until we know the server has
+	// no STS policy that would have us reconnect with TLS
+	if password != "" && !secure {
+		select {
+		case <-listed:
+		case err := <-done:
+			return err
+		case <-time.After(CAP_TIMEOUT):
+		}
+	}
+
+	if password != "" {
+		i.Write(&adapter.Event{
+			Command:    IRC_PASS,
+			Parameters: []string{password},
+		})
+	}
+
+	i.Write(&adapter.Event{
+		Command:    IRC_NICK,
+		Parameters: []string{nick},
+	})
+
+	// RFC 2812 USER command
+	i.Write(&adapter.Event{
+		Command: IRC_USER,
+		Parameters: []string{
+			i.Ident,
+			"0",
+			"*",
+			nick,
+		},
+	})
+
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		return ErrRegistrationTimeout
+	}
+}
+
+// listed is called once the server has listed its capabilities (or said it
+// has none)
+func (i *Client) listed() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.capsListed != nil {
+		close(i.capsListed)
+		i.capsListed = nil
+	}
+}
+
+// registered finishes registration with err (or nil, if we were welcomed)
+func (i *Client) registered(err error) {
+	i.mu.Lock()
+	done := i.regDone
+	i.regDone = nil
+	i.mu.Unlock()
+
+	if err == nil {
+		i.setRegistration(RegWelcomed)
+	}
+	if done != nil {
+		done <- err
+	}
+}
+
+// registering handles the server's replies while we register
+func (i *Client) registering(ev *adapter.Event, sent bool) {
+	if sent {
+		return
+	}
+
+	s := i.Registration()
+	if ev.Command == DISCONNECTED {
+		i.setRegistration(RegDisconnected)
+		return
+	}
+	if s == RegDisconnected || s == RegWelcomed {
+		return
+	}
+
+	switch ev.Command {
+	case IRC_RPL_WELCOME:
+		i.listed()
+		i.registered(nil)
+	case IRC_ERR_UNKNOWNCOMMAND, IRC_ERR_NOTREGISTERED:
+		// The server does not support capabilities
+		i.listed()
+	case IRC_ERR_NONICKNAMEGIVEN,
+		IRC_ERR_ERRONEUSNICKNAME,
+		IRC_ERR_NICKNAMEINUSE,
+		IRC_ERR_NICKCOLLISION,
+		IRC_ERR_UNAVAILRESOURCE:
+		nick, ok := i.nextNick(ev.Command == IRC_ERR_ERRONEUSNICKNAME)
+		if !ok {
+			i.registered(ErrNickUnavailable)
+			return
+		}
+
+		logger.Log.Infof("Nick %s is unavailable, trying %s", i.CurrentNick(), nick)
+		i.setNick(nick)
+		i.Write(&adapter.Event{
+			Command:    IRC_NICK,
+			Parameters: []string{nick},
+		})
+	case IRC_ERR_PASSWDMISMATCH:
+		i.registered(ErrBadPassword)
+	case IRC_ERR_YOUREBANNEDCREEP:
+		i.registered(ErrBanned)
+	case IRC_ERROR:
+		var reason string
+		if len(ev.Parameters) > 0 {
+			reason = ev.Parameters[len(ev.Parameters)-1]
+		}
+		i.registered(&ServerError{Reason: reason})
+	case IRC_AUTHENTICATE:
+		if len(ev.Parameters) > 0 && ev.Parameters[0] == "+" {
+			i.authenticate()
+		}
+	case IRC_RPL_SASLSUCCESS, IRC_ERR_SASLALREADY:
+		i.endCaps()
+	case IRC_ERR_NICKLOCKED,
+		IRC_ERR_SASLFAIL,
+		IRC_ERR_SASLTOOLONG,
+		IRC_ERR_SASLABORTED:
+		i.registered(ErrSASLFailed)
+	}
+}
+
+// nextNick returns the next nick to try, after ours was refused. Suffixed
+// nicks are only shortened to fit the server's NICKLEN, or, if it has not told
+// us, when our nick was erroneous (which may be because it was too long)
+func (i *Client) nextNick(erroneous bool) (string, bool) {
+	n := i.nicks
+	i.nicks++
+
+	if n < len(i.AltNicks) {
+		return i.AltNicks[n], true
+	}
+
+	n -= len(i.AltNicks)
+	if n >= MAX_NICK_SUFFIXES {
+		return "", false
+	}
+
+	suffix := "_"
+	if n > 0 {
+		suffix = strconv.Itoa(n)
+	}
+
+	nick := i.wantNick
+	max, ok := i.nickLen()
+	if !ok && erroneous {
+		max = DEFAULT_NICKLEN
+	}
+	if max > len(suffix) && len(nick)+len(suffix) > max {
+		nick = nick[:max-len(suffix)]
+	}
+
+	return nick + suffix, true
+}
+
+// nickLen is the longest nick the server allows, and whether it has told us
+func (i *Client) nickLen() (int, bool) {
+	if v, ok := i.ISupport("NICKLEN"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n, true
+		}
+	}
+
+	return 0, false
+}
+
+// startSASL starts SASL authentication, if it is configured, and reports
+// whether it was started
+func (i *Client) startSASL() bool {
+	if i.SASLUser == "" || !i.HasCap(CAP_SASL) ||
+		i.Registration() != RegCaps {
+		return false
+	}
+
+	i.setRegistration(RegSASL)
+	i.Write(&adapter.Event{
+		Command:    IRC_AUTHENTICATE,
+		Parameters: []string{"PLAIN"},
+	})
+
+	return true
+}
+
+// authenticate sends our SASL PLAIN credentials, in 400 byte chunks
+func (i *Client) authenticate() {
+	creds := base64.StdEncoding.EncodeToString(
+		[]byte(i.SASLUser + "\x00" + i.SASLUser + "\x00" + i.SASLPassword),
+	)
+
+	for len(creds) >= 400 {
+		i.Write(&adapter.Event{
+			Command:    IRC_AUTHENTICATE,
+			Parameters: []string{creds[:400]},
+		})
+		creds = creds[400:]
+	}
+	if creds == "" {
+		creds = "+"
+	}
+
+	i.Write(&adapter.Event{
+		Command:    IRC_AUTHENTICATE,
+		Parameters: []string{creds},
+	})
+}
+
+// wantCaps returns the capabilities to request
+func (i *Client) wantCaps() []string {
+	caps := append([]string(nil), i.Caps...)
+	if i.SASLUser != "" {
+		caps = append(caps, CAP_SASL)
+	}
+	if i.Dialect == DIALECT_TWITCH {
+		caps = []string{
+			CAP_TWITCH_COMMANDS,
+			CAP_TWITCH_MEMBERSHIP,
+			CAP_TWITCH_TAGS,
+		}
+	}
+
+	return caps
+}
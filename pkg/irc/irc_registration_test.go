@@ -0,0 +1,59 @@
+package irc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/irc/irctest"
+)
+
+const timeout = 2 * time.Second
+
+// refuseNicks starts connecting a client to a server that refuses every nick
+// with numeric. The client stops registering once the server is closed
+func refuseNicks(t *testing.T, numeric string) (*irctest.Server, func()) {
+	s := irctest.NewServer()
+	s.Handle("NICK", func(c *irctest.Conn, m *irctest.Message) {
+		c.Numeric(numeric, m.Param(0), "Nickname is unavailable")
+	})
+
+	addr, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := irc.NewClient("quarid-the-bot", "quarid", false, false)
+	go c.Loop()
+
+	done := make(chan error, 1)
+	go func() { done <- c.Connect(addr) }()
+
+	return s, func() {
+		s.Close()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			t.Fatal("The client did not stop registering")
+		}
+	}
+}
+
+func TestNickInUse(t *testing.T) {
+	s, done := refuseNicks(t, irc.IRC_ERR_NICKNAMEINUSE)
+	defer done()
+
+	// The server has not told us its NICKLEN, so the nick is not shortened
+	if _, err := s.Expect(`^NICK quarid-the-bot_$`, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNickErroneous(t *testing.T) {
+	s, done := refuseNicks(t, irc.IRC_ERR_ERRONEUSNICKNAME)
+	defer done()
+
+	if _, err := s.Expect(`^NICK quarid-t_$`, timeout); err != nil {
+		t.Fatal(err)
+	}
+}
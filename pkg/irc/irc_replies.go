@@ -0,0 +1,125 @@
+package irc
+
+// Replies
+//
+// With the IRCv3 message-tags capability, messages carry a msgid, and clients
+// may send tags of their own: +draft/reply marks a message as a reply to
+// another, and +draft/react reacts to one. Reactions with no text are sent as
+// TAGMSG. Servers may deny client tags with CLIENTTAGDENY.
+//
+// See also: https://ircv3.net/specs/extensions/message-ids
+// See also: https://ircv3.net/specs/client-tags/reply
+// See also: https://ircv3.net/specs/client-tags/react
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// Client tags
+const (
+	TAG_REPLY = "+draft/reply"
+	TAG_REACT = "+draft/react"
+)
+
+// ErrNoClientTags is returned when a client tag is needed, but the server
+// does not support it
+var ErrNoClientTags = errors.New("The server does not allow client tags")
+
+// MsgID returns the ID of the message ev, or "" if it has none
+func MsgID(ev *adapter.Event) string {
+	if id, ok := ev.Tags["msgid"]; ok {
+		return id
+	}
+
+	// Twitch's message IDs
+	return ev.Tags["id"]
+}
+
+// ReplyTarget returns where a reply to ev should be sent: the channel it was
+// sent to, or the nick that sent it privately
+func (i *Client) ReplyTarget(ev *adapter.Event) string {
+	if len(ev.Parameters) < 1 {
+		return ""
+	}
+
+	if i.IsChannel(ev.Parameters[0]) {
+		return ev.Parameters[0]
+	}
+
+	return ParseHostmask(ev.Prefix).Nick
+}
+
+// Reply to the message ev with text. The reply is threaded to ev if the
+// server allows it; otherwise, replies in a channel are addressed to the
+// sender ("nick: text"). The event returned is the reply as it was delivered
+func (i *Client) Reply(ev *adapter.Event, text string) (*adapter.Event, error) {
+	target := i.ReplyTarget(ev)
+	r := &adapter.Event{
+		Command:    IRC_PRIVMSG,
+		Parameters: []string{target, text},
+	}
+
+	id := MsgID(ev)
+	switch {
+	case id != "" && i.Dialect == DIALECT_TWITCH:
+		r.Tags = map[string]string{"reply-parent-msg-id": id}
+	case id != "" && i.ClientTag(TAG_REPLY):
+		r.Tags = map[string]string{TAG_REPLY: id}
+	case target != ParseHostmask(ev.Prefix).Nick:
+		r.Parameters[1] = ParseHostmask(ev.Prefix).Nick + ": " + text
+	}
+
+	return i.Deliver(r)
+}
+
+// React to the message ev with reaction (usually an emoji)
+func (i *Client) React(ev *adapter.Event, reaction string) error {
+	return i.react(i.ReplyTarget(ev), MsgID(ev), reaction)
+}
+
+// react to the message with ID id, sent to target
+func (i *Client) react(target, id, reaction string) error {
+	if id == "" || !i.ClientTag(TAG_REACT) {
+		return ErrNoClientTags
+	}
+
+	return i.Write(&adapter.Event{
+		Tags: map[string]string{
+			TAG_REPLY: id,
+			TAG_REACT: reaction,
+		},
+		Command:    IRC_TAGMSG,
+		Parameters: []string{target},
+	})
+}
+
+// ClientTag reports whether the client tag name may be sent to the server
+func (i *Client) ClientTag(name string) bool {
+	if !i.HasCap(CAP_MESSAGE_TAGS) {
+		return false
+	}
+
+	deny, ok := i.ISupport("CLIENTTAGDENY")
+	if !ok {
+		return true
+	}
+
+	// A list of denied tags, where "*" denies all, and "-tag" allows a tag
+	name = strings.TrimPrefix(name, "+")
+	allowed := true
+	for _, t := range strings.Split(deny, ",") {
+		switch {
+		case t == "*":
+			allowed = false
+		case t == "-"+name:
+			allowed = true
+		case t == name:
+			allowed = false
+		}
+	}
+
+	return allowed
+}
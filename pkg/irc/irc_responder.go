@@ -3,32 +3,96 @@ package irc
 // Responder
 //
 // Responder responds to the IRC server, by writing an IRC Event to the CLient's
-// connection
+// transport
 
 import (
-	"bytes"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/enmand/quarid-go/pkg/adapter"
 	"github.com/enmand/quarid-go/pkg/logger"
 )
 
-// Write an event to the server, and return an error if it fails
+// Write an event to the server, through our middleware, and return an error
+// if it fails
 func (i *Client) Write(ev *adapter.Event) error {
-	var payload [][]byte
+	return i.Middleware.Out(ev, i.write)
+}
+
+// WriteDirect writes an event to the server without our middleware. It is for
+// events that are not the bot's own, such as those typed by a bouncer's
+// clients, which the middleware should not change or drop
+func (i *Client) WriteDirect(ev *adapter.Event) error {
+	return i.write(ev)
+}
+
+func (i *Client) write(ev *adapter.Event) error {
+	if i.Dialect == DIALECT_TWITCH && twitchLimited(ev) {
+		i.queueTwitch(ev)
+		return nil
+	}
+
+	return i.send(ev)
+}
+
+// send ev to the server now
+func (i *Client) send(ev *adapter.Event) error {
 	logger.Log.Info("Writing event: ", ev)
 
-	payload = append(payload, []byte(ev.Command))
-	for i, p := range ev.Parameters {
-		if i == len(ev.Parameters)-1 && len(ev.Parameters) > 1 {
-			p = fmt.Sprintf(":%s\r\n", p)
+	err := i.transport.WriteLine(FormatLine(ev))
+	if err == nil {
+		if i.Tap != nil {
+			i.Tap(ev, true)
 		}
-		payload = append(payload, []byte(p))
+		i.observe(ev, true)
 	}
 
-	payload = append(payload, []byte("\r\n"))
-	full := bytes.Join(payload, []byte(" "))
-
-	_, err := i.conn.Write(full)
 	return err
 }
+
+// FormatLine formats an event as a line of the IRC protocol, without the
+// trailing CRLF
+func FormatLine(ev *adapter.Event) string {
+	var payload []string
+
+	if len(ev.Tags) > 0 {
+		var tags []string
+		for k, v := range ev.Tags {
+			if v == "" {
+				tags = append(tags, k)
+			} else {
+				tags = append(tags, fmt.Sprintf("%s=%s", k, tagEscaper.Replace(v)))
+			}
+		}
+		sort.Strings(tags)
+
+		payload = append(payload, "@"+strings.Join(tags, ";"))
+	}
+
+	if ev.Prefix != "" {
+		payload = append(payload, ":"+ev.Prefix)
+	}
+
+	payload = append(payload, ev.Command)
+	for i, p := range ev.Parameters {
+		last := i == len(ev.Parameters)-1
+		if last && (len(ev.Parameters) > 1 ||
+			p == "" ||
+			p[0] == ':' ||
+			strings.Contains(p, " ")) {
+			p = ":" + p
+		}
+		payload = append(payload, p)
+	}
+
+	return strings.Join(payload, " ")
+}
+
+var tagEscaper = strings.NewReplacer(
+	";", `\:`,
+	" ", `\s`,
+	`\`, `\\`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
@@ -0,0 +1,327 @@
+package irc
+
+// State
+//
+// State tracks the channels the client is in, their topics, and their members,
+// as events are read from the server.
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// Channel is the state of a channel the client has joined
+type Channel struct {
+	// The channel name
+	Name string
+
+	// The channel topic, if one is set
+	Topic string
+
+	// The channel members, and their membership prefixes (e.g. "@" or "+")
+	Members map[string]string
+}
+
+// State tracks the channels the client has joined
+type State struct {
+	mu       sync.RWMutex
+	channels map[string]*Channel
+
+	// channels we are reading a RPL_NAMREPLY list for
+	names map[string]bool
+}
+
+func newState() *State {
+	return &State{
+		channels: make(map[string]*Channel),
+		names:    make(map[string]bool),
+	}
+}
+
+// Channels returns a copy of the state of every channel the client is in
+func (s *State) Channels() []*Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var chs []*Channel
+	for _, ch := range s.channels {
+		chs = append(chs, ch.copy())
+	}
+
+	return chs
+}
+
+// Channel returns a copy of the state of the channel name, if the client is
+// in the channel
+func (s *State) Channel(name string) (*Channel, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ch, ok := s.channels[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+
+	return ch.copy(), true
+}
+
+// IsOn reports whether nick is a member of the channel name
+func (s *State) IsOn(name, nick string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ch, ok := s.channels[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+
+	_, ok = ch.member(nick)
+	return ok
+}
+
+// track updates the client's State (and nick) from events read from the
+// server
+func (i *Client) track(ev *adapter.Event, sent bool) {
+	if sent || ev.Historical {
+		return
+	}
+
+	if ev.Command == IRC_BATCH {
+		for _, b := range ev.Batch {
+			i.track(b, sent)
+		}
+		return
+	}
+
+	s := i.state
+	who := ParseHostmask(ev.Prefix).Nick
+	nick := i.CurrentNick()
+	me := strings.EqualFold(who, nick)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch ev.Command {
+	case IRC_RPL_WELCOME:
+		if len(ev.Parameters) > 0 {
+			i.setNick(ev.Parameters[0])
+		}
+	case IRC_JOIN:
+		if len(ev.Parameters) < 1 {
+			return
+		}
+		name := ev.Parameters[0]
+		if me {
+			s.channels[strings.ToLower(name)] = &Channel{
+				Name:    name,
+				Members: make(map[string]string),
+			}
+		}
+		if ch, ok := s.channels[strings.ToLower(name)]; ok {
+			ch.Members[who] = ""
+		}
+	case IRC_PART:
+		if len(ev.Parameters) < 1 {
+			return
+		}
+		s.leave(ev.Parameters[0], who, me)
+	case IRC_KICK:
+		if len(ev.Parameters) < 2 {
+			return
+		}
+		s.leave(
+			ev.Parameters[0],
+			ev.Parameters[1],
+			strings.EqualFold(ev.Parameters[1], nick),
+		)
+	case IRC_QUIT:
+		for _, ch := range s.channels {
+			ch.remove(who)
+		}
+	case IRC_NICK:
+		if len(ev.Parameters) < 1 {
+			return
+		}
+		to := ev.Parameters[0]
+		if me {
+			i.setNick(to)
+		}
+		for _, ch := range s.channels {
+			if p, ok := ch.member(who); ok {
+				ch.remove(who)
+				ch.Members[to] = p
+			}
+		}
+	case IRC_TOPIC:
+		if len(ev.Parameters) < 2 {
+			return
+		}
+		if ch, ok := s.channels[strings.ToLower(ev.Parameters[0])]; ok {
+			ch.Topic = ev.Parameters[1]
+		}
+	case IRC_RPL_TOPIC:
+		if len(ev.Parameters) < 3 {
+			return
+		}
+		if ch, ok := s.channels[strings.ToLower(ev.Parameters[1])]; ok {
+			ch.Topic = ev.Parameters[2]
+		}
+	case IRC_RPL_NAMREPLY:
+		if len(ev.Parameters) < 4 {
+			return
+		}
+		key := strings.ToLower(ev.Parameters[2])
+		ch, ok := s.channels[key]
+		if !ok {
+			return
+		}
+		if !s.names[key] {
+			// A new list of names replaces the members we know about
+			s.names[key] = true
+			ch.Members = make(map[string]string)
+		}
+		for _, n := range strings.Fields(ev.Parameters[3]) {
+			nick := strings.TrimLeft(n, i.prefixes())
+			ch.Members[nick] = n[:len(n)-len(nick)]
+		}
+	case IRC_RPL_ENDOFNAMES:
+		if len(ev.Parameters) < 2 {
+			return
+		}
+		delete(s.names, strings.ToLower(ev.Parameters[1]))
+	case IRC_MODE:
+		if len(ev.Parameters) < 3 {
+			return
+		}
+		if ch, ok := s.channels[strings.ToLower(ev.Parameters[0])]; ok {
+			i.modes(ch, ev.Parameters[1], ev.Parameters[2:])
+		}
+	case DISCONNECTED:
+		s.channels = make(map[string]*Channel)
+		s.names = make(map[string]bool)
+	}
+}
+
+// modes applies membership mode changes (such as +o) to the channel ch
+func (i *Client) modes(ch *Channel, modes string, args []string) {
+	prefixes := i.prefixModes()
+	add := true
+
+	for _, m := range modes {
+		switch m {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+
+		p, ok := prefixes[m]
+		if !ok {
+			// Only membership modes are tracked, but other modes may take
+			// an argument we need to skip
+			if i.modeTakesArg(m, add) && len(args) > 0 {
+				args = args[1:]
+			}
+			continue
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		nick := args[0]
+		args = args[1:]
+
+		cur, ok := ch.member(nick)
+		if !ok {
+			continue
+		}
+		cur = strings.Replace(cur, string(p), "", -1)
+		if add {
+			cur = string(p) + cur
+		}
+		ch.Members[nick] = cur
+	}
+}
+
+// prefixModes maps channel membership modes to their prefixes, from the
+// server's PREFIX token
+func (i *Client) prefixModes() map[rune]rune {
+	modes, prefixes := i.prefix()
+
+	m := make(map[rune]rune, len(modes))
+	for n, r := range modes {
+		m[r] = rune(prefixes[n])
+	}
+
+	return m
+}
+
+// prefixes returns the membership prefixes that may appear in RPL_NAMREPLY
+func (i *Client) prefixes() string {
+	_, prefixes := i.prefix()
+	return prefixes
+}
+
+// prefix returns the membership modes and their prefixes, in order, from the
+// PREFIX token (e.g. "(ov)@+")
+func (i *Client) prefix() (string, string) {
+	v, ok := i.ISupport("PREFIX")
+	if !ok || !strings.HasPrefix(v, "(") || !strings.Contains(v, ")") {
+		return "qaohv", "~&@%+"
+	}
+
+	end := strings.Index(v, ")")
+	modes, prefixes := v[1:end], v[end+1:]
+	if len(modes) != len(prefixes) {
+		return "qaohv", "~&@%+"
+	}
+
+	return modes, prefixes
+}
+
+func (s *State) leave(name, nick string, me bool) {
+	key := strings.ToLower(name)
+	if me {
+		delete(s.channels, key)
+		return
+	}
+
+	if ch, ok := s.channels[key]; ok {
+		ch.remove(nick)
+	}
+}
+
+func (ch *Channel) member(nick string) (string, bool) {
+	for n, p := range ch.Members {
+		if strings.EqualFold(n, nick) {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
+func (ch *Channel) remove(nick string) {
+	for n := range ch.Members {
+		if strings.EqualFold(n, nick) {
+			delete(ch.Members, n)
+		}
+	}
+}
+
+func (ch *Channel) copy() *Channel {
+	c := &Channel{
+		Name:    ch.Name,
+		Topic:   ch.Topic,
+		Members: make(map[string]string, len(ch.Members)),
+	}
+	for n, p := range ch.Members {
+		c.Members[n] = p
+	}
+
+	return c
+}
@@ -0,0 +1,196 @@
+package irc
+
+// Strict Transport Security
+//
+// Servers advertise an STS policy with the sts capability. On a plaintext
+// connection, the policy gives a port to reconnect to with TLS, and the client
+// does so immediately. On a TLS connection, the policy gives how long the
+// client must only use TLS for the server's hostname. Policies are kept in
+// the client's Store, so they apply after a restart, and a plaintext
+// connection is never made to a host with an active policy.
+//
+// See also: https://ircv3.net/specs/extensions/sts
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// CAP_STS is the capability servers advertise their STS policy with
+const CAP_STS = "sts"
+
+// stsBucket is where STS policies are kept, by hostname
+const stsBucket = "sts"
+
+// stsPolicy is a server's STS policy
+type stsPolicy struct {
+	Port     int           `json:"port"`
+	Duration time.Duration `json:"duration"`
+	Expires  time.Time     `json:"expires"`
+	Preload  bool          `json:"preload,omitempty"`
+}
+
+// stsUpgrade is returned while registering, when the server's STS policy
+// asks us to reconnect with TLS
+type stsUpgrade struct {
+	port int
+}
+
+func (u *stsUpgrade) Error() string {
+	return fmt.Sprintf("The server requires TLS, on port %d", u.port)
+}
+
+// parseSTS parses the value of the sts capability
+func parseSTS(v string) (port int, duration time.Duration, preload bool, ok bool) {
+	duration = -1
+
+	for _, kv := range strings.Split(v, ",") {
+		ts := strings.SplitN(kv, "=", 2)
+		switch ts[0] {
+		case "port":
+			if len(ts) == 2 {
+				port, _ = strconv.Atoi(ts[1])
+			}
+		case "duration":
+			if len(ts) == 2 {
+				if n, err := strconv.Atoi(ts[1]); err == nil && n >= 0 {
+					duration = time.Duration(n) * time.Second
+				}
+			}
+		case "preload":
+			preload = true
+		}
+	}
+
+	return port, duration, preload, port != 0 || duration >= 0
+}
+
+// sts applies the STS policy the server advertised, if it did. It returns
+// true if we are reconnecting with TLS, and negotiation should stop
+func (i *Client) sts() bool {
+	v, ok := i.Available(CAP_STS)
+	if !ok {
+		return false
+	}
+
+	port, duration, preload, ok := parseSTS(v)
+	if !ok {
+		return false
+	}
+
+	i.mu.Lock()
+	secure, addr := i.secure, i.addr
+	i.mu.Unlock()
+
+	if !secure {
+		if port == 0 {
+			return false
+		}
+
+		i.registered(&stsUpgrade{port: port})
+		return true
+	}
+
+	// The policy only applies once it was advertised over TLS
+	if duration < 0 {
+		return false
+	}
+	if duration == 0 {
+		i.deleteSTS()
+		return false
+	}
+
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, _ = strconv.Atoi(p)
+
+	i.saveSTS(&stsPolicy{
+		Port:     port,
+		Duration: duration,
+		Expires:  time.Now().Add(duration),
+		Preload:  preload,
+	})
+
+	return false
+}
+
+// stsPort returns the port to connect to with TLS, if the server's hostname
+// has an STS policy, or 0
+func (i *Client) stsPort() int {
+	if i.upgrade != 0 {
+		return i.upgrade
+	}
+
+	if p := i.loadSTS(); p != nil {
+		return p.Port
+	}
+
+	return 0
+}
+
+// refreshSTS restarts the expiry of the policy when we disconnect from a TLS
+// connection, as the policy was in effect until then
+func (i *Client) refreshSTS() {
+	i.mu.Lock()
+	secure := i.secure
+	i.mu.Unlock()
+
+	if p := i.loadSTS(); p != nil && secure {
+		p.Expires = time.Now().Add(p.Duration)
+		i.saveSTS(p)
+	}
+}
+
+// loadSTS returns the active STS policy for the server's hostname, if there
+// is one
+func (i *Client) loadSTS() *stsPolicy {
+	if i.Store == nil {
+		return nil
+	}
+
+	host := strings.ToLower(Hostname(i.Server))
+	p := &stsPolicy{}
+	if err := i.Store.Get(stsBucket, host, p); err != nil {
+		if err != database.ErrNotFound {
+			logger.Log.Errorf("Could not load the STS policy for %s: %s", host, err)
+		}
+		return nil
+	}
+
+	if time.Now().After(p.Expires) {
+		i.deleteSTS()
+		return nil
+	}
+
+	return p
+}
+
+func (i *Client) saveSTS(p *stsPolicy) {
+	if i.Store == nil {
+		return
+	}
+
+	host := strings.ToLower(Hostname(i.Server))
+	if err := i.Store.Put(stsBucket, host, p); err != nil {
+		logger.Log.Errorf("Could not save the STS policy for %s: %s", host, err)
+	}
+}
+
+func (i *Client) deleteSTS() {
+	if i.Store == nil {
+		return
+	}
+
+	host := strings.ToLower(Hostname(i.Server))
+	if err := i.Store.Delete(stsBucket, host); err != nil {
+		logger.Log.Errorf("Could not remove the STS policy for %s: %s", host, err)
+	}
+}
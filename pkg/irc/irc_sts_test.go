@@ -0,0 +1,46 @@
+package irc
+
+import (
+	"crypto/tls"
+	"sync"
+	"testing"
+
+	"github.com/enmand/quarid-go/pkg/irc/irctest"
+)
+
+func TestSTSUpgrade(t *testing.T) {
+	s := irctest.NewServer()
+	defer s.Close()
+	s.Caps[CAP_STS] = "port=6697"
+
+	// Every connection is made to the test server, which cannot speak TLS,
+	// but the addresses dialed are kept
+	var mu sync.Mutex
+	var dialed []string
+	irc := transports["irc"]
+	defer func() { transports["irc"] = irc }()
+	RegisterTransport("irc", func(addr string, tlsConfig *tls.Config) (Transport, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if tlsConfig != nil {
+			addr = "tls " + addr
+		}
+		dialed = append(dialed, addr)
+		return NewConnTransport(s.Pipe()), nil
+	}, false)
+
+	i := NewClient("quarid", "quarid", true, false)
+	go i.Loop()
+
+	if err := i.Connect("irc://irc.test:6667"); err != nil {
+		t.Fatal(err)
+	}
+	defer i.Disconnect()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 2 || dialed[0] != "irc.test:6667" || dialed[1] != "tls irc.test:6697" {
+		t.Fatalf("Expected to reconnect with TLS on port 6697, but dialed %q", dialed)
+	}
+}
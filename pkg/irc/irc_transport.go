@@ -0,0 +1,270 @@
+package irc
+
+// Transports
+//
+// A Transport carries lines of the IRC protocol between the client and the
+// server. The transport is chosen by the scheme of the server address:
+//
+//	irc.example.com:6667         TCP (or TLS, if the client uses TLS)
+//	irc://irc.example.com:6667   TCP
+//	ircs://irc.example.com:6697  TLS
+//	ws://irc.example.com/webirc  WebSocket
+//	wss://irc.example.com/webirc WebSocket, over TLS
+//
+// See also: https://ircv3.net/specs/extensions/websocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries lines of the IRC protocol to and from a server
+type Transport interface {
+	// ReadLine reads a single line, without its line ending
+	ReadLine() (string, error)
+
+	// WriteLine writes a single line, without a line ending
+	WriteLine(l string) error
+
+	// Close the transport
+	Close() error
+}
+
+// DialFunc connects a Transport to the server at addr. If tlsConfig is not
+// nil, the connection must use TLS
+type DialFunc func(addr string, tlsConfig *tls.Config) (Transport, error)
+
+// WebSocket subprotocols for IRC
+const (
+	WS_TEXT   = "text.ircv3.net"
+	WS_BINARY = "binary.ircv3.net"
+)
+
+// transports are the DialFuncs for each server address scheme, and whether
+// the scheme always uses TLS
+var transports = map[string]struct {
+	dial DialFunc
+	tls  bool
+}{
+	"":     {dialTCP, false},
+	"irc":  {dialTCP, false},
+	"ircs": {dialTCP, true},
+	"ws":   {dialWebSocket, false},
+	"wss":  {dialWebSocket, true},
+}
+
+// RegisterTransport makes a Transport available for server addresses with
+// the given scheme
+func RegisterTransport(scheme string, dial DialFunc, useTLS bool) {
+	transports[scheme] = struct {
+		dial DialFunc
+		tls  bool
+	}{dial, useTLS}
+}
+
+// dial the server, using the transport for its address scheme
+func (i *Client) dial() (Transport, error) {
+	scheme, addr := splitScheme(i.Server)
+
+	t, ok := transports[scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unknown transport %s://", scheme)
+	}
+
+	secure := i.TLS || t.tls
+	verify := i.TLSVerify
+
+	// Hosts with an STS policy are only connected to with TLS
+	if !secure && (scheme == "" || scheme == "irc") {
+		if port := i.stsPort(); port != 0 {
+			logger.Log.Infof(
+				"Using TLS on port %d for %s, as required by its STS policy",
+				port,
+				Hostname(i.Server),
+			)
+			addr = net.JoinHostPort(Hostname(i.Server), strconv.Itoa(port))
+			secure, verify = true, true
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if secure {
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: !verify,
+			ServerName:         Hostname(i.Server),
+		}
+	}
+
+	i.mu.Lock()
+	i.secure = secure
+	i.addr = addr
+	i.mu.Unlock()
+
+	return t.dial(addr, tlsConfig)
+}
+
+// Hostname returns the hostname of a server address
+func Hostname(server string) string {
+	scheme, addr := splitScheme(server)
+	if scheme == "ws" || scheme == "wss" {
+		if u, err := url.Parse(server); err == nil {
+			return u.Hostname()
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// splitScheme splits a server address into its scheme, and the address to
+// dial. WebSocket addresses are kept whole
+func splitScheme(server string) (string, string) {
+	i := strings.Index(server, "://")
+	if i < 0 {
+		return "", server
+	}
+
+	scheme := strings.ToLower(server[:i])
+	if scheme == "ws" || scheme == "wss" {
+		return scheme, server
+	}
+
+	return scheme, strings.TrimRight(server[i+3:], "/")
+}
+
+// tcpTransport is IRC over TCP (or TLS), with CRLF line endings
+type tcpTransport struct {
+	conn net.Conn
+	r    *textproto.Reader
+
+	mu sync.Mutex
+}
+
+func dialTCP(addr string, tlsConfig *tls.Config) (Transport, error) {
+	var conn net.Conn
+	var err error
+
+	d := &net.Dialer{Timeout: TIMEOUT}
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConnTransport(conn), nil
+}
+
+// NewConnTransport returns a Transport for IRC over an existing connection
+func NewConnTransport(conn net.Conn) Transport {
+	return &tcpTransport{
+		conn: conn,
+		r:    textproto.NewReader(bufio.NewReader(conn)),
+	}
+}
+
+func (t *tcpTransport) ReadLine() (string, error) {
+	return t.r.ReadLine()
+}
+
+func (t *tcpTransport) WriteLine(l string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, err := t.conn.Write([]byte(l + "\r\n"))
+	return err
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// wsTransport is IRC over WebSocket, with one line per message
+type wsTransport struct {
+	conn *websocket.Conn
+
+	// The message type lines are sent as, from the negotiated subprotocol
+	messageType int
+
+	mu sync.Mutex
+}
+
+func dialWebSocket(addr string, tlsConfig *tls.Config) (Transport, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WebSocket address %s: %s", addr, err)
+	}
+	if tlsConfig != nil {
+		u.Scheme = "wss"
+	}
+
+	d := &websocket.Dialer{
+		HandshakeTimeout: TIMEOUT,
+		TLSClientConfig:  tlsConfig,
+		Subprotocols:     []string{WS_BINARY, WS_TEXT},
+	}
+
+	conn, _, err := d.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &wsTransport{
+		conn:        conn,
+		messageType: websocket.TextMessage,
+	}
+	if conn.Subprotocol() == WS_BINARY {
+		t.messageType = websocket.BinaryMessage
+	}
+
+	return t, nil
+}
+
+func (t *wsTransport) ReadLine() (string, error) {
+	for {
+		_, m, err := t.conn.ReadMessage()
+		if err != nil {
+			return "", err
+		}
+
+		// Lines should not have line endings, but be lenient if they do
+		l := strings.TrimRight(string(m), "\r\n")
+		if l != "" {
+			return l, nil
+		}
+	}
+}
+
+func (t *wsTransport) WriteLine(l string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.conn.WriteMessage(t.messageType, []byte(l))
+}
+
+func (t *wsTransport) Close() error {
+	t.mu.Lock()
+	t.conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+	)
+	t.mu.Unlock()
+
+	return t.conn.Close()
+}
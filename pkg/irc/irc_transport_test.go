@@ -0,0 +1,242 @@
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/irc/irctest"
+	"github.com/gorilla/websocket"
+)
+
+const timeout = 2 * time.Second
+
+// webIRC serves IRC over WebSocket, offering the subprotocols given, with each
+// connection bridged to an irctest.Server
+type webIRC struct {
+	*irctest.Server
+	http *httptest.Server
+
+	mu    sync.Mutex
+	types []int
+}
+
+func newWebIRC(secure bool, protocols ...string) *webIRC {
+	w := &webIRC{Server: irctest.NewServer()}
+
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		u := websocket.Upgrader{Subprotocols: protocols}
+		ws, err := u.Upgrade(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		conn := w.Pipe()
+		defer conn.Close()
+
+		mt := websocket.TextMessage
+		if ws.Subprotocol() == WS_BINARY {
+			mt = websocket.BinaryMessage
+		}
+
+		go func() {
+			lines := bufio.NewScanner(conn)
+			for lines.Scan() {
+				ws.WriteMessage(mt, []byte(strings.TrimRight(lines.Text(), "\r")))
+			}
+		}()
+
+		for {
+			t, m, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			w.mu.Lock()
+			w.types = append(w.types, t)
+			w.mu.Unlock()
+
+			if _, err := conn.Write(append(m, '\r', '\n')); err != nil {
+				return
+			}
+		}
+	})
+
+	if secure {
+		w.http = httptest.NewTLSServer(h)
+	} else {
+		w.http = httptest.NewServer(h)
+	}
+
+	return w
+}
+
+// url of the server, with the scheme given
+func (w *webIRC) url(scheme string) string {
+	return scheme + strings.TrimPrefix(strings.TrimPrefix(w.http.URL, "https"), "http") + "/webirc"
+}
+
+// messageTypes returns the types of the messages the client sent
+func (w *webIRC) messageTypes() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]int(nil), w.types...)
+}
+
+func (w *webIRC) Close() {
+	w.Server.Close()
+	w.http.Close()
+}
+
+// register as quarid through t, and return the lines read until the server
+// welcomed us
+func register(tt *testing.T, t Transport) []string {
+	for _, l := range []string{"NICK quarid", "USER quarid 0 * quarid"} {
+		if err := t.WriteLine(l); err != nil {
+			tt.Fatalf("Could not write %q: %s", l, err)
+		}
+	}
+
+	read := make(chan []string, 1)
+	go func() {
+		var ls []string
+		for {
+			l, err := t.ReadLine()
+			if err != nil {
+				read <- nil
+				return
+			}
+			ls = append(ls, l)
+			if strings.Contains(l, " 001 quarid ") {
+				read <- ls
+				return
+			}
+		}
+	}()
+
+	select {
+	case ls := <-read:
+		if ls == nil {
+			tt.Fatal("Expected to be welcomed before the transport closed")
+		}
+		return ls
+	case <-time.After(timeout):
+		tt.Fatal("Expected to be welcomed")
+	}
+
+	return nil
+}
+
+func TestWebSocketText(t *testing.T) {
+	w := newWebIRC(false, WS_TEXT)
+	defer w.Close()
+
+	tr, err := dialWebSocket(w.url("ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	for _, l := range register(t, tr) {
+		if strings.HasSuffix(l, "\r") || strings.HasSuffix(l, "\n") {
+			t.Fatalf("Expected lines without line endings, but got %q", l)
+		}
+	}
+	if _, err := w.Expect(`^NICK quarid$`, timeout); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mt := range w.messageTypes() {
+		if mt != websocket.TextMessage {
+			t.Fatalf("Expected text messages, but got type %d", mt)
+		}
+	}
+}
+
+func TestWebSocketBinary(t *testing.T) {
+	w := newWebIRC(false, WS_BINARY, WS_TEXT)
+	defer w.Close()
+
+	tr, err := dialWebSocket(w.url("ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	register(t, tr)
+
+	mts := w.messageTypes()
+	if len(mts) == 0 {
+		t.Fatal("Expected messages from the client")
+	}
+	for _, mt := range mts {
+		if mt != websocket.BinaryMessage {
+			t.Fatalf("Expected binary messages, but got type %d", mt)
+		}
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	w := newWebIRC(true, WS_TEXT)
+	defer w.Close()
+
+	// The test server only speaks TLS
+	if _, err := dialWebSocket(w.url("ws"), nil); err == nil {
+		t.Fatal("Expected plain WebSocket to fail against a TLS server")
+	}
+
+	// The test server's certificate is self-signed
+	tr, err := dialWebSocket(w.url("wss"), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	register(t, tr)
+}
+
+func TestDial(t *testing.T) {
+	s := irctest.NewServer()
+	defer s.Close()
+	addr, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, server := range []string{addr, "irc://" + addr, "irc://" + addr + "/"} {
+		tr, err := (&Client{Server: server}).dial()
+		if err != nil {
+			t.Fatalf("Could not dial %s: %s", server, err)
+		}
+		if _, ok := tr.(*tcpTransport); !ok {
+			t.Fatalf("Expected a TCP transport for %s, but got %T", server, tr)
+		}
+		tr.Close()
+	}
+
+	if _, err := (&Client{Server: "gopher://irc.example.com"}).dial(); err == nil {
+		t.Fatal("Expected an error for an unknown transport")
+	}
+}
+
+func TestHostname(t *testing.T) {
+	for server, host := range map[string]string{
+		"irc.example.com:6667":          "irc.example.com",
+		"irc://irc.example.com:6667":    "irc.example.com",
+		"ircs://irc.example.com:6697/":  "irc.example.com",
+		"ws://irc.example.com/webirc":   "irc.example.com",
+		"wss://irc.example.com:8097/ws": "irc.example.com",
+		"irc.example.com":               "irc.example.com",
+	} {
+		if h := Hostname(server); h != host {
+			t.Errorf("Expected the hostname of %s to be %s, but got %s", server, host, h)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package irc
+
+// Twitch
+//
+// Twitch chat is IRC, with its own dialect: the PASS is an OAuth token, the
+// twitch.tv/* capabilities are requested without CAP LS, users are described
+// by tags (with badges), and there are commands of its own, such as
+// USERNOTICE and CLEARCHAT. With the Twitch dialect, TwitchEvent parses these
+// into typed events, and messages are queued to be sent within Twitch's rate
+// limits, which are higher in channels where we are a moderator.
+//
+// See also: https://dev.twitch.tv/docs/irc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// Dialect is the variant of IRC a server speaks
+type Dialect string
+
+// Dialects the client can speak
+const (
+	DIALECT_RFC    Dialect = "rfc"
+	DIALECT_TWITCH Dialect = "twitch"
+)
+
+// Twitch capabilities
+const (
+	CAP_TWITCH_COMMANDS   = "twitch.tv/commands"
+	CAP_TWITCH_MEMBERSHIP = "twitch.tv/membership"
+	CAP_TWITCH_TAGS       = "twitch.tv/tags"
+)
+
+// Twitch commands
+const (
+	TWITCH_CLEARCHAT       = "CLEARCHAT"
+	TWITCH_CLEARMSG        = "CLEARMSG"
+	TWITCH_GLOBALUSERSTATE = "GLOBALUSERSTATE"
+	TWITCH_RECONNECT       = "RECONNECT"
+	TWITCH_ROOMSTATE       = "ROOMSTATE"
+	TWITCH_USERNOTICE      = "USERNOTICE"
+	TWITCH_USERSTATE       = "USERSTATE"
+	TWITCH_WHISPER         = "WHISPER"
+)
+
+// Twitch rate limits: how many messages may be sent in each period, in
+// channels where we are (or aren't) a moderator
+const (
+	TWITCH_RATE_PERIOD = 30 * time.Second
+	TWITCH_RATE        = 20
+	TWITCH_RATE_MOD    = 100
+)
+
+// TwitchUser is a Twitch user, as described by a message's tags
+type TwitchUser struct {
+	Login       string
+	DisplayName string
+	ID          string
+	Color       string
+
+	// Badges, and their versions (e.g. "subscriber": "12")
+	Badges map[string]string
+
+	Broadcaster bool
+	Moderator   bool
+	Subscriber  bool
+	VIP         bool
+}
+
+// TwitchMessage is a PRIVMSG in a Twitch channel
+type TwitchMessage struct {
+	Channel string
+	User    *TwitchUser
+	Text    string
+
+	// The message's ID, and how many bits were cheered with it
+	ID   string
+	Bits int
+}
+
+// UserNotice is a USERNOTICE: a subscription, raid, or other event in a
+// channel
+type UserNotice struct {
+	Channel string
+	User    *TwitchUser
+
+	// The kind of notice (e.g. "sub", "resub" or "raid")
+	Kind string
+
+	// The message Twitch shows for the notice, and any message from the user
+	SystemMsg string
+	Text      string
+
+	// The msg-param-* tags, without the msg-param- prefix
+	Params map[string]string
+}
+
+// ClearChat is a CLEARCHAT: a user was timed out or banned, or the channel's
+// chat was cleared
+type ClearChat struct {
+	Channel string
+
+	// The user whose messages were cleared, or "" if the whole chat was
+	Login string
+
+	// How long the user was timed out for, or 0 if they were banned
+	Duration time.Duration
+}
+
+// RoomState is a ROOMSTATE: the channel's chat settings. Only the settings
+// that were sent are set
+type RoomState struct {
+	Channel string
+
+	EmoteOnly *bool
+	SubsOnly  *bool
+	R9K       *bool
+
+	// Followers-only (-1 if disabled), and slow mode
+	FollowersOnly *time.Duration
+	Slow          *time.Duration
+}
+
+// Whisper is a private message on Twitch
+type Whisper struct {
+	User *TwitchUser
+	To   string
+	Text string
+}
+
+// TwitchEvent parses ev into a *TwitchMessage, *UserNotice, *ClearChat,
+// *RoomState or *Whisper. It returns nil if ev is none of these
+func TwitchEvent(ev *adapter.Event) interface{} {
+	var channel, text string
+	if len(ev.Parameters) > 0 {
+		channel = ev.Parameters[0]
+	}
+	if len(ev.Parameters) > 1 {
+		text = ev.Parameters[len(ev.Parameters)-1]
+	}
+
+	switch ev.Command {
+	case IRC_PRIVMSG:
+		bits, _ := strconv.Atoi(ev.Tags["bits"])
+		return &TwitchMessage{
+			Channel: channel,
+			User:    twitchUser(ev),
+			Text:    text,
+			ID:      ev.Tags["id"],
+			Bits:    bits,
+		}
+	case TWITCH_USERNOTICE:
+		n := &UserNotice{
+			Channel:   channel,
+			User:      twitchUser(ev),
+			Kind:      ev.Tags["msg-id"],
+			SystemMsg: ev.Tags["system-msg"],
+			Text:      text,
+			Params:    make(map[string]string),
+		}
+		for k, v := range ev.Tags {
+			if strings.HasPrefix(k, "msg-param-") {
+				n.Params[strings.TrimPrefix(k, "msg-param-")] = v
+			}
+		}
+		return n
+	case TWITCH_CLEARCHAT:
+		c := &ClearChat{Channel: channel, Login: text}
+		if d, err := strconv.Atoi(ev.Tags["ban-duration"]); err == nil {
+			c.Duration = time.Duration(d) * time.Second
+		}
+		return c
+	case TWITCH_ROOMSTATE:
+		r := &RoomState{Channel: channel}
+		r.EmoteOnly = tagBool(ev, "emote-only")
+		r.SubsOnly = tagBool(ev, "subs-only")
+		r.R9K = tagBool(ev, "r9k")
+		r.FollowersOnly = tagDuration(ev, "followers-only", time.Minute)
+		r.Slow = tagDuration(ev, "slow", time.Second)
+		return r
+	case TWITCH_WHISPER:
+		return &Whisper{
+			User: twitchUser(ev),
+			To:   channel,
+			Text: text,
+		}
+	}
+
+	return nil
+}
+
+// twitchUser describes the user that sent ev, from its tags
+func twitchUser(ev *adapter.Event) *TwitchUser {
+	u := &TwitchUser{
+		Login:       ParseHostmask(ev.Prefix).Nick,
+		DisplayName: ev.Tags["display-name"],
+		ID:          ev.Tags["user-id"],
+		Color:       ev.Tags["color"],
+		Badges:      make(map[string]string),
+	}
+	if l, ok := ev.Tags["login"]; ok {
+		u.Login = l
+	}
+
+	for _, b := range strings.Split(ev.Tags["badges"], ",") {
+		kv := strings.SplitN(b, "/", 2)
+		if kv[0] == "" {
+			continue
+		}
+		if len(kv) == 2 {
+			u.Badges[kv[0]] = kv[1]
+		} else {
+			u.Badges[kv[0]] = ""
+		}
+	}
+
+	_, u.Broadcaster = u.Badges["broadcaster"]
+	_, u.VIP = u.Badges["vip"]
+	u.Moderator = ev.Tags["mod"] == "1" || u.Broadcaster
+	u.Subscriber = ev.Tags["subscriber"] == "1"
+
+	return u
+}
+
+func tagBool(ev *adapter.Event, tag string) *bool {
+	v, ok := ev.Tags[tag]
+	if !ok {
+		return nil
+	}
+
+	b := v == "1"
+	return &b
+}
+
+func tagDuration(ev *adapter.Event, tag string, unit time.Duration) *time.Duration {
+	v, ok := ev.Tags[tag]
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil
+	}
+
+	d := time.Duration(n) * unit
+	if n < 0 {
+		d = -1
+	}
+	return &d
+}
+
+// twitch is the state kept for the Twitch dialect
+type twitch struct {
+	mu   sync.Mutex
+	mods map[string]bool
+
+	// PRIVMSGs waiting to be sent, whether they are being written, and when
+	// those in the current rate limit period were sent
+	queue   []*adapter.Event
+	writing bool
+	sent    []time.Time
+}
+
+func newTwitch() *twitch {
+	return &twitch{
+		mods: make(map[string]bool),
+	}
+}
+
+// observeTwitch tracks the channels where we are a moderator, and drops the
+// queued messages when we are disconnected
+func (i *Client) observeTwitch(ev *adapter.Event, sent bool) {
+	if sent || i.Dialect != DIALECT_TWITCH {
+		return
+	}
+
+	switch ev.Command {
+	case TWITCH_USERSTATE:
+		if len(ev.Parameters) < 1 {
+			return
+		}
+
+		u := twitchUser(ev)
+
+		i.twitch.mu.Lock()
+		i.twitch.mods[strings.ToLower(ev.Parameters[0])] = u.Moderator
+		i.twitch.mu.Unlock()
+	case DISCONNECTED:
+		i.twitch.mu.Lock()
+		if n := len(i.twitch.queue); n > 0 {
+			logger.Log.Warningf("Dropping %d messages waiting to be sent to Twitch", n)
+		}
+		i.twitch.queue = nil
+		i.twitch.mu.Unlock()
+	}
+}
+
+// twitchLimited reports whether ev counts against Twitch's rate limits
+func twitchLimited(ev *adapter.Event) bool {
+	return ev.Command == IRC_PRIVMSG && len(ev.Parameters) > 0
+}
+
+// queueTwitch queues ev to be sent once Twitch's rate limits allow it. The
+// queue is written apart from the caller, which may be handling events
+func (i *Client) queueTwitch(ev *adapter.Event) {
+	t := i.twitch
+
+	t.mu.Lock()
+	t.queue = append(t.queue, ev)
+	start := !t.writing
+	t.writing = true
+	t.mu.Unlock()
+
+	if start {
+		clock.Go(clock.Or(i.Clock), i.writeTwitch)
+	}
+}
+
+// writeTwitch sends queued messages while the rate limits allow it, and
+// continues once they allow the next
+func (i *Client) writeTwitch() {
+	c := clock.Or(i.Clock)
+	t := i.twitch
+
+	for {
+		t.mu.Lock()
+		if len(t.queue) == 0 {
+			t.writing = false
+			t.mu.Unlock()
+			return
+		}
+
+		ev := t.queue[0]
+		now := c.Now()
+		if d := t.delay(ev, now); d > 0 {
+			t.mu.Unlock()
+			c.AfterFunc(d, i.writeTwitch)
+			return
+		}
+
+		t.queue = t.queue[1:]
+		t.sent = append(t.sent, now)
+		t.mu.Unlock()
+
+		if err := i.send(ev); err != nil {
+			logger.Log.Errorf("Could not send to %s: %s", ev.Parameters[0], err)
+		}
+	}
+}
+
+// delay returns how long ev must wait, at now, to be sent within the rate
+// limits. Messages to every channel count in the same period, and one may be
+// sent while fewer than TWITCH_RATE were, or TWITCH_RATE_MOD in channels
+// where we are a moderator. t.mu must be held
+func (t *twitch) delay(ev *adapter.Event, now time.Time) time.Duration {
+	for len(t.sent) > 0 && !now.Before(t.sent[0].Add(TWITCH_RATE_PERIOD)) {
+		t.sent = t.sent[1:]
+	}
+
+	n := TWITCH_RATE
+	if t.mods[strings.ToLower(ev.Parameters[0])] {
+		n = TWITCH_RATE_MOD
+	}
+	if len(t.sent) < n {
+		return 0
+	}
+
+	return t.sent[len(t.sent)-n].Add(TWITCH_RATE_PERIOD).Sub(now)
+}
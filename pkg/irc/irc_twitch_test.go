@@ -0,0 +1,166 @@
+package irc
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+)
+
+// lines is a Transport that keeps the lines written to it
+type lines struct {
+	mu      sync.Mutex
+	written []string
+}
+
+func (l *lines) ReadLine() (string, error) { select {} }
+func (l *lines) Close() error              { return nil }
+
+func (l *lines) WriteLine(s string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.written = append(l.written, s)
+	return nil
+}
+
+func (l *lines) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.written)
+}
+
+// manual is a Clock that only moves when it is advanced
+type manual struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+	busy   sync.WaitGroup
+}
+
+type manualTimer struct {
+	at time.Time
+	f  func()
+}
+
+func (t *manualTimer) Stop() bool { return false }
+
+func (c *manual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *manual) AfterFunc(d time.Duration, f func()) clock.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &manualTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *manual) Busy() func() {
+	c.busy.Add(1)
+	return c.busy.Done
+}
+
+// advance the clock by d, running the timers that are due, and wait for
+// anything they started
+func (c *manual) advance(d time.Duration) {
+	c.busy.Wait()
+
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*manualTimer
+	var rest []*manualTimer
+	for _, t := range c.timers {
+		if c.now.Before(t.at) {
+			rest = append(rest, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = rest
+	c.mu.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+	c.busy.Wait()
+}
+
+func twitchClient() (*Client, *lines, *manual) {
+	l := &lines{}
+	c := &manual{now: time.Unix(0, 0)}
+
+	i := NewClient("quarid", "quarid", true, true)
+	i.Dialect = DIALECT_TWITCH
+	i.Clock = c
+	i.transport = l
+
+	return i, l, c
+}
+
+func privmsg(channel string) *adapter.Event {
+	return &adapter.Event{Command: IRC_PRIVMSG, Parameters: []string{channel, "hi"}}
+}
+
+func TestTwitchRateLimit(t *testing.T) {
+	i, l, c := twitchClient()
+
+	start := time.Now()
+	for n := 0; n < TWITCH_RATE+5; n++ {
+		if err := i.Write(privmsg("#channel")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Writes waited for the rate limit, for %s", d)
+	}
+
+	c.advance(0)
+	if n := l.count(); n != TWITCH_RATE {
+		t.Fatalf("Expected %d messages to be sent, but %d were", TWITCH_RATE, n)
+	}
+
+	c.advance(TWITCH_RATE_PERIOD)
+	if n := l.count(); n != TWITCH_RATE+5 {
+		t.Fatalf("Expected every message to be sent after %s, but %d were", TWITCH_RATE_PERIOD, n)
+	}
+}
+
+func TestTwitchRateLimitShared(t *testing.T) {
+	i, l, c := twitchClient()
+	i.observe(&adapter.Event{
+		Command:    TWITCH_USERSTATE,
+		Tags:       map[string]string{"mod": "1"},
+		Parameters: []string{"#modded"},
+	}, false)
+
+	// Messages where we are a moderator count against the lower limit too
+	for n := 0; n < TWITCH_RATE; n++ {
+		i.Write(privmsg("#modded"))
+	}
+	i.Write(privmsg("#channel"))
+	c.advance(0)
+
+	if n := l.count(); n != TWITCH_RATE {
+		t.Fatalf("Expected %d messages to be sent, but %d were", TWITCH_RATE, n)
+	}
+	for _, w := range l.written {
+		if strings.Contains(w, "#channel") {
+			t.Fatalf("A message was sent over the limit: %s", w)
+		}
+	}
+
+	c.advance(TWITCH_RATE_PERIOD)
+	if n := l.count(); n != TWITCH_RATE+1 {
+		t.Fatalf("Expected %d messages to be sent, but %d were", TWITCH_RATE+1, n)
+	}
+}
@@ -0,0 +1,396 @@
+// Package irctest provides an in-process IRC server for testing IRC clients
+//
+// About
+//
+// The Server in this package speaks enough of the IRC protocol to register a
+// client (including CAP negotiation and SASL PLAIN), join channels, list
+// names, and send messages between clients. Every line read and written is
+// recorded, so that a test can wait for the client to send an expected line:
+//
+//	s := irctest.NewServer()
+//	addr, _ := s.Listen()
+//	defer s.Close()
+//
+//	// ... connect a client to addr ...
+//
+//	if _, err := s.Expect(`^JOIN #test`, time.Second); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// Server behaviour can be scripted per-command using Handle.
+package irctest
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default server name, used as the prefix for server messages
+const DefaultName = "irc.test"
+
+// Direction is the direction a Line was sent in
+type Direction int
+
+const (
+	// FromClient lines were read from a client
+	FromClient Direction = iota
+
+	// FromServer lines were written to a client
+	FromServer
+)
+
+// Line is a single recorded line of traffic
+type Line struct {
+	// The connection the line was read from, or written to
+	Conn *Conn
+
+	// Whether the line came from the client or the server
+	Direction Direction
+
+	// The parsed line
+	Message *Message
+
+	// When the line was recorded
+	Time time.Time
+}
+
+// HandlerFunc handles a Message read from a client connection. Handlers
+// registered with Server.Handle replace the built-in handling for a command
+type HandlerFunc func(c *Conn, m *Message)
+
+// Server is a scriptable, in-memory IRC server
+type Server struct {
+	// The server name, sent as the prefix of server messages
+	Name string
+
+	// Capabilities advertised in CAP LS, and their values
+	Caps map[string]string
+
+	// Accounts accepted for SASL PLAIN authentication (account → password).
+	// If this is non-nil, the "sasl" capability is advertised
+	Accounts map[string]string
+
+	// Connection password required with PASS, if non-empty
+	Password string
+
+	// ISUPPORT tokens sent in RPL_ISUPPORT (005) after registration
+	ISupport []string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	listener net.Listener
+	conns    []*Conn
+	channels map[string]*channel
+	handlers map[string]HandlerFunc
+	traffic  []*Line
+	cursor   map[Direction]int
+	closed   bool
+}
+
+type channel struct {
+	name    string
+	key     string
+	topic   string
+	members []*Conn
+}
+
+// NewServer returns a new Server, that has not started listening
+func NewServer() *Server {
+	s := &Server{
+		Name: DefaultName,
+		Caps: map[string]string{},
+		ISupport: []string{
+			"CHANTYPES=#&",
+			"NICKLEN=30",
+			"PREFIX=(ov)@+",
+			"NETWORK=IRCTest",
+		},
+		channels: make(map[string]*channel),
+		handlers: make(map[string]HandlerFunc),
+		cursor:   make(map[Direction]int),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// Listen starts listening for clients on a loopback TCP port, and returns the
+// address clients should connect to
+func (s *Server) Listen() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("Could not listen: %s", err)
+	}
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(nc)
+		}
+	}()
+
+	return l.Addr().String(), nil
+}
+
+// Addr returns the address the Server is listening on, if it is listening
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return ""
+	}
+
+	return s.listener.Addr().String()
+}
+
+// Pipe returns the client end of an in-memory connection to the Server
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+	s.serve(server)
+
+	return client
+}
+
+// Close stops the Server, and closes all client connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	l := s.listener
+	conns := append([]*Conn(nil), s.conns...)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	if l != nil {
+		return l.Close()
+	}
+
+	return nil
+}
+
+// Handle replaces the built-in handling of command with h. If h is nil, the
+// built-in handler is restored
+func (s *Server) Handle(command string, h HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	command = strings.ToUpper(command)
+	if h == nil {
+		delete(s.handlers, command)
+	} else {
+		s.handlers[command] = h
+	}
+}
+
+// Conns returns the client connections the Server currently has
+func (s *Server) Conns() []*Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Conn(nil), s.conns...)
+}
+
+// Broadcast sends a raw line to every connected client
+func (s *Server) Broadcast(format string, args ...interface{}) {
+	for _, c := range s.Conns() {
+		c.Send(format, args...)
+	}
+}
+
+// Lines returns all of the traffic recorded so far
+func (s *Server) Lines() []*Line {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Line(nil), s.traffic...)
+}
+
+// Expect waits up to timeout for a client to send a line matching the regular
+// expression pattern. Lines are consumed in order: each call only considers
+// client lines recorded after the previous match
+func (s *Server) Expect(pattern string, timeout time.Duration) (*Line, error) {
+	return s.expect(FromClient, pattern, timeout)
+}
+
+// ExpectSent waits up to timeout for the server to write a line matching the
+// regular expression pattern to a client. Like Expect, matches are consumed in
+// order
+func (s *Server) ExpectSent(pattern string, timeout time.Duration) (*Line, error) {
+	return s.expect(FromServer, pattern, timeout)
+}
+
+func (s *Server) expect(
+	d Direction,
+	pattern string,
+	timeout time.Duration,
+) (*Line, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid expectation %q: %s", pattern, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for i := s.cursor[d]; i < len(s.traffic); i++ {
+			l := s.traffic[i]
+			if l.Direction == d && re.MatchString(l.Message.Raw) {
+				s.cursor[d] = i + 1
+				return l, nil
+			}
+		}
+
+		if s.closed {
+			return nil, fmt.Errorf("Server closed while expecting %q", pattern)
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("No line matching %q within %s", pattern, timeout)
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// record a line of traffic, and wake anyone waiting on an expectation
+func (s *Server) record(c *Conn, d Direction, m *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.traffic = append(s.traffic, &Line{
+		Conn:      c,
+		Direction: d,
+		Message:   m,
+		Time:      time.Now(),
+	})
+	s.cond.Broadcast()
+}
+
+func (s *Server) serve(nc net.Conn) {
+	c := newConn(s, nc)
+
+	s.mu.Lock()
+	s.conns = append(s.conns, c)
+	s.mu.Unlock()
+
+	go c.loop()
+}
+
+func (s *Server) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, o := range s.conns {
+		if o == c {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+
+	for name, ch := range s.channels {
+		ch.remove(c)
+		if len(ch.members) == 0 {
+			delete(s.channels, name)
+		}
+	}
+}
+
+func (s *Server) handler(command string) HandlerFunc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h, ok := s.handlers[command]; ok {
+		return h
+	}
+
+	return builtins[command]
+}
+
+// SetKey sets the key required to join the channel name, creating the channel
+// if it does not exist
+func (s *Server) SetKey(name, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channel(name, true).key = key
+}
+
+// Members returns the nicks of the members of the channel name
+func (s *Server) Members(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var nicks []string
+	if ch := s.channel(name, false); ch != nil {
+		for _, c := range ch.members {
+			nicks = append(nicks, c.Nick())
+		}
+	}
+
+	return nicks
+}
+
+// channel returns the named channel, creating it if create is true. s.mu must
+// be held
+func (s *Server) channel(name string, create bool) *channel {
+	ch, ok := s.channels[strings.ToLower(name)]
+	if !ok && create {
+		ch = &channel{name: name}
+		s.channels[strings.ToLower(name)] = ch
+	}
+
+	return ch
+}
+
+// find a registered connection by nick. s.mu must be held
+func (s *Server) find(nick string) *Conn {
+	for _, c := range s.conns {
+		if strings.EqualFold(c.Nick(), nick) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (ch *channel) has(c *Conn) bool {
+	for _, m := range ch.members {
+		if m == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ch *channel) remove(c *Conn) {
+	for i, m := range ch.members {
+		if m == c {
+			ch.members = append(ch.members[:i], ch.members[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package irctest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Conn is a single client connection to the Server
+type Conn struct {
+	s  *Server
+	nc net.Conn
+
+	mu         sync.Mutex
+	nick       string
+	user       string
+	host       string
+	account    string
+	mech       string
+	passed     bool
+	negotiate  bool
+	registered bool
+	caps       map[string]bool
+	closed     bool
+}
+
+func newConn(s *Server, nc net.Conn) *Conn {
+	return &Conn{
+		s:    s,
+		nc:   nc,
+		host: "127.0.0.1",
+		caps: make(map[string]bool),
+	}
+}
+
+// Nick returns the client's current nickname
+func (c *Conn) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nick
+}
+
+// Hostmask returns the client's nick!user@host
+func (c *Conn) Hostmask() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fmt.Sprintf("%s!%s@%s", c.nick, c.user, c.host)
+}
+
+// Account returns the account the client authenticated as with SASL, if any
+func (c *Conn) Account() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.account
+}
+
+// Registered reports whether the client has completed registration
+func (c *Conn) Registered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.registered
+}
+
+// HasCap reports whether the client has enabled the capability name
+func (c *Conn) HasCap(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.caps[name]
+}
+
+// Send writes a raw line to the client
+func (c *Conn) Send(format string, args ...interface{}) error {
+	l := fmt.Sprintf(format, args...)
+	m := ParseMessage(l)
+	if m == nil {
+		return fmt.Errorf("Will not send an empty line")
+	}
+
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return fmt.Errorf("Connection is closed")
+	}
+
+	c.s.record(c, FromServer, m)
+
+	_, err := c.nc.Write([]byte(l + "\r\n"))
+	return err
+}
+
+// Numeric sends a numeric reply to the client, from the server
+func (c *Conn) Numeric(numeric string, params ...string) error {
+	nick := c.Nick()
+	if nick == "" {
+		nick = "*"
+	}
+
+	m := &Message{
+		Prefix:  c.s.Name,
+		Command: numeric,
+		Params:  append([]string{nick}, params...),
+	}
+
+	return c.Send("%s", m.String())
+}
+
+// Error sends an ERROR line to the client, and closes the connection
+func (c *Conn) Error(reason string) error {
+	err := c.Send("ERROR :%s", reason)
+	c.Close()
+
+	return err
+}
+
+// Close closes the client connection
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.s.remove(c)
+
+	return c.nc.Close()
+}
+
+func (c *Conn) loop() {
+	defer c.Close()
+
+	r := bufio.NewReader(c.nc)
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		m := ParseMessage(strings.TrimRight(l, "\r\n"))
+		if m == nil {
+			// Tolerate blank lines
+			continue
+		}
+		c.s.record(c, FromClient, m)
+
+		if h := c.s.handler(m.Command); h != nil {
+			h(c, m)
+		} else if c.Registered() {
+			c.Numeric("421", m.Command, "Unknown command")
+		}
+	}
+}
+
+// builtins are the default handlers for client commands
+var builtins map[string]HandlerFunc
+
+func init() {
+	builtins = map[string]HandlerFunc{
+		"CAP":          handleCap,
+		"AUTHENTICATE": handleAuthenticate,
+		"PASS":         handlePass,
+		"NICK":         handleNick,
+		"USER":         handleUser,
+		"PING":         handlePing,
+		"PONG":         func(*Conn, *Message) {},
+		"JOIN":         handleJoin,
+		"PART":         handlePart,
+		"NAMES":        handleNames,
+		"PRIVMSG":      handleMessage,
+		"NOTICE":       handleMessage,
+		"QUIT":         handleQuit,
+	}
+}
+
+func handleCap(c *Conn, m *Message) {
+	switch strings.ToUpper(m.Param(0)) {
+	case "LS":
+		c.mu.Lock()
+		c.negotiate = true
+		c.mu.Unlock()
+
+		var caps []string
+		for k, v := range c.s.advertised() {
+			if v != "" && m.Param(1) == "302" {
+				k = fmt.Sprintf("%s=%s", k, v)
+			}
+			caps = append(caps, k)
+		}
+		c.Send(":%s CAP %s LS :%s", c.s.Name, c.target(), strings.Join(caps, " "))
+	case "LIST":
+		var caps []string
+		c.mu.Lock()
+		for k := range c.caps {
+			caps = append(caps, k)
+		}
+		c.mu.Unlock()
+		c.Send(":%s CAP %s LIST :%s", c.s.Name, c.target(), strings.Join(caps, " "))
+	case "REQ":
+		c.mu.Lock()
+		c.negotiate = true
+		c.mu.Unlock()
+
+		req := strings.Fields(m.Param(1))
+		adv := c.s.advertised()
+		for _, r := range req {
+			if _, ok := adv[strings.TrimPrefix(r, "-")]; !ok {
+				c.Send(":%s CAP %s NAK :%s", c.s.Name, c.target(), m.Param(1))
+				return
+			}
+		}
+
+		c.mu.Lock()
+		for _, r := range req {
+			if strings.HasPrefix(r, "-") {
+				delete(c.caps, r[1:])
+			} else {
+				c.caps[r] = true
+			}
+		}
+		c.mu.Unlock()
+		c.Send(":%s CAP %s ACK :%s", c.s.Name, c.target(), m.Param(1))
+	case "END":
+		c.mu.Lock()
+		c.negotiate = false
+		c.mu.Unlock()
+		c.register()
+	default:
+		c.Numeric("410", m.Param(0), "Invalid CAP command")
+	}
+}
+
+func handleAuthenticate(c *Conn, m *Message) {
+	if !c.HasCap("sasl") {
+		c.Numeric("904", "SASL authentication failed")
+		return
+	}
+
+	c.mu.Lock()
+	mech := c.mech
+	c.mu.Unlock()
+
+	switch p := m.Param(0); {
+	case p == "*":
+		c.setMech("")
+		c.Numeric("906", "SASL authentication aborted")
+	case mech == "" && strings.ToUpper(p) == "PLAIN":
+		c.setMech("PLAIN")
+		c.Send("AUTHENTICATE +")
+	case mech == "":
+		c.Numeric("908", "PLAIN", "are available SASL mechanisms")
+		c.Numeric("904", "SASL authentication failed")
+	default:
+		c.setMech("")
+
+		d, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			c.Numeric("904", "SASL authentication failed")
+			return
+		}
+
+		fs := bytes.Split(d, []byte{0})
+		if len(fs) != 3 {
+			c.Numeric("904", "SASL authentication failed")
+			return
+		}
+
+		account, pass := string(fs[1]), string(fs[2])
+		if want, ok := c.s.Accounts[account]; !ok || want != pass {
+			c.Numeric("904", "SASL authentication failed")
+			return
+		}
+
+		c.mu.Lock()
+		c.account = account
+		c.mu.Unlock()
+
+		c.Numeric("900", c.Hostmask(), account, "You are now logged in as "+account)
+		c.Numeric("903", "SASL authentication successful")
+	}
+}
+
+func handlePass(c *Conn, m *Message) {
+	c.mu.Lock()
+	c.passed = m.Param(0) == c.s.Password
+	c.mu.Unlock()
+}
+
+func handleNick(c *Conn, m *Message) {
+	nick := m.Param(0)
+	if nick == "" {
+		c.Numeric("431", "No nickname given")
+		return
+	}
+	if strings.ContainsAny(nick, " ,*?!@#") {
+		c.Numeric("432", nick, "Erroneous nickname")
+		return
+	}
+
+	c.s.mu.Lock()
+	o := c.s.find(nick)
+	c.s.mu.Unlock()
+	if o != nil && o != c {
+		c.Numeric("433", nick, "Nickname is already in use")
+		return
+	}
+
+	old := c.Hostmask()
+
+	c.mu.Lock()
+	c.nick = nick
+	registered := c.registered
+	c.mu.Unlock()
+
+	if registered {
+		c.Send(":%s NICK :%s", old, nick)
+		for _, o := range c.peers() {
+			o.Send(":%s NICK :%s", old, nick)
+		}
+		return
+	}
+
+	c.register()
+}
+
+func handleUser(c *Conn, m *Message) {
+	if len(m.Params) < 4 {
+		c.Numeric("461", "USER", "Not enough parameters")
+		return
+	}
+
+	c.mu.Lock()
+	c.user = m.Param(0)
+	c.mu.Unlock()
+
+	c.register()
+}
+
+func handlePing(c *Conn, m *Message) {
+	c.Send(":%s PONG %s :%s", c.s.Name, c.s.Name, m.Param(0))
+}
+
+func handleJoin(c *Conn, m *Message) {
+	if !c.Registered() {
+		c.Numeric("451", "You have not registered")
+		return
+	}
+
+	if m.Param(0) == "" {
+		c.Numeric("461", "JOIN", "Not enough parameters")
+		return
+	}
+
+	names := strings.Split(m.Param(0), ",")
+	keys := strings.Split(m.Param(1), ",")
+	for i, name := range names {
+		if name == "" {
+			continue
+		}
+		if !strings.ContainsAny(name[:1], "#&") {
+			c.Numeric("403", name, "No such channel")
+			continue
+		}
+
+		var key string
+		if i < len(keys) {
+			key = keys[i]
+		}
+
+		c.s.mu.Lock()
+		ch := c.s.channel(name, true)
+		if ch.key != "" && ch.key != key {
+			c.s.mu.Unlock()
+			c.Numeric("475", name, "Cannot join channel (+k)")
+			continue
+		}
+		if ch.has(c) {
+			c.s.mu.Unlock()
+			continue
+		}
+		ch.members = append(ch.members, c)
+		members := append([]*Conn(nil), ch.members...)
+		topic := ch.topic
+		c.s.mu.Unlock()
+
+		for _, o := range members {
+			o.Send(":%s JOIN %s", c.Hostmask(), ch.name)
+		}
+		if topic != "" {
+			c.Numeric("332", ch.name, topic)
+		}
+		c.names(ch.name)
+	}
+}
+
+func handlePart(c *Conn, m *Message) {
+	for _, name := range strings.Split(m.Param(0), ",") {
+		c.s.mu.Lock()
+		ch := c.s.channel(name, false)
+		if ch == nil || !ch.has(c) {
+			c.s.mu.Unlock()
+			c.Numeric("442", name, "You're not on that channel")
+			continue
+		}
+		members := append([]*Conn(nil), ch.members...)
+		ch.remove(c)
+		c.s.mu.Unlock()
+
+		for _, o := range members {
+			if m.Param(1) != "" {
+				o.Send(":%s PART %s :%s", c.Hostmask(), ch.name, m.Param(1))
+			} else {
+				o.Send(":%s PART %s", c.Hostmask(), ch.name)
+			}
+		}
+	}
+}
+
+func handleNames(c *Conn, m *Message) {
+	for _, name := range strings.Split(m.Param(0), ",") {
+		c.names(name)
+	}
+}
+
+func handleMessage(c *Conn, m *Message) {
+	if !c.Registered() {
+		c.Numeric("451", "You have not registered")
+		return
+	}
+	if len(m.Params) < 2 {
+		c.Numeric("412", "No text to send")
+		return
+	}
+
+	for _, target := range strings.Split(m.Param(0), ",") {
+		out := &Message{
+			Prefix:  c.Hostmask(),
+			Command: m.Command,
+			Params:  []string{target, m.Param(1)},
+		}
+
+		if !c.s.deliver(c, target, out) && m.Command == "PRIVMSG" {
+			c.Numeric("401", target, "No such nick/channel")
+			continue
+		}
+
+		if c.HasCap("echo-message") {
+			c.Send("%s", out.String())
+		}
+	}
+}
+
+func handleQuit(c *Conn, m *Message) {
+	reason := m.Param(0)
+	if reason == "" {
+		reason = "Client quit"
+	}
+
+	for _, o := range c.peers() {
+		o.Send(":%s QUIT :%s", c.Hostmask(), reason)
+	}
+	c.Error(fmt.Sprintf("Closing link: %s (%s)", c.host, reason))
+}
+
+// Privmsg delivers a PRIVMSG from the hostmask from, to the channel or nick
+// target, as though another user sent it
+func (s *Server) Privmsg(from, target, text string) bool {
+	return s.deliver(nil, target, &Message{
+		Prefix:  from,
+		Command: "PRIVMSG",
+		Params:  []string{target, text},
+	})
+}
+
+// deliver m to target (a channel or nick), skipping the sender. It returns
+// false if there is no such target
+func (s *Server) deliver(sender *Conn, target string, m *Message) bool {
+	var recipients []*Conn
+
+	s.mu.Lock()
+	if ch := s.channel(target, false); ch != nil {
+		for _, o := range ch.members {
+			if o != sender {
+				recipients = append(recipients, o)
+			}
+		}
+	} else if o := s.find(target); o != nil {
+		recipients = append(recipients, o)
+	} else {
+		s.mu.Unlock()
+		return false
+	}
+	s.mu.Unlock()
+
+	for _, o := range recipients {
+		o.Send("%s", m.String())
+	}
+
+	return true
+}
+
+// advertised returns the capabilities the server advertises
+func (s *Server) advertised() map[string]string {
+	caps := make(map[string]string)
+	for k, v := range s.Caps {
+		caps[k] = v
+	}
+	if s.Accounts != nil {
+		caps["sasl"] = "PLAIN"
+	}
+
+	return caps
+}
+
+// register completes client registration, if the client has sent everything
+// it needs to
+func (c *Conn) register() {
+	c.mu.Lock()
+	if c.registered || c.negotiate || c.nick == "" || c.user == "" {
+		c.mu.Unlock()
+		return
+	}
+	if c.s.Password != "" && !c.passed {
+		c.mu.Unlock()
+		c.Numeric("464", "Password incorrect")
+		c.Error("Bad password")
+		return
+	}
+	c.registered = true
+	nick := c.nick
+	c.mu.Unlock()
+
+	c.Numeric("001", fmt.Sprintf("Welcome to the test network, %s", nick))
+	c.Numeric("002", fmt.Sprintf("Your host is %s", c.s.Name))
+	c.Numeric("003", "This server was created for a test")
+	c.Numeric("004", c.s.Name, "irctest", "io", "knt")
+	if len(c.s.ISupport) > 0 {
+		c.Numeric("005", append(
+			append([]string(nil), c.s.ISupport...),
+			"are supported by this server",
+		)...)
+	}
+	c.Numeric("422", "MOTD File is missing")
+}
+
+// names sends RPL_NAMREPLY and RPL_ENDOFNAMES for the channel name
+func (c *Conn) names(name string) {
+	c.s.mu.Lock()
+	var nicks []string
+	if ch := c.s.channel(name, false); ch != nil {
+		for _, o := range ch.members {
+			nicks = append(nicks, o.Nick())
+		}
+	}
+	c.s.mu.Unlock()
+
+	if len(nicks) > 0 {
+		c.Numeric("353", "=", name, strings.Join(nicks, " "))
+	}
+	c.Numeric("366", name, "End of /NAMES list")
+}
+
+// peers returns the connections that share a channel with c
+func (c *Conn) peers() []*Conn {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	seen := make(map[*Conn]bool)
+	var ps []*Conn
+	for _, ch := range c.s.channels {
+		if !ch.has(c) {
+			continue
+		}
+		for _, o := range ch.members {
+			if o != c && !seen[o] {
+				seen[o] = true
+				ps = append(ps, o)
+			}
+		}
+	}
+
+	return ps
+}
+
+// target is the client's nick, or "*" before a nick is set
+func (c *Conn) target() string {
+	if n := c.Nick(); n != "" {
+		return n
+	}
+
+	return "*"
+}
+
+func (c *Conn) setMech(mech string) {
+	c.mu.Lock()
+	c.mech = mech
+	c.mu.Unlock()
+}
@@ -0,0 +1,119 @@
+package irctest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Message is a single IRC protocol line, as seen by the test server
+type Message struct {
+	// IRCv3 message tags, if any were sent
+	Tags map[string]string
+
+	// The message prefix (optional in spec)
+	Prefix string
+
+	// The command, or numeric
+	Command string
+
+	// The command parameters, with the trailing parameter (if any) last
+	Params []string
+
+	// The line as it was read or written, without the line ending
+	Raw string
+}
+
+// ParseMessage parses a single line of the IRC protocol. It returns nil if
+// the line contains no command
+func ParseMessage(l string) *Message {
+	m := &Message{Raw: l}
+	l = strings.TrimSpace(l)
+
+	if strings.HasPrefix(l, "@") {
+		var tags string
+		tags, l = split(l[1:])
+		m.Tags = make(map[string]string)
+		for _, t := range strings.Split(tags, ";") {
+			kv := strings.SplitN(t, "=", 2)
+			if len(kv) == 2 {
+				m.Tags[kv[0]] = kv[1]
+			} else {
+				m.Tags[kv[0]] = ""
+			}
+		}
+	}
+
+	if strings.HasPrefix(l, ":") {
+		m.Prefix, l = split(l[1:])
+	}
+
+	m.Command, l = split(l)
+	if m.Command == "" {
+		return nil
+	}
+	m.Command = strings.ToUpper(m.Command)
+
+	for l != "" {
+		if l[0] == ':' {
+			m.Params = append(m.Params, l[1:])
+			break
+		}
+
+		var p string
+		p, l = split(l)
+		m.Params = append(m.Params, p)
+	}
+
+	return m
+}
+
+// Param returns the nth parameter of the message, or "" if there is none
+func (m *Message) Param(n int) string {
+	if n < len(m.Params) {
+		return m.Params[n]
+	}
+
+	return ""
+}
+
+// String formats the Message as a line of the IRC protocol
+func (m *Message) String() string {
+	var ws []string
+
+	if len(m.Tags) > 0 {
+		var tags []string
+		for k, v := range m.Tags {
+			if v == "" {
+				tags = append(tags, k)
+			} else {
+				tags = append(tags, fmt.Sprintf("%s=%s", k, v))
+			}
+		}
+		ws = append(ws, "@"+strings.Join(tags, ";"))
+	}
+
+	if m.Prefix != "" {
+		ws = append(ws, ":"+m.Prefix)
+	}
+	ws = append(ws, m.Command)
+
+	for i, p := range m.Params {
+		if i == len(m.Params)-1 &&
+			(p == "" || p[0] == ':' || strings.Contains(p, " ")) {
+			p = ":" + p
+		}
+		ws = append(ws, p)
+	}
+
+	return strings.Join(ws, " ")
+}
+
+// split the first space separated word from the rest of l
+func split(l string) (string, string) {
+	ws := strings.SplitN(l, " ", 2)
+	if len(ws) == 1 {
+		return ws[0], ""
+	}
+
+	return ws[0], strings.TrimLeft(ws[1], " ")
+}
@@ -0,0 +1,182 @@
+// Package matrix adapts the Matrix client-server API to the adapter package
+//
+// About
+//
+// The Matrix adapter logs in to a homeserver with a password (or uses an
+// access token it was given), and long-polls /sync for events. Messages,
+// reactions, redactions and membership changes in the rooms the bot has
+// joined are translated into adapter Updates, and Updates are sent back as
+// Matrix events. Formatted text is sent as HTML, alongside its plain text.
+//
+// The sync token is kept in a Store, so that a restart resumes where the bot
+// left off, instead of replaying the rooms' history. Without a token, the
+// first sync only learns the state of the rooms.
+//
+// See also: https://spec.matrix.org/latest/client-server-api/
+package matrix
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// ADAPTER_NAME is the name of the Matrix adapter
+const ADAPTER_NAME = "matrix"
+
+// SYNC_TIMEOUT is how long the homeserver holds each /sync open, waiting for
+// events
+const SYNC_TIMEOUT = 30 * time.Second
+
+// How long to wait before retrying a failed /sync, doubling up to the maximum
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// ErrNoCredentials is returned when there is neither an access token nor a
+// password to log in with
+var ErrNoCredentials = errors.New("No Matrix access token or password")
+
+// Matrix is a connection to a Matrix homeserver
+type Matrix struct {
+	// The homeserver's base URL (e.g. https://matrix.example.com)
+	Homeserver string
+
+	// The user to log in as, and their password. If AccessToken is set, it
+	// is used instead of logging in
+	User        string
+	Password    string
+	AccessToken string
+
+	// The device to log in as. If empty, the homeserver creates one
+	DeviceID string
+
+	// Rooms (by ID or alias) to join when we connect
+	Rooms []string
+
+	// Join rooms the bot is invited to
+	AutoJoin bool
+
+	// The HTTP client for requests to the homeserver
+	HTTPClient *http.Client
+
+	store database.Store
+
+	// Our own user ID, once we are logged in
+	userID string
+
+	mu       sync.Mutex
+	since    string
+	rooms    map[string]*room
+	direct   map[string]bool
+	names    map[string]string
+	handlers []adapter.UpdateFunc
+
+	// Reactions, by event ID, so that redacting them can be understood, and
+	// our own reactions, so that they can be redacted
+	reactions map[string]*adapter.Reaction
+	reacted   map[string]string
+
+	txn  int
+	stop chan struct{}
+	done chan error
+}
+
+// room is what we know of a joined room, from its state
+type room struct {
+	id      string
+	name    string
+	alias   string
+	members map[string]string
+}
+
+// New returns a Matrix adapter for the homeserver, that keeps its sync token
+// in store
+func New(homeserver string, store database.Store) *Matrix {
+	return &Matrix{
+		Homeserver: homeserver,
+		HTTPClient: &http.Client{Timeout: SYNC_TIMEOUT + time.Minute},
+		store:      store,
+		rooms:      make(map[string]*room),
+		direct:     make(map[string]bool),
+		names:      make(map[string]string),
+		reactions:  make(map[string]*adapter.Reaction),
+		reacted:    make(map[string]string),
+	}
+}
+
+// Name of the adapter
+func (m *Matrix) Name() string {
+	return ADAPTER_NAME
+}
+
+// UserID returns our own user ID, once we are connected
+func (m *Matrix) UserID() string {
+	return m.userID
+}
+
+// Connect logs in to the homeserver, and starts syncing
+func (m *Matrix) Connect() error {
+	if err := m.login(); err != nil {
+		return err
+	}
+
+	for _, r := range m.Rooms {
+		if err := m.request("POST", "/join/"+url.PathEscape(r), nil, struct{}{}, nil); err != nil {
+			logger.Log.Warningf("Could not join Matrix room %s: %s", r, err)
+		}
+	}
+
+	// When resuming from a sync token, the state of the rooms is not synced
+	// again, so we ask for it
+	if m.since = m.loadSince(); m.since != "" {
+		m.loadRooms()
+	}
+
+	m.stop = make(chan struct{})
+	m.done = make(chan error, 1)
+	go m.syncLoop(m.stop)
+
+	return nil
+}
+
+// Disconnect stops syncing. The access token is kept, so that the device's
+// keys and sync token stay valid
+func (m *Matrix) Disconnect() error {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+
+	return nil
+}
+
+// Wait blocks while syncing, and returns the error that stopped it
+func (m *Matrix) Wait() error {
+	return <-m.done
+}
+
+// Receive calls f with each Update from the homeserver
+func (m *Matrix) Receive(f adapter.UpdateFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handlers = append(m.handlers, f)
+}
+
+func (m *Matrix) dispatch(u adapter.Update) {
+	m.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), m.handlers...)
+	m.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, m)
+	}
+}
@@ -0,0 +1,173 @@
+package matrix
+
+// Client-server API
+//
+// Requests to the homeserver are JSON, authenticated with the access token.
+// Errors have an errcode (such as M_FORBIDDEN); requests that are rate
+// limited (M_LIMIT_EXCEEDED) are retried once the homeserver allows it.
+//
+// See also: https://spec.matrix.org/latest/client-server-api/#api-standards
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// API_PREFIX is the path of the client-server API on the homeserver
+const API_PREFIX = "/_matrix/client/v3"
+
+// maxRetries is how many times a rate limited request is retried
+const maxRetries = 5
+
+// Error is an error response from the homeserver
+type Error struct {
+	Status     int    `json:"-"`
+	Code       string `json:"errcode"`
+	Message    string `json:"error"`
+	RetryAfter int    `json:"retry_after_ms,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Matrix error %s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+// request sends a request to the homeserver, with the JSON body in (if not
+// nil), and decodes the response into out (if not nil)
+func (m *Matrix) request(method, path string, query url.Values, in, out interface{}) error {
+	u := strings.TrimRight(m.Homeserver, "/") + API_PREFIX + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	for n := 0; ; n++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if m.AccessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+		}
+
+		resp, err := m.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode >= 400 {
+			e := &Error{Status: resp.StatusCode}
+			if err := json.Unmarshal(b, e); err != nil {
+				e.Message = http.StatusText(resp.StatusCode)
+			}
+
+			if e.Code == "M_LIMIT_EXCEEDED" && n < maxRetries {
+				wait := time.Duration(e.RetryAfter) * time.Millisecond
+				if wait <= 0 {
+					wait = time.Second
+				}
+				logger.Log.Debugf("Rate limited by the homeserver; retrying in %s", wait)
+				time.Sleep(wait)
+				continue
+			}
+
+			return e
+		}
+
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(b, out)
+	}
+}
+
+// login with the password, or check the access token we were given
+func (m *Matrix) login() error {
+	if m.AccessToken != "" {
+		var r struct {
+			UserID   string `json:"user_id"`
+			DeviceID string `json:"device_id"`
+		}
+		if err := m.request("GET", "/account/whoami", nil, nil, &r); err != nil {
+			return fmt.Errorf("Could not check Matrix access token: %s", err)
+		}
+
+		m.userID = r.UserID
+		if r.DeviceID != "" {
+			m.DeviceID = r.DeviceID
+		}
+		return nil
+	}
+
+	if m.User == "" || m.Password == "" {
+		return ErrNoCredentials
+	}
+
+	req := map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]string{
+			"type": "m.id.user",
+			"user": m.User,
+		},
+		"password":                    m.Password,
+		"initial_device_display_name": "quarid",
+	}
+	if m.DeviceID != "" {
+		req["device_id"] = m.DeviceID
+	}
+
+	var r struct {
+		UserID      string `json:"user_id"`
+		AccessToken string `json:"access_token"`
+		DeviceID    string `json:"device_id"`
+	}
+	if err := m.request("POST", "/login", nil, req, &r); err != nil {
+		return fmt.Errorf("Could not log in to Matrix as %s: %s", m.User, err)
+	}
+
+	m.userID, m.AccessToken, m.DeviceID = r.UserID, r.AccessToken, r.DeviceID
+	logger.Log.Infof("Logged in to Matrix as %s (device %s)", m.userID, m.DeviceID)
+
+	return nil
+}
+
+// txnID returns a new transaction ID, so that the homeserver can recognise
+// requests that are retried
+func (m *Matrix) txnID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.txn++
+	return fmt.Sprintf("quarid.%d.%d", time.Now().UnixNano(), m.txn)
+}
+
+// roomPath is the path of an endpoint for a room
+func roomPath(roomID string, parts ...string) string {
+	p := "/rooms/" + url.PathEscape(roomID)
+	for _, s := range parts {
+		p += "/" + url.PathEscape(s)
+	}
+
+	return p
+}
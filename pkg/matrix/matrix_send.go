@@ -0,0 +1,220 @@
+package matrix
+
+// Sending
+//
+// Messages are sent as m.room.message events, with formatted text as HTML
+// alongside its plain text. Replies and threads use m.relates_to, edits are
+// m.replace relations, and reactions are m.reaction annotations, which are
+// taken back by redacting them. Topics are set as the m.room.topic state.
+//
+// See also: https://spec.matrix.org/latest/client-server-api/#sending-events-to-a-room
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// Send an Update to the homeserver
+func (m *Matrix) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		c := content(u.Kind, u.Text)
+		if u.ReplyTo != "" || u.Thread != "" {
+			c.RelatesTo = relation(u.ReplyTo, u.Thread)
+		}
+		return m.send(u.Room, u.Kind, u.Text, c)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+
+		c := content(u.Kind, u.Text)
+		c.RelatesTo = relation(u.To.ID, u.To.Thread)
+		return m.send(u.To.Room, u.Kind, u.Text, c)
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+
+		n := content(u.Message.Kind, u.Text)
+		c := content(u.Message.Kind, "* "+u.Text)
+		c.NewContent = n
+		c.RelatesTo = &relatesTo{RelType: REL_REPLACE, EventID: u.Message.ID}
+		return m.send(u.Message.Room, u.Message.Kind, u.Text, c)
+	case *adapter.Reaction:
+		return nil, m.react(u)
+	case *adapter.Membership:
+		return nil, m.setMembership(u)
+	case *adapter.Topic:
+		return nil, m.request("PUT", roomPath(u.Room.ID, "state", EVENT_TOPIC, ""), nil, map[string]string{"topic": u.Topic}, nil)
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// SendHTML sends a message of HTML to a room, with its plain text
+func (m *Matrix) SendHTML(roomID, html, plain string) (*adapter.Message, error) {
+	c := &messageContent{
+		MsgType:       MSG_TEXT,
+		Body:          plain,
+		Format:        FORMAT_HTML,
+		FormattedBody: html,
+	}
+
+	return m.send(m.room(roomID), adapter.Text, format.ParseHTML(html), c)
+}
+
+// Redact an event, such as a message, with an optional reason
+func (m *Matrix) Redact(roomID, eventID, reason string) error {
+	body := map[string]string{}
+	if reason != "" {
+		body["reason"] = reason
+	}
+
+	return m.request("PUT", roomPath(roomID, "redact", eventID, m.txnID()), nil, body, nil)
+}
+
+// content is the content of a message, with formatted text sent as HTML
+func content(kind adapter.Kind, text string) *messageContent {
+	c := &messageContent{MsgType: MSG_TEXT, Body: format.Strip(text)}
+	switch kind {
+	case adapter.Notice:
+		c.MsgType = MSG_NOTICE
+	case adapter.Action:
+		c.MsgType = MSG_EMOTE
+	}
+
+	if c.Body != text || strings.Contains(text, "\n") {
+		c.Format = FORMAT_HTML
+		c.FormattedBody = format.HTML(text)
+	}
+
+	return c
+}
+
+// relation makes a message a reply to the event replyTo, in thread (if not
+// empty)
+func relation(replyTo, thread string) *relatesTo {
+	if thread != "" {
+		r := &relatesTo{RelType: REL_THREAD, EventID: thread}
+		if replyTo != "" && replyTo != thread {
+			r.InReplyTo = &inReplyTo{EventID: replyTo}
+		} else {
+			// Clients without threads show the message as a reply to the
+			// thread's latest message, which we don't know
+			r.InReplyTo = &inReplyTo{EventID: thread}
+			r.IsFallingBack = true
+		}
+		return r
+	}
+
+	return &relatesTo{InReplyTo: &inReplyTo{EventID: replyTo}}
+}
+
+// send the message content c to a room
+func (m *Matrix) send(rm adapter.Room, kind adapter.Kind, text string, c *messageContent) (*adapter.Message, error) {
+	var r struct {
+		EventID string `json:"event_id"`
+	}
+
+	path := roomPath(rm.ID, "send", EVENT_MESSAGE, m.txnID())
+	if err := m.request("PUT", path, nil, c, &r); err != nil {
+		return nil, err
+	}
+
+	msg := &adapter.Message{
+		Adapter: m.Name(),
+		ID:      r.EventID,
+		Room:    rm,
+		User:    m.user(rm.ID, m.userID),
+		Kind:    kind,
+		Text:    text,
+		Time:    time.Now(),
+	}
+	if c.RelatesTo != nil {
+		if c.RelatesTo.RelType == REL_THREAD {
+			msg.Thread = c.RelatesTo.EventID
+		}
+		if c.RelatesTo.InReplyTo != nil && !c.RelatesTo.IsFallingBack {
+			msg.ReplyTo = c.RelatesTo.InReplyTo.EventID
+		}
+	}
+
+	return msg, nil
+}
+
+// react to a message, or take back our reaction
+func (m *Matrix) react(u *adapter.Reaction) error {
+	key := u.Room.ID + " " + u.MessageID + " " + u.Reaction
+
+	if u.Removed {
+		m.mu.Lock()
+		id, ok := m.reacted[key]
+		delete(m.reacted, key)
+		m.mu.Unlock()
+
+		if !ok {
+			return nil
+		}
+		return m.Redact(u.Room.ID, id, "")
+	}
+
+	c := map[string]interface{}{
+		"m.relates_to": &relatesTo{
+			RelType: REL_ANNOTATION,
+			EventID: u.MessageID,
+			Key:     u.Reaction,
+		},
+	}
+
+	var r struct {
+		EventID string `json:"event_id"`
+	}
+	path := roomPath(u.Room.ID, "send", EVENT_REACTION, m.txnID())
+	if err := m.request("PUT", path, nil, c, &r); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.reacted[key] = r.EventID
+	m.mu.Unlock()
+
+	return nil
+}
+
+// setMembership joins or leaves a room, changes someone's membership of a
+// room, or changes our display name
+func (m *Matrix) setMembership(u *adapter.Membership) error {
+	reason := map[string]string{}
+	if u.Reason != "" {
+		reason["reason"] = u.Reason
+	}
+
+	switch u.Kind {
+	case adapter.Join:
+		return m.request("POST", "/join/"+url.PathEscape(u.Room.ID), nil, reason, nil)
+	case adapter.Leave:
+		return m.request("POST", roomPath(u.Room.ID, "leave"), nil, reason, nil)
+	case adapter.Kick, adapter.Invite:
+		endpoint := "kick"
+		if u.Kind == adapter.Invite {
+			endpoint = "invite"
+		}
+		reason["user_id"] = u.User.ID
+		return m.request("POST", roomPath(u.Room.ID, endpoint), nil, reason, nil)
+	case adapter.Rename:
+		return m.request(
+			"PUT",
+			"/profile/"+url.PathEscape(m.userID)+"/displayname",
+			nil,
+			map[string]string{"displayname": u.NewName},
+			nil,
+		)
+	}
+
+	return adapter.ErrNotSupported
+}
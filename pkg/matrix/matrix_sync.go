@@ -0,0 +1,667 @@
+package matrix
+
+// Sync
+//
+// /sync is long-polled for new events, starting from the sync token of the
+// last sync. Room state (names, aliases and members) is tracked, so that rooms
+// and users can be described by name, and timeline events are translated into
+// adapter Updates.
+//
+// See also: https://spec.matrix.org/latest/client-server-api/#syncing
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/format"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// sinceBucket is where sync tokens are kept, by user ID
+const sinceBucket = "matrix.since"
+
+// initialFilter limits the timeline of the first sync, which is not
+// dispatched
+const initialFilter = `{"room":{"timeline":{"limit":1}}}`
+
+// Matrix event types
+const (
+	EVENT_MESSAGE        = "m.room.message"
+	EVENT_REACTION       = "m.reaction"
+	EVENT_REDACTION      = "m.room.redaction"
+	EVENT_MEMBER         = "m.room.member"
+	EVENT_NAME           = "m.room.name"
+	EVENT_TOPIC          = "m.room.topic"
+	EVENT_CANONICAL_NAME = "m.room.canonical_alias"
+	EVENT_DIRECT         = "m.direct"
+)
+
+// Message types
+const (
+	MSG_TEXT   = "m.text"
+	MSG_NOTICE = "m.notice"
+	MSG_EMOTE  = "m.emote"
+)
+
+// Relation types
+const (
+	REL_ANNOTATION = "m.annotation"
+	REL_REPLACE    = "m.replace"
+	REL_THREAD     = "m.thread"
+)
+
+// FORMAT_HTML is the format of HTML message bodies
+const FORMAT_HTML = "org.matrix.custom.html"
+
+type syncResponse struct {
+	NextBatch   string `json:"next_batch"`
+	AccountData events `json:"account_data"`
+	Rooms       struct {
+		Join map[string]struct {
+			State    events `json:"state"`
+			Timeline events `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]struct {
+			InviteState events `json:"invite_state"`
+		} `json:"invite"`
+		Leave map[string]struct {
+			Timeline events `json:"timeline"`
+		} `json:"leave"`
+	} `json:"rooms"`
+}
+
+type events struct {
+	Events []*event `json:"events"`
+}
+
+type event struct {
+	Type     string          `json:"type"`
+	EventID  string          `json:"event_id"`
+	Sender   string          `json:"sender"`
+	StateKey *string         `json:"state_key"`
+	TS       int64           `json:"origin_server_ts"`
+	Content  json.RawMessage `json:"content"`
+	Redacts  string          `json:"redacts"`
+	Unsigned struct {
+		PrevContent json.RawMessage `json:"prev_content"`
+	} `json:"unsigned"`
+}
+
+func (e *event) time() time.Time {
+	if e.TS == 0 {
+		return time.Now()
+	}
+
+	return time.Unix(0, e.TS*int64(time.Millisecond))
+}
+
+type messageContent struct {
+	MsgType       string          `json:"msgtype"`
+	Body          string          `json:"body"`
+	Format        string          `json:"format,omitempty"`
+	FormattedBody string          `json:"formatted_body,omitempty"`
+	RelatesTo     *relatesTo      `json:"m.relates_to,omitempty"`
+	NewContent    *messageContent `json:"m.new_content,omitempty"`
+}
+
+type relatesTo struct {
+	RelType       string     `json:"rel_type,omitempty"`
+	EventID       string     `json:"event_id,omitempty"`
+	Key           string     `json:"key,omitempty"`
+	InReplyTo     *inReplyTo `json:"m.in_reply_to,omitempty"`
+	IsFallingBack bool       `json:"is_falling_back,omitempty"`
+}
+
+type inReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+type memberContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname"`
+	Reason      string `json:"reason"`
+	IsDirect    bool   `json:"is_direct"`
+}
+
+// syncLoop syncs until stop is closed, or the access token is refused
+func (m *Matrix) syncLoop(stop chan struct{}) {
+	wait := retryMin
+
+	for {
+		select {
+		case <-stop:
+			m.done <- nil
+			return
+		default:
+		}
+
+		r, err := m.sync()
+		if err != nil {
+			if e, ok := err.(*Error); ok &&
+				(e.Code == "M_UNKNOWN_TOKEN" || e.Code == "M_MISSING_TOKEN") {
+				m.done <- err
+				return
+			}
+
+			logger.Log.Warningf("Matrix sync failed, retrying in %s: %s", wait, err)
+			select {
+			case <-stop:
+				m.done <- nil
+				return
+			case <-time.After(wait):
+			}
+
+			if wait *= 2; wait > retryMax {
+				wait = retryMax
+			}
+			continue
+		}
+		wait = retryMin
+
+		m.process(r, m.since == "")
+		m.since = r.NextBatch
+		m.saveSince()
+	}
+}
+
+func (m *Matrix) sync() (*syncResponse, error) {
+	q := url.Values{}
+	if m.since != "" {
+		q.Set("since", m.since)
+		q.Set("timeout", strconv.Itoa(int(SYNC_TIMEOUT/time.Millisecond)))
+	} else {
+		q.Set("filter", initialFilter)
+	}
+
+	r := &syncResponse{}
+	if err := m.request("GET", "/sync", q, nil, r); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// process a sync response. The first sync only updates the state we track
+func (m *Matrix) process(r *syncResponse, initial bool) {
+	for _, e := range r.AccountData.Events {
+		if e.Type == EVENT_DIRECT {
+			m.updateDirect(e)
+		}
+	}
+
+	for id, j := range r.Rooms.Join {
+		for _, e := range j.State.Events {
+			m.state(id, e)
+		}
+		for _, e := range j.Timeline.Events {
+			m.state(id, e)
+			if !initial {
+				m.timeline(id, e)
+			}
+		}
+	}
+
+	for id, i := range r.Rooms.Invite {
+		for _, e := range i.InviteState.Events {
+			m.state(id, e)
+			if e.Type == EVENT_MEMBER && e.StateKey != nil && *e.StateKey == m.userID {
+				m.invited(id, e)
+			}
+		}
+	}
+
+	for id, l := range r.Rooms.Leave {
+		for _, e := range l.Timeline.Events {
+			if !initial {
+				m.timeline(id, e)
+			}
+		}
+
+		m.mu.Lock()
+		delete(m.rooms, id)
+		m.mu.Unlock()
+	}
+}
+
+// loadRooms loads the state of the rooms we have joined
+func (m *Matrix) loadRooms() {
+	var r struct {
+		JoinedRooms []string `json:"joined_rooms"`
+	}
+	if err := m.request("GET", "/joined_rooms", nil, nil, &r); err != nil {
+		logger.Log.Warningf("Could not list joined Matrix rooms: %s", err)
+		return
+	}
+
+	for _, id := range r.JoinedRooms {
+		var state []*event
+		if err := m.request("GET", roomPath(id, "state"), nil, nil, &state); err != nil {
+			logger.Log.Warningf("Could not load the state of Matrix room %s: %s", id, err)
+			continue
+		}
+
+		for _, e := range state {
+			m.state(id, e)
+		}
+	}
+}
+
+// invited to a room, by the event e
+func (m *Matrix) invited(roomID string, e *event) {
+	c := &memberContent{}
+	json.Unmarshal(e.Content, c)
+	if c.IsDirect {
+		m.mu.Lock()
+		m.direct[roomID] = true
+		m.mu.Unlock()
+	}
+
+	actor := m.user(roomID, e.Sender)
+	m.dispatch(&adapter.Membership{
+		Adapter: m.Name(),
+		Kind:    adapter.Invite,
+		Room:    m.room(roomID),
+		User:    m.user(roomID, m.userID),
+		Actor:   &actor,
+		Time:    e.time(),
+	})
+
+	if m.AutoJoin {
+		go func() {
+			if err := m.request("POST", "/join/"+url.PathEscape(roomID), nil, struct{}{}, nil); err != nil {
+				logger.Log.Warningf("Could not join Matrix room %s: %s", roomID, err)
+			}
+		}()
+	}
+}
+
+// state updates what we know of a room from the event e
+func (m *Matrix) state(roomID string, e *event) {
+	if e.StateKey == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.rooms[roomID]
+	if !ok {
+		r = &room{id: roomID, members: make(map[string]string)}
+		m.rooms[roomID] = r
+	}
+
+	switch e.Type {
+	case EVENT_NAME:
+		var c struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(e.Content, &c)
+		r.name = c.Name
+	case EVENT_CANONICAL_NAME:
+		var c struct {
+			Alias string `json:"alias"`
+		}
+		json.Unmarshal(e.Content, &c)
+		r.alias = c.Alias
+	case EVENT_MEMBER:
+		c := &memberContent{}
+		json.Unmarshal(e.Content, c)
+
+		switch c.Membership {
+		case "join":
+			r.members[*e.StateKey] = c.DisplayName
+			if c.DisplayName != "" {
+				m.names[*e.StateKey] = c.DisplayName
+			}
+		case "invite":
+		default:
+			delete(r.members, *e.StateKey)
+		}
+	}
+}
+
+// updateDirect records which rooms are direct conversations, from m.direct
+func (m *Matrix) updateDirect(e *event) {
+	var c map[string][]string
+	if err := json.Unmarshal(e.Content, &c); err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rooms := range c {
+		for _, id := range rooms {
+			m.direct[id] = true
+		}
+	}
+}
+
+// room describes the room with the ID given
+func (m *Matrix) room(id string) adapter.Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rm := adapter.Room{ID: id, Name: id, Private: m.direct[id]}
+
+	r, ok := m.rooms[id]
+	if !ok {
+		return rm
+	}
+
+	switch {
+	case r.name != "":
+		rm.Name = r.name
+	case r.alias != "":
+		rm.Name = r.alias
+	}
+
+	// Unnamed rooms with only one other member are direct conversations
+	if r.name == "" && r.alias == "" && len(r.members) == 2 {
+		rm.Private = true
+		for u, n := range r.members {
+			if u != m.userID {
+				rm.Name = u
+				if n != "" {
+					rm.Name = n
+				}
+			}
+		}
+	}
+
+	return rm
+}
+
+// user describes the user with the ID given, by their name in the room
+func (m *Matrix) user(roomID, id string) adapter.User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := adapter.User{ID: id, Name: localpart(id), Account: id, Mask: id}
+	if n := m.names[id]; n != "" {
+		u.Name = n
+	}
+	if r, ok := m.rooms[roomID]; ok && r.members[id] != "" {
+		u.Name = r.members[id]
+	}
+
+	return u
+}
+
+// localpart is the user part of a user ID, such as "alice" for
+// @alice:example.com
+func localpart(id string) string {
+	id = strings.TrimPrefix(id, "@")
+	if n := strings.IndexByte(id, ':'); n >= 0 {
+		return id[:n]
+	}
+
+	return id
+}
+
+// timeline translates the event e into an Update, and dispatches it
+func (m *Matrix) timeline(roomID string, e *event) {
+	if u := m.update(roomID, e); u != nil {
+		m.dispatch(u)
+	}
+}
+
+func (m *Matrix) update(roomID string, e *event) adapter.Update {
+	switch e.Type {
+	case EVENT_MESSAGE:
+		if e.Sender == m.userID {
+			return nil
+		}
+
+		c := &messageContent{}
+		if err := json.Unmarshal(e.Content, c); err != nil {
+			return nil
+		}
+
+		if c.RelatesTo != nil && c.RelatesTo.RelType == REL_REPLACE && c.NewContent != nil {
+			return &adapter.Edit{
+				Adapter: m.Name(),
+				Message: &adapter.Message{
+					Adapter: m.Name(),
+					ID:      c.RelatesTo.EventID,
+					Room:    m.room(roomID),
+					User:    m.user(roomID, e.Sender),
+				},
+				Text: text(c.NewContent),
+				User: m.user(roomID, e.Sender),
+				Time: e.time(),
+			}
+		}
+
+		msg := &adapter.Message{
+			Adapter: m.Name(),
+			ID:      e.EventID,
+			Room:    m.room(roomID),
+			User:    m.user(roomID, e.Sender),
+			Text:    text(c),
+			Time:    e.time(),
+			Raw:     raw(roomID, e, c.Body),
+		}
+
+		switch c.MsgType {
+		case MSG_NOTICE:
+			msg.Kind = adapter.Notice
+		case MSG_EMOTE:
+			msg.Kind = adapter.Action
+		}
+
+		if r := c.RelatesTo; r != nil {
+			if r.RelType == REL_THREAD {
+				msg.Thread = r.EventID
+			}
+			if r.InReplyTo != nil && !r.IsFallingBack {
+				msg.ReplyTo = r.InReplyTo.EventID
+			}
+		}
+
+		return msg
+	case EVENT_REACTION:
+		var c struct {
+			RelatesTo relatesTo `json:"m.relates_to"`
+		}
+		if err := json.Unmarshal(e.Content, &c); err != nil ||
+			c.RelatesTo.RelType != REL_ANNOTATION {
+			return nil
+		}
+
+		r := &adapter.Reaction{
+			Adapter:   m.Name(),
+			Room:      m.room(roomID),
+			MessageID: c.RelatesTo.EventID,
+			User:      m.user(roomID, e.Sender),
+			Reaction:  c.RelatesTo.Key,
+			Time:      e.time(),
+		}
+
+		m.mu.Lock()
+		m.reactions[e.EventID] = r
+		m.mu.Unlock()
+
+		if e.Sender == m.userID {
+			return nil
+		}
+		return r
+	case EVENT_REDACTION:
+		redacts := e.Redacts
+		if redacts == "" {
+			var c struct {
+				Redacts string `json:"redacts"`
+			}
+			json.Unmarshal(e.Content, &c)
+			redacts = c.Redacts
+		}
+
+		// Only redacted reactions are Updates, as reactions taken back
+		m.mu.Lock()
+		r, ok := m.reactions[redacts]
+		delete(m.reactions, redacts)
+		m.mu.Unlock()
+
+		if !ok || e.Sender == m.userID {
+			return nil
+		}
+
+		removed := *r
+		removed.Removed = true
+		removed.Time = e.time()
+		return &removed
+	case EVENT_MEMBER:
+		return m.membership(roomID, e)
+	case EVENT_TOPIC:
+		var c struct {
+			Topic string `json:"topic"`
+		}
+		if e.Sender == m.userID || json.Unmarshal(e.Content, &c) != nil {
+			return nil
+		}
+
+		return &adapter.Topic{
+			Adapter: m.Name(),
+			Room:    m.room(roomID),
+			User:    m.user(roomID, e.Sender),
+			Topic:   c.Topic,
+			Time:    e.time(),
+		}
+	}
+
+	return nil
+}
+
+// membership translates a member event into a Membership
+func (m *Matrix) membership(roomID string, e *event) adapter.Update {
+	if e.StateKey == nil {
+		return nil
+	}
+
+	c, prev := &memberContent{}, &memberContent{}
+	json.Unmarshal(e.Content, c)
+	if len(e.Unsigned.PrevContent) > 0 {
+		json.Unmarshal(e.Unsigned.PrevContent, prev)
+	}
+
+	ms := &adapter.Membership{
+		Adapter: m.Name(),
+		Room:    m.room(roomID),
+		User:    m.user(roomID, *e.StateKey),
+		Reason:  c.Reason,
+		Time:    e.time(),
+	}
+	if prev.DisplayName != "" {
+		ms.User.Name = prev.DisplayName
+	}
+	if e.Sender != *e.StateKey {
+		actor := m.user(roomID, e.Sender)
+		ms.Actor = &actor
+	}
+
+	switch c.Membership {
+	case "join":
+		if prev.Membership == "join" {
+			if c.DisplayName == prev.DisplayName {
+				// Only the avatar changed
+				return nil
+			}
+
+			ms.Kind = adapter.Rename
+			ms.NewName = c.DisplayName
+			if ms.NewName == "" {
+				ms.NewName = localpart(*e.StateKey)
+			}
+			ms.Actor = nil
+			return ms
+		}
+		ms.Kind = adapter.Join
+	case "leave", "ban":
+		ms.Kind = adapter.Leave
+		if ms.Actor != nil {
+			ms.Kind = adapter.Kick
+		}
+	case "invite":
+		ms.Kind = adapter.Invite
+	default:
+		return nil
+	}
+
+	return ms
+}
+
+// text returns the formatted text of a message
+func text(c *messageContent) string {
+	if c.Format == FORMAT_HTML && c.FormattedBody != "" {
+		return format.ParseHTML(c.FormattedBody)
+	}
+
+	body := c.Body
+	if c.RelatesTo != nil && c.RelatesTo.InReplyTo != nil {
+		body = stripFallback(body)
+	}
+
+	return body
+}
+
+// stripFallback removes the quote of the message being replied to, from the
+// body of a reply
+func stripFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	n := 0
+	for n < len(lines) && strings.HasPrefix(lines[n], ">") {
+		n++
+	}
+	if n == 0 {
+		return body
+	}
+	if n < len(lines) && lines[n] == "" {
+		n++
+	}
+
+	return strings.Join(lines[n:], "\n")
+}
+
+// raw describes a Matrix event as an adapter.Event, with the sender as the
+// prefix, the event type as the command, and the room and text as parameters
+func raw(roomID string, e *event, body string) *adapter.Event {
+	return &adapter.Event{
+		Tags:       map[string]string{"msgid": e.EventID},
+		Prefix:     e.Sender,
+		Command:    e.Type,
+		Parameters: []string{roomID, body},
+		Timestamp:  e.time(),
+	}
+}
+
+// loadSince returns the sync token from the last sync, if there was one
+func (m *Matrix) loadSince() string {
+	if m.store == nil {
+		return ""
+	}
+
+	var since string
+	if err := m.store.Get(sinceBucket, m.userID, &since); err != nil {
+		if err != database.ErrNotFound {
+			logger.Log.Errorf("Could not load Matrix sync token: %s", err)
+		}
+		return ""
+	}
+
+	return since
+}
+
+func (m *Matrix) saveSince() {
+	if m.store == nil {
+		return
+	}
+
+	if err := m.store.Put(sinceBucket, m.userID, m.since); err != nil {
+		logger.Log.Errorf("Could not save Matrix sync token: %s", err)
+	}
+}
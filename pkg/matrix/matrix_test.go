@@ -0,0 +1,277 @@
+package matrix_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/format"
+	"github.com/enmand/quarid-go/pkg/matrix"
+)
+
+const timeout = 2 * time.Second
+
+const (
+	roomID = "!room:example.com"
+	userID = "@quarid:example.com"
+	token  = "secret-token"
+)
+
+// homeserver is a stub Matrix homeserver, that logs in one user, serves the
+// syncs it is given in order, and records the messages sent to it
+type homeserver struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	syncs []string
+	since []string
+	sent  []map[string]interface{}
+}
+
+func newHomeserver(syncs ...string) *homeserver {
+	h := &homeserver{syncs: syncs}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(matrix.API_PREFIX+"/login", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Password string `json:"password"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Password != "hunter2" {
+			h.error(w, http.StatusForbidden, "M_FORBIDDEN")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"user_id":      userID,
+			"access_token": token,
+			"device_id":    "QUARID",
+		})
+	})
+	mux.HandleFunc(matrix.API_PREFIX+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			h.error(w, http.StatusUnauthorized, "M_UNKNOWN_TOKEN")
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, matrix.API_PREFIX)
+		switch {
+		case path == "/sync":
+			h.sync(w, r)
+		case strings.HasPrefix(path, "/rooms/"+roomID+"/send/"+matrix.EVENT_MESSAGE+"/"):
+			var c map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&c)
+
+			h.mu.Lock()
+			h.sent = append(h.sent, c)
+			h.mu.Unlock()
+
+			json.NewEncoder(w).Encode(map[string]string{"event_id": "$sent"})
+		default:
+			h.error(w, http.StatusNotFound, "M_UNRECOGNIZED")
+		}
+	})
+
+	h.Server = httptest.NewServer(mux)
+	return h
+}
+
+func (h *homeserver) sync(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.since = append(h.since, r.URL.Query().Get("since"))
+	if len(h.syncs) == 0 {
+		h.mu.Unlock()
+
+		// Nothing more happens, which a homeserver would wait to say
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"next_batch": "end"}`))
+		return
+	}
+	next := h.syncs[0]
+	h.syncs = h.syncs[1:]
+	h.mu.Unlock()
+
+	w.Write([]byte(next))
+}
+
+func (h *homeserver) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"errcode": code, "error": code})
+}
+
+func (h *homeserver) messages() []map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]map[string]interface{}(nil), h.sent...)
+}
+
+// connect logs in to h as quarid, with password
+func connect(h *homeserver, password string) (*matrix.Matrix, error) {
+	m := matrix.New(h.URL, database.NewMemoryStore())
+	m.User, m.Password = "quarid", password
+
+	return m, m.Connect()
+}
+
+// message is a sync with a message from alice, in the timeline of the room
+func message(batch, content string) string {
+	return `{
+		"next_batch": "` + batch + `",
+		"rooms": {"join": {"` + roomID + `": {"timeline": {"events": [{
+			"type": "m.room.message",
+			"event_id": "$` + batch + `",
+			"sender": "@alice:example.com",
+			"origin_server_ts": 1500000000000,
+			"content": ` + content + `
+		}]}}}}
+	}`
+}
+
+// initial is the first sync, with the state of the room
+const initial = `{
+	"next_batch": "s1",
+	"rooms": {"join": {"` + roomID + `": {"state": {"events": [
+		{
+			"type": "m.room.name",
+			"state_key": "",
+			"sender": "@alice:example.com",
+			"content": {"name": "Test"}
+		},
+		{
+			"type": "m.room.member",
+			"state_key": "@alice:example.com",
+			"sender": "@alice:example.com",
+			"content": {"membership": "join", "displayname": "Alice"}
+		}
+	]}}}}
+}`
+
+func TestLogin(t *testing.T) {
+	h := newHomeserver()
+	defer h.Close()
+
+	m, err := connect(h, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	if m.UserID() != userID || m.AccessToken != token {
+		t.Fatalf("Expected to log in as %s, but got %s (%s)", userID, m.UserID(), m.AccessToken)
+	}
+
+	if _, err := connect(h, "wrong"); err == nil {
+		t.Fatal("Expected logging in with the wrong password to fail")
+	}
+}
+
+func TestUnknownToken(t *testing.T) {
+	h := newHomeserver()
+	defer h.Close()
+
+	m := matrix.New(h.URL, nil)
+	m.AccessToken = "expired"
+	if err := m.Connect(); err == nil {
+		t.Fatal("Expected an expired access token to be refused")
+	}
+}
+
+func TestReceive(t *testing.T) {
+	h := newHomeserver(
+		initial,
+		message("s2", `{
+			"msgtype": "m.text",
+			"body": "hi red",
+			"format": "org.matrix.custom.html",
+			"formatted_body": "<b>hi</b> <font data-mx-color=\"#ff0000\">red</font>"
+		}`),
+	)
+	defer h.Close()
+
+	m, err := connect(h, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	received := make(chan *adapter.Message, 1)
+	m.Receive(func(u adapter.Update, r adapter.Adapter) {
+		if msg, ok := u.(*adapter.Message); ok {
+			received <- msg
+		}
+	})
+
+	select {
+	case msg := <-received:
+		if msg.ID != "$s2" || msg.Room.ID != roomID || msg.Room.Name != "Test" {
+			t.Fatalf("Expected $s2 in Test, but got %s in %+v", msg.ID, msg.Room)
+		}
+		if msg.User.Name != "Alice" {
+			t.Fatalf("Expected the message from Alice, but got %+v", msg.User)
+		}
+
+		expected := format.Bold("hi") + " " + format.Colored("red", format.Red)
+		if format.Format(format.Parse(msg.Text)) != format.Format(format.Parse(expected)) {
+			t.Fatalf("Expected %q, but got %q", expected, msg.Text)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Expected a message")
+	}
+
+	// The initial sync is not dispatched, and the next syncs follow on
+	h.mu.Lock()
+	since := h.since
+	h.mu.Unlock()
+	if len(since) < 2 || since[0] != "" || since[1] != "s1" {
+		t.Fatalf("Expected to sync from the start and then from s1, but got %q", since)
+	}
+}
+
+func TestSendFormatted(t *testing.T) {
+	h := newHomeserver()
+	defer h.Close()
+
+	m, err := connect(h, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Disconnect()
+
+	text := format.Bold("bold") + " and " + format.Colored("5 red", format.Red) + "5 plain"
+	msg, err := m.Send(&adapter.Message{
+		Room: adapter.Room{ID: roomID},
+		Text: text,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "$sent" {
+		t.Fatalf("Expected the sent event's ID, but got %s", msg.ID)
+	}
+
+	sent := h.messages()
+	if len(sent) != 1 {
+		t.Fatalf("Expected one message, but got %d", len(sent))
+	}
+	c := sent[0]
+
+	if c["msgtype"] != matrix.MSG_TEXT || c["body"] != "bold and 5 red5 plain" {
+		t.Fatalf("Expected the plain text, but got %v", c)
+	}
+	if c["format"] != matrix.FORMAT_HTML {
+		t.Fatalf("Expected HTML, but got %v", c["format"])
+	}
+
+	// The formatting comes back from the HTML as it was sent
+	html, _ := c["formatted_body"].(string)
+	if r := format.ParseHTML(html); format.Format(format.Parse(r)) != format.Format(format.Parse(text)) {
+		t.Fatalf("Expected %q to round-trip through %q, but got %q", text, html, r)
+	}
+}
@@ -0,0 +1,207 @@
+// Package mattermost adapts Mattermost's WebSocket and REST APIs to the
+// adapter package
+//
+// About
+//
+// The Mattermost adapter logs in with a personal access token, and receives
+// events over the WebSocket API: posts, edits, reactions, and members joining
+// and leaving channels are translated into adapter Updates. Updates are sent
+// with the REST API; replies are posted in the thread of the post they reply
+// to.
+//
+// A channel in a team is a room, named "team/channel" (by the team's and the
+// channel's names, as they appear in their URLs), so that the rooms to join
+// can be given in the configuration; a room can be sent to by its name, or by
+// its ID. Mattermost's Markdown is translated to and from formatted text.
+//
+// See also: https://api.mattermost.com/
+package mattermost
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// ADAPTER_NAME is the name of the Mattermost adapter
+const ADAPTER_NAME = "mattermost"
+
+// TIMEOUT is the timeout of requests to the REST API, and of connecting to
+// the WebSocket API
+const TIMEOUT = 30 * time.Second
+
+// How long to wait before reconnecting, doubling up to the maximum
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// ErrNoToken is returned when connecting without a server URL and a personal
+// access token
+var ErrNoToken = errors.New("Mattermost needs a server URL and a personal access token")
+
+// Mattermost is a connection to a Mattermost server, as a user (or bot)
+type Mattermost struct {
+	// The server's URL (e.g. https://mattermost.example.com)
+	URL string
+
+	// The personal access token to log in with
+	Token string
+
+	// Channels to join when we connect, as "team/channel"
+	Rooms []string
+
+	// The HTTP client for requests to the REST API
+	HTTPClient *http.Client
+
+	// Our own user ID and username, once we are connected
+	userID   string
+	username string
+
+	mu       sync.Mutex
+	users    map[string]*cachedUser
+	channels map[string]*cachedChannel
+	teams    map[string]string
+	named    map[string]string
+	dms      map[string]string
+	handlers []adapter.UpdateFunc
+
+	wmu    sync.Mutex
+	conn   *websocket.Conn
+	events chan *event
+
+	// The WebSocket connection's ID, and the sequence number of the next
+	// event, to resume the connection with
+	connectionID string
+	seq          int64
+
+	stop chan struct{}
+	done chan error
+}
+
+// New returns a Mattermost adapter for the server, that logs in with token
+func New(url, token string) *Mattermost {
+	return &Mattermost{
+		URL:        url,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: TIMEOUT},
+		users:      make(map[string]*cachedUser),
+		channels:   make(map[string]*cachedChannel),
+		teams:      make(map[string]string),
+		named:      make(map[string]string),
+		dms:        make(map[string]string),
+		events:     make(chan *event, EVENT_QUEUE),
+	}
+}
+
+// Name of the adapter
+func (m *Mattermost) Name() string {
+	return ADAPTER_NAME
+}
+
+// UserID returns our own user ID, once we are connected
+func (m *Mattermost) UserID() string {
+	return m.userID
+}
+
+// Connect to Mattermost, join the configured channels, and start receiving
+// events
+func (m *Mattermost) Connect() error {
+	if m.URL == "" || m.Token == "" {
+		return ErrNoToken
+	}
+
+	var me mmUser
+	if err := m.request("GET", "/users/me", nil, &me); err != nil {
+		return err
+	}
+	m.userID, m.username = me.ID, me.Username
+	m.cacheUser(&me)
+	logger.Log.Infof("Logged in to Mattermost as %s", me.Username)
+
+	for _, r := range m.Rooms {
+		id, err := m.channelByName(r)
+		if err == nil {
+			err = m.request("POST", "/channels/"+id+"/members", map[string]string{"user_id": m.userID}, nil)
+		}
+		if err != nil {
+			logger.Log.Warningf("Could not join Mattermost channel %s: %s", r, err)
+		}
+	}
+
+	if err := m.connect(); err != nil {
+		return err
+	}
+
+	m.stop = make(chan struct{})
+	m.done = make(chan error, 1)
+	go m.run(m.stop)
+	go m.handle(m.stop)
+
+	return nil
+}
+
+// Disconnect from the WebSocket API
+func (m *Mattermost) Disconnect() error {
+	if m.stop == nil {
+		return nil
+	}
+	close(m.stop)
+	m.stop = nil
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	if m.conn == nil {
+		return nil
+	}
+
+	err := m.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	m.conn.Close()
+
+	return err
+}
+
+// Wait blocks while connected (or reconnecting), and returns the error that
+// stopped us
+func (m *Mattermost) Wait() error {
+	return <-m.done
+}
+
+// Receive calls f with each Update from Mattermost
+func (m *Mattermost) Receive(f adapter.UpdateFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handlers = append(m.handlers, f)
+}
+
+func (m *Mattermost) dispatch(u adapter.Update) {
+	m.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), m.handlers...)
+	m.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, m)
+	}
+}
+
+// decode a JSON value, logging it if it cannot be
+func decode(what string, raw []byte, v interface{}) bool {
+	if err := json.Unmarshal(raw, v); err != nil {
+		logger.Log.Warningf("Could not decode Mattermost %s: %s", what, err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,105 @@
+package mattermost
+
+// REST API
+//
+// Requests are made to <server>/api/v4, with the personal access token as a
+// bearer token, and bodies in JSON. Errors have an ID and a message. Requests
+// that are rate limited are retried when the limit resets.
+//
+// See also: https://api.mattermost.com/#tag/authentication
+// See also: https://api.mattermost.com/#tag/rate-limiting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// API_PATH is the path of the REST API, on the server
+const API_PATH = "/api/v4"
+
+// maxRetries is how many times a rate limited request is retried
+const maxRetries = 5
+
+// Error is an error from the REST API
+type Error struct {
+	Status  int    `json:"status_code"`
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Mattermost failed: %d %s (%s)", e.Status, e.Message, e.ID)
+}
+
+// request calls the REST API, with body (if not nil) as JSON, and decodes the
+// response into out (if not nil)
+func (m *Mattermost) request(method, path string, body, out interface{}) error {
+	u := strings.TrimRight(m.URL, "/") + API_PATH + path
+
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for n := 0; ; n++ {
+		var r io.Reader
+		if b != nil {
+			r = bytes.NewReader(b)
+		}
+
+		req, err := http.NewRequest(method, u, r)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+m.Token)
+		if b != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := m.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		d, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && n < maxRetries {
+			wait := time.Second
+			if secs, err := strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset")); err == nil && secs > 0 {
+				wait = time.Duration(secs) * time.Second
+			}
+			logger.Log.Debugf("Rate limited by Mattermost on %s %s; retrying in %s", method, path, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		if resp.StatusCode >= 400 {
+			e := &Error{Status: resp.StatusCode}
+			if json.Unmarshal(d, e) != nil || e.Message == "" {
+				e.Message = http.StatusText(resp.StatusCode)
+			}
+			return e
+		}
+
+		if out == nil || len(d) == 0 {
+			return nil
+		}
+		return json.Unmarshal(d, out)
+	}
+}
@@ -0,0 +1,242 @@
+package mattermost
+
+// Events
+//
+// WebSocket events are translated into adapter Updates: posts (and /me posts)
+// in channels, edits, reactions, and members joining and leaving channels.
+// Posts in a thread are in the thread of the post that started it. System
+// posts (such as "alice joined the channel") are left out, as their changes
+// have their own events.
+//
+// See also: https://api.mattermost.com/#tag/WebSocket
+
+import (
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// Event types
+const (
+	EVENT_POSTED           = "posted"
+	EVENT_POST_EDITED      = "post_edited"
+	EVENT_REACTION_ADDED   = "reaction_added"
+	EVENT_REACTION_REMOVED = "reaction_removed"
+	EVENT_USER_ADDED       = "user_added"
+	EVENT_USER_REMOVED     = "user_removed"
+	EVENT_CHANNEL_UPDATED  = "channel_updated"
+	EVENT_USER_UPDATED     = "user_updated"
+)
+
+// POST_ME is the type of /me posts. Other types (besides ordinary posts,
+// which have none) are system posts
+const POST_ME = "me"
+
+// POST_HEADER_CHANGE is the type of the system post made when a channel's
+// header (its topic) is changed
+const POST_HEADER_CHANGE = "system_header_change"
+
+type post struct {
+	ID        string `json:"id"`
+	CreateAt  int64  `json:"create_at"`
+	EditAt    int64  `json:"edit_at"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	RootID    string `json:"root_id"`
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+
+	Props map[string]interface{} `json:"props"`
+}
+
+type reaction struct {
+	UserID    string `json:"user_id"`
+	PostID    string `json:"post_id"`
+	EmojiName string `json:"emoji_name"`
+	CreateAt  int64  `json:"create_at"`
+}
+
+// event handles a WebSocket event
+func (m *Mattermost) event(e *event) {
+	switch e.Event {
+	case EVENT_POSTED, EVENT_POST_EDITED:
+		// Posts are given as JSON, in a string
+		p := &post{}
+		if !decode(e.Event, []byte(e.str("post")), p) || p.UserID == m.userID {
+			return
+		}
+		if p.Type == POST_HEADER_CHANGE && e.Event == EVENT_POSTED {
+			m.headerChanged(p)
+			return
+		}
+		if p.Type != "" && p.Type != POST_ME {
+			return
+		}
+
+		if e.Event == EVENT_POSTED {
+			m.posted(p)
+		} else {
+			m.edited(p)
+		}
+	case EVENT_REACTION_ADDED, EVENT_REACTION_REMOVED:
+		r := &reaction{}
+		if !decode(e.Event, []byte(e.str("reaction")), r) || r.UserID == m.userID {
+			return
+		}
+
+		m.dispatch(&adapter.Reaction{
+			Adapter:   m.Name(),
+			Room:      m.room(e.Broadcast.ChannelID),
+			MessageID: r.PostID,
+			User:      m.user(r.UserID),
+			Reaction:  ":" + r.EmojiName + ":",
+			Removed:   e.Event == EVENT_REACTION_REMOVED,
+			Time:      timestamp(r.CreateAt),
+		})
+	case EVENT_USER_ADDED:
+		m.dispatch(&adapter.Membership{
+			Adapter: m.Name(),
+			Kind:    adapter.Join,
+			Room:    m.room(e.Broadcast.ChannelID),
+			User:    m.user(e.str("user_id")),
+			Time:    time.Now(),
+		})
+	case EVENT_USER_REMOVED:
+		// When we are removed, the channel is in the event, rather than its
+		// broadcast
+		channel := e.Broadcast.ChannelID
+		if channel == "" {
+			channel = e.str("channel_id")
+		}
+		user := e.str("user_id")
+		if user == "" {
+			user = e.Broadcast.UserID
+		}
+
+		ms := &adapter.Membership{
+			Adapter: m.Name(),
+			Kind:    adapter.Leave,
+			Room:    m.room(channel),
+			User:    m.user(user),
+			Time:    time.Now(),
+		}
+		if remover := e.str("remover_id"); remover != "" && remover != user {
+			actor := m.user(remover)
+			ms.Kind, ms.Actor = adapter.Kick, &actor
+		}
+		m.dispatch(ms)
+	case EVENT_CHANNEL_UPDATED:
+		ch := &mmChannel{}
+		if decode(e.Event, []byte(e.str("channel")), ch) {
+			m.forgetChannel(ch.ID)
+		}
+	case EVENT_USER_UPDATED:
+		u := &mmUser{}
+		if decode(e.Event, e.Data["user"], u) {
+			m.userUpdated(u)
+		}
+	}
+}
+
+// posted handles a new post
+func (m *Mattermost) posted(p *post) {
+	t := timestamp(p.CreateAt)
+	msg := &adapter.Message{
+		Adapter: m.Name(),
+		ID:      p.ID,
+		Room:    m.room(p.ChannelID),
+		User:    m.user(p.UserID),
+		Text:    text(p.Message),
+		Thread:  p.RootID,
+		Time:    t,
+		Raw: &adapter.Event{
+			Tags:       map[string]string{"msgid": p.ID},
+			Prefix:     p.UserID,
+			Command:    EVENT_POSTED,
+			Parameters: []string{p.ChannelID, p.Message},
+			Timestamp:  t,
+		},
+	}
+	if p.Type == POST_ME {
+		msg.Kind = adapter.Action
+	}
+
+	m.dispatch(msg)
+}
+
+// headerChanged handles a channel's header being changed, as a Topic
+func (m *Mattermost) headerChanged(p *post) {
+	header, _ := p.Props["new_header"].(string)
+
+	m.dispatch(&adapter.Topic{
+		Adapter: m.Name(),
+		Room:    m.room(p.ChannelID),
+		User:    m.user(p.UserID),
+		Topic:   text(header),
+		Time:    timestamp(p.CreateAt),
+	})
+}
+
+// edited handles a post being edited
+func (m *Mattermost) edited(p *post) {
+	user := m.user(p.UserID)
+	msg := &adapter.Message{
+		Adapter: m.Name(),
+		ID:      p.ID,
+		Room:    m.room(p.ChannelID),
+		User:    user,
+		Thread:  p.RootID,
+		Time:    timestamp(p.CreateAt),
+	}
+
+	m.dispatch(&adapter.Edit{
+		Adapter: m.Name(),
+		Message: msg,
+		Text:    text(p.Message),
+		User:    user,
+		Time:    timestamp(p.EditAt),
+	})
+}
+
+// userUpdated notices a user changing their username
+func (m *Mattermost) userUpdated(u *mmUser) {
+	m.mu.Lock()
+	old, known := m.users[u.ID]
+	m.mu.Unlock()
+
+	c := m.cacheUser(u)
+	if !known || old.name == c.name {
+		return
+	}
+
+	m.dispatch(&adapter.Membership{
+		Adapter: m.Name(),
+		Kind:    adapter.Rename,
+		User:    adapter.User{ID: u.ID, Name: old.name, Account: old.name},
+		NewName: c.name,
+		Time:    time.Now(),
+	})
+}
+
+// text is the formatted text of a post. Mattermost's Markdown is CommonMark,
+// in which __text__ is bold, rather than underlined
+func text(md string) string {
+	spans := format.Parse(format.ParseMarkdown(md))
+	for n := range spans {
+		if spans[n].Underline {
+			spans[n].Underline, spans[n].Bold = false, true
+		}
+	}
+
+	return format.Format(spans)
+}
+
+// timestamp parses a Mattermost timestamp (milliseconds since the epoch)
+func timestamp(ms int64) time.Time {
+	if ms == 0 {
+		return time.Now()
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,212 @@
+package mattermost
+
+// Names
+//
+// Events name users and channels by ID. Their names are looked up, and cached
+// for NAME_TTL, or until an event says they changed. A channel in a team is
+// named "team/channel"; a direct channel is named after the user it is with,
+// and a group channel by its display name. A lookup that fails leaves the ID
+// as the name.
+//
+// See also: https://api.mattermost.com/#tag/users
+// See also: https://api.mattermost.com/#tag/channels
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// NAME_TTL is how long names are cached
+const NAME_TTL = time.Hour
+
+// Types of channels
+const (
+	CHANNEL_OPEN    = "O"
+	CHANNEL_PRIVATE = "P"
+	CHANNEL_DIRECT  = "D"
+	CHANNEL_GROUP   = "G"
+)
+
+// cachedUser is a user we looked up
+type cachedUser struct {
+	name string
+	at   time.Time
+}
+
+// cachedChannel is a channel we looked up. Direct channels have the user they
+// are with
+type cachedChannel struct {
+	name string
+	kind string
+	user string
+	at   time.Time
+}
+
+type mmUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	DeleteAt int64  `json:"delete_at"`
+}
+
+type mmChannel struct {
+	ID          string `json:"id"`
+	TeamID      string `json:"team_id"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type mmTeam struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// user describes a user, by their ID. Users are named by their username,
+// which is how they are mentioned
+func (m *Mattermost) user(id string) adapter.User {
+	m.mu.Lock()
+	c, ok := m.users[id]
+	m.mu.Unlock()
+
+	if !ok || time.Since(c.at) > NAME_TTL {
+		var u mmUser
+		if err := m.request("GET", "/users/"+id, nil, &u); err != nil {
+			logger.Log.Debugf("Could not look up Mattermost user %s: %s", id, err)
+			return adapter.User{ID: id, Name: id}
+		}
+		c = m.cacheUser(&u)
+	}
+
+	return adapter.User{ID: id, Name: c.name, Account: c.name}
+}
+
+// cacheUser keeps the name of a user
+func (m *Mattermost) cacheUser(u *mmUser) *cachedUser {
+	c := &cachedUser{name: u.Username, at: time.Now()}
+
+	m.mu.Lock()
+	m.users[u.ID] = c
+	m.mu.Unlock()
+
+	return c
+}
+
+// room describes a channel, by its ID
+func (m *Mattermost) room(id string) adapter.Room {
+	m.mu.Lock()
+	c, ok := m.channels[id]
+	m.mu.Unlock()
+
+	if !ok || time.Since(c.at) > NAME_TTL {
+		var ch mmChannel
+		if err := m.request("GET", "/channels/"+id, nil, &ch); err != nil {
+			logger.Log.Debugf("Could not look up Mattermost channel %s: %s", id, err)
+			return adapter.Room{ID: id, Name: id}
+		}
+		c = m.cacheChannel(&ch)
+	}
+
+	rm := adapter.Room{ID: id, Name: c.name, Private: c.kind == CHANNEL_DIRECT}
+	if c.user != "" {
+		rm.Name = m.user(c.user).Name
+	}
+
+	return rm
+}
+
+// cacheChannel keeps the name of a channel
+func (m *Mattermost) cacheChannel(ch *mmChannel) *cachedChannel {
+	c := &cachedChannel{name: ch.DisplayName, kind: ch.Type, at: time.Now()}
+
+	switch ch.Type {
+	case CHANNEL_OPEN, CHANNEL_PRIVATE:
+		c.name = m.team(ch.TeamID) + "/" + ch.Name
+	case CHANNEL_DIRECT:
+		// Direct channels are named for their users' IDs: "user1__user2"
+		for _, u := range strings.Split(ch.Name, "__") {
+			if u != m.userID {
+				c.user = u
+			}
+		}
+		if c.user == "" {
+			c.user = m.userID
+		}
+	}
+
+	m.mu.Lock()
+	m.channels[ch.ID] = c
+	if ch.Type == CHANNEL_OPEN || ch.Type == CHANNEL_PRIVATE {
+		m.named[c.name] = ch.ID
+	}
+	if c.user != "" {
+		m.dms[c.user] = ch.ID
+	}
+	m.mu.Unlock()
+
+	return c
+}
+
+// forgetChannel drops a channel's name, so that it is looked up again
+func (m *Mattermost) forgetChannel(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c, ok := m.channels[id]; ok {
+		delete(m.named, c.name)
+	}
+	delete(m.channels, id)
+}
+
+// team returns the name of a team, by its ID
+func (m *Mattermost) team(id string) string {
+	m.mu.Lock()
+	name, ok := m.teams[id]
+	m.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	var t mmTeam
+	if err := m.request("GET", "/teams/"+id, nil, &t); err != nil {
+		logger.Log.Debugf("Could not look up Mattermost team %s: %s", id, err)
+		return id
+	}
+
+	m.mu.Lock()
+	m.teams[id] = t.Name
+	m.mu.Unlock()
+
+	return t.Name
+}
+
+// channelByName returns the ID of a channel, by its name ("team/channel")
+func (m *Mattermost) channelByName(name string) (string, error) {
+	m.mu.Lock()
+	id, ok := m.named[name]
+	m.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	ts := strings.SplitN(name, "/", 2)
+	if len(ts) != 2 {
+		return "", &Error{Status: 404, ID: "quarid.channel_name", Message: "Channels are named team/channel: " + name}
+	}
+
+	var ch mmChannel
+	path := "/teams/name/" + url.PathEscape(ts[0]) + "/channels/name/" + url.PathEscape(ts[1])
+	if err := m.request("GET", path, nil, &ch); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.teams[ch.TeamID] = ts[0]
+	m.mu.Unlock()
+	m.cacheChannel(&ch)
+
+	return ch.ID, nil
+}
@@ -0,0 +1,207 @@
+package mattermost
+
+// Sending
+//
+// Posts are created with the REST API, as Markdown, and replies are posted in
+// the thread of the post they reply to. Actions are italic. Mattermost sees
+// @username in a post as a mention of that user, so no mentions need to be
+// turned into Mattermost's. A room may be given by its ID, or by its name
+// ("team/channel"); posts to a user open a direct channel with them.
+//
+// See also: https://api.mattermost.com/#tag/posts/operation/CreatePost
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// MAX_MESSAGE_LENGTH is the longest post Mattermost allows, in characters
+const MAX_MESSAGE_LENGTH = 16383
+
+// Send an Update to Mattermost
+func (m *Mattermost) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		thread := u.Thread
+		if thread == "" {
+			thread = u.ReplyTo
+		}
+		return m.post(u.Room, thread, u.Kind, u.Text)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+
+		thread := u.To.Thread
+		if thread == "" {
+			thread = u.To.ID
+		}
+		msg, err := m.post(u.To.Room, thread, u.Kind, u.Text)
+		if msg != nil {
+			msg.ReplyTo = u.To.ID
+		}
+		return msg, err
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+		return m.edit(u.Message, u.Text)
+	case *adapter.Reaction:
+		name := strings.Trim(u.Reaction, ":")
+		if u.Removed {
+			return nil, m.request("DELETE", "/users/"+m.userID+"/posts/"+u.MessageID+"/reactions/"+url.PathEscape(name), nil, nil)
+		}
+		return nil, m.request("POST", "/reactions", map[string]string{
+			"user_id":    m.userID,
+			"post_id":    u.MessageID,
+			"emoji_name": name,
+		}, nil)
+	case *adapter.Membership:
+		return nil, m.setMembership(u)
+	case *adapter.Topic:
+		ch, err := m.channelID(u.Room)
+		if err != nil {
+			return nil, err
+		}
+		return nil, m.request("PUT", "/channels/"+ch+"/patch", map[string]string{"header": markdown(adapter.Text, u.Topic)}, nil)
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// post a message to a channel, in thread (if not empty). Long messages are
+// posted in parts; the last part posted is returned
+func (m *Mattermost) post(rm adapter.Room, thread string, kind adapter.Kind, text string) (*adapter.Message, error) {
+	ch, err := m.channelID(rm)
+	if err != nil {
+		return nil, err
+	}
+
+	var p post
+	for _, part := range split(markdown(kind, text)) {
+		err := m.request("POST", "/posts", map[string]string{
+			"channel_id": ch,
+			"message":    part,
+			"root_id":    thread,
+		}, &p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rm.ID != ch {
+		rm = m.room(ch)
+	}
+
+	return &adapter.Message{
+		Adapter: m.Name(),
+		ID:      p.ID,
+		Room:    rm,
+		User:    adapter.User{ID: m.userID, Name: m.username, Account: m.username},
+		Kind:    kind,
+		Text:    text,
+		Thread:  thread,
+		Time:    time.Now(),
+	}, nil
+}
+
+// edit the text of one of our posts
+func (m *Mattermost) edit(msg *adapter.Message, text string) (*adapter.Message, error) {
+	err := m.request("PUT", "/posts/"+msg.ID+"/patch", map[string]string{"message": split(markdown(msg.Kind, text))[0]}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := *msg
+	e.Text, e.Time = text, time.Now()
+	return &e, nil
+}
+
+// setMembership joins or leaves a channel, or removes someone from, or adds
+// someone to, a channel
+func (m *Mattermost) setMembership(u *adapter.Membership) error {
+	ch, err := m.channelID(u.Room)
+	if err != nil {
+		return err
+	}
+
+	switch u.Kind {
+	case adapter.Join:
+		return m.request("POST", "/channels/"+ch+"/members", map[string]string{"user_id": m.userID}, nil)
+	case adapter.Leave:
+		return m.request("DELETE", "/channels/"+ch+"/members/"+m.userID, nil, nil)
+	case adapter.Kick:
+		return m.request("DELETE", "/channels/"+ch+"/members/"+u.User.ID, nil, nil)
+	case adapter.Invite:
+		return m.request("POST", "/channels/"+ch+"/members", map[string]string{"user_id": u.User.ID}, nil)
+	}
+
+	return adapter.ErrNotSupported
+}
+
+// channelID returns the channel to post to a room in. Rooms may be named
+// ("team/channel"), and private rooms may be a user, to open a direct
+// channel with
+func (m *Mattermost) channelID(rm adapter.Room) (string, error) {
+	if strings.Contains(rm.ID, "/") {
+		return m.channelByName(rm.ID)
+	}
+	if !rm.Private || rm.ID == "" {
+		return rm.ID, nil
+	}
+
+	m.mu.Lock()
+	_, isChannel := m.channels[rm.ID]
+	dm, ok := m.dms[rm.ID]
+	m.mu.Unlock()
+	switch {
+	case isChannel:
+		return rm.ID, nil
+	case ok:
+		return dm, nil
+	}
+
+	var ch mmChannel
+	if err := m.request("POST", "/channels/direct", []string{m.userID, rm.ID}, &ch); err != nil {
+		return "", err
+	}
+	m.cacheChannel(&ch)
+
+	return ch.ID, nil
+}
+
+// markdown renders formatted text as Mattermost's Markdown, which cannot
+// underline text. Actions are italic
+func markdown(kind adapter.Kind, text string) string {
+	spans := format.Parse(text)
+	for n := range spans {
+		spans[n].Underline = false
+		if kind == adapter.Action {
+			spans[n].Italic = true
+		}
+	}
+
+	return format.Markdown(format.Format(spans))
+}
+
+// split a post into parts that each fit in a post, between lines where it can
+func split(content string) []string {
+	var parts []string
+
+	for len([]rune(content)) > MAX_MESSAGE_LENGTH {
+		rs := []rune(content)
+		head := string(rs[:MAX_MESSAGE_LENGTH])
+		if n := strings.LastIndex(head, "\n"); n > 0 {
+			head = head[:n+1]
+		}
+
+		parts = append(parts, head)
+		content = content[len(head):]
+	}
+
+	return append(parts, content)
+}
@@ -0,0 +1,211 @@
+package mattermost
+
+// WebSocket API
+//
+// The WebSocket API is at <server>/api/v4/websocket, and is authenticated with
+// the same token as the REST API. It sends hello, with the connection's ID,
+// and then events, numbered in order. When the connection is lost, we
+// reconnect with its ID and the number of the next event, and Mattermost
+// sends the events we missed, if it still has them; otherwise it starts a new
+// connection.
+//
+// See also: https://api.mattermost.com/#tag/WebSocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// PING_TIMEOUT is how long the WebSocket API can be silent (Mattermost pings
+// every minute or so) before the connection is lost
+const PING_TIMEOUT = 2 * time.Minute
+
+// EVENT_QUEUE is how many events can wait to be handled before we stop
+// reading from the WebSocket API
+const EVENT_QUEUE = 256
+
+// EVENT_HELLO is the first event on a connection
+const EVENT_HELLO = "hello"
+
+// event is an event from the WebSocket API
+type event struct {
+	Event     string                     `json:"event"`
+	Data      map[string]json.RawMessage `json:"data"`
+	Broadcast struct {
+		ChannelID string `json:"channel_id"`
+		TeamID    string `json:"team_id"`
+		UserID    string `json:"user_id"`
+	} `json:"broadcast"`
+	Seq int64 `json:"seq"`
+}
+
+// str returns a string from an event's data
+func (e *event) str(key string) string {
+	var s string
+	json.Unmarshal(e.Data[key], &s)
+	return s
+}
+
+// connect to the WebSocket API, resuming the last connection if there was
+// one, and wait for hello
+func (m *Mattermost) connect() error {
+	u, err := url.Parse(strings.TrimRight(m.URL, "/") + API_PATH + "/websocket")
+	if err != nil {
+		return err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+
+	m.wmu.Lock()
+	resume, seq := m.connectionID, m.seq
+	m.wmu.Unlock()
+	if resume != "" {
+		u.RawQuery = url.Values{
+			"connection_id":   {resume},
+			"sequence_number": {strconv.FormatInt(seq, 10)},
+		}.Encode()
+	}
+
+	dialer := &websocket.Dialer{HandshakeTimeout: TIMEOUT}
+	conn, resp, err := dialer.Dial(u.String(), http.Header{"Authorization": {"Bearer " + m.Token}})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return &Error{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		}
+		return fmt.Errorf("Could not connect to Mattermost: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+	var e event
+	if err := conn.ReadJSON(&e); err != nil {
+		conn.Close()
+		return err
+	}
+	if e.Event != EVENT_HELLO {
+		conn.Close()
+		return fmt.Errorf("Expected hello from Mattermost, got %s", e.Event)
+	}
+
+	id := e.str("connection_id")
+	if resume != "" && id != resume {
+		logger.Log.Warningf("Could not resume the Mattermost connection; events may have been missed")
+	}
+	if id != resume {
+		seq = e.Seq + 1
+	}
+
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(PING_TIMEOUT))
+
+		m.wmu.Lock()
+		defer m.wmu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	m.wmu.Lock()
+	m.conn, m.connectionID, m.seq = conn, id, seq
+	m.wmu.Unlock()
+
+	logger.Log.Debugf("Connected to the Mattermost WebSocket API")
+	return nil
+}
+
+// run reads from the WebSocket API, reconnecting whenever the connection is
+// lost, until stop is closed
+func (m *Mattermost) run(stop chan struct{}) {
+	for {
+		err := m.read(stop)
+
+		select {
+		case <-stop:
+			m.done <- nil
+			return
+		default:
+		}
+
+		m.wmu.Lock()
+		m.conn = nil
+		m.wmu.Unlock()
+
+		logger.Log.Warningf("Lost the Mattermost connection: %s", err)
+
+		wait := retryMin
+		for {
+			err := m.connect()
+			if err == nil {
+				break
+			}
+			if e, ok := err.(*Error); ok && e.Status == http.StatusUnauthorized {
+				m.done <- err
+				return
+			}
+
+			logger.Log.Warningf("Could not reconnect to Mattermost, retrying in %s: %s", wait, err)
+			select {
+			case <-stop:
+				m.done <- nil
+				return
+			case <-time.After(wait):
+			}
+
+			if wait *= 2; wait > retryMax {
+				wait = retryMax
+			}
+		}
+	}
+}
+
+// read events from the WebSocket API, until the connection fails
+func (m *Mattermost) read(stop chan struct{}) error {
+	m.wmu.Lock()
+	conn := m.conn
+	m.wmu.Unlock()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(PING_TIMEOUT))
+
+		e := &event{}
+		if err := conn.ReadJSON(e); err != nil {
+			conn.Close()
+			return err
+		}
+
+		// Replies to our own requests have no event
+		if e.Event == "" {
+			continue
+		}
+
+		m.wmu.Lock()
+		if e.Seq != m.seq {
+			logger.Log.Debugf("Expected Mattermost event %d, got %d", m.seq, e.Seq)
+		}
+		m.seq = e.Seq + 1
+		m.wmu.Unlock()
+
+		select {
+		case m.events <- e:
+		case <-stop:
+			conn.Close()
+			return nil
+		}
+	}
+}
+
+// handle events, in the order they arrived, until stop is closed
+func (m *Mattermost) handle(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case e := <-m.events:
+			m.event(e)
+		}
+	}
+}
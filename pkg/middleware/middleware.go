@@ -0,0 +1,128 @@
+// Package middleware provides built-in adapter.Middleware
+//
+// About
+//
+// Middleware is configured as a list, for each adapter, and for each network.
+// Each item in the list is the name of a built-in, or an object with its name
+// and its options:
+//
+//	["log", {"name": "ignore", "masks": ["*!*@spam.example"]}]
+//
+// The built-ins are:
+//
+//	ignore    drops events from users matching "masks" or "accounts"
+//	sanitize  cleans up messages sent, splitting lines, dropping control
+//	          characters, and cutting them to "max_length" (stripping
+//	          formatting, if "strip" is set)
+//	log       logs every event, in and out
+//	dryrun    drops the "commands" sent (PRIVMSG, NOTICE and TAGMSG, if
+//	          none are given), logging them instead
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// ErrUnknown is returned for middleware that is not built in
+var ErrUnknown = errors.New("Unknown middleware")
+
+// Options configure a built-in
+type Options map[string]interface{}
+
+// Builder builds a built-in, from its options
+type Builder func(opts Options) (adapter.Middleware, error)
+
+// Builtins are the built-in middleware, by name
+var Builtins = map[string]Builder{
+	"ignore":   newIgnore,
+	"sanitize": newSanitize,
+	"log":      newLog,
+	"dryrun":   newDryRun,
+}
+
+// Build the middleware configured by spec: the name of a built-in, or an
+// object with its name, and its options
+func Build(spec interface{}) (adapter.Middleware, error) {
+	var name string
+	opts := Options{}
+
+	switch s := spec.(type) {
+	case string:
+		name = s
+	case map[string]interface{}:
+		name, _ = s["name"].(string)
+		for k, v := range s {
+			opts[strings.ToLower(k)] = v
+		}
+	}
+
+	b, ok := Builtins[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Could not build middleware %v: %s", spec, ErrUnknown)
+	}
+
+	m, err := b(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Could not build middleware %s: %s", name, err)
+	}
+
+	return m, nil
+}
+
+// Chain builds a Chain from a list of specs
+func Chain(specs []interface{}) (adapter.Chain, error) {
+	var c adapter.Chain
+	for _, s := range specs {
+		m, err := Build(s)
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, m)
+	}
+
+	return c, nil
+}
+
+// Strings returns the option key, as a list of strings
+func (o Options) Strings(key string) []string {
+	var ss []string
+
+	switch v := o[key].(type) {
+	case string:
+		ss = append(ss, v)
+	case []string:
+		ss = append(ss, v...)
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+	}
+
+	return ss
+}
+
+// Int returns the option key, as an integer
+func (o Options) Int(key string) int {
+	switch v := o[key].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+
+	return 0
+}
+
+// Bool returns the option key, as a boolean
+func (o Options) Bool(key string) bool {
+	b, _ := o[key].(bool)
+	return b
+}
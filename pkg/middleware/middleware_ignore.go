@@ -0,0 +1,97 @@
+package middleware
+
+// Ignore
+//
+// Ignore drops events from the users in an ignore list, before anything
+// handles them: users whose hostmask matches one of the masks (with * and ?
+// as wildcards, as in IRC bans), or who are authenticated as one of the
+// accounts (from the IRCv3 account tag).
+
+import (
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// Ignore drops events from users in the ignore list
+type Ignore struct {
+	Masks    []string
+	Accounts []string
+}
+
+func newIgnore(opts Options) (adapter.Middleware, error) {
+	return &Ignore{
+		Masks:    opts.Strings("masks"),
+		Accounts: opts.Strings("accounts"),
+	}, nil
+}
+
+// Inbound drops ev if it is from an ignored user
+func (ig *Ignore) Inbound(ev *adapter.Event, next func(ev *adapter.Event)) {
+	if !ig.Ignored(ev) {
+		next(ev)
+	}
+}
+
+// Outbound passes ev on
+func (ig *Ignore) Outbound(ev *adapter.Event, next func(ev *adapter.Event) error) error {
+	return next(ev)
+}
+
+// Ignored reports whether ev is from an ignored user
+func (ig *Ignore) Ignored(ev *adapter.Event) bool {
+	if ev.Prefix == "" {
+		return false
+	}
+
+	for _, m := range ig.Masks {
+		if Match(m, ev.Prefix) {
+			return true
+		}
+	}
+
+	if a := ev.Tags["account"]; a != "" && a != "*" {
+		for _, ia := range ig.Accounts {
+			if strings.EqualFold(ia, a) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Match reports whether s matches the mask, case-insensitively, where * in
+// the mask matches any characters, and ? any single character
+func Match(mask, s string) bool {
+	return match([]rune(strings.ToLower(mask)), []rune(strings.ToLower(s)))
+}
+
+func match(mask, s []rune) bool {
+	// The last * seen, and where in s it matched up to
+	star, at := -1, 0
+
+	m, i := 0, 0
+	for i < len(s) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == s[i]):
+			m++
+			i++
+		case m < len(mask) && mask[m] == '*':
+			star, at = m, i
+			m++
+		case star >= 0:
+			// Let the last * match one more character
+			at++
+			m, i = star+1, at
+		default:
+			return false
+		}
+	}
+
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+
+	return m == len(mask)
+}
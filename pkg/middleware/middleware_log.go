@@ -0,0 +1,66 @@
+package middleware
+
+// Log and DryRun
+//
+// Log logs every event, on its way in and out, as an IRC line. DryRun logs
+// what would have been sent, instead of sending it, for the commands that
+// speak on the network; everything else (such as registering, and answering
+// PINGs) is still sent.
+
+import (
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// Log logs every event
+type Log struct{}
+
+func newLog(Options) (adapter.Middleware, error) {
+	return Log{}, nil
+}
+
+// Inbound logs ev, and passes it on
+func (Log) Inbound(ev *adapter.Event, next func(ev *adapter.Event)) {
+	logger.Log.Infof("<- %s", irc.FormatLine(ev))
+	next(ev)
+}
+
+// Outbound logs ev, and passes it on
+func (Log) Outbound(ev *adapter.Event, next func(ev *adapter.Event) error) error {
+	logger.Log.Infof("-> %s", irc.FormatLine(ev))
+	return next(ev)
+}
+
+// DryRun drops events sent with any of its commands, and logs them instead
+type DryRun struct {
+	Commands []string
+}
+
+func newDryRun(opts Options) (adapter.Middleware, error) {
+	d := &DryRun{Commands: opts.Strings("commands")}
+	if len(d.Commands) == 0 {
+		d.Commands = []string{irc.IRC_PRIVMSG, irc.IRC_NOTICE, irc.IRC_TAGMSG}
+	}
+
+	return d, nil
+}
+
+// Inbound passes ev on
+func (d *DryRun) Inbound(ev *adapter.Event, next func(ev *adapter.Event)) {
+	next(ev)
+}
+
+// Outbound drops ev, if it is sent with one of our commands
+func (d *DryRun) Outbound(ev *adapter.Event, next func(ev *adapter.Event) error) error {
+	for _, c := range d.Commands {
+		if strings.EqualFold(c, ev.Command) {
+			logger.Log.Infof("Dry run, not sending: %s", irc.FormatLine(ev))
+			return nil
+		}
+	}
+
+	return next(ev)
+}
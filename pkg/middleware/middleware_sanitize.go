@@ -0,0 +1,145 @@
+package middleware
+
+// Sanitize
+//
+// Sanitize cleans up the text of messages before they are sent, so that
+// nothing a plugin says can break the protocol, or the network's rules. Each
+// line of a message is sent as a message of its own; control characters
+// (other than formatting, and the CTCP wrapper of actions) and invalid UTF-8
+// are dropped, and lines longer than max_length bytes are cut short. With
+// strip set, formatting is dropped too. Lines left empty are not sent.
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// Sanitize cleans up the text of messages sent
+type Sanitize struct {
+	// The longest a line may be, in bytes. If it is 0, lines are not cut
+	MaxLength int
+
+	// Strip formatting from messages
+	Strip bool
+
+	// The commands sanitized, by default PRIVMSG and NOTICE
+	Commands []string
+}
+
+func newSanitize(opts Options) (adapter.Middleware, error) {
+	s := &Sanitize{
+		MaxLength: opts.Int("max_length"),
+		Strip:     opts.Bool("strip"),
+		Commands:  opts.Strings("commands"),
+	}
+	if len(s.Commands) == 0 {
+		s.Commands = []string{"PRIVMSG", "NOTICE"}
+	}
+
+	return s, nil
+}
+
+// Inbound passes ev on
+func (s *Sanitize) Inbound(ev *adapter.Event, next func(ev *adapter.Event)) {
+	next(ev)
+}
+
+// Outbound sends each line of ev's text, cleaned up, as an event of its own
+func (s *Sanitize) Outbound(ev *adapter.Event, next func(ev *adapter.Event) error) error {
+	if !s.sanitizes(ev.Command) || len(ev.Parameters) < 2 {
+		return next(ev)
+	}
+
+	last := len(ev.Parameters) - 1
+	for _, l := range s.Lines(ev.Parameters[last]) {
+		out := *ev
+		out.Parameters = append([]string(nil), ev.Parameters...)
+		out.Parameters[last] = l
+
+		if err := next(&out); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Lines returns the lines of text, cleaned up. Each line of a CTCP message
+// (such as an action) is wrapped as one
+func (s *Sanitize) Lines(text string) []string {
+	prefix, suffix := "", ""
+	if strings.HasPrefix(text, "\x01") {
+		suffix = "\x01"
+		text = strings.TrimSuffix(text[1:], "\x01")
+		if n := strings.Index(text, " "); n >= 0 {
+			prefix, text = "\x01"+text[:n+1], text[n+1:]
+		} else {
+			prefix, text = "\x01"+text, ""
+		}
+	}
+
+	if s.Strip {
+		text = format.Strip(text)
+	}
+
+	var lines []string
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.Map(clean, strings.ToValidUTF8(l, ""))
+		if strings.TrimSpace(l) == "" && prefix == "" {
+			continue
+		}
+
+		if s.MaxLength > 0 {
+			l = cut(l, s.MaxLength-len(prefix)-len(suffix))
+		}
+		lines = append(lines, prefix+l+suffix)
+	}
+
+	return lines
+}
+
+func (s *Sanitize) sanitizes(command string) bool {
+	for _, c := range s.Commands {
+		if strings.EqualFold(c, command) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clean drops control characters, other than formatting
+func clean(r rune) rune {
+	switch r {
+	case format.BOLD, format.COLOR, format.HEX_COLOR, format.RESET,
+		format.MONOSPACE, format.REVERSE, format.ITALIC,
+		format.STRIKETHROUGH, format.UNDERLINE:
+		return r
+	}
+
+	if unicode.IsControl(r) {
+		return -1
+	}
+
+	return r
+}
+
+// cut s to at most n bytes, without splitting a character
+func cut(s string, n int) string {
+	if n < 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
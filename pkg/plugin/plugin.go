@@ -1,10 +1,62 @@
 package plugin
 
-import "github.com/enmand/quarid-go/vm"
+import (
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/bus"
+	"github.com/enmand/quarid-go/vm"
+)
 
 type Plugin interface {
 	Load(i map[string]vm.VM) error
 	Run() error
+
+	// Handle a message, from any adapter, returning the plugin's reply (or ""
+	// for no reply)
+	Handle(m *adapter.Message) (string, error)
+
+	// Historical reports whether the plugin should be sent messages replayed
+	// from history, such as messages missed while disconnected
+	Historical() bool
+
+	// Subscriptions are the topic patterns on the bus the plugin subscribes
+	// to
+	Subscriptions() []string
+
+	// Event passes an event from the bus to the plugin
+	Event(ev *bus.Event) error
+
+	// Commands the plugin gives users
+	Commands() []Command
+
+	// Command runs one of the plugin's commands, called as called (with its
+	// subcommands, such as "remind in"), returning its reply
+	Command(called string, args map[string]interface{}, m *adapter.Message) (string, error)
+}
+
+// Command is a command a plugin gives users, as described in plugin.json
+type Command struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+	Help    string   `json:"help"`
+
+	// The command's arguments, in order
+	Args []CommandArg `json:"args"`
+
+	Subcommands []Command `json:"subcommands"`
+
+	// How long a user must wait between using the command, such as "30s"
+	Cooldown string `json:"cooldown"`
+
+	// Only admins may use the command
+	Admin bool `json:"admin"`
+}
+
+// CommandArg is an argument a plugin's command takes. Its type is word, int,
+// duration, nick, channel or rest
+type CommandArg struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional"`
 }
 
 func NewPlugin(name, path string) *plugin {
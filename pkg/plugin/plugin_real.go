@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"time"
 
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/bus"
 	qvm "github.com/enmand/quarid-go/vm"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,6 +21,15 @@ type plugin struct {
 	VM   string `json:"vm"`
 	Main string `json:"main"`
 
+	// Should the plugin be sent events replayed from history
+	History bool `json:"historical"`
+
+	// Topic patterns on the bus to be sent events from
+	Subscribe []string `json:"subscribe"`
+
+	// Commands the plugin gives users
+	CommandList []Command `json:"commands"`
+
 	Configuration interface{} `json:"configuration"`
 }
 
@@ -26,6 +38,121 @@ func (p *plugin) Run() error {
 	return err
 }
 
+// Handle a message, by calling the "handle" function the plugin exports.
+// Plugins that do not export "handle" do not handle messages
+func (p *plugin) Handle(m *adapter.Message) (string, error) {
+	r, err := p.vm.Call(p.path, "handle", messageObject(m))
+	if err == qvm.ErrNotExported {
+		return "", nil
+	}
+
+	return r, err
+}
+
+func (p *plugin) Historical() bool {
+	return p.History
+}
+
+func (p *plugin) Subscriptions() []string {
+	return p.Subscribe
+}
+
+// Event passes an event from the bus to the "event" function the plugin
+// exports. Plugins that do not export "event" are not sent events
+func (p *plugin) Event(ev *bus.Event) error {
+	_, err := p.vm.Call(p.path, "event", eventObject(ev))
+	if err == qvm.ErrNotExported {
+		return nil
+	}
+
+	return err
+}
+
+func (p *plugin) Commands() []Command {
+	return p.CommandList
+}
+
+// Command runs a command, by calling the "command" function the plugin
+// exports with the command, its arguments, and the message that called it.
+// Durations are given in seconds
+func (p *plugin) Command(called string, args map[string]interface{}, m *adapter.Message) (string, error) {
+	as := make(map[string]interface{}, len(args))
+	for k, v := range args {
+		if d, ok := v.(time.Duration); ok {
+			v = d.Seconds()
+		}
+		as[k] = v
+	}
+
+	return p.vm.Call(p.path, "command", map[string]interface{}{
+		"command": called,
+		"args":    as,
+		"message": messageObject(m),
+	})
+}
+
+// eventObject converts an event from the bus into the object plugins are
+// given. Messages are given as they are to "handle"
+func eventObject(ev *bus.Event) map[string]interface{} {
+	data := ev.Data
+	if m, ok := data.(*adapter.Message); ok {
+		data = messageObject(m)
+	}
+
+	return map[string]interface{}{
+		"topic": ev.Topic,
+		"time":  ev.Time.Unix(),
+		"data":  data,
+	}
+}
+
+// messageObject converts a message into the object plugins are given. Messages
+// with a native event also carry the event's fields, and every message has a
+// ref, by which the bot can find the message again
+func messageObject(m *adapter.Message) map[string]interface{} {
+	o := map[string]interface{}{
+		"ref":     ref(m),
+		"adapter": m.Adapter,
+		"id":      m.ID,
+		"room": map[string]interface{}{
+			"id":      m.Room.ID,
+			"name":    m.Room.Name,
+			"private": m.Room.Private,
+		},
+		"user": map[string]interface{}{
+			"id":      m.User.ID,
+			"name":    m.User.Name,
+			"account": m.User.Account,
+			"mask":    m.User.Mask,
+		},
+		"kind":       m.Kind.String(),
+		"text":       m.Text,
+		"reply_to":   m.ReplyTo,
+		"thread":     m.Thread,
+		"time":       m.Time.Unix(),
+		"historical": m.Historical,
+	}
+
+	if ev := m.Raw; ev != nil {
+		params := make([]interface{}, len(ev.Parameters))
+		for i, p := range ev.Parameters {
+			params[i] = p
+		}
+
+		tags := make(map[string]interface{}, len(ev.Tags))
+		for k, v := range ev.Tags {
+			tags[k] = v
+		}
+
+		o["prefix"] = ev.Prefix
+		o["command"] = ev.Command
+		o["parameters"] = params
+		o["tags"] = tags
+	}
+
+	return o
+}
+
 // Compile our plugin, using the VM given
 func (p *plugin) Compile() error {
 	m, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", p.path, p.Main))
@@ -47,7 +174,7 @@ func (p *plugin) Load(vms map[string]qvm.VM) error {
 		return err
 	}
 
-	p = pp.(*plugin) // Set our plugin configuration our loaded config
+	*p = *pp.(*plugin) // Set our plugin configuration our loaded config
 	log.Infof("Loading plugin: %s (in VM: %s)", p.Name, p.VM)
 
 	if err := p.Compile(); err != nil {
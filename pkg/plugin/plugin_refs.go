@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// maxRefs is how many of the messages most recently given to plugins can be
+// looked up by their ref
+const maxRefs = 1000
+
+// refs are the messages recently given to plugins, by the "ref" in the
+// objects plugins are given. Plugins may change anything in those objects, so
+// what they pass back is looked up by its ref, rather than trusted
+var refs = struct {
+	mu        sync.Mutex
+	next      int
+	order     []string
+	messages  map[string]*adapter.Message
+	byMessage map[*adapter.Message]string
+}{
+	messages:  make(map[string]*adapter.Message),
+	byMessage: make(map[*adapter.Message]string),
+}
+
+// ref returns the ref m is given to plugins with
+func ref(m *adapter.Message) string {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+
+	if r, ok := refs.byMessage[m]; ok {
+		return r
+	}
+
+	refs.next++
+	r := strconv.Itoa(refs.next)
+	refs.messages[r] = m
+	refs.byMessage[m] = r
+	refs.order = append(refs.order, r)
+
+	if len(refs.order) > maxRefs {
+		old := refs.order[0]
+		refs.order = refs.order[1:]
+		delete(refs.byMessage, refs.messages[old])
+		delete(refs.messages, old)
+	}
+
+	return r
+}
+
+// Message returns the message that was given to plugins with the ref r, if
+// it was one of the last given
+func Message(r string) (*adapter.Message, bool) {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+
+	m, ok := refs.messages[r]
+	return m, ok
+}
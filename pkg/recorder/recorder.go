@@ -0,0 +1,187 @@
+// Package recorder records the events of a session, and replays them
+//
+// About
+//
+// A Recorder writes every event the bot reads from, and writes to, each of
+// its networks to a log, with the time it happened: as JSON, one record to a
+// line, or (for files named .gob or .bin) in a compact binary encoding.
+//
+// IRC is recorded as it is on the wire, before batches are put together or
+// middleware sees it, through the client's Tap. Other adapters are recorded
+// by wrapping them, so that their messages are recorded as the events IRC
+// would have for them, along with the room and user they came from. Wrapped
+// inside their middleware, what they receive is recorded before middleware
+// sees it, and what they send after it has, as with IRC.
+//
+// A recorded session can be replayed to the bot, in place of its networks,
+// to see whether it still says what it said.
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// ErrClosed is returned when recording to a Recorder that has been closed
+var ErrClosed = errors.New("Recorder is closed")
+
+// Record is an event read from, or written to, a network
+type Record struct {
+	// When the event happened
+	Time time.Time
+
+	// The adapter, and the network it was on
+	Adapter string
+	Network string
+
+	// Whether the event was written to the network, rather than read from it
+	Out bool
+
+	Event *adapter.Event
+
+	// For adapters other than IRC, the message the event was read as
+	Message *adapter.Message
+}
+
+// Recorder writes Records to a file
+type Recorder struct {
+	file *os.File
+	enc  encoder
+
+	mu sync.Mutex
+}
+
+// Open a file to record to, in the format for its name. It is truncated if it
+// already exists
+func Open(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open recording %s: %s", path, err)
+	}
+
+	return &Recorder{file: f, enc: newEncoder(formatOf(path), f)}, nil
+}
+
+// Record r
+func (rec *Recorder) Record(r *Record) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.file == nil {
+		return ErrClosed
+	}
+
+	return rec.enc.encode(r)
+}
+
+// Close the file being recorded to
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.file == nil {
+		return nil
+	}
+
+	err := rec.file.Close()
+	rec.file = nil
+
+	return err
+}
+
+// Tap records each event an IRC client on network reads or writes, for its
+// Tap
+func (rec *Recorder) Tap(network string) func(ev *adapter.Event, sent bool) {
+	return func(ev *adapter.Event, sent bool) {
+		t := ev.Timestamp
+		if sent || t.IsZero() {
+			t = time.Now()
+		}
+
+		rec.record(&Record{
+			Time:    t,
+			Adapter: irc.ADAPTER_NAME,
+			Network: network,
+			Out:     sent,
+			Event:   ev,
+		})
+	}
+}
+
+// Wrap an Adapter, so that the messages it receives and sends are recorded
+func (rec *Recorder) Wrap(a adapter.Adapter) adapter.Adapter {
+	return &recorded{Adapter: a, recorder: rec}
+}
+
+// record r, logging (rather than returning) errors, so that the session goes
+// on if it cannot be recorded
+func (rec *Recorder) record(r *Record) {
+	if err := rec.Record(r); err != nil && err != ErrClosed {
+		logger.Log.Warningf("Could not record an event: %s", err)
+	}
+}
+
+type recorded struct {
+	adapter.Adapter
+	recorder *Recorder
+}
+
+// Unwrap returns the recorded Adapter
+func (r *recorded) Unwrap() adapter.Adapter {
+	return r.Adapter
+}
+
+func (r *recorded) Receive(f adapter.UpdateFunc) {
+	r.Adapter.Receive(func(u adapter.Update, _ adapter.Adapter) {
+		if m, ok := u.(*adapter.Message); ok {
+			t := m.Time
+			if t.IsZero() {
+				t = time.Now()
+			}
+
+			r.recorder.record(&Record{
+				Time:    t,
+				Adapter: r.Name(),
+				Network: r.Name(),
+				Event:   adapter.MessageEvent(m),
+				Message: m,
+			})
+		}
+
+		f(u, r)
+	})
+}
+
+func (r *recorded) Send(u adapter.Update) (*adapter.Message, error) {
+	m, err := r.Adapter.Send(u)
+
+	var sent *adapter.Message
+	switch u := u.(type) {
+	case *adapter.Message:
+		sent = u
+	case *adapter.Reply:
+		sent = &adapter.Message{Kind: u.Kind, Text: u.Text}
+		if u.To != nil {
+			sent.Room = u.To.Room
+		}
+	}
+
+	if sent != nil && err == nil {
+		r.recorder.record(&Record{
+			Time:    time.Now(),
+			Adapter: r.Name(),
+			Network: r.Name(),
+			Out:     true,
+			Event:   adapter.MessageEvent(sent),
+		})
+	}
+
+	return m, err
+}
@@ -0,0 +1,186 @@
+package recorder
+
+// Encoding
+//
+// Records are written compactly, with short field names, and without what
+// can be worked out again: an event's time is the record's, and a message
+// keeps only what its event does not have (its ID, room, user and thread).
+// JSON records are written one to a line; binary records are a stream of
+// gob values.
+//
+// See also: https://jsonlines.org/
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+)
+
+// Format is how Records are encoded in a file
+type Format int
+
+// Formats of recordings
+const (
+	// JSON Lines: a JSON object on each line
+	JSONL Format = iota
+
+	// A stream of gob values
+	BINARY
+)
+
+// formatOf the file at path, from its extension
+func formatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gob", ".bin":
+		return BINARY
+	}
+
+	return JSONL
+}
+
+type record struct {
+	Time    time.Time         `json:"t"`
+	Adapter string            `json:"a"`
+	Network string            `json:"n,omitempty"`
+	Out     bool              `json:"o,omitempty"`
+	Tags    map[string]string `json:"g,omitempty"`
+	Prefix  string            `json:"p,omitempty"`
+	Command string            `json:"c"`
+	Params  []string          `json:"x,omitempty"`
+	History bool              `json:"h,omitempty"`
+	Message *message          `json:"m,omitempty"`
+}
+
+type message struct {
+	ID      string       `json:"i,omitempty"`
+	Room    adapter.Room `json:"r"`
+	User    adapter.User `json:"u"`
+	ReplyTo string       `json:"re,omitempty"`
+	Thread  string       `json:"th,omitempty"`
+}
+
+func encodeRecord(r *Record) *record {
+	e := &record{
+		Time:    r.Time,
+		Adapter: r.Adapter,
+		Network: r.Network,
+		Out:     r.Out,
+		Tags:    r.Event.Tags,
+		Prefix:  r.Event.Prefix,
+		Command: r.Event.Command,
+		Params:  r.Event.Parameters,
+		History: r.Event.Historical,
+	}
+	if m := r.Message; m != nil {
+		e.Message = &message{
+			ID:      m.ID,
+			Room:    m.Room,
+			User:    m.User,
+			ReplyTo: m.ReplyTo,
+			Thread:  m.Thread,
+		}
+	}
+
+	return e
+}
+
+func decodeRecord(e *record) *Record {
+	r := &Record{
+		Time:    e.Time,
+		Adapter: e.Adapter,
+		Network: e.Network,
+		Out:     e.Out,
+		Event: &adapter.Event{
+			Tags:       e.Tags,
+			Prefix:     e.Prefix,
+			Command:    e.Command,
+			Parameters: e.Params,
+			Timestamp:  e.Time,
+			Historical: e.History,
+		},
+	}
+	if e.Message != nil {
+		m := &adapter.Message{
+			Adapter:    e.Adapter,
+			ID:         e.Message.ID,
+			Room:       e.Message.Room,
+			User:       e.Message.User,
+			ReplyTo:    e.Message.ReplyTo,
+			Thread:     e.Message.Thread,
+			Time:       e.Time,
+			Historical: e.History,
+		}
+		r.Message = adapter.EventMessage(m, r.Event)
+	}
+
+	return r
+}
+
+type encoder interface {
+	encode(r *Record) error
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (j *jsonEncoder) encode(r *Record) error {
+	return j.enc.Encode(encodeRecord(r))
+}
+
+type gobEncoder struct {
+	enc *gob.Encoder
+}
+
+func (g *gobEncoder) encode(r *Record) error {
+	return g.enc.Encode(encodeRecord(r))
+}
+
+func newEncoder(f Format, w io.Writer) encoder {
+	if f == BINARY {
+		return &gobEncoder{enc: gob.NewEncoder(w)}
+	}
+
+	return &jsonEncoder{enc: json.NewEncoder(w)}
+}
+
+// Read the Records recorded in the file at path
+func Read(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open recording %s: %s", path, err)
+	}
+	defer f.Close()
+
+	type decoder interface {
+		Decode(v interface{}) error
+	}
+
+	var dec decoder = json.NewDecoder(f)
+	if formatOf(path) == BINARY {
+		dec = gob.NewDecoder(f)
+	}
+
+	var rs []*Record
+	for {
+		e := &record{}
+		err := dec.Decode(e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return rs, fmt.Errorf("Could not read record %d of %s: %s", len(rs)+1, path, err)
+		}
+
+		rs = append(rs, decodeRecord(e))
+	}
+
+	return rs, nil
+}
@@ -0,0 +1,630 @@
+package recorder
+
+// Replay
+//
+// A Replay plays a recorded session back to the bot, in place of its
+// networks. IRC is replayed through a transport for replay:// addresses
+// (replay://network), which reads the recorded lines, and keeps what the
+// client writes; any other adapter is replaced by a Player, which receives
+// the recorded messages, and keeps what is sent with it.
+//
+// Time is virtual: events are played one after another, as fast as the bot
+// handles them, with the times they were recorded at (on IRC, as their
+// server-time). A Replay is the bot's clock while it is replayed, so that
+// cooldowns, timed bans, join retries and the bus's timers see the recorded
+// time, and fire as it passes them. Each event is played once the bot has
+// finished with the last (and any timers due before it), so that what it
+// writes can be compared with what it wrote in the recording, event by event.
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/irc"
+)
+
+// SCHEME is the scheme of the IRC server address to replay a network from
+const SCHEME = "replay"
+
+// Errors replaying, when the bot stops reading events, or does not finish
+// handling them
+var (
+	ErrNotRead     = errors.New("Events are not being read")
+	ErrNotFinished = errors.New("Events are not being finished with")
+)
+
+// Replay plays a recording back to the bot, and is its clock while it does
+type Replay struct {
+	// How long to wait for the bot to read an event, and to finish with it,
+	// before giving up, in real time
+	Timeout time.Duration
+
+	records []*Record
+	streams map[string]*stream
+
+	mu sync.Mutex
+
+	// How many events have been played, when the last was recorded, and
+	// what the bot wrote
+	played   int
+	now      time.Time
+	produced []written
+
+	// Timers waiting for the time to pass them
+	timers []*timer
+
+	// How much work the bot is doing, and a channel closed once it is done
+	busy int
+	idle chan struct{}
+}
+
+// timer is a timer on a Replay's clock
+type timer struct {
+	replay *Replay
+	at     time.Time
+	f      func()
+}
+
+// written is an event the bot wrote, and how many events had been played
+// when it did
+type written struct {
+	*Record
+	played int
+}
+
+type stream struct {
+	adapter string
+	network string
+
+	// Events to be read by the IRC transport, or the Player for the stream
+	events chan *played
+	player *Player
+}
+
+// played is a record being played to the IRC transport, and what to call
+// once it has been read
+type played struct {
+	*Record
+	done func()
+}
+
+// Load a recording to replay. IRC networks in it are replayed from
+// replay://network, and others by their Player
+func Load(path string) (*Replay, error) {
+	rs, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Replay{
+		Timeout: 10 * time.Second,
+		records: rs,
+		streams: make(map[string]*stream),
+	}
+	if len(rs) > 0 {
+		r.now = rs[0].Time
+	}
+	for _, rec := range rs {
+		k := streamKey(rec.Adapter, rec.Network)
+		if _, ok := r.streams[k]; ok {
+			continue
+		}
+
+		s := &stream{adapter: rec.Adapter, network: rec.Network}
+		if rec.Adapter == irc.ADAPTER_NAME {
+			s.events = make(chan *played)
+		} else {
+			s.player = &Player{replay: r, stream: s, done: make(chan struct{})}
+		}
+		r.streams[k] = s
+	}
+
+	irc.RegisterTransport(SCHEME, r.dial, false)
+
+	return r, nil
+}
+
+// Has reports whether the adapter on network was recorded
+func (r *Replay) Has(adapterName, network string) bool {
+	_, ok := r.streams[streamKey(adapterName, network)]
+	return ok
+}
+
+// Address is the IRC server address to replay network from
+func Address(network string) string {
+	return SCHEME + "://" + network
+}
+
+// Players replace the adapters (other than IRC) that were recorded
+func (r *Replay) Players() []*Player {
+	var ps []*Player
+	for _, s := range r.streams {
+		if s.player != nil {
+			ps = append(ps, s.player)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].stream.adapter < ps[j].stream.adapter
+	})
+
+	return ps
+}
+
+// Now is the time the last event played was recorded at, or the time a timer
+// firing was due
+func (r *Replay) Now() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.now
+}
+
+// AfterFunc calls f once the recording's time has passed d from now
+func (r *Replay) AfterFunc(d time.Duration, f func()) clock.Timer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := &timer{replay: r, at: r.now.Add(d), f: f}
+	r.timers = append(r.timers, t)
+
+	return t
+}
+
+// Stop the timer, if it has not fired
+func (t *timer) Stop() bool {
+	r := t.replay
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, rt := range r.timers {
+		if rt == t {
+			r.timers = append(r.timers[:i], r.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Busy marks work the bot is doing, which is waited for before the next event
+// is played
+func (r *Replay) Busy() func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.busy == 0 {
+		r.idle = make(chan struct{})
+	}
+	r.busy++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.busy--; r.busy == 0 {
+				close(r.idle)
+			}
+		})
+	}
+}
+
+// Run plays each event read in the recording, in order, once the bot has
+// finished with the last
+func (r *Replay) Run() error {
+	for n, rec := range r.records {
+		if rec.Out {
+			continue
+		}
+
+		if err := r.until(rec.Time); err != nil {
+			return fmt.Errorf("Could not replay record %d, to %s: %s", n+1, streamKey(rec.Adapter, rec.Network), err)
+		}
+
+		s := r.streams[streamKey(rec.Adapter, rec.Network)]
+		if s.player != nil {
+			done := r.Busy()
+			r.advance(rec)
+			s.player.play(rec)
+			done()
+		} else {
+			// The transport is done with it once it is asked for the next
+			// line, which is once the client has queued it
+			select {
+			case s.events <- &played{Record: rec, done: r.Busy()}:
+			case <-time.After(r.Timeout):
+				return fmt.Errorf("Could not replay record %d, to %s: %s", n+1, s, ErrNotRead)
+			}
+		}
+
+		if err := r.wait(); err != nil {
+			return fmt.Errorf("Could not replay record %d, to %s: %s", n+1, s, err)
+		}
+	}
+
+	return nil
+}
+
+// until fires the timers due up to t, in order, each at the time it was due,
+// and waits for the bot to finish with each
+func (r *Replay) until(t time.Time) error {
+	for {
+		r.mu.Lock()
+		var next *timer
+		for _, rt := range r.timers {
+			if !rt.at.After(t) && (next == nil || rt.at.Before(next.at)) {
+				next = rt
+			}
+		}
+		if next == nil {
+			r.mu.Unlock()
+			return nil
+		}
+
+		for i, rt := range r.timers {
+			if rt == next {
+				r.timers = append(r.timers[:i], r.timers[i+1:]...)
+				break
+			}
+		}
+		if next.at.After(r.now) {
+			r.now = next.at
+		}
+		r.mu.Unlock()
+
+		clock.Go(r, next.f)
+		if err := r.wait(); err != nil {
+			return err
+		}
+	}
+}
+
+// wait until the bot has finished what it is doing
+func (r *Replay) wait() error {
+	r.mu.Lock()
+	if r.busy == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	idle := r.idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-time.After(r.Timeout):
+		return ErrNotFinished
+	}
+}
+
+// Difference is an event the bot wrote differently from the recording
+type Difference struct {
+	// How many events had been played when it was written
+	Played int
+
+	Adapter string
+	Network string
+
+	// The event, as a line of IRC, and whether it was recorded but not
+	// written (missing), or written but not recorded
+	Line    string
+	Missing bool
+}
+
+func (d Difference) String() string {
+	sign := "+"
+	if d.Missing {
+		sign = "-"
+	}
+
+	return fmt.Sprintf("%s [%s/%s after %d] %s", sign, d.Adapter, d.Network, d.Played, d.Line)
+}
+
+// Diff compares what the bot wrote while replaying with what was recorded,
+// after each event played. Events written in a different order in response
+// to the same event are not differences
+func (r *Replay) Diff() []Difference {
+	groups := make(map[string]*group)
+	var order []*group
+
+	add := func(rec *Record, played int, expected bool) {
+		k := fmt.Sprintf("%d %s", played, streamKey(rec.Adapter, rec.Network))
+		g, ok := groups[k]
+		if !ok {
+			g = &group{
+				played:  played,
+				stream:  streamKey(rec.Adapter, rec.Network),
+				adapter: rec.Adapter,
+				net:     rec.Network,
+			}
+			groups[k] = g
+			order = append(order, g)
+		}
+
+		if expected {
+			g.expected = append(g.expected, line(rec.Event))
+		} else {
+			g.wrote = append(g.wrote, line(rec.Event))
+		}
+	}
+
+	played := 0
+	for _, rec := range r.records {
+		if !rec.Out {
+			played++
+			continue
+		}
+		add(rec, played, true)
+	}
+
+	r.mu.Lock()
+	for _, w := range r.produced {
+		add(w.Record, w.played, false)
+	}
+	r.mu.Unlock()
+
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].played != order[j].played {
+			return order[i].played < order[j].played
+		}
+		return order[i].stream < order[j].stream
+	})
+
+	var ds []Difference
+	for _, g := range order {
+		wrote := append([]string(nil), g.wrote...)
+
+		for _, l := range g.expected {
+			found := false
+			for i, w := range wrote {
+				if w == l {
+					wrote = append(wrote[:i], wrote[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				ds = append(ds, g.difference(l, true))
+			}
+		}
+
+		for _, l := range wrote {
+			ds = append(ds, g.difference(l, false))
+		}
+	}
+
+	return ds
+}
+
+// group is what was recorded, and what the bot wrote, to a stream after the
+// same event was played
+type group struct {
+	played          int
+	stream          string
+	adapter, net    string
+	expected, wrote []string
+}
+
+func (g *group) difference(l string, missing bool) Difference {
+	return Difference{
+		Played:  g.played,
+		Adapter: g.adapter,
+		Network: g.net,
+		Line:    l,
+		Missing: missing,
+	}
+}
+
+// advance the clock to a record being played
+func (r *Replay) advance(rec *Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.played++
+	r.now = rec.Time
+}
+
+// wrote keeps an event the bot wrote to a stream
+func (r *Replay) wrote(s *stream, ev *adapter.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.produced = append(r.produced, written{
+		Record: &Record{
+			Time:    r.now,
+			Adapter: s.adapter,
+			Network: s.network,
+			Out:     true,
+			Event:   ev,
+		},
+		played: r.played,
+	})
+}
+
+func (s *stream) String() string {
+	return streamKey(s.adapter, s.network)
+}
+
+func streamKey(adapterName, network string) string {
+	return adapterName + "/" + network
+}
+
+// line is an event as a line of IRC
+func line(ev *adapter.Event) string {
+	return irc.FormatLine(ev)
+}
+
+// withTime is an event read, with the time it was recorded at as its
+// server-time (unless it has one), so that the bot sees it at that time
+func withTime(ev *adapter.Event) *adapter.Event {
+	if _, ok := ev.Tags["time"]; ok || ev.Timestamp.IsZero() {
+		return ev
+	}
+
+	out := *ev
+	out.Tags = map[string]string{
+		"time": ev.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"),
+	}
+	for k, v := range ev.Tags {
+		out.Tags[k] = v
+	}
+
+	return &out
+}
+
+// dial the stream for an IRC network
+func (r *Replay) dial(addr string, _ *tls.Config) (irc.Transport, error) {
+	s, ok := r.streams[streamKey(irc.ADAPTER_NAME, addr)]
+	if !ok || s.events == nil {
+		return nil, fmt.Errorf("No IRC network %s in the recording", addr)
+	}
+
+	return &transport{replay: r, stream: s, closed: make(chan struct{})}, nil
+}
+
+// transport replays an IRC network's recorded lines to the client
+type transport struct {
+	replay *Replay
+	stream *stream
+
+	// What to call once the client has queued the last line read
+	done func()
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (t *transport) ReadLine() (string, error) {
+	if t.done != nil {
+		t.done()
+		t.done = nil
+	}
+
+	select {
+	case p := <-t.stream.events:
+		t.replay.advance(p.Record)
+		t.done = p.done
+		return line(withTime(p.Event)), nil
+	case <-t.closed:
+		return "", io.EOF
+	}
+}
+
+func (t *transport) WriteLine(l string) error {
+	ev, err := irc.ParseLine(l)
+	if err != nil {
+		return err
+	}
+	ev.Timestamp = time.Time{}
+
+	t.replay.wrote(t.stream, ev)
+	return nil
+}
+
+func (t *transport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+
+	return nil
+}
+
+// Player is an adapter, other than IRC, being replayed. It receives the
+// messages recorded for it, and keeps what is sent with it
+type Player struct {
+	replay *Replay
+	stream *stream
+
+	mu       sync.Mutex
+	handlers []adapter.UpdateFunc
+	sent     int
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Name of the adapter being replayed
+func (p *Player) Name() string {
+	return p.stream.adapter
+}
+
+// Connect does nothing: there is nothing to connect to
+func (p *Player) Connect() error {
+	return nil
+}
+
+// Disconnect stops the Player
+func (p *Player) Disconnect() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+
+	return nil
+}
+
+// Wait blocks until the Player is disconnected
+func (p *Player) Wait() error {
+	<-p.done
+	return nil
+}
+
+// Receive calls f with each message played
+func (p *Player) Receive(f adapter.UpdateFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.handlers = append(p.handlers, f)
+}
+
+// Send keeps messages and replies sent, as the events they would be
+// recorded as. Anything else is not recorded, and is dropped
+func (p *Player) Send(u adapter.Update) (*adapter.Message, error) {
+	var m *adapter.Message
+	switch u := u.(type) {
+	case *adapter.Message:
+		c := *u
+		m = &c
+	case *adapter.Reply:
+		m = &adapter.Message{Kind: u.Kind, Text: u.Text}
+		if u.To != nil {
+			m.Room = u.To.Room
+		}
+	default:
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	p.sent++
+	m.Adapter = p.Name()
+	m.ID = fmt.Sprintf("replay-%d", p.sent)
+	m.Time = p.replay.Now()
+	p.mu.Unlock()
+
+	p.replay.wrote(p.stream, adapter.MessageEvent(m))
+
+	return m, nil
+}
+
+// play a recorded message to each handler
+func (p *Player) play(rec *Record) {
+	if rec.Message == nil {
+		return
+	}
+
+	p.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), p.handlers...)
+	p.mu.Unlock()
+
+	for _, h := range hs {
+		m := *rec.Message
+		h(&m, p)
+	}
+}
@@ -0,0 +1,233 @@
+package recorder_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/clock"
+	"github.com/enmand/quarid-go/pkg/irc"
+	"github.com/enmand/quarid-go/pkg/recorder"
+)
+
+var start = time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// record writes rs to a new recording, and loads it to replay
+func record(t *testing.T, rs ...*recorder.Record) (*recorder.Replay, func()) {
+	dir, err := ioutil.TempDir("", "quarid-recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "session.json")
+
+	rec, err := recorder.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rs {
+		if err := rec.Record(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := recorder.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Timeout = time.Second
+
+	return r, func() { os.RemoveAll(dir) }
+}
+
+// in is a message from alice in the room, at d after start
+func in(d time.Duration, text string) *recorder.Record {
+	m := &adapter.Message{
+		Adapter: "matrix",
+		ID:      text,
+		Room:    adapter.Room{ID: "!room"},
+		User:    adapter.User{ID: "@alice"},
+		Text:    text,
+		Time:    start.Add(d),
+	}
+
+	return &recorder.Record{
+		Time:    m.Time,
+		Adapter: "matrix",
+		Network: "matrix",
+		Event:   adapter.MessageEvent(m),
+		Message: m,
+	}
+}
+
+// out is what the bot said in the room
+func out(d time.Duration, text string) *recorder.Record {
+	return &recorder.Record{
+		Time:    start.Add(d),
+		Adapter: "matrix",
+		Network: "matrix",
+		Out:     true,
+		Event: &adapter.Event{
+			Command:    "PRIVMSG",
+			Parameters: []string{"!room", text},
+		},
+	}
+}
+
+// player is the recording's only Player
+func player(t *testing.T, r *recorder.Replay) *recorder.Player {
+	ps := r.Players()
+	if len(ps) != 1 {
+		t.Fatalf("Expected one player, but got %d", len(ps))
+	}
+
+	return ps[0]
+}
+
+func TestReplayWaitsForHandlers(t *testing.T) {
+	r, done := record(t,
+		in(0, "ping"),
+		out(0, "pong"),
+		in(time.Second, "bye"),
+	)
+	defer done()
+
+	p := player(t, r)
+	p.Receive(func(u adapter.Update, a adapter.Adapter) {
+		m := u.(*adapter.Message)
+		if m.Text != "ping" {
+			return
+		}
+
+		// Replies are sent once the handler has taken its time
+		clock.Go(r, func() {
+			time.Sleep(100 * time.Millisecond)
+			a.Send(&adapter.Reply{To: m, Text: "pong"})
+		})
+	})
+
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if ds := r.Diff(); len(ds) > 0 {
+		t.Fatalf("Expected no differences, but got %v", ds)
+	}
+}
+
+func TestReplayTimers(t *testing.T) {
+	r, done := record(t,
+		in(0, "hello"),
+		out(time.Minute, "tick at 12:01"),
+		in(2*time.Minute, "bye"),
+	)
+	defer done()
+
+	p := player(t, r)
+	if now := r.Now(); !now.Equal(start) {
+		t.Fatalf("Expected the clock to start at %s, but it is at %s", start, now)
+	}
+
+	stopped := r.AfterFunc(90*time.Second, func() {
+		t.Error("Expected a stopped timer not to fire")
+	})
+	r.AfterFunc(time.Minute, func() {
+		p.Send(&adapter.Message{
+			Room: adapter.Room{ID: "!room"},
+			Text: "tick at " + r.Now().Format("15:04"),
+		})
+	})
+	if !stopped.Stop() {
+		t.Fatal("Expected to stop the timer")
+	}
+
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if ds := r.Diff(); len(ds) > 0 {
+		t.Fatalf("Expected no differences, but got %v", ds)
+	}
+	if now := r.Now(); !now.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("Expected the clock to be at the last event, but it is at %s", now)
+	}
+}
+
+func TestReplayNotFinished(t *testing.T) {
+	r, done := record(t, in(0, "hello"))
+	defer done()
+	r.Timeout = 50 * time.Millisecond
+
+	player(t, r).Receive(func(u adapter.Update, a adapter.Adapter) {
+		// Work that never finishes
+		r.Busy()
+	})
+
+	if err := r.Run(); err == nil {
+		t.Fatal("Expected the replay to give up on the bot")
+	}
+}
+
+// line is an IRC line the bot read, or wrote, at d after start
+func line(d time.Duration, l string, written bool) *recorder.Record {
+	ev, err := irc.ParseLine(l)
+	if err != nil {
+		panic(err)
+	}
+
+	return &recorder.Record{
+		Time:    start.Add(d),
+		Adapter: irc.ADAPTER_NAME,
+		Network: "test",
+		Out:     written,
+		Event:   ev,
+	}
+}
+
+func TestReplayIRC(t *testing.T) {
+	r, done := record(t,
+		line(0, ":irc.test 001 quarid :Welcome", false),
+		line(time.Second, ":alice!alice@example.com PRIVMSG #test :ping", false),
+		line(time.Second, "PRIVMSG #test :pong at 12:00:01", true),
+		line(2*time.Second, ":alice!alice@example.com PRIVMSG #test :bye", false),
+	)
+	defer done()
+
+	c := irc.NewClient("quarid", "quarid", false, false)
+	c.Clock = r
+	c.Handle([]adapter.Filter{irc.CommandFilter{Command: irc.IRC_PRIVMSG}}, func(ev *adapter.Event, w adapter.Responder) {
+		if len(ev.Parameters) < 2 || ev.Parameters[1] != "ping" {
+			return
+		}
+
+		// Handlers are waited for, however long they take
+		time.Sleep(100 * time.Millisecond)
+		w.Write(&adapter.Event{
+			Command:    irc.IRC_PRIVMSG,
+			Parameters: []string{"#test", "pong at " + r.Now().Format("15:04:05")},
+		})
+	})
+	go c.Loop()
+
+	connected := make(chan error, 1)
+	go func() { connected <- c.Connect(recorder.Address("test")) }()
+
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	// Registration was not recorded, only the reply
+	for _, d := range r.Diff() {
+		if strings.Contains(d.Line, "PRIVMSG") {
+			t.Errorf("Expected no differences in messages, but got %s", d)
+		}
+	}
+}
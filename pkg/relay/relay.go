@@ -0,0 +1,316 @@
+// Package relay bridges rooms on different networks
+//
+// About
+//
+// A Relay links groups of rooms, each on a network reached through an
+// adapter. What is said in one room of a link is said in each of the others,
+// by the bot, with the nick of the user who said it: messages, actions,
+// notices and topic changes, and (if asked for) joins, parts, quits and
+// renames. Formatting is kept, as each adapter translates it to and from its
+// own network's.
+//
+// Any adapter can be linked, and a single adapter may be on more than one
+// network (such as the IRC adapter), so rooms are named by the adapter, the
+// network, and the room: an Endpoint.
+//
+// On networks with puppets, each user from the other networks is given their
+// own connection (such as their own IRC nick), and speaks for themselves,
+// rather than through the bot.
+//
+// Anything the relay says is remembered for a while, so that it is not
+// relayed again if it comes back, from the network it was said on or from
+// another bridge.
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// QUEUE_SIZE is how many updates may be waiting to be relayed to a network
+const QUEUE_SIZE = 256
+
+// Errors linking rooms
+var (
+	ErrUnknownNetwork = errors.New("Unknown network")
+	ErrTooFewRooms    = errors.New("A link needs at least two rooms")
+)
+
+// Endpoint is a room on a network, reached through an adapter
+type Endpoint struct {
+	// The name of the adapter
+	Adapter string
+
+	// The network the adapter is on. It may be left empty, for the first
+	// network the adapter was added with
+	Network string
+
+	// The room's ID, or its name
+	Room string
+}
+
+func (e Endpoint) String() string {
+	return e.Adapter + "/" + e.Network + "/" + e.Room
+}
+
+// Relay relays updates between the rooms of each link
+type Relay struct {
+	// Relay joins, parts, kicks, quits and renames
+	Memberships bool
+
+	// Relay topic changes, by setting the topic in each room, and saying who
+	// changed it
+	Topics bool
+
+	mu       sync.Mutex
+	networks map[string]*network
+	first    map[string]string
+	links    [][]Endpoint
+	recent   *recent
+}
+
+// network is an adapter on a network, and the updates waiting to be relayed
+// to it
+type network struct {
+	name    string
+	adapter adapter.Adapter
+	queue   chan func()
+
+	mu sync.Mutex
+
+	// Users on the network who are the relay (the bot), by their ID
+	self map[string]bool
+
+	// The linked rooms each user has been seen in, by their ID
+	members map[string]map[string]adapter.Room
+
+	puppets *puppets
+}
+
+// New returns a Relay, with no networks or links
+func New() *Relay {
+	return &Relay{
+		Topics:   true,
+		networks: make(map[string]*network),
+		first:    make(map[string]string),
+		recent:   newRecent(),
+	}
+}
+
+// Add an adapter, on the network named name, so that its rooms can be linked
+func (r *Relay) Add(name string, a adapter.Adapter) {
+	n := &network{
+		name:    name,
+		adapter: a,
+		queue:   make(chan func(), QUEUE_SIZE),
+		self:    make(map[string]bool),
+		members: make(map[string]map[string]adapter.Room),
+	}
+
+	r.mu.Lock()
+	r.networks[key(a.Name(), name)] = n
+	if _, ok := r.first[a.Name()]; !ok {
+		r.first[a.Name()] = name
+	}
+	r.mu.Unlock()
+
+	go n.run()
+	a.Receive(func(u adapter.Update, _ adapter.Adapter) {
+		r.receive(n, u)
+	})
+}
+
+// Link rooms together, so that what happens in each is relayed to the others
+func (r *Relay) Link(eps ...Endpoint) error {
+	if len(eps) < 2 {
+		return ErrTooFewRooms
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	link := make([]Endpoint, len(eps))
+	for i, ep := range eps {
+		if ep.Network == "" {
+			ep.Network = r.first[ep.Adapter]
+		}
+		if _, ok := r.networks[key(ep.Adapter, ep.Network)]; !ok {
+			return fmt.Errorf("Could not link %s: %s", ep, ErrUnknownNetwork)
+		}
+		link[i] = ep
+	}
+	r.links = append(r.links, link)
+
+	return nil
+}
+
+// Rooms are the rooms linked on a network
+func (r *Relay) Rooms(adapterName, network string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var rooms []string
+	for _, l := range r.links {
+		for _, ep := range l {
+			if ep.Adapter == adapterName && ep.Network == network {
+				rooms = append(rooms, ep.Room)
+			}
+		}
+	}
+
+	return rooms
+}
+
+// targets are the rooms linked to the room rm, on the network n. Without a
+// room, they are the rooms linked to any room on n
+func (r *Relay) targets(n *network, rm *adapter.Room) []Endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var eps []Endpoint
+	seen := make(map[Endpoint]bool)
+	for _, l := range r.links {
+		from := -1
+		for i, ep := range l {
+			if ep.Adapter == n.adapter.Name() && ep.Network == n.name &&
+				(rm == nil || sameRoom(ep.Room, *rm)) {
+				from = i
+				break
+			}
+		}
+		if from < 0 {
+			continue
+		}
+
+		for i, ep := range l {
+			if i != from && !seen[ep] {
+				seen[ep] = true
+				eps = append(eps, ep)
+			}
+		}
+	}
+
+	return eps
+}
+
+// network returns the network of ep
+func (r *Relay) network(ep Endpoint) *network {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.networks[key(ep.Adapter, ep.Network)]
+}
+
+// isSelf reports whether the user u is the relay, or one of its puppets, on n
+func (n *network) isSelf(u adapter.User) bool {
+	if n.puppets != nil && n.puppets.isPuppet(u) {
+		return true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.self[strings.ToLower(u.ID)]
+}
+
+// sent records who the relay is on n, from a message it sent
+func (n *network) sent(d *adapter.Message) {
+	if d == nil || d.User.ID == "" {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.self[strings.ToLower(d.User.ID)] = true
+}
+
+// saw the user u in the room rm
+func (n *network) saw(u adapter.User, rm adapter.Room) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := strings.ToLower(u.ID)
+	if n.members[id] == nil {
+		n.members[id] = make(map[string]adapter.Room)
+	}
+	n.members[id][strings.ToLower(rm.ID)] = rm
+}
+
+// left is the user u leaving the room rm, or every room, if rm is nil
+func (n *network) left(u adapter.User, rm *adapter.Room) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	id := strings.ToLower(u.ID)
+	if rm == nil {
+		delete(n.members, id)
+		return
+	}
+
+	delete(n.members[id], strings.ToLower(rm.ID))
+	if len(n.members[id]) == 0 {
+		delete(n.members, id)
+	}
+}
+
+// renamed is the user u being renamed, on networks where their ID is their
+// name
+func (n *network) renamed(u adapter.User, name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !strings.EqualFold(u.ID, u.Name) {
+		return
+	}
+
+	id := strings.ToLower(u.ID)
+	if rooms, ok := n.members[id]; ok {
+		delete(n.members, id)
+		n.members[strings.ToLower(name)] = rooms
+	}
+}
+
+// rooms are the linked rooms the user u has been seen in
+func (n *network) rooms(u adapter.User) []adapter.Room {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var rms []adapter.Room
+	for _, rm := range n.members[strings.ToLower(u.ID)] {
+		rms = append(rms, rm)
+	}
+
+	return rms
+}
+
+// run relays updates to the network, in order
+func (n *network) run() {
+	for f := range n.queue {
+		f()
+	}
+}
+
+// enqueue f to be run for n, without waiting for the updates before it
+func (n *network) enqueue(f func()) {
+	select {
+	case n.queue <- f:
+	default:
+		logger.Log.Warningf("Relay queue for %s/%s is full, dropping an update", n.adapter.Name(), n.name)
+	}
+}
+
+// key is the key of an adapter on a network
+func key(adapterName, network string) string {
+	return adapterName + "/" + network
+}
+
+// sameRoom reports whether the room named room (by its ID or name) is rm
+func sameRoom(room string, rm adapter.Room) bool {
+	return strings.EqualFold(room, rm.ID) || (rm.Name != "" && strings.EqualFold(room, rm.Name))
+}
@@ -0,0 +1,268 @@
+package relay
+
+// Forwarding
+//
+// Updates are relayed to each room linked to the room they happened in. The
+// bot says them with the nick of the user they are from: "<nick> text" for
+// messages, "* nick text" for actions, and notices for joins, parts and topic
+// changes (so that no bot replies to them). Nicks are colored by the user, and
+// have a zero-width space after their first letter, so that relaying a
+// message does not highlight someone with the same nick on the other network.
+//
+// Quits and renames are not in a single room, so they are relayed to the
+// rooms linked to those the user has been seen in. On networks with puppets,
+// the puppets act out joins and parts, instead.
+
+import (
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// nickColors are the colors nicks are shown in: those that are readable on
+// both dark and light backgrounds
+var nickColors = []format.Color{
+	format.Blue,
+	format.Green,
+	format.Red,
+	format.Brown,
+	format.Magenta,
+	format.Orange,
+	format.Cyan,
+	format.LightBlue,
+	format.Pink,
+	format.Grey,
+}
+
+// receive an Update from the network n, and relay it
+func (r *Relay) receive(n *network, u adapter.Update) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		if u.Historical || u.Room.Private || n.isSelf(u.User) || r.recent.seen(n, u) {
+			return
+		}
+
+		eps := r.targets(n, &u.Room)
+		if len(eps) > 0 {
+			n.saw(u.User, u.Room)
+		}
+		for _, ep := range eps {
+			r.message(n, ep, u)
+		}
+	case *adapter.Membership:
+		if n.isSelf(u.User) || u.Room.Private {
+			return
+		}
+		r.membership(n, u)
+	case *adapter.Topic:
+		if !r.Topics || n.isSelf(u.User) || r.recent.ownTopic(n, u.Room, u.Topic) {
+			return
+		}
+
+		for _, ep := range r.targets(n, &u.Room) {
+			r.topic(n, ep, u)
+		}
+	}
+}
+
+// message relays the message m, from the network from, to the room ep
+func (r *Relay) message(from *network, ep Endpoint, m *adapter.Message) {
+	to := r.network(ep)
+	if to == nil {
+		return
+	}
+
+	to.enqueue(func() {
+		replyTo := r.recent.translate(from, m.ReplyTo, to)
+
+		if to.puppets != nil {
+			d, err := to.puppets.say(from, m.User, ep.Room, m.Kind, m.Text, replyTo)
+			if err == nil {
+				r.recent.add(from, m.ID, to, d, "")
+				return
+			}
+			logger.Log.Warningf("Could not relay to %s as %s, relaying as the bot: %s", ep, m.User.Name, err)
+		}
+
+		text := attribute(m.User, m.Kind, m.Text)
+		kind := adapter.Text
+		if m.Kind == adapter.Notice {
+			kind = adapter.Notice
+		}
+
+		d, err := to.adapter.Send(&adapter.Message{
+			Room:    room(ep),
+			Kind:    kind,
+			Text:    text,
+			ReplyTo: replyTo,
+		})
+		if err != nil {
+			logger.Log.Warningf("Could not relay to %s: %s", ep, err)
+			return
+		}
+
+		to.sent(d)
+		r.recent.add(from, m.ID, to, d, text)
+	})
+}
+
+// membership relays a user joining, leaving, quitting or renaming. Puppets
+// follow their users, even if memberships are not relayed
+func (r *Relay) membership(n *network, u *adapter.Membership) {
+	var eps []Endpoint
+	var text string
+
+	name := nick(u.User)
+	switch u.Kind {
+	case adapter.Join:
+		eps = r.targets(n, &u.Room)
+		if len(eps) > 0 {
+			n.saw(u.User, u.Room)
+		}
+		text = name + " joined " + u.Room.Name
+	case adapter.Leave, adapter.Kick:
+		eps = r.targets(n, &u.Room)
+		n.left(u.User, &u.Room)
+
+		text = name + " left " + u.Room.Name
+		if u.Kind == adapter.Kick && u.Actor != nil {
+			text = name + " was kicked from " + u.Room.Name + " by " + nick(*u.Actor)
+		}
+		if u.Reason != "" {
+			text += " (" + u.Reason + ")"
+		}
+	case adapter.Quit:
+		eps = r.seenIn(n, u.User)
+		n.left(u.User, nil)
+
+		text = name + " quit"
+		if u.Reason != "" {
+			text += " (" + u.Reason + ")"
+		}
+	case adapter.Rename:
+		eps = r.seenIn(n, u.User)
+		n.renamed(u.User, u.NewName)
+
+		text = name + " is now known as " + nick(adapter.User{ID: u.NewName, Name: u.NewName})
+	default:
+		return
+	}
+
+	for _, ep := range eps {
+		to := r.network(ep)
+		if to == nil {
+			continue
+		}
+
+		ep := ep
+		to.enqueue(func() {
+			if to.puppets != nil {
+				to.puppets.follow(n, u, ep.Room, r.Memberships)
+				return
+			}
+			if !r.Memberships {
+				return
+			}
+
+			d, err := to.adapter.Send(&adapter.Message{Room: room(ep), Kind: adapter.Notice, Text: text})
+			if err != nil {
+				logger.Log.Warningf("Could not relay to %s: %s", ep, err)
+				return
+			}
+			to.sent(d)
+			r.recent.add(n, "", to, d, text)
+		})
+	}
+}
+
+// topic relays a room's topic being changed: it is set in the room ep, and
+// the bot says who changed it
+func (r *Relay) topic(from *network, ep Endpoint, t *adapter.Topic) {
+	to := r.network(ep)
+	if to == nil {
+		return
+	}
+
+	to.enqueue(func() {
+		rm := room(ep)
+		r.recent.setTopic(to, rm, t.Topic)
+
+		_, err := to.adapter.Send(&adapter.Topic{Room: rm, Topic: t.Topic, Time: time.Now()})
+		if err != nil && err != adapter.ErrNotSupported {
+			logger.Log.Infof("Could not set the topic of %s: %s", ep, err)
+		}
+
+		text := nick(t.User) + " changed the topic of " + t.Room.Name + " to: " + t.Topic
+		d, err := to.adapter.Send(&adapter.Message{Room: rm, Kind: adapter.Notice, Text: text})
+		if err != nil {
+			logger.Log.Warningf("Could not relay to %s: %s", ep, err)
+			return
+		}
+		to.sent(d)
+		r.recent.add(from, "", to, d, text)
+	})
+}
+
+// seenIn are the rooms linked to those the user u has been seen in, on n
+func (r *Relay) seenIn(n *network, u adapter.User) []Endpoint {
+	var eps []Endpoint
+	seen := make(map[Endpoint]bool)
+	for _, rm := range n.rooms(u) {
+		rm := rm
+		for _, ep := range r.targets(n, &rm) {
+			if !seen[ep] {
+				seen[ep] = true
+				eps = append(eps, ep)
+			}
+		}
+	}
+
+	return eps
+}
+
+// attribute text of the kind given, said by the user u
+func attribute(u adapter.User, kind adapter.Kind, text string) string {
+	var b strings.Builder
+	for i, l := range strings.Split(text, "\n") {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		if kind == adapter.Action {
+			b.WriteString("* " + nick(u) + " " + l)
+		} else {
+			b.WriteString("<" + nick(u) + "> " + l)
+		}
+	}
+
+	return b.String()
+}
+
+// nick is a user's name as it is shown when their messages are relayed:
+// bold, colored by the user, and with a zero-width space, so that it does not
+// highlight anyone
+func nick(u adapter.User) string {
+	name := u.Name
+	if name == "" {
+		name = u.ID
+	}
+
+	if rs := []rune(name); len(rs) > 1 {
+		name = string(rs[:1]) + "\u200b" + string(rs[1:])
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(u.ID)))
+	c := nickColors[h.Sum32()%uint32(len(nickColors))]
+
+	return format.Bold(format.Colored(name, c))
+}
+
+// room is the room of an Endpoint
+func room(ep Endpoint) adapter.Room {
+	return adapter.Room{ID: ep.Room, Name: ep.Room}
+}
@@ -0,0 +1,237 @@
+package relay
+
+// Puppets
+//
+// On a network with puppets, each user from another network who speaks in a
+// linked room is given their own connection to the network (on IRC, a client
+// with a nick of their own), which joins the linked rooms they speak in, and
+// says what they say, without the bot's attribution. Their joins, parts and
+// quits are acted out by their puppet, rather than said by the bot.
+//
+// Puppets are connected when their user first speaks (or joins, if
+// memberships are relayed), and quit after their user has been idle for a
+// while, or quits. A user who renames has their puppet quit, and a new one
+// connected when they next speak.
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// PUPPET_IDLE is how long a puppet stays connected without its user speaking,
+// if no other time is given
+const PUPPET_IDLE = 1 * time.Hour
+
+// PuppetFunc connects to a network as a puppet of the user u, from another
+// network. It returns the connected adapter, and who the puppet is on its
+// network
+type PuppetFunc func(u adapter.User) (adapter.Adapter, adapter.User, error)
+
+// puppets are the puppets on a network
+type puppets struct {
+	connect PuppetFunc
+	idle    time.Duration
+
+	mu sync.Mutex
+
+	// Puppets by the network and ID of their user, and by who they are on
+	// their own network
+	byUser map[string]*puppet
+	selves map[string]*puppet
+}
+
+// puppet is a single user's puppet
+type puppet struct {
+	key     string
+	adapter adapter.Adapter
+	self    adapter.User
+	rooms   map[string]bool
+	timer   *time.Timer
+}
+
+// Puppet users from the other networks on the network named name, with
+// connections made by f. Puppets quit after idle without their user speaking
+func (r *Relay) Puppet(adapterName, name string, f PuppetFunc, idle time.Duration) error {
+	if idle <= 0 {
+		idle = PUPPET_IDLE
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n, ok := r.networks[key(adapterName, name)]
+	if !ok {
+		return ErrUnknownNetwork
+	}
+
+	n.puppets = &puppets{
+		connect: f,
+		idle:    idle,
+		byUser:  make(map[string]*puppet),
+		selves:  make(map[string]*puppet),
+	}
+
+	return nil
+}
+
+// say text in room, as the user u from the network from
+func (ps *puppets) say(from *network, u adapter.User, room string, kind adapter.Kind, text, replyTo string) (*adapter.Message, error) {
+	p, err := ps.get(from, u, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := ps.join(p, room); err != nil {
+		return nil, err
+	}
+
+	p.timer.Reset(ps.idle)
+
+	return p.adapter.Send(&adapter.Message{
+		Room:    adapter.Room{ID: room, Name: room},
+		Kind:    kind,
+		Text:    text,
+		ReplyTo: replyTo,
+	})
+}
+
+// follow acts out the membership change m, from the network from, in room,
+// if its user has a puppet. If create is set, users who join are given one
+func (ps *puppets) follow(from *network, m *adapter.Membership, room string, create bool) {
+	p, err := ps.get(from, m.User, create && m.Kind == adapter.Join)
+	if err != nil {
+		logger.Log.Warningf("Could not connect a puppet for %s: %s", m.User.Name, err)
+		return
+	}
+	if p == nil {
+		return
+	}
+
+	switch m.Kind {
+	case adapter.Join:
+		err = ps.join(p, room)
+	case adapter.Leave, adapter.Kick:
+		ps.mu.Lock()
+		joined := p.rooms[strings.ToLower(room)]
+		delete(p.rooms, strings.ToLower(room))
+		empty := len(p.rooms) == 0
+		ps.mu.Unlock()
+
+		if empty {
+			ps.close(p, m.Reason)
+		} else if joined {
+			_, err = p.adapter.Send(&adapter.Membership{
+				Kind:   adapter.Leave,
+				Room:   adapter.Room{ID: room, Name: room},
+				Reason: m.Reason,
+			})
+		}
+	case adapter.Quit:
+		ps.close(p, m.Reason)
+	case adapter.Rename:
+		ps.close(p, "Now known as "+m.NewName)
+	}
+
+	if err != nil {
+		logger.Log.Warningf("Puppet of %s could not follow them: %s", m.User.Name, err)
+	}
+}
+
+// get the puppet of the user u, from the network from. If there is none,
+// one is connected, if create is set
+func (ps *puppets) get(from *network, u adapter.User, create bool) (*puppet, error) {
+	k := netKey(from) + "\x00" + strings.ToLower(u.ID)
+
+	ps.mu.Lock()
+	p, ok := ps.byUser[k]
+	ps.mu.Unlock()
+	if ok || !create {
+		return p, nil
+	}
+
+	a, self, err := ps.connect(u)
+	if err != nil {
+		return nil, err
+	}
+
+	p = &puppet{
+		key:     k,
+		adapter: a,
+		self:    self,
+		rooms:   make(map[string]bool),
+	}
+	p.timer = time.AfterFunc(ps.idle, func() {
+		ps.close(p, "Idle")
+	})
+
+	ps.mu.Lock()
+	ps.byUser[k] = p
+	ps.selves[strings.ToLower(self.ID)] = p
+	ps.mu.Unlock()
+
+	go func() {
+		if err := a.Wait(); err != nil {
+			logger.Log.Infof("Puppet %s was disconnected: %s", self.Name, err)
+		}
+		ps.remove(p)
+	}()
+
+	return p, nil
+}
+
+// join the puppet p to room, if it is not in it already
+func (ps *puppets) join(p *puppet, room string) error {
+	ps.mu.Lock()
+	joined := p.rooms[strings.ToLower(room)]
+	p.rooms[strings.ToLower(room)] = true
+	ps.mu.Unlock()
+
+	if joined {
+		return nil
+	}
+
+	_, err := p.adapter.Send(&adapter.Membership{
+		Kind: adapter.Join,
+		Room: adapter.Room{ID: room, Name: room},
+	})
+	return err
+}
+
+// close the puppet p, quitting with reason
+func (ps *puppets) close(p *puppet, reason string) {
+	if !ps.remove(p) {
+		return
+	}
+
+	p.timer.Stop()
+	p.adapter.Send(&adapter.Membership{Kind: adapter.Quit, Reason: reason})
+	if err := p.adapter.Disconnect(); err != nil {
+		logger.Log.Debugf("Could not disconnect puppet %s: %s", p.self.Name, err)
+	}
+}
+
+// remove the puppet p, returning whether it was there to remove
+func (ps *puppets) remove(p *puppet) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.byUser[p.key] != p {
+		return false
+	}
+
+	delete(ps.byUser, p.key)
+	delete(ps.selves, strings.ToLower(p.self.ID))
+	return true
+}
+
+// isPuppet reports whether the user u is one of the puppets
+func (ps *puppets) isPuppet(u adapter.User) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	_, ok := ps.selves[strings.ToLower(u.ID)]
+	return ok
+}
@@ -0,0 +1,191 @@
+package relay
+
+// Loops
+//
+// A relay must not relay what it said itself, or it would say it again, and
+// again. Messages from the bot, or from its puppets, are never relayed, but
+// that is not enough: the bot is not always told who it is on a network until
+// it has said something, and another bridge in one of the rooms would relay
+// what we said back to us, as said by its own bot.
+//
+// So what the relay says is remembered, for RECENT_TTL: the IDs of the
+// messages it sent, and their text. A message with one of those IDs, or that
+// ends with one of those texts (as another bridge would relay it, after its
+// own attribution), is not relayed. The IDs also let replies be relayed, as
+// replies to the copy of the message on the network they are relayed to.
+//
+// Topics the relay sets are remembered too, so that a network telling us the
+// topic was set is not relayed back.
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// RECENT_TTL is how long what the relay said is remembered
+const RECENT_TTL = 10 * time.Minute
+
+// minEcho is the shortest text that is recognized as an echo of what we said,
+// so that a short message is not taken for the end of one
+const minEcho = 8
+
+// recent is what the relay said recently
+type recent struct {
+	mu sync.Mutex
+
+	// Messages relayed, oldest first, and by network and ID
+	messages []*relayed
+	ids      map[string]*relayed
+
+	// Topics set, by network and room
+	topics map[string]topic
+}
+
+// relayed is a message, and each copy of it the relay sent
+type relayed struct {
+	at time.Time
+
+	// The message's ID on each network, and the text of each copy
+	ids   map[string]string
+	texts []string
+}
+
+type topic struct {
+	at    time.Time
+	topic string
+}
+
+func newRecent() *recent {
+	return &recent{
+		ids:    make(map[string]*relayed),
+		topics: make(map[string]topic),
+	}
+}
+
+// add records that the message from the network from, with the ID id (if it
+// has one), was relayed to the network to as d, with the text given
+func (rc *recent) add(from *network, id string, to *network, d *adapter.Message, text string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	now := time.Now()
+	rc.expire(now)
+
+	m, ok := rc.ids[msgKey(from, id)]
+	if id == "" || !ok {
+		m = &relayed{at: now, ids: make(map[string]string)}
+		rc.messages = append(rc.messages, m)
+		if id != "" {
+			m.ids[netKey(from)] = id
+			rc.ids[msgKey(from, id)] = m
+		}
+	}
+
+	if d != nil && d.ID != "" {
+		m.ids[netKey(to)] = d.ID
+		rc.ids[msgKey(to, d.ID)] = m
+	}
+	if t := strings.TrimSpace(format.Strip(text)); len(t) >= minEcho {
+		m.texts = append(m.texts, t)
+	}
+}
+
+// seen reports whether the message m, from the network n, is one the relay
+// said (or relayed) recently
+func (rc *recent) seen(n *network, m *adapter.Message) bool {
+	text := strings.TrimSpace(format.Strip(m.Text))
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.expire(time.Now())
+
+	if _, ok := rc.ids[msgKey(n, m.ID)]; ok && m.ID != "" {
+		return true
+	}
+
+	for _, r := range rc.messages {
+		for _, t := range r.texts {
+			if strings.HasSuffix(text, t) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// translate the ID of a message on the network from to the ID of its copy on
+// the network to, if it was relayed there (or relayed from there)
+func (rc *recent) translate(from *network, id string, to *network) string {
+	if id == "" {
+		return ""
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if m, ok := rc.ids[msgKey(from, id)]; ok {
+		return m.ids[netKey(to)]
+	}
+
+	return ""
+}
+
+// setTopic records that we set the topic of rm, on n
+func (rc *recent) setTopic(n *network, rm adapter.Room, t string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.topics[roomKey(n, rm)] = topic{at: time.Now(), topic: t}
+}
+
+// ownTopic reports whether the topic t of rm, on n, is one we recently set
+func (rc *recent) ownTopic(n *network, rm adapter.Room, t string) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for _, k := range []string{roomKey(n, rm), netKey(n) + "\x00" + strings.ToLower(rm.Name)} {
+		if tp, ok := rc.topics[k]; ok && tp.topic == t && time.Since(tp.at) < RECENT_TTL {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expire forgets what was said before RECENT_TTL. It is called with mu locked
+func (rc *recent) expire(now time.Time) {
+	n := 0
+	for n < len(rc.messages) && now.Sub(rc.messages[n].at) > RECENT_TTL {
+		m := rc.messages[n]
+		for net, id := range m.ids {
+			delete(rc.ids, net+"\x00"+id)
+		}
+		rc.messages[n] = nil
+		n++
+	}
+	rc.messages = rc.messages[n:]
+
+	for k, tp := range rc.topics {
+		if now.Sub(tp.at) > RECENT_TTL {
+			delete(rc.topics, k)
+		}
+	}
+}
+
+func netKey(n *network) string {
+	return key(n.adapter.Name(), n.name)
+}
+
+func msgKey(n *network, id string) string {
+	return netKey(n) + "\x00" + id
+}
+
+func roomKey(n *network, rm adapter.Room) string {
+	return netKey(n) + "\x00" + strings.ToLower(rm.ID)
+}
@@ -0,0 +1,189 @@
+// Package slack adapts Slack's Socket Mode and Web API to the adapter package
+//
+// About
+//
+// The Slack adapter receives events over Socket Mode: it opens a WebSocket
+// with the app-level token, and acknowledges each envelope of events as it
+// arrives. Messages, edits, thread replies, reactions and members joining and
+// leaving channels are translated into adapter Updates, and Updates are sent
+// with the Web API (chat.postMessage, and others), with the bot token.
+//
+// Slack's events name users and channels by ID; their names are looked up,
+// and cached. Slack's mrkdwn is translated to and from formatted text, and
+// mentions (<@U123>) are shown by name.
+//
+// See also: https://api.slack.com/apis/connections/socket
+// See also: https://api.slack.com/web
+package slack
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// ADAPTER_NAME is the name of the Slack adapter
+const ADAPTER_NAME = "slack"
+
+// API_URL is the base URL of Slack's Web API
+const API_URL = "https://slack.com/api"
+
+// TIMEOUT is the timeout of requests to the Web API, and of connecting to
+// Socket Mode
+const TIMEOUT = 30 * time.Second
+
+// How long to wait before reconnecting, doubling up to the maximum
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// ErrNoToken is returned when connecting without an app-level token and a bot
+// token
+var ErrNoToken = errors.New("Slack needs an app-level token (xapp-) and a bot token (xoxb-)")
+
+// Slack is a connection to a Slack workspace, as an app's bot user
+type Slack struct {
+	// The app-level token, with the connections:write scope, for Socket
+	// Mode, and the bot token, for the Web API
+	AppToken string
+	BotToken string
+
+	// The base URL of the Web API
+	APIURL string
+
+	// The HTTP client for requests to the Web API
+	HTTPClient *http.Client
+
+	// Our bot user, and bot, IDs, and the workspace's
+	userID string
+	botID  string
+	teamID string
+
+	mu       sync.Mutex
+	users    map[string]*cachedUser
+	channels map[string]*cachedChannel
+	dms      map[string]string
+	handlers []adapter.UpdateFunc
+
+	// The IDs of the events we handled recently
+	seen map[string]time.Time
+
+	wmu    sync.Mutex
+	conn   *websocket.Conn
+	events chan json.RawMessage
+
+	stop chan struct{}
+	done chan error
+}
+
+// New returns a Slack adapter, that connects with the tokens given
+func New(appToken, botToken string) *Slack {
+	return &Slack{
+		AppToken:   appToken,
+		BotToken:   botToken,
+		APIURL:     API_URL,
+		HTTPClient: &http.Client{Timeout: TIMEOUT},
+		users:      make(map[string]*cachedUser),
+		channels:   make(map[string]*cachedChannel),
+		dms:        make(map[string]string),
+		seen:       make(map[string]time.Time),
+		events:     make(chan json.RawMessage, EVENT_QUEUE),
+	}
+}
+
+// Name of the adapter
+func (s *Slack) Name() string {
+	return ADAPTER_NAME
+}
+
+// UserID returns the bot user's ID, once we are connected
+func (s *Slack) UserID() string {
+	return s.userID
+}
+
+// Connect to Slack, and start receiving events
+func (s *Slack) Connect() error {
+	if s.AppToken == "" || s.BotToken == "" {
+		return ErrNoToken
+	}
+
+	var r struct {
+		UserID string `json:"user_id"`
+		BotID  string `json:"bot_id"`
+		TeamID string `json:"team_id"`
+		User   string `json:"user"`
+		Team   string `json:"team"`
+	}
+	if err := s.call("auth.test", nil, &r); err != nil {
+		return err
+	}
+	s.userID, s.botID, s.teamID = r.UserID, r.BotID, r.TeamID
+	logger.Log.Infof("Logged in to Slack as %s, in %s", r.User, r.Team)
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	s.stop = make(chan struct{})
+	s.done = make(chan error, 1)
+	go s.run(s.stop)
+	go s.handle(s.stop)
+
+	return nil
+}
+
+// Disconnect from Socket Mode
+func (s *Slack) Disconnect() error {
+	if s.stop == nil {
+		return nil
+	}
+	close(s.stop)
+	s.stop = nil
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	s.conn.Close()
+
+	return err
+}
+
+// Wait blocks while connected (or reconnecting), and returns the error that
+// stopped us
+func (s *Slack) Wait() error {
+	return <-s.done
+}
+
+// Receive calls f with each Update from Slack
+func (s *Slack) Receive(f adapter.UpdateFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers = append(s.handlers, f)
+}
+
+func (s *Slack) dispatch(u adapter.Update) {
+	s.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), s.handlers...)
+	s.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, s)
+	}
+}
@@ -0,0 +1,111 @@
+package slack
+
+// Web API
+//
+// Methods are called with a form-encoded POST, with the bot token (or, to
+// open a Socket Mode connection, the app-level token). Every response has
+// "ok", and an "error" when it is false. Calls that are rate limited are
+// retried after the Retry-After Slack gives.
+//
+// See also: https://api.slack.com/web#basics
+// See also: https://api.slack.com/docs/rate-limits
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// maxRetries is how many times a rate limited call is retried
+const maxRetries = 5
+
+// Error is an error from the Web API
+type Error struct {
+	Method string
+	Code   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Slack %s failed: %s", e.Method, e.Code)
+}
+
+// call a Web API method with the bot token, and decode its response into out
+// (if not nil)
+func (s *Slack) call(method string, params url.Values, out interface{}) error {
+	return s.callWith(s.BotToken, method, params, out)
+}
+
+// callWith calls a Web API method with the token given
+func (s *Slack) callWith(token, method string, params url.Values, out interface{}) error {
+	u := strings.TrimRight(s.APIURL, "/") + "/" + method
+
+	for n := 0; ; n++ {
+		req, err := http.NewRequest("POST", u, strings.NewReader(params.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := s.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && n < maxRetries {
+			wait := time.Second
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(secs) * time.Second
+			}
+			logger.Log.Debugf("Rate limited by Slack on %s; retrying in %s", method, wait)
+			time.Sleep(wait)
+			continue
+		}
+
+		if resp.StatusCode >= 400 {
+			return &Error{Method: method, Code: http.StatusText(resp.StatusCode)}
+		}
+
+		var r struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		if !r.OK {
+			return &Error{Method: method, Code: r.Error}
+		}
+
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(b, out)
+	}
+}
+
+// values builds the parameters of a call, from pairs of names and values.
+// Empty values are left out
+func values(kv ...string) url.Values {
+	v := url.Values{}
+	for n := 0; n+1 < len(kv); n += 2 {
+		if kv[n+1] != "" {
+			v.Set(kv[n], kv[n+1])
+		}
+	}
+
+	return v
+}
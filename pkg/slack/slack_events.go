@@ -0,0 +1,338 @@
+package slack
+
+// Events
+//
+// Events API events are translated into adapter Updates: messages (and
+// /me messages) in channels and direct conversations, edits, reactions, and
+// members joining and leaving channels. Messages in a thread are in the
+// thread of the message that started it. Slack may send an event again if it
+// was not acknowledged in time, so events are only handled once.
+//
+// See also: https://api.slack.com/events/message
+// See also: https://api.slack.com/events
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// Event types
+const (
+	EVENT_MESSAGE          = "message"
+	EVENT_REACTION_ADDED   = "reaction_added"
+	EVENT_REACTION_REMOVED = "reaction_removed"
+	EVENT_MEMBER_JOINED    = "member_joined_channel"
+	EVENT_MEMBER_LEFT      = "member_left_channel"
+	EVENT_CHANNEL_RENAME   = "channel_rename"
+	EVENT_GROUP_RENAME     = "group_rename"
+	EVENT_USER_CHANGE      = "user_change"
+)
+
+// Message subtypes
+const (
+	SUBTYPE_ME_MESSAGE       = "me_message"
+	SUBTYPE_MESSAGE_CHANGED  = "message_changed"
+	SUBTYPE_BOT_MESSAGE      = "bot_message"
+	SUBTYPE_THREAD_BROADCAST = "thread_broadcast"
+	SUBTYPE_FILE_SHARE       = "file_share"
+)
+
+// seenTTL is how long an event's ID is kept, to notice it being sent again
+const seenTTL = 10 * time.Minute
+
+// mentionPattern matches mentions of users, channels, groups and special
+// mentions (such as <!here>), with their optional labels
+var mentionPattern = regexp.MustCompile(`<([@#!])([^>|]+)(?:\|([^>]*))?>`)
+
+type slackMessage struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+
+	Edited *struct {
+		User string `json:"user"`
+		TS   string `json:"ts"`
+	} `json:"edited"`
+
+	// The message as it is now, for message_changed
+	Message *slackMessage `json:"message"`
+}
+
+// duplicate reports whether an event was handled already
+func (s *Slack) duplicate(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[id]; ok {
+		return true
+	}
+
+	for k, t := range s.seen {
+		if time.Since(t) > seenTTL {
+			delete(s.seen, k)
+		}
+	}
+	s.seen[id] = time.Now()
+
+	return false
+}
+
+// event handles an Events API event
+func (s *Slack) event(raw json.RawMessage) {
+	var h struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &h); err != nil {
+		logger.Log.Warningf("Could not decode Slack event: %s", err)
+		return
+	}
+
+	switch h.Type {
+	case EVENT_MESSAGE:
+		m := &slackMessage{}
+		if s.decode(h.Type, raw, m) {
+			s.message(m)
+		}
+	case EVENT_REACTION_ADDED, EVENT_REACTION_REMOVED:
+		var r struct {
+			User     string `json:"user"`
+			Reaction string `json:"reaction"`
+			EventTS  string `json:"event_ts"`
+			Item     struct {
+				Type    string `json:"type"`
+				Channel string `json:"channel"`
+				TS      string `json:"ts"`
+			} `json:"item"`
+		}
+		if s.decode(h.Type, raw, &r) && r.Item.Type == "message" && r.User != s.userID {
+			s.dispatch(&adapter.Reaction{
+				Adapter:   s.Name(),
+				Room:      s.room(r.Item.Channel),
+				MessageID: r.Item.TS,
+				User:      s.user(r.User),
+				Reaction:  ":" + r.Reaction + ":",
+				Removed:   h.Type == EVENT_REACTION_REMOVED,
+				Time:      timestamp(r.EventTS),
+			})
+		}
+	case EVENT_MEMBER_JOINED, EVENT_MEMBER_LEFT:
+		var r struct {
+			User    string `json:"user"`
+			Channel string `json:"channel"`
+			Inviter string `json:"inviter"`
+			EventTS string `json:"event_ts"`
+		}
+		if s.decode(h.Type, raw, &r) {
+			ms := &adapter.Membership{
+				Adapter: s.Name(),
+				Kind:    adapter.Join,
+				Room:    s.room(r.Channel),
+				User:    s.user(r.User),
+				Time:    timestamp(r.EventTS),
+			}
+			if h.Type == EVENT_MEMBER_LEFT {
+				ms.Kind = adapter.Leave
+			}
+			if r.Inviter != "" && r.Inviter != r.User {
+				inviter := s.user(r.Inviter)
+				ms.Actor = &inviter
+			}
+			s.dispatch(ms)
+		}
+	case EVENT_CHANNEL_RENAME, EVENT_GROUP_RENAME:
+		var r struct {
+			Channel slackChannel `json:"channel"`
+		}
+		if s.decode(h.Type, raw, &r) {
+			s.forgetChannel(r.Channel.ID)
+		}
+	case EVENT_USER_CHANGE:
+		var r struct {
+			User *slackUser `json:"user"`
+		}
+		if s.decode(h.Type, raw, &r) && r.User != nil {
+			s.userChange(r.User)
+		}
+	}
+}
+
+// decode an event, logging it if it cannot be
+func (s *Slack) decode(t string, raw json.RawMessage, v interface{}) bool {
+	if err := json.Unmarshal(raw, v); err != nil {
+		logger.Log.Warningf("Could not decode Slack %s event: %s", t, err)
+		return false
+	}
+
+	return true
+}
+
+// message handles a message event
+func (s *Slack) message(m *slackMessage) {
+	switch m.Subtype {
+	case "", SUBTYPE_ME_MESSAGE, SUBTYPE_BOT_MESSAGE, SUBTYPE_THREAD_BROADCAST, SUBTYPE_FILE_SHARE:
+	case SUBTYPE_MESSAGE_CHANGED:
+		s.edited(m)
+		return
+	default:
+		return
+	}
+
+	if s.self(m) {
+		return
+	}
+
+	rm := s.room(m.Channel)
+	t := timestamp(m.TS)
+	msg := &adapter.Message{
+		Adapter: s.Name(),
+		ID:      m.TS,
+		Room:    rm,
+		User:    s.sender(m),
+		Text:    s.text(m.Text),
+		Time:    t,
+		Raw: &adapter.Event{
+			Tags:       map[string]string{"msgid": m.TS},
+			Prefix:     m.User,
+			Command:    EVENT_MESSAGE,
+			Parameters: []string{m.Channel, m.Text},
+			Timestamp:  t,
+		},
+	}
+	if m.ThreadTS != "" && m.ThreadTS != m.TS {
+		msg.Thread = m.ThreadTS
+	}
+	if m.Subtype == SUBTYPE_ME_MESSAGE {
+		msg.Kind = adapter.Action
+	}
+
+	s.dispatch(msg)
+}
+
+// edited handles a message being changed. Changes that are not edits (such as
+// links being unfurled) are not Updates
+func (s *Slack) edited(m *slackMessage) {
+	n := m.Message
+	if n == nil || n.Edited == nil || s.self(n) {
+		return
+	}
+
+	user := s.sender(n)
+	msg := &adapter.Message{
+		Adapter: s.Name(),
+		ID:      n.TS,
+		Room:    s.room(m.Channel),
+		User:    user,
+	}
+	if n.ThreadTS != "" && n.ThreadTS != n.TS {
+		msg.Thread = n.ThreadTS
+	}
+
+	s.dispatch(&adapter.Edit{
+		Adapter: s.Name(),
+		Message: msg,
+		Text:    s.text(n.Text),
+		User:    user,
+		Time:    timestamp(n.Edited.TS),
+	})
+}
+
+// self reports whether a message is our own
+func (s *Slack) self(m *slackMessage) bool {
+	return m.User != "" && m.User == s.userID || m.BotID != "" && m.BotID == s.botID
+}
+
+// sender describes who sent a message: a user, or a bot without a user
+func (s *Slack) sender(m *slackMessage) adapter.User {
+	if m.User == "" && m.BotID != "" {
+		name := m.Username
+		if name == "" {
+			name = m.BotID
+		}
+		return adapter.User{ID: m.BotID, Name: name}
+	}
+
+	return s.user(m.User)
+}
+
+// userChange notices a user changing their name
+func (s *Slack) userChange(u *slackUser) {
+	s.mu.Lock()
+	old, known := s.users[u.ID]
+	s.mu.Unlock()
+
+	c := s.cacheUser(u)
+	if !known || old.name == c.name {
+		return
+	}
+
+	s.dispatch(&adapter.Membership{
+		Adapter: s.Name(),
+		Kind:    adapter.Rename,
+		User:    adapter.User{ID: u.ID, Name: old.name, Account: c.account},
+		NewName: c.name,
+		Time:    time.Now(),
+	})
+}
+
+// text is the formatted text of a message, with mentions shown by name
+func (s *Slack) text(mrkdwn string) string {
+	return mentionPattern.ReplaceAllStringFunc(format.ParseMrkdwn(mrkdwn), func(m string) string {
+		ms := mentionPattern.FindStringSubmatch(m)
+		kind, id, label := ms[1], ms[2], ms[3]
+
+		switch kind {
+		case "@":
+			if label != "" {
+				return "@" + label
+			}
+			return "@" + s.user(id).Name
+		case "#":
+			if label != "" {
+				return "#" + label
+			}
+			return "#" + s.room(id).Name
+		}
+
+		// Special mentions, user groups (subteam^ID) and dates have a label,
+		// or are named for what they mention
+		switch {
+		case label != "":
+			if strings.HasPrefix(id, "subteam^") && !strings.HasPrefix(label, "@") {
+				return "@" + label
+			}
+			return label
+		case id == "here" || id == "channel" || id == "everyone":
+			return "@" + id
+		}
+		return m
+	})
+}
+
+// timestamp parses a Slack timestamp (seconds since the epoch, with
+// microseconds)
+func timestamp(ts string) time.Time {
+	f, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return time.Now()
+	}
+
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)).Round(time.Microsecond)
+}
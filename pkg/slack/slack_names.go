@@ -0,0 +1,144 @@
+package slack
+
+// Names
+//
+// Events name users and conversations by ID. Their names are looked up with
+// users.info and conversations.info, and cached for NAME_TTL, or until an
+// event says they changed. A lookup that fails leaves the ID as the name.
+//
+// See also: https://api.slack.com/methods/users.info
+// See also: https://api.slack.com/methods/conversations.info
+
+import (
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// NAME_TTL is how long names are cached
+const NAME_TTL = time.Hour
+
+// cachedUser is a user we looked up
+type cachedUser struct {
+	name    string
+	account string
+	at      time.Time
+}
+
+// cachedChannel is a conversation we looked up: a channel, or a direct
+// conversation with a user
+type cachedChannel struct {
+	name    string
+	private bool
+	user    string
+	at      time.Time
+}
+
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted"`
+	Profile struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	IsIM   bool   `json:"is_im"`
+	IsMPIM bool   `json:"is_mpim"`
+	User   string `json:"user"`
+}
+
+// user describes a user, by their ID
+func (s *Slack) user(id string) adapter.User {
+	s.mu.Lock()
+	c, ok := s.users[id]
+	s.mu.Unlock()
+
+	if !ok || time.Since(c.at) > NAME_TTL {
+		var r struct {
+			User *slackUser `json:"user"`
+		}
+		if err := s.call("users.info", values("user", id), &r); err != nil || r.User == nil {
+			logger.Log.Debugf("Could not look up Slack user %s: %s", id, err)
+			return adapter.User{ID: id, Name: id}
+		}
+		c = s.cacheUser(r.User)
+	}
+
+	return adapter.User{ID: id, Name: c.name, Account: c.account}
+}
+
+// cacheUser keeps the names of a user
+func (s *Slack) cacheUser(u *slackUser) *cachedUser {
+	c := &cachedUser{name: u.Profile.DisplayName, account: u.Name, at: time.Now()}
+	if c.name == "" {
+		c.name = u.Profile.RealName
+	}
+	if c.name == "" {
+		c.name = u.Name
+	}
+
+	s.mu.Lock()
+	s.users[u.ID] = c
+	s.mu.Unlock()
+
+	return c
+}
+
+// room describes a conversation, by its ID. Direct conversations are named
+// after the user they are with
+func (s *Slack) room(id string) adapter.Room {
+	s.mu.Lock()
+	c, ok := s.channels[id]
+	s.mu.Unlock()
+
+	if !ok || time.Since(c.at) > NAME_TTL {
+		var r struct {
+			Channel *slackChannel `json:"channel"`
+		}
+		if err := s.call("conversations.info", values("channel", id), &r); err != nil || r.Channel == nil {
+			logger.Log.Debugf("Could not look up Slack conversation %s: %s", id, err)
+
+			// Direct conversations' IDs start with D
+			return adapter.Room{ID: id, Name: id, Private: len(id) > 0 && id[0] == 'D'}
+		}
+		c = s.cacheChannel(r.Channel)
+	}
+
+	rm := adapter.Room{ID: id, Name: c.name, Private: c.private}
+	if c.user != "" {
+		rm.Name = s.user(c.user).Name
+	}
+
+	return rm
+}
+
+// cacheChannel keeps the name of a conversation
+func (s *Slack) cacheChannel(ch *slackChannel) *cachedChannel {
+	c := &cachedChannel{name: ch.Name, private: ch.IsIM || ch.IsMPIM, at: time.Now()}
+	if ch.IsIM {
+		c.user = ch.User
+	}
+
+	s.mu.Lock()
+	s.channels[ch.ID] = c
+	if c.user != "" {
+		s.dms[c.user] = ch.ID
+	}
+	s.mu.Unlock()
+
+	return c
+}
+
+// forgetChannel drops a conversation's name, so that it is looked up again
+func (s *Slack) forgetChannel(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.channels, id)
+}
@@ -0,0 +1,240 @@
+package slack
+
+// Sending
+//
+// Messages are posted with chat.postMessage, as mrkdwn, and replies are
+// posted in the thread of the message they reply to. Actions are sent with
+// chat.meMessage, except in threads, where they are italic. Mentions of the
+// users and channels we know of (@name and #name) are turned into Slack's
+// mentions. Messages to a user open a direct conversation with them.
+//
+// See also: https://api.slack.com/methods/chat.postMessage
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// Send an Update to Slack
+func (s *Slack) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		thread := u.Thread
+		if thread == "" {
+			thread = u.ReplyTo
+		}
+		return s.post(u.Room, thread, u.Kind, u.Text)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+
+		thread := u.To.Thread
+		if thread == "" {
+			thread = u.To.ID
+		}
+		m, err := s.post(u.To.Room, thread, u.Kind, u.Text)
+		if m != nil {
+			m.ReplyTo = u.To.ID
+		}
+		return m, err
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+		return s.update(u.Message, u.Text)
+	case *adapter.Reaction:
+		method := "reactions.add"
+		if u.Removed {
+			method = "reactions.remove"
+		}
+		return nil, s.call(method, values(
+			"channel", u.Room.ID,
+			"timestamp", u.MessageID,
+			"name", strings.Trim(u.Reaction, ":"),
+		), nil)
+	case *adapter.Membership:
+		return nil, s.setMembership(u)
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// post a message to a conversation, in thread (if not empty)
+func (s *Slack) post(rm adapter.Room, thread string, kind adapter.Kind, text string) (*adapter.Message, error) {
+	ch, err := s.channelID(rm)
+	if err != nil {
+		return nil, err
+	}
+
+	content := s.mentionIDs(format.Mrkdwn(text))
+	method := "chat.postMessage"
+	switch {
+	case kind == adapter.Action && thread == "":
+		method = "chat.meMessage"
+	case kind == adapter.Action:
+		content = "_" + content + "_"
+	}
+
+	var r struct {
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	}
+	err = s.call(method, values(
+		"channel", ch,
+		"text", content,
+		"thread_ts", thread,
+	), &r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &adapter.Message{
+		Adapter: s.Name(),
+		ID:      r.TS,
+		Room:    rm,
+		User:    s.user(s.userID),
+		Kind:    kind,
+		Text:    text,
+		Thread:  thread,
+		Time:    time.Now(),
+	}, nil
+}
+
+// update the text of one of our messages
+func (s *Slack) update(m *adapter.Message, text string) (*adapter.Message, error) {
+	ch, err := s.channelID(m.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.call("chat.update", values(
+		"channel", ch,
+		"ts", m.ID,
+		"text", s.mentionIDs(format.Mrkdwn(text)),
+	), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := *m
+	e.Text, e.Time = text, time.Now()
+	return &e, nil
+}
+
+// setMembership joins or leaves a channel, or removes someone from, or
+// invites someone to, a channel
+func (s *Slack) setMembership(u *adapter.Membership) error {
+	switch u.Kind {
+	case adapter.Join:
+		return s.call("conversations.join", values("channel", u.Room.ID), nil)
+	case adapter.Leave:
+		return s.call("conversations.leave", values("channel", u.Room.ID), nil)
+	case adapter.Kick:
+		return s.call("conversations.kick", values("channel", u.Room.ID, "user", u.User.ID), nil)
+	case adapter.Invite:
+		return s.call("conversations.invite", values("channel", u.Room.ID, "users", u.User.ID), nil)
+	}
+
+	return adapter.ErrNotSupported
+}
+
+// channelID returns the conversation to send to a room in. Private rooms may
+// be a user, to open a direct conversation with
+func (s *Slack) channelID(rm adapter.Room) (string, error) {
+	if !rm.Private || rm.ID == "" {
+		return rm.ID, nil
+	}
+
+	// Users' IDs start with U or W
+	if c := rm.ID[0]; c != 'U' && c != 'W' {
+		return rm.ID, nil
+	}
+
+	s.mu.Lock()
+	dm, ok := s.dms[rm.ID]
+	s.mu.Unlock()
+	if ok {
+		return dm, nil
+	}
+
+	var r struct {
+		Channel slackChannel `json:"channel"`
+	}
+	if err := s.call("conversations.open", values("users", rm.ID), &r); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.dms[rm.ID] = r.Channel.ID
+	s.mu.Unlock()
+
+	return r.Channel.ID, nil
+}
+
+// mentionIDs turns @name and #name in mrkdwn into mentions of the users and
+// channels we know of with those names
+func (s *Slack) mentionIDs(mrkdwn string) string {
+	if !strings.ContainsAny(mrkdwn, "@#") {
+		return mrkdwn
+	}
+
+	s.mu.Lock()
+	names := make(map[string]string)
+	for id, u := range s.users {
+		names["@"+u.name] = "<@" + id + ">"
+	}
+	for id, c := range s.channels {
+		if c.name != "" && !c.private {
+			names["#"+c.name] = "<#" + id + ">"
+		}
+	}
+	s.mu.Unlock()
+
+	for _, special := range []string{"here", "channel", "everyone"} {
+		delete(names, "@"+special)
+	}
+
+	// Longer names first, so that @Alice Smith is not taken as @Alice
+	var keys []string
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	for _, k := range keys {
+		var b strings.Builder
+		rest := mrkdwn
+		for {
+			n := strings.Index(rest, k)
+			if n < 0 {
+				break
+			}
+
+			// The name must be a whole word, and not part of an address
+			end := n + len(k)
+			r, _ := utf8.DecodeRuneInString(rest[end:])
+			p, _ := utf8.DecodeLastRuneInString(rest[:n])
+			whole := (end == len(rest) || !unicode.IsLetter(r) && !unicode.IsDigit(r)) &&
+				(n == 0 || !unicode.IsLetter(p) && !unicode.IsDigit(p))
+
+			b.WriteString(rest[:n])
+			if whole {
+				b.WriteString(names[k])
+			} else {
+				b.WriteString(k)
+			}
+			rest = rest[end:]
+		}
+		b.WriteString(rest)
+		mrkdwn = b.String()
+	}
+
+	return mrkdwn
+}
@@ -0,0 +1,233 @@
+package slack
+
+// Socket Mode
+//
+// apps.connections.open gives a WebSocket URL, which sends hello once it is
+// ready. Events arrive in envelopes, each of which must be acknowledged, with
+// its envelope_id, within a few seconds, or Slack sends it again. Slack asks
+// us to reconnect (with a disconnect message) every few hours, and before
+// its servers restart; a new connection is opened, without losing events.
+//
+// See also: https://api.slack.com/apis/connections/socket-implement
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gorilla/websocket"
+)
+
+// PING_TIMEOUT is how long Socket Mode can be silent (Slack pings every few
+// seconds) before the connection is lost
+const PING_TIMEOUT = 2 * time.Minute
+
+// EVENT_QUEUE is how many events can wait to be handled before we stop
+// reading from Socket Mode
+const EVENT_QUEUE = 256
+
+// Socket Mode message types
+const (
+	SOCKET_HELLO          = "hello"
+	SOCKET_DISCONNECT     = "disconnect"
+	SOCKET_EVENTS_API     = "events_api"
+	SOCKET_SLASH_COMMANDS = "slash_commands"
+	SOCKET_INTERACTIVE    = "interactive"
+)
+
+var (
+	// ErrNotConnected is returned when writing to Socket Mode while
+	// disconnected
+	ErrNotConnected = errors.New("Not connected to Slack")
+
+	// ErrReconnect is returned when Slack asks us to reconnect
+	ErrReconnect = errors.New("Slack asked us to reconnect")
+
+	// ErrLinkDisabled is returned when Socket Mode is turned off for the app
+	ErrLinkDisabled = errors.New("Socket Mode was disabled for the Slack app")
+)
+
+// envelope is a Socket Mode message
+type envelope struct {
+	Type       string          `json:"type"`
+	EnvelopeID string          `json:"envelope_id"`
+	Payload    json.RawMessage `json:"payload"`
+	Reason     string          `json:"reason"`
+	RetryCount int             `json:"retry_attempt"`
+}
+
+// connect opens a Socket Mode connection, and waits for hello
+func (s *Slack) connect() error {
+	var r struct {
+		URL string `json:"url"`
+	}
+	if err := s.callWith(s.AppToken, "apps.connections.open", nil, &r); err != nil {
+		return err
+	}
+
+	dialer := &websocket.Dialer{HandshakeTimeout: TIMEOUT}
+	conn, _, err := dialer.Dial(r.URL, nil)
+	if err != nil {
+		return fmt.Errorf("Could not connect to Slack: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(TIMEOUT))
+	var e envelope
+	if err := conn.ReadJSON(&e); err != nil {
+		conn.Close()
+		return err
+	}
+	if e.Type != SOCKET_HELLO {
+		conn.Close()
+		return fmt.Errorf("Expected hello from Slack, got %s", e.Type)
+	}
+
+	// Slack pings the connection every few seconds; each ping is answered,
+	// and keeps the connection alive
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(PING_TIMEOUT))
+
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	s.wmu.Lock()
+	s.conn = conn
+	s.wmu.Unlock()
+
+	logger.Log.Debugf("Connected to Slack Socket Mode")
+	return nil
+}
+
+// run reads from Socket Mode, reconnecting whenever the connection is lost,
+// until stop is closed
+func (s *Slack) run(stop chan struct{}) {
+	for {
+		err := s.read(stop)
+
+		select {
+		case <-stop:
+			s.done <- nil
+			return
+		default:
+		}
+
+		s.wmu.Lock()
+		s.conn = nil
+		s.wmu.Unlock()
+
+		if err == ErrLinkDisabled {
+			s.done <- err
+			return
+		}
+		if err != ErrReconnect {
+			logger.Log.Warningf("Lost the Slack connection: %s", err)
+		}
+
+		wait := retryMin
+		for {
+			err := s.connect()
+			if err == nil {
+				break
+			}
+			if e, ok := err.(*Error); ok && (e.Code == "invalid_auth" || e.Code == "not_authed") {
+				s.done <- err
+				return
+			}
+
+			logger.Log.Warningf("Could not reconnect to Slack, retrying in %s: %s", wait, err)
+			select {
+			case <-stop:
+				s.done <- nil
+				return
+			case <-time.After(wait):
+			}
+
+			if wait *= 2; wait > retryMax {
+				wait = retryMax
+			}
+		}
+	}
+}
+
+// read envelopes from Socket Mode, until the connection fails or Slack asks
+// us to reconnect
+func (s *Slack) read(stop chan struct{}) error {
+	s.wmu.Lock()
+	conn := s.conn
+	s.wmu.Unlock()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(PING_TIMEOUT))
+
+		var e envelope
+		if err := conn.ReadJSON(&e); err != nil {
+			conn.Close()
+			return err
+		}
+
+		if e.EnvelopeID != "" {
+			if err := s.ack(e.EnvelopeID); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+
+		switch e.Type {
+		case SOCKET_DISCONNECT:
+			conn.Close()
+			if e.Reason == "link_disabled" {
+				return ErrLinkDisabled
+			}
+			return ErrReconnect
+		case SOCKET_EVENTS_API:
+			var p struct {
+				EventID string          `json:"event_id"`
+				Event   json.RawMessage `json:"event"`
+			}
+			if err := json.Unmarshal(e.Payload, &p); err != nil {
+				logger.Log.Warningf("Could not decode Slack event: %s", err)
+				continue
+			}
+			if s.duplicate(p.EventID) {
+				continue
+			}
+
+			select {
+			case s.events <- p.Event:
+			case <-stop:
+				conn.Close()
+				return nil
+			}
+		}
+	}
+}
+
+// handle events, in the order they arrived, until stop is closed. Events are
+// handled apart from reading them, so that envelopes are acknowledged in time
+// while a slow handler runs
+func (s *Slack) handle(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case e := <-s.events:
+			s.event(e)
+		}
+	}
+}
+
+// ack acknowledges an envelope
+func (s *Slack) ack(id string) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.conn == nil {
+		return ErrNotConnected
+	}
+
+	return s.conn.WriteJSON(map[string]string{"envelope_id": id})
+}
@@ -0,0 +1,229 @@
+// Package telegram adapts the Telegram Bot API to the adapter package
+//
+// About
+//
+// The Telegram adapter receives updates either by long-polling getUpdates,
+// or, if it is given a webhook URL, by having Telegram post them to a webhook
+// mounted on quaridd's router. Messages and edited messages in private chats
+// and groups, replies, and members joining and leaving groups are translated
+// into adapter Updates, and Updates are sent back with the Bot API, as HTML.
+//
+// Each update has an ID, and the ID after the last update we handled (the
+// offset) is kept in a Store, so that a restart neither handles an update
+// again, nor misses the updates Telegram kept for us meanwhile.
+//
+// See also: https://core.telegram.org/bots/api
+package telegram
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// ADAPTER_NAME is the name of the Telegram adapter
+const ADAPTER_NAME = "telegram"
+
+// API_URL is the base URL of the Bot API
+const API_URL = "https://api.telegram.org"
+
+// TIMEOUT is the timeout of requests to the Bot API, besides the time
+// getUpdates is held open for
+const TIMEOUT = 30 * time.Second
+
+// How long to wait before polling again after a failure, doubling up to the
+// maximum
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+var (
+	// ErrNoToken is returned when connecting without a bot token
+	ErrNoToken = errors.New("No Telegram bot token")
+
+	// ErrNotMounted is returned when connecting with a webhook URL, but
+	// without the webhook mounted on a router
+	ErrNotMounted = errors.New("Telegram webhook is not mounted on a router (it is served by quaridd)")
+)
+
+// Telegram is a connection to the Bot API, as a bot
+type Telegram struct {
+	// The bot's token, from @BotFather
+	Token string
+
+	// The base URL of the Bot API
+	APIURL string
+
+	// The public URL Telegram posts updates to. If empty, updates are
+	// long-polled instead
+	WebhookURL string
+
+	// The secret Telegram sends with each update to the webhook. If empty,
+	// one is made up when we connect
+	WebhookSecret string
+
+	// The HTTP client for requests to the Bot API
+	HTTPClient *http.Client
+
+	store database.Store
+
+	// Our own user ID and username, once we are connected
+	userID   int64
+	username string
+
+	mu       sync.Mutex
+	offset   int64
+	last     time.Time
+	handlers []adapter.UpdateFunc
+	mounted  bool
+
+	// Updates posted to the webhook, waiting to be handled
+	updates chan *update
+
+	stop chan struct{}
+	done chan error
+}
+
+// New returns a Telegram adapter for the bot with the token given, that keeps
+// its update offset in store
+func New(token string, store database.Store) *Telegram {
+	return &Telegram{
+		Token:      token,
+		APIURL:     API_URL,
+		HTTPClient: &http.Client{Timeout: POLL_TIMEOUT + TIMEOUT},
+		store:      store,
+		updates:    make(chan *update, UPDATE_QUEUE),
+	}
+}
+
+// Name of the adapter
+func (t *Telegram) Name() string {
+	return ADAPTER_NAME
+}
+
+// Username returns the bot's username, once we are connected
+func (t *Telegram) Username() string {
+	return t.username
+}
+
+// Mount the webhook on a router, at the path of the webhook URL. It must be
+// mounted before connecting with a webhook URL
+func (t *Telegram) Mount(r *gin.RouterGroup) error {
+	u, err := url.Parse(t.WebhookURL)
+	if err != nil {
+		return err
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	r.POST(path, t.webhook)
+
+	t.mu.Lock()
+	t.mounted = true
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Connect to the Bot API, and start receiving updates
+func (t *Telegram) Connect() error {
+	if t.Token == "" {
+		return ErrNoToken
+	}
+
+	var me user
+	if err := t.call("getMe", nil, &me); err != nil {
+		return err
+	}
+	t.userID, t.username = me.ID, me.Username
+	logger.Log.Infof("Logged in to Telegram as @%s", me.Username)
+
+	o := t.loadOffset()
+
+	t.mu.Lock()
+	t.offset, t.last = o.Offset, o.Time
+	mounted := t.mounted
+	if t.WebhookSecret == "" && t.WebhookURL != "" {
+		t.WebhookSecret = secret()
+	}
+	t.mu.Unlock()
+
+	t.stop = make(chan struct{})
+	t.done = make(chan error, 1)
+
+	if t.WebhookURL == "" {
+		// Updates cannot be polled while a webhook is set
+		if err := t.call("deleteWebhook", params{}, nil); err != nil {
+			return err
+		}
+		go t.poll(t.stop)
+
+		return nil
+	}
+
+	if !mounted {
+		return ErrNotMounted
+	}
+	if err := t.setWebhook(); err != nil {
+		return err
+	}
+	go t.handle(t.stop)
+
+	return nil
+}
+
+// Disconnect stops receiving updates. A webhook is left set, so that Telegram
+// keeps the updates that arrive meanwhile
+func (t *Telegram) Disconnect() error {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+
+	return nil
+}
+
+// Wait blocks while receiving updates, and returns the error that stopped us
+func (t *Telegram) Wait() error {
+	return <-t.done
+}
+
+// Receive calls f with each Update from Telegram
+func (t *Telegram) Receive(f adapter.UpdateFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.handlers = append(t.handlers, f)
+}
+
+func (t *Telegram) dispatch(u adapter.Update) {
+	t.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), t.handlers...)
+	t.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, t)
+	}
+}
+
+// secret makes up a webhook secret
+func secret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,129 @@
+package telegram
+
+// Bot API
+//
+// Methods are called with a JSON POST to <API URL>/bot<token>/<method>. Every
+// response has "ok", and, when it is false, an error code and description.
+// Calls that are rate limited are retried after the time Telegram gives.
+//
+// See also: https://core.telegram.org/bots/api#making-requests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// maxRetries is how many times a rate limited call is retried
+const maxRetries = 5
+
+// params are the parameters of a call
+type params map[string]interface{}
+
+// Error is an error from the Bot API
+type Error struct {
+	Method      string
+	Code        int
+	Description string
+
+	// The chat a group was upgraded to, if it was
+	MigrateTo int64
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Telegram %s failed: %d %s", e.Method, e.Code, e.Description)
+}
+
+// Fatal errors mean the bot's token is not valid
+func (e *Error) Fatal() bool {
+	return e.Code == http.StatusUnauthorized || e.Code == http.StatusNotFound
+}
+
+// call a method, and decode its result into out (if not nil)
+func (t *Telegram) call(method string, p params, out interface{}) error {
+	return t.callContext(context.Background(), method, p, out)
+}
+
+// callContext calls a method, until ctx is done
+func (t *Telegram) callContext(ctx context.Context, method string, p params, out interface{}) error {
+	u := strings.TrimRight(t.APIURL, "/") + "/bot" + t.Token + "/" + method
+
+	body := []byte("{}")
+	if p != nil {
+		var err error
+		if body, err = json.Marshal(p); err != nil {
+			return err
+		}
+	}
+
+	for n := 0; ; n++ {
+		req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := t.HTTPClient.Do(req)
+		if err != nil {
+			// Leave the token out of the error
+			return fmt.Errorf("Could not call Telegram %s: %s", method, strings.Replace(err.Error(), t.Token, "<token>", -1))
+		}
+
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		var r struct {
+			OK          bool            `json:"ok"`
+			Result      json.RawMessage `json:"result"`
+			ErrorCode   int             `json:"error_code"`
+			Description string          `json:"description"`
+			Parameters  struct {
+				RetryAfter      int   `json:"retry_after"`
+				MigrateToChatID int64 `json:"migrate_to_chat_id"`
+			} `json:"parameters"`
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return &Error{Method: method, Code: resp.StatusCode, Description: http.StatusText(resp.StatusCode)}
+		}
+
+		if r.ErrorCode == http.StatusTooManyRequests && n < maxRetries {
+			wait := time.Duration(r.Parameters.RetryAfter) * time.Second
+			if wait <= 0 {
+				wait = time.Second
+			}
+			logger.Log.Debugf("Rate limited by Telegram on %s; retrying in %s", method, wait)
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if !r.OK {
+			return &Error{
+				Method:      method,
+				Code:        r.ErrorCode,
+				Description: r.Description,
+				MigrateTo:   r.Parameters.MigrateToChatID,
+			}
+		}
+
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(r.Result, out)
+	}
+}
@@ -0,0 +1,393 @@
+package telegram
+
+// Events
+//
+// Messages and edited messages in private chats and groups are translated
+// into adapter Updates, as are members joining and leaving groups, and
+// reactions. A message's entities (bold, links, and so on) become formatted
+// text. Replies name the message they reply to, and messages in a forum topic
+// are in the topic's thread. Commands addressed to us (/cmd@ourbot) are given
+// as if they were not addressed (/cmd).
+//
+// See also: https://core.telegram.org/bots/api#message
+// See also: https://core.telegram.org/bots/api#messageentity
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// Kinds of updates, and of chats
+const (
+	EVENT_MESSAGE        = "message"
+	EVENT_EDITED_MESSAGE = "edited_message"
+
+	CHAT_PRIVATE    = "private"
+	CHAT_GROUP      = "group"
+	CHAT_SUPERGROUP = "supergroup"
+	CHAT_CHANNEL    = "channel"
+)
+
+// commandPattern matches a command at the start of a message, and the bot it
+// is addressed to
+var commandPattern = regexp.MustCompile(`^(/[A-Za-z0-9_]+)@([A-Za-z0-9_]+)`)
+
+type user struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+type chat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type entity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url"`
+	User   *user  `json:"user"`
+}
+
+type message struct {
+	MessageID       int64    `json:"message_id"`
+	MessageThreadID int64    `json:"message_thread_id"`
+	IsTopicMessage  bool     `json:"is_topic_message"`
+	From            *user    `json:"from"`
+	Chat            chat     `json:"chat"`
+	Date            int64    `json:"date"`
+	EditDate        int64    `json:"edit_date"`
+	Text            string   `json:"text"`
+	Entities        []entity `json:"entities"`
+	Caption         string   `json:"caption"`
+	CaptionEntities []entity `json:"caption_entities"`
+	ReplyToMessage  *message `json:"reply_to_message"`
+	NewChatMembers  []user   `json:"new_chat_members"`
+	LeftChatMember  *user    `json:"left_chat_member"`
+}
+
+type reactionType struct {
+	Type          string `json:"type"`
+	Emoji         string `json:"emoji"`
+	CustomEmojiID string `json:"custom_emoji_id"`
+}
+
+type messageReaction struct {
+	Chat        chat           `json:"chat"`
+	MessageID   int64          `json:"message_id"`
+	User        *user          `json:"user"`
+	Date        int64          `json:"date"`
+	OldReaction []reactionType `json:"old_reaction"`
+	NewReaction []reactionType `json:"new_reaction"`
+}
+
+// message handles a new message
+func (t *Telegram) message(m *message) {
+	if m.Chat.Type == CHAT_CHANNEL || m.From == nil {
+		return
+	}
+
+	if len(m.NewChatMembers) > 0 || m.LeftChatMember != nil {
+		t.membership(m)
+		return
+	}
+
+	if m.From.ID == t.userID {
+		return
+	}
+
+	msg := t.convert(m)
+	if msg.Text == "" {
+		return
+	}
+	msg.Raw = raw(EVENT_MESSAGE, m)
+
+	t.dispatch(msg)
+}
+
+// edited handles a message being edited
+func (t *Telegram) edited(m *message) {
+	if m.Chat.Type == CHAT_CHANNEL || m.From == nil || m.From.ID == t.userID {
+		return
+	}
+
+	msg := t.convert(m)
+	if msg.Text == "" {
+		return
+	}
+
+	tm := msg.Time
+	if m.EditDate != 0 {
+		tm = time.Unix(m.EditDate, 0)
+	}
+
+	t.dispatch(&adapter.Edit{
+		Adapter: t.Name(),
+		Message: msg,
+		Text:    msg.Text,
+		User:    msg.User,
+		Time:    tm,
+	})
+}
+
+// convert a Telegram message into a Message
+func (t *Telegram) convert(m *message) *adapter.Message {
+	text, entities := m.Text, m.Entities
+	if text == "" {
+		text, entities = m.Caption, m.CaptionEntities
+	}
+
+	msg := &adapter.Message{
+		Adapter: t.Name(),
+		ID:      strconv.FormatInt(m.MessageID, 10),
+		Room:    room(m.Chat),
+		User:    describe(m.From),
+		Text:    t.command(formatted(text, entities)),
+		Time:    time.Unix(m.Date, 0),
+	}
+
+	if m.IsTopicMessage {
+		msg.Thread = strconv.FormatInt(m.MessageThreadID, 10)
+	}
+
+	// In a topic, a message that is not a reply replies to the message that
+	// started the topic
+	if r := m.ReplyToMessage; r != nil && !(m.IsTopicMessage && r.MessageID == m.MessageThreadID) {
+		msg.ReplyTo = strconv.FormatInt(r.MessageID, 10)
+	}
+
+	return msg
+}
+
+// command drops our username from a command addressed to us
+func (t *Telegram) command(text string) string {
+	m := commandPattern.FindStringSubmatch(text)
+	if m == nil || !strings.EqualFold(m[2], t.username) {
+		return text
+	}
+
+	return m[1] + text[len(m[0]):]
+}
+
+// membership handles members joining, or leaving, a group
+func (t *Telegram) membership(m *message) {
+	rm := room(m.Chat)
+	tm := time.Unix(m.Date, 0)
+	actor := describe(m.From)
+
+	for n := range m.NewChatMembers {
+		u := &m.NewChatMembers[n]
+		ms := &adapter.Membership{
+			Adapter: t.Name(),
+			Kind:    adapter.Join,
+			Room:    rm,
+			User:    describe(u),
+			Time:    tm,
+		}
+		if m.From.ID != u.ID {
+			ms.Actor = &actor
+		}
+		t.dispatch(ms)
+	}
+
+	if u := m.LeftChatMember; u != nil {
+		ms := &adapter.Membership{
+			Adapter: t.Name(),
+			Kind:    adapter.Leave,
+			Room:    rm,
+			User:    describe(u),
+			Time:    tm,
+		}
+		if m.From.ID != u.ID {
+			ms.Kind = adapter.Kick
+			ms.Actor = &actor
+		}
+		t.dispatch(ms)
+	}
+}
+
+// reaction handles reactions to a message changing. Each reaction added or
+// taken back is a Reaction
+func (t *Telegram) reaction(r *messageReaction) {
+	if r.User == nil || r.User.ID == t.userID {
+		return
+	}
+
+	old, now := reactions(r.OldReaction), reactions(r.NewReaction)
+	rm := room(r.Chat)
+	u := describe(r.User)
+	id := strconv.FormatInt(r.MessageID, 10)
+
+	for e := range now {
+		if !old[e] {
+			t.dispatch(&adapter.Reaction{
+				Adapter:   t.Name(),
+				Room:      rm,
+				MessageID: id,
+				User:      u,
+				Reaction:  e,
+				Time:      time.Unix(r.Date, 0),
+			})
+		}
+	}
+	for e := range old {
+		if !now[e] {
+			t.dispatch(&adapter.Reaction{
+				Adapter:   t.Name(),
+				Room:      rm,
+				MessageID: id,
+				User:      u,
+				Reaction:  e,
+				Removed:   true,
+				Time:      time.Unix(r.Date, 0),
+			})
+		}
+	}
+}
+
+// reactions returns the emoji reactions given (custom emoji are left out)
+func reactions(rs []reactionType) map[string]bool {
+	es := make(map[string]bool)
+	for _, r := range rs {
+		if r.Type == "emoji" {
+			es[r.Emoji] = true
+		}
+	}
+
+	return es
+}
+
+// describe a Telegram user. Their name is their full name, and their account
+// is their username, if they have one
+func describe(u *user) adapter.User {
+	if u == nil {
+		return adapter.User{}
+	}
+
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		name = u.Username
+	}
+
+	return adapter.User{
+		ID:      strconv.FormatInt(u.ID, 10),
+		Name:    name,
+		Account: u.Username,
+	}
+}
+
+// room describes a chat. Private chats are named after the user they are with
+func room(c chat) adapter.Room {
+	rm := adapter.Room{
+		ID:      strconv.FormatInt(c.ID, 10),
+		Name:    c.Title,
+		Private: c.Type == CHAT_PRIVATE,
+	}
+
+	if rm.Name == "" {
+		rm.Name = strings.TrimSpace(c.FirstName + " " + c.LastName)
+	}
+	if rm.Name == "" && c.Username != "" {
+		rm.Name = "@" + c.Username
+	}
+
+	return rm
+}
+
+// raw is a message's native event
+func raw(kind string, m *message) *adapter.Event {
+	from := ""
+	if m.From != nil {
+		from = strconv.FormatInt(m.From.ID, 10)
+	}
+
+	text := m.Text
+	if text == "" {
+		text = m.Caption
+	}
+
+	return &adapter.Event{
+		Tags:       map[string]string{"msgid": strconv.FormatInt(m.MessageID, 10)},
+		Prefix:     from,
+		Command:    kind,
+		Parameters: []string{strconv.FormatInt(m.Chat.ID, 10), text},
+		Timestamp:  time.Unix(m.Date, 0),
+	}
+}
+
+// formatted turns text and its entities into formatted text. Entities'
+// offsets and lengths are in UTF-16 code units
+func formatted(text string, entities []entity) string {
+	if len(entities) == 0 {
+		return text
+	}
+
+	size := units(text)
+	styles := make([]format.Style, size+1)
+	for n := range styles {
+		styles[n] = format.Plain
+	}
+	links := make(map[int][]string)
+
+	for _, e := range entities {
+		end := e.Offset + e.Length
+		if e.Offset < 0 || end > size {
+			continue
+		}
+
+		for n := e.Offset; n < end; n++ {
+			switch e.Type {
+			case "bold":
+				styles[n].Bold = true
+			case "italic":
+				styles[n].Italic = true
+			case "underline":
+				styles[n].Underline = true
+			case "strikethrough":
+				styles[n].Strike = true
+			case "code", "pre":
+				styles[n].Monospace = true
+			}
+		}
+
+		if e.Type == "text_link" && e.URL != "" {
+			links[end] = append(links[end], e.URL)
+		}
+	}
+
+	var spans []format.Span
+	write := func(st format.Style, s string) {
+		if n := len(spans); n > 0 && spans[n-1].Style == st {
+			spans[n-1].Text += s
+		} else {
+			spans = append(spans, format.Span{Style: st, Text: s})
+		}
+	}
+
+	n := 0
+	for _, r := range []rune(text) {
+		for _, l := range links[n] {
+			write(format.Plain, " ("+l+")")
+		}
+		write(styles[n], string(r))
+		n += units(string(r))
+	}
+	for _, l := range links[n] {
+		write(format.Plain, " ("+l+")")
+	}
+
+	return format.Format(spans)
+}
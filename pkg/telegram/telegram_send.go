@@ -0,0 +1,291 @@
+package telegram
+
+// Sending
+//
+// Messages are sent with sendMessage, as HTML, and split to fit Telegram's
+// limit on their length. Replies are sent as replies to the message, in its
+// thread (a forum topic); actions are italic, and notices are sent silently.
+// Telegram sees @username in a message as a mention of that user, so no
+// mentions need to be turned into Telegram's. When a group is upgraded to a
+// supergroup, messages are sent to the supergroup instead.
+//
+// See also: https://core.telegram.org/bots/api#sendmessage
+// See also: https://core.telegram.org/bots/api#formatting-options
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// MAX_MESSAGE_LENGTH is the longest message Telegram allows, in UTF-16 code
+// units, once its HTML is parsed
+const MAX_MESSAGE_LENGTH = 4096
+
+// Send an Update to Telegram
+func (t *Telegram) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		return t.send(u.Room, u.Thread, u.ReplyTo, u.Kind, u.Text)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+		return t.send(u.To.Room, u.To.Thread, u.To.ID, u.Kind, u.Text)
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+		return t.edit(u.Message, u.Text)
+	case *adapter.Reaction:
+		return nil, t.react(u)
+	case *adapter.Membership:
+		return nil, t.setMembership(u)
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// send a message to a chat, in thread, replying to replyTo (if either is not
+// empty). Long messages are sent in parts; the last part sent is returned
+func (t *Telegram) send(rm adapter.Room, thread, replyTo string, kind adapter.Kind, text string) (*adapter.Message, error) {
+	spans := format.Parse(text)
+	if kind == adapter.Action {
+		for n := range spans {
+			spans[n].Italic = true
+		}
+	}
+
+	parts := split(spans)
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	var sent message
+	for n, part := range parts {
+		p := params{
+			"chat_id":              rm.ID,
+			"text":                 render(part),
+			"parse_mode":           "HTML",
+			"disable_notification": kind == adapter.Notice,
+		}
+		if thread != "" {
+			p["message_thread_id"] = number(thread)
+		}
+		if replyTo != "" && n == 0 {
+			p["reply_parameters"] = params{
+				"message_id":                  number(replyTo),
+				"allow_sending_without_reply": true,
+			}
+		}
+
+		if err := t.callChat("sendMessage", p, &sent); err != nil {
+			return nil, err
+		}
+
+		// The chat may have been upgraded to a supergroup
+		rm.ID = p["chat_id"].(string)
+	}
+
+	return &adapter.Message{
+		Adapter: t.Name(),
+		ID:      strconv.FormatInt(sent.MessageID, 10),
+		Room:    rm,
+		User:    adapter.User{ID: strconv.FormatInt(t.userID, 10), Name: t.username, Account: t.username},
+		Kind:    kind,
+		Text:    text,
+		ReplyTo: replyTo,
+		Thread:  thread,
+		Time:    time.Now(),
+	}, nil
+}
+
+// edit the text of one of our messages. Text that is too long for one message
+// is cut short
+func (t *Telegram) edit(m *adapter.Message, text string) (*adapter.Message, error) {
+	spans := format.Parse(text)
+	if m.Kind == adapter.Action {
+		for n := range spans {
+			spans[n].Italic = true
+		}
+	}
+
+	var parts [][]format.Span
+	if parts = split(spans); len(parts) == 0 {
+		return nil, nil
+	}
+
+	err := t.callChat("editMessageText", params{
+		"chat_id":    m.Room.ID,
+		"message_id": number(m.ID),
+		"text":       render(parts[0]),
+		"parse_mode": "HTML",
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := *m
+	e.Text, e.Time = text, time.Now()
+	return &e, nil
+}
+
+// react to a message with an emoji, or take our reaction back. Bots have one
+// reaction to each message
+func (t *Telegram) react(r *adapter.Reaction) error {
+	rs := []params{}
+	if !r.Removed {
+		rs = append(rs, params{"type": "emoji", "emoji": r.Reaction})
+	}
+
+	return t.callChat("setMessageReaction", params{
+		"chat_id":    r.Room.ID,
+		"message_id": number(r.MessageID),
+		"reaction":   rs,
+	}, nil)
+}
+
+// setMembership leaves a group, or removes someone from one. Bots cannot
+// join groups, or invite users, themselves
+func (t *Telegram) setMembership(u *adapter.Membership) error {
+	switch u.Kind {
+	case adapter.Leave:
+		return t.call("leaveChat", params{"chat_id": u.Room.ID}, nil)
+	case adapter.Kick:
+		// Banning removes the user, and unbanning lets them come back
+		p := params{"chat_id": u.Room.ID, "user_id": number(u.User.ID)}
+		if err := t.call("banChatMember", p, nil); err != nil {
+			return err
+		}
+		p["only_if_banned"] = true
+		return t.call("unbanChatMember", p, nil)
+	}
+
+	return adapter.ErrNotSupported
+}
+
+// callChat calls a method on a chat. If the chat was upgraded to a
+// supergroup, the method is called again, on the supergroup
+func (t *Telegram) callChat(method string, p params, out interface{}) error {
+	err := t.call(method, p, out)
+	if e, ok := err.(*Error); ok && e.MigrateTo != 0 {
+		p["chat_id"] = strconv.FormatInt(e.MigrateTo, 10)
+		return t.call(method, p, out)
+	}
+
+	return err
+}
+
+// render formatted text as the HTML Telegram allows
+func render(spans []format.Span) string {
+	var b strings.Builder
+
+	for _, sp := range spans {
+		var open, close []string
+		tag := func(name string) {
+			open = append(open, "<"+name+">")
+			close = append([]string{"</" + name + ">"}, close...)
+		}
+
+		if sp.Bold {
+			tag("b")
+		}
+		if sp.Italic {
+			tag("i")
+		}
+		if sp.Underline {
+			tag("u")
+		}
+		if sp.Strike {
+			tag("s")
+		}
+		if sp.Monospace && strings.Contains(sp.Text, "\n") {
+			tag("pre")
+		} else if sp.Monospace {
+			tag("code")
+		}
+
+		b.WriteString(strings.Join(open, ""))
+		b.WriteString(html.EscapeString(sp.Text))
+		b.WriteString(strings.Join(close, ""))
+	}
+
+	return b.String()
+}
+
+// split formatted text into parts that each fit in a message, between lines
+// or words where it can
+func split(spans []format.Span) [][]format.Span {
+	var parts [][]format.Span
+	var part []format.Span
+	size := 0
+
+	for _, sp := range spans {
+		text := sp.Text
+		for text != "" {
+			n := cut(text, MAX_MESSAGE_LENGTH-size, size == 0)
+			if n == 0 {
+				parts = append(parts, part)
+				part, size = nil, 0
+				continue
+			}
+
+			part = append(part, format.Span{Style: sp.Style, Text: text[:n]})
+			size += units(text[:n])
+			text = text[n:]
+		}
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+
+	return parts
+}
+
+// cut returns how much of text (in bytes) fits in space UTF-16 code units,
+// ending after a newline or space if it can. If it cannot, and the message
+// is not empty, none of it fits
+func cut(text string, space int, empty bool) int {
+	if units(text) <= space {
+		return len(text)
+	}
+
+	end, size := 0, 0
+	for n, r := range text {
+		if size += units(string(r)); size > space {
+			break
+		}
+		end = n + len(string(r))
+	}
+
+	if n := strings.LastIndexAny(text[:end], "\n "); n >= 0 {
+		return n + 1
+	}
+	if !empty {
+		return 0
+	}
+
+	return end
+}
+
+// units is the length of s in UTF-16 code units
+func units(s string) int {
+	n := 0
+	for _, r := range s {
+		if n++; r >= 0x10000 {
+			n++
+		}
+	}
+
+	return n
+}
+
+// number parses an ID. IDs are given to Telegram as numbers
+func number(id string) int64 {
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
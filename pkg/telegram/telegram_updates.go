@@ -0,0 +1,236 @@
+package telegram
+
+// Updates
+//
+// Updates are long-polled with getUpdates, or posted by Telegram to the
+// webhook, one at a time, with our secret. The webhook queues them to be
+// handled, so that Telegram is answered at once. Either way, the offset is
+// saved before an update is handled, so that it is never handled twice; an
+// update posted again is dropped.
+//
+// Telegram numbers updates in order, but after a week without updates it may
+// start again anywhere, so an offset that old is forgotten.
+//
+// See also: https://core.telegram.org/bots/api#getting-updates
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/database"
+	"github.com/enmand/quarid-go/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// POLL_TIMEOUT is how long Telegram holds each getUpdates open, waiting for
+// updates
+const POLL_TIMEOUT = 30 * time.Second
+
+// UPDATE_QUEUE is how many updates posted to the webhook can wait to be
+// handled. When it is full, Telegram is told to post them again later
+const UPDATE_QUEUE = 256
+
+// SECRET_HEADER is the header Telegram sends the webhook's secret in
+const SECRET_HEADER = "X-Telegram-Bot-Api-Secret-Token"
+
+// offsetBucket is where offsets are kept, by the bot's user ID
+const offsetBucket = "telegram.offset"
+
+// idRestart is how long without updates before Telegram may number updates
+// from anywhere
+const idRestart = 7 * 24 * time.Hour
+
+// allowedUpdates are the kinds of updates we ask Telegram for
+var allowedUpdates = []string{
+	"message",
+	"edited_message",
+	"message_reaction",
+}
+
+// update is an update from Telegram
+type update struct {
+	UpdateID        int64            `json:"update_id"`
+	Message         *message         `json:"message"`
+	EditedMessage   *message         `json:"edited_message"`
+	MessageReaction *messageReaction `json:"message_reaction"`
+}
+
+// savedOffset is an offset, as it is kept in the Store
+type savedOffset struct {
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time"`
+}
+
+// poll for updates with getUpdates, until stop is closed
+func (t *Telegram) poll(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	wait := retryMin
+	for {
+		t.mu.Lock()
+		offset := t.offset
+		t.mu.Unlock()
+
+		var us []*update
+		err := t.callContext(ctx, "getUpdates", params{
+			"offset":          offset,
+			"timeout":         int(POLL_TIMEOUT / time.Second),
+			"allowed_updates": allowedUpdates,
+		}, &us)
+
+		select {
+		case <-stop:
+			t.done <- nil
+			return
+		default:
+		}
+
+		if err != nil {
+			if e, ok := err.(*Error); ok && e.Fatal() {
+				t.done <- err
+				return
+			}
+
+			logger.Log.Warningf("Could not get Telegram updates: %s; retrying in %s", err, wait)
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				t.done <- nil
+				return
+			}
+
+			if wait *= 2; wait > retryMax {
+				wait = retryMax
+			}
+			continue
+		}
+		wait = retryMin
+
+		for _, u := range us {
+			t.process(u)
+		}
+	}
+}
+
+// setWebhook asks Telegram to post updates to the webhook, one at a time
+func (t *Telegram) setWebhook() error {
+	return t.call("setWebhook", params{
+		"url":             t.WebhookURL,
+		"secret_token":    t.WebhookSecret,
+		"allowed_updates": allowedUpdates,
+		"max_connections": 1,
+	}, nil)
+}
+
+// webhook receives an update posted by Telegram
+func (t *Telegram) webhook(c *gin.Context) {
+	t.mu.Lock()
+	secret := t.WebhookSecret
+	t.mu.Unlock()
+
+	if secret == "" {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	got := c.Request.Header.Get(SECRET_HEADER)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	u := &update{}
+	if err := json.NewDecoder(c.Request.Body).Decode(u); err != nil {
+		logger.Log.Warningf("Could not decode Telegram update: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case t.updates <- u:
+		c.String(http.StatusOK, "")
+	default:
+		logger.Log.Warningf("Too many Telegram updates waiting; asking for update %d again", u.UpdateID)
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+	}
+}
+
+// handle the updates posted to the webhook, until stop is closed
+func (t *Telegram) handle(stop chan struct{}) {
+	for {
+		select {
+		case u := <-t.updates:
+			t.process(u)
+		case <-stop:
+			t.done <- nil
+			return
+		}
+	}
+}
+
+// process an update, unless it was handled already
+func (t *Telegram) process(u *update) {
+	t.mu.Lock()
+	if u.UpdateID < t.offset && time.Since(t.last) < idRestart {
+		t.mu.Unlock()
+		logger.Log.Debugf("Dropping Telegram update %d, which was handled already", u.UpdateID)
+		return
+	}
+	t.offset, t.last = u.UpdateID+1, time.Now()
+	offset := t.offset
+	t.mu.Unlock()
+
+	t.saveOffset(offset)
+
+	switch {
+	case u.Message != nil:
+		t.message(u.Message)
+	case u.EditedMessage != nil:
+		t.edited(u.EditedMessage)
+	case u.MessageReaction != nil:
+		t.reaction(u.MessageReaction)
+	}
+}
+
+// loadOffset returns the offset we saved, if we saved it recently enough
+func (t *Telegram) loadOffset() savedOffset {
+	var o savedOffset
+	if t.store == nil {
+		return o
+	}
+
+	if err := t.store.Get(offsetBucket, strconv.FormatInt(t.userID, 10), &o); err != nil {
+		if err != database.ErrNotFound {
+			logger.Log.Errorf("Could not load Telegram update offset: %s", err)
+		}
+		return savedOffset{}
+	}
+
+	if time.Since(o.Time) > idRestart {
+		return savedOffset{}
+	}
+
+	return o
+}
+
+func (t *Telegram) saveOffset(offset int64) {
+	if t.store == nil {
+		return
+	}
+
+	o := savedOffset{Offset: offset, Time: time.Now()}
+	if err := t.store.Put(offsetBucket, strconv.FormatInt(t.userID, 10), o); err != nil {
+		logger.Log.Errorf("Could not save Telegram update offset: %s", err)
+	}
+}
@@ -0,0 +1,413 @@
+// Package xmpp adapts XMPP multi-user chat to the adapter package
+//
+// About
+//
+// The XMPP adapter connects to a server as a client: it negotiates STARTTLS
+// and SASL, binds a resource, joins multi-user chat rooms (MUCs) with a
+// nickname, and exchanges groupchat and direct messages. Messages and room
+// presence are translated into adapter Updates, so plugins can respond in
+// rooms as they do on any other network.
+//
+// With XEP-0198 stream management, stanzas are acknowledged by the server,
+// and a lost connection is resumed where it left off: stanzas the server did
+// not receive are sent again, and the rooms stay joined. Without it, the
+// client reconnects, and rejoins its rooms, asking only for the history it
+// missed.
+//
+// See also: https://xmpp.org/rfcs/rfc6120.html
+// See also: https://xmpp.org/extensions/xep-0045.html
+// See also: https://xmpp.org/extensions/xep-0198.html
+package xmpp
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// ADAPTER_NAME is the name of the XMPP adapter
+const ADAPTER_NAME = "xmpp"
+
+// DIAL_TIMEOUT is the connection timeout to the XMPP server
+const DIAL_TIMEOUT = 30 * time.Second
+
+// KEEPALIVE is how often the connection is checked while it is idle. A
+// connection that is silent for three times as long is lost
+const KEEPALIVE = time.Minute
+
+// How long to wait before reconnecting, doubling up to the maximum
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// ErrNotConnected is returned when sending while disconnected, if the stream
+// cannot be resumed
+var ErrNotConnected = errors.New("Not connected to the XMPP server")
+
+// XMPP is a connection to an XMPP server
+type XMPP struct {
+	// The JID to log in as (e.g. quarid@example.com), and its password
+	JID      string
+	Password string
+
+	// The resource to bind
+	Resource string
+
+	// The server to connect to (host:port). If empty, it is found from the
+	// JID's domain
+	Server string
+
+	// Connect with TLS directly, rather than with STARTTLS
+	DirectTLS bool
+
+	// Verify the server's certificate
+	TLSVerify bool
+
+	// Allow connecting, and authenticating, without TLS
+	AllowPlaintext bool
+
+	// The nickname to use in rooms
+	Nick string
+
+	// How many messages of history to ask for when joining a room, or -1 for
+	// the room's default
+	History int
+
+	// Join rooms we are invited to
+	AutoJoin bool
+
+	// Our full JID, once we are bound
+	full string
+
+	mu       sync.Mutex
+	wmu      sync.Mutex
+	stream   *stream
+	rooms    map[string]*room
+	handlers []adapter.UpdateFunc
+	sm       streamManagement
+
+	// Reactions, by user and message, as reactions are sent as a whole set
+	reactions map[string][]string
+	reacted   map[string][]string
+
+	id   int
+	stop chan struct{}
+	done chan error
+}
+
+// New returns an XMPP adapter, that logs in as jid
+func New(jid, password string) *XMPP {
+	return &XMPP{
+		JID:       jid,
+		Password:  password,
+		Resource:  "quarid",
+		Nick:      localpart(jid),
+		History:   -1,
+		TLSVerify: true,
+		rooms:     make(map[string]*room),
+		reactions: make(map[string][]string),
+		reacted:   make(map[string][]string),
+	}
+}
+
+// Name of the adapter
+func (x *XMPP) Name() string {
+	return ADAPTER_NAME
+}
+
+// Connect to the server, and join the rooms that have been added
+func (x *XMPP) Connect() error {
+	if err := x.connect(); err != nil {
+		return err
+	}
+
+	x.stop = make(chan struct{})
+	x.done = make(chan error, 1)
+	go x.run(x.stop)
+
+	return nil
+}
+
+// Disconnect from the server. The stream is closed, and is not resumed
+func (x *XMPP) Disconnect() error {
+	if x.stop == nil {
+		return nil
+	}
+	close(x.stop)
+	x.stop = nil
+
+	x.wmu.Lock()
+	defer x.wmu.Unlock()
+
+	x.sm = streamManagement{}
+	if x.stream == nil {
+		return nil
+	}
+
+	x.stream.send(el("presence", "", "type", "unavailable"))
+	_, err := x.stream.conn.Write([]byte("</stream:stream>"))
+	x.stream.conn.Close()
+
+	return err
+}
+
+// Wait blocks while connected (or reconnecting), and returns the error that
+// stopped us
+func (x *XMPP) Wait() error {
+	return <-x.done
+}
+
+// Receive calls f with each Update from the server
+func (x *XMPP) Receive(f adapter.UpdateFunc) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.handlers = append(x.handlers, f)
+}
+
+func (x *XMPP) dispatch(u adapter.Update) {
+	x.mu.Lock()
+	hs := append([]adapter.UpdateFunc(nil), x.handlers...)
+	x.mu.Unlock()
+
+	for _, h := range hs {
+		h(u, x)
+	}
+}
+
+// connect to the server, and negotiate a stream. A new session announces our
+// presence, and joins our rooms; a resumed one continues as it was
+func (x *XMPP) connect() error {
+	conn, err := x.dial()
+	if err != nil {
+		return err
+	}
+
+	s, resumed, err := x.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	x.wmu.Lock()
+	var pending []string
+	if resumed {
+		pending = x.sm.pending()
+	} else {
+		pending = x.sm.failed()
+		if s.sm {
+			err = x.enable(s)
+		}
+	}
+	if err == nil {
+		x.stream = s
+	}
+	x.wmu.Unlock()
+
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if resumed {
+		logger.Log.Infof("Resumed XMPP session as %s", x.full)
+		for _, p := range pending {
+			x.writeRaw(p)
+		}
+		return nil
+	}
+
+	logger.Log.Infof("Connected to XMPP as %s", x.full)
+	x.write(el("presence", ""))
+	x.rejoin()
+
+	// Messages sent while the stream could not be resumed are sent again, as
+	// new stanzas on this stream
+	for _, p := range pending {
+		x.writeStanza(p)
+	}
+
+	return nil
+}
+
+// run reads from the server, reconnecting whenever the connection is lost,
+// until stop is closed
+func (x *XMPP) run(stop chan struct{}) {
+	for {
+		err := x.read(stop)
+
+		select {
+		case <-stop:
+			x.done <- nil
+			return
+		default:
+		}
+
+		x.wmu.Lock()
+		x.stream = nil
+		x.wmu.Unlock()
+		logger.Log.Warningf("Lost the XMPP connection: %s", err)
+
+		wait := retryMin
+		for {
+			select {
+			case <-stop:
+				x.done <- nil
+				return
+			case <-time.After(wait):
+			}
+
+			err := x.connect()
+			if err == nil {
+				break
+			}
+			if _, ok := err.(*AuthError); ok {
+				x.done <- err
+				return
+			}
+
+			logger.Log.Warningf("Could not reconnect to XMPP, retrying in %s: %s", wait, err)
+			if wait *= 2; wait > retryMax {
+				wait = retryMax
+			}
+		}
+	}
+}
+
+// read stanzas from the server, until the connection fails
+func (x *XMPP) read(stop chan struct{}) error {
+	x.wmu.Lock()
+	s := x.stream
+	x.wmu.Unlock()
+
+	alive := make(chan struct{})
+	defer close(alive)
+	go x.keepalive(alive, stop)
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(3 * KEEPALIVE))
+
+		n, err := s.next()
+		if err != nil {
+			s.conn.Close()
+			return err
+		}
+
+		switch n.XMLName.Space {
+		case NS_SM:
+			x.streamManagement(n)
+			continue
+		}
+
+		x.handled()
+
+		switch n.XMLName.Local {
+		case "message":
+			x.message(n)
+		case "presence":
+			x.presence(n)
+		case "iq":
+			x.iq(n)
+		}
+	}
+}
+
+// keepalive checks the connection while it is idle, by requesting an
+// acknowledgement, or pinging the server
+func (x *XMPP) keepalive(alive, stop chan struct{}) {
+	t := time.NewTicker(KEEPALIVE)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-alive:
+			return
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		x.wmu.Lock()
+		enabled := x.sm.enabled
+		x.wmu.Unlock()
+
+		if enabled {
+			x.request()
+		} else {
+			x.write(el("iq", "", "type", "get", "id", x.nextID(), "to", domainpart(x.JID)).
+				add(el("ping", NS_PING)))
+		}
+	}
+}
+
+// iq answers requests from the server: pings, and errors for anything else
+func (x *XMPP) iq(n *node) {
+	typ := n.attr("type")
+	if typ != "get" && typ != "set" {
+		if typ == "error" {
+			logger.Log.Debugf("XMPP request %s failed: %s", n.attr("id"),
+				n.child("error", "").condition(NS_STANZAS))
+		}
+		return
+	}
+
+	r := el("iq", "", "type", "result", "id", n.attr("id"), "to", n.attr("from"))
+	if n.child("ping", NS_PING) == nil {
+		r = el("iq", "", "type", "error", "id", n.attr("id"), "to", n.attr("from")).add(
+			el("error", "", "type", "cancel").add(el("service-unavailable", NS_STANZAS)),
+		)
+	}
+
+	x.write(r)
+}
+
+// write a stanza to the server. While the connection is lost, stanzas are
+// kept to be sent when the stream is resumed
+func (x *XMPP) write(n *node) error {
+	return x.writeStanza(n.String())
+}
+
+// writeStanza writes a serialized stanza to the server, and counts it
+func (x *XMPP) writeStanza(data string) error {
+	x.wmu.Lock()
+	defer x.wmu.Unlock()
+
+	x.sm.sent(data)
+	if x.stream == nil {
+		if x.sm.resumable() {
+			return nil
+		}
+		return ErrNotConnected
+	}
+
+	_, err := x.stream.conn.Write([]byte(data))
+	return err
+}
+
+// writeRaw writes serialized XML to the server, such as a stanza being sent
+// again on a resumed stream, which was already counted
+func (x *XMPP) writeRaw(data string) error {
+	x.wmu.Lock()
+	defer x.wmu.Unlock()
+
+	if x.stream == nil {
+		return ErrNotConnected
+	}
+
+	_, err := x.stream.conn.Write([]byte(data))
+	return err
+}
+
+// nextID returns a new stanza ID
+func (x *XMPP) nextID() string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.id++
+	return "quarid" + time.Now().Format("150405") + "-" + strconv.Itoa(x.id)
+}
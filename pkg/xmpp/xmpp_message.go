@@ -0,0 +1,402 @@
+package xmpp
+
+// Messages
+//
+// Messages in rooms are groupchat messages, from room@service/nick, and are
+// identified by the stanza-id the room gives them. Direct messages are chat
+// messages, from a user's JID, or from an occupant of a room. Replies
+// (XEP-0461), reactions (XEP-0444) and corrections (XEP-0308) are elements of
+// the message they refer to. Actions are messages starting with "/me ".
+//
+// See also: https://xmpp.org/extensions/xep-0461.html
+// See also: https://xmpp.org/extensions/xep-0444.html
+// See also: https://xmpp.org/extensions/xep-0308.html
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/format"
+)
+
+// NS_CONFERENCE is the namespace of direct invitations to rooms (XEP-0249)
+const NS_CONFERENCE = "jabber:x:conference"
+
+// actionPrefix starts messages that are actions
+const actionPrefix = "/me "
+
+// message handles a message from the server
+func (x *XMPP) message(n *node) {
+	typ := n.attr("type")
+	from := n.attr("from")
+	if typ == "error" {
+		return
+	}
+
+	if x.invited(n) {
+		return
+	}
+
+	r := x.findRoom(from)
+	t, delayed := delay(n)
+	if !delayed {
+		t = time.Now()
+	}
+
+	var rm adapter.Room
+	var user adapter.User
+	id := n.attr("id")
+
+	if typ == "groupchat" {
+		if r == nil {
+			return
+		}
+
+		nick := resourcepart(from)
+		if s := n.child("subject", ""); s != nil && n.child("body", "") == nil {
+			x.mu.Lock()
+			r.subject = s.Text
+			x.mu.Unlock()
+			return
+		}
+
+		x.mu.Lock()
+		if t.After(r.last) {
+			r.last = t
+		}
+		self := nick == r.nick
+		x.mu.Unlock()
+
+		// Messages from the room itself, and our own messages echoed back,
+		// are not Updates
+		if nick == "" || self {
+			return
+		}
+
+		for _, sid := range n.children("stanza-id") {
+			if sid.XMLName.Space == NS_SID && sid.attr("by") == r.jid {
+				id = sid.attr("id")
+			}
+		}
+
+		rm, user = r.room(), x.occupant(r, nick)
+	} else if r != nil {
+		// A private message from an occupant of a room
+		nick := resourcepart(from)
+		rm = adapter.Room{ID: from, Name: nick, Private: true}
+		user = x.occupant(r, nick)
+	} else {
+		name := localpart(from)
+		if name == "" {
+			name = bare(from)
+		}
+		rm = adapter.Room{ID: bare(from), Name: name, Private: true}
+		user = adapter.User{ID: bare(from), Name: name, Account: bare(from), Mask: from}
+	}
+
+	if rs := n.child("reactions", NS_REACT); rs != nil {
+		x.reacting(rm, user, rs, t)
+		return
+	}
+
+	body := n.child("body", "")
+	if body == nil {
+		return
+	}
+	text := stripFallback(n, body.Text)
+
+	if c := n.child("replace", NS_CORRECT); c != nil {
+		x.dispatch(&adapter.Edit{
+			Adapter: x.Name(),
+			Message: &adapter.Message{
+				Adapter: x.Name(),
+				ID:      c.attr("id"),
+				Room:    rm,
+				User:    user,
+			},
+			Text: text,
+			User: user,
+			Time: t,
+		})
+		return
+	}
+
+	m := &adapter.Message{
+		Adapter:    x.Name(),
+		ID:         id,
+		Room:       rm,
+		User:       user,
+		Text:       text,
+		Time:       t,
+		Historical: delayed,
+		Raw: &adapter.Event{
+			Tags:       map[string]string{"msgid": id},
+			Prefix:     user.ID,
+			Command:    "message",
+			Parameters: []string{rm.ID, body.Text},
+			Timestamp:  t,
+		},
+	}
+	if strings.HasPrefix(m.Text, actionPrefix) {
+		m.Kind, m.Text = adapter.Action, strings.TrimPrefix(m.Text, actionPrefix)
+	}
+	if re := n.child("reply", NS_REPLY); re != nil {
+		m.ReplyTo = re.attr("id")
+	}
+
+	x.dispatch(m)
+}
+
+// invited handles invitations to rooms. It returns true if n was one
+func (x *XMPP) invited(n *node) bool {
+	var roomJID, from, password string
+
+	if i := n.child("x", NS_MUC_USER).child("invite", ""); i != nil {
+		roomJID, from = bare(n.attr("from")), i.attr("from")
+		if p := n.child("x", NS_MUC_USER).child("password", ""); p != nil {
+			password = p.Text
+		}
+	} else if c := n.child("x", NS_CONFERENCE); c != nil {
+		roomJID, from, password = c.attr("jid"), n.attr("from"), c.attr("password")
+	} else {
+		return false
+	}
+
+	actor := adapter.User{ID: bare(from), Name: localpart(from), Account: bare(from), Mask: from}
+	x.dispatch(&adapter.Membership{
+		Adapter: x.Name(),
+		Kind:    adapter.Invite,
+		Room:    adapter.Room{ID: roomJID, Name: localpart(roomJID)},
+		User:    adapter.User{ID: x.full, Name: x.Nick},
+		Actor:   &actor,
+		Time:    time.Now(),
+	})
+
+	if x.AutoJoin {
+		x.AddRoom(roomJID, password)
+	}
+
+	return true
+}
+
+// reacting dispatches the reactions a user added and removed. Each reactions
+// element has all of the user's reactions to the message
+func (x *XMPP) reacting(rm adapter.Room, user adapter.User, rs *node, t time.Time) {
+	id := rs.attr("id")
+	var now []string
+	for _, r := range rs.children("reaction") {
+		now = append(now, r.Text)
+	}
+
+	key := user.ID + " " + id
+	x.mu.Lock()
+	before := x.reactions[key]
+	if len(now) > 0 {
+		x.reactions[key] = now
+	} else {
+		delete(x.reactions, key)
+	}
+	x.mu.Unlock()
+
+	added, removed := diff(before, now)
+	for _, r := range added {
+		x.dispatch(&adapter.Reaction{Adapter: x.Name(), Room: rm, MessageID: id, User: user, Reaction: r, Time: t})
+	}
+	for _, r := range removed {
+		x.dispatch(&adapter.Reaction{Adapter: x.Name(), Room: rm, MessageID: id, User: user, Reaction: r, Removed: true, Time: t})
+	}
+}
+
+// diff returns what is in b but not a, and in a but not b
+func diff(a, b []string) (added, removed []string) {
+	in := func(s string, ss []string) bool {
+		for _, t := range ss {
+			if s == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, s := range b {
+		if !in(s, a) {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !in(s, b) {
+			removed = append(removed, s)
+		}
+	}
+
+	return added, removed
+}
+
+// stripFallback removes the parts of a message's body that are only there for
+// clients that do not understand replies (XEP-0428)
+func stripFallback(n *node, body string) string {
+	type span struct{ start, end int }
+	var spans []span
+
+	for _, f := range n.children("fallback") {
+		if f.XMLName.Space != NS_FALLBACK || f.attr("for") != NS_REPLY {
+			continue
+		}
+		for _, b := range f.children("body") {
+			start, err1 := strconv.Atoi(b.attr("start"))
+			end, err2 := strconv.Atoi(b.attr("end"))
+			if err1 == nil && err2 == nil && start < end {
+				spans = append(spans, span{start, end})
+			}
+		}
+	}
+
+	// Offsets are in code points, and are removed from the last to the first
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start > spans[j].start })
+	rs := []rune(body)
+	for _, s := range spans {
+		if s.end <= len(rs) {
+			rs = append(rs[:s.start], rs[s.end:]...)
+		}
+	}
+
+	return string(rs)
+}
+
+// Send an Update to the server
+func (x *XMPP) Send(u adapter.Update) (*adapter.Message, error) {
+	switch u := u.(type) {
+	case *adapter.Message:
+		s := x.stanza(u.Room, u.Kind, u.Text)
+		if u.ReplyTo != "" {
+			s.add(el("reply", NS_REPLY, "id", u.ReplyTo))
+		}
+		return x.send(u.Room, u.Kind, u.Text, s)
+	case *adapter.Reply:
+		if u.To == nil {
+			return nil, nil
+		}
+
+		s := x.stanza(u.To.Room, u.Kind, u.Text)
+		s.add(el("reply", NS_REPLY, "id", u.To.ID, "to", u.To.User.ID))
+
+		// In rooms, clients that do not understand replies see the reply
+		// addressed to the sender
+		if !u.To.Room.Private && u.Kind == adapter.Text {
+			prefix := u.To.User.Name + ": "
+			b := s.child("body", "")
+			b.Text = prefix + b.Text
+			s.add(el("fallback", NS_FALLBACK, "for", NS_REPLY).add(
+				el("body", "", "start", "0", "end", strconv.Itoa(len([]rune(prefix)))),
+			))
+		}
+
+		m, err := x.send(u.To.Room, u.Kind, u.Text, s)
+		if m != nil {
+			m.ReplyTo = u.To.ID
+		}
+		return m, err
+	case *adapter.Edit:
+		if u.Message == nil {
+			return nil, nil
+		}
+
+		s := x.stanza(u.Message.Room, u.Message.Kind, u.Text)
+		s.add(el("replace", NS_CORRECT, "id", u.Message.ID))
+		return x.send(u.Message.Room, u.Message.Kind, u.Text, s)
+	case *adapter.Reaction:
+		return nil, x.react(u)
+	case *adapter.Membership:
+		switch u.Kind {
+		case adapter.Join:
+			x.AddRoom(u.Room.ID, "")
+			return nil, nil
+		case adapter.Leave:
+			return nil, x.RemoveRoom(u.Room.ID)
+		case adapter.Kick:
+			return nil, x.kick(u.Room.ID, resourcepart(u.User.ID), u.Reason)
+		case adapter.Invite:
+			return nil, x.invite(u.Room.ID, u.User.ID)
+		case adapter.Rename:
+			return nil, x.rename(u.NewName)
+		}
+	}
+
+	return nil, adapter.ErrNotSupported
+}
+
+// stanza builds a message to a room, with text as its body
+func (x *XMPP) stanza(rm adapter.Room, kind adapter.Kind, text string) *node {
+	typ := "groupchat"
+	if rm.Private {
+		typ = "chat"
+	}
+
+	body := format.Strip(text)
+	if kind == adapter.Action {
+		body = actionPrefix + body
+	}
+
+	return el("message", "", "type", typ, "to", rm.ID, "id", x.nextID()).
+		add(el("body", "").text(body))
+}
+
+// send the message stanza s
+func (x *XMPP) send(rm adapter.Room, kind adapter.Kind, text string, s *node) (*adapter.Message, error) {
+	if err := x.write(s); err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	nick := x.Nick
+	if r, ok := x.rooms[bare(rm.ID)]; ok {
+		nick = r.nick
+	}
+	x.mu.Unlock()
+
+	return &adapter.Message{
+		Adapter: x.Name(),
+		ID:      s.attr("id"),
+		Room:    rm,
+		User:    adapter.User{ID: x.full, Name: nick, Account: bare(x.full)},
+		Kind:    kind,
+		Text:    text,
+		Time:    time.Now(),
+	}, nil
+}
+
+// react to a message, or take back our reaction. Our reactions to the
+// message are sent as a whole
+func (x *XMPP) react(u *adapter.Reaction) error {
+	key := u.Room.ID + " " + u.MessageID
+
+	x.mu.Lock()
+	var rs []string
+	for _, r := range x.reacted[key] {
+		if r != u.Reaction {
+			rs = append(rs, r)
+		}
+	}
+	if !u.Removed {
+		rs = append(rs, u.Reaction)
+	}
+	x.reacted[key] = rs
+	x.mu.Unlock()
+
+	typ := "groupchat"
+	if u.Room.Private {
+		typ = "chat"
+	}
+
+	reactions := el("reactions", NS_REACT, "id", u.MessageID)
+	for _, r := range rs {
+		reactions.add(el("reaction", "").text(r))
+	}
+
+	return x.write(el("message", "", "type", typ, "to", u.Room.ID, "id", x.nextID()).
+		add(reactions).
+		add(el("store", "urn:xmpp:hints")))
+}
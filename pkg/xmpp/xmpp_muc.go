@@ -0,0 +1,319 @@
+package xmpp
+
+// Multi-user chat
+//
+// Rooms are joined by sending presence to room@service/nick. The room sends
+// the presence of each occupant, then our own (with status code 110), and
+// then its history, as delayed messages. Occupants joining, leaving, being
+// kicked or changing their nick are sent as presence, with status codes.
+//
+// When a room is rejoined after a reconnect, only the history since the last
+// message we saw is asked for.
+//
+// See also: https://xmpp.org/extensions/xep-0045.html
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/enmand/quarid-go/pkg/adapter"
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// MUC status codes
+const (
+	MUC_SELF_PRESENCE = "110"
+	MUC_BANNED        = "301"
+	MUC_NICK_CHANGED  = "303"
+	MUC_KICKED        = "307"
+)
+
+// room is a multi-user chat room
+type room struct {
+	jid      string
+	nick     string
+	password string
+
+	// Whether we have joined, and when we saw the room's last message
+	joined bool
+	last   time.Time
+
+	subject string
+
+	// The occupants, by nick, with their real JIDs (if the room shows them),
+	// and the nicks of occupants who are changing their nick
+	occupants map[string]string
+	renaming  map[string]bool
+}
+
+// AddRoom joins a room, and rejoins it whenever we reconnect. If we are not
+// connected, it is joined once we are
+func (x *XMPP) AddRoom(jid, password string) {
+	x.mu.Lock()
+	r, ok := x.rooms[bare(jid)]
+	if !ok {
+		r = &room{
+			jid:       bare(jid),
+			nick:      x.Nick,
+			password:  password,
+			occupants: make(map[string]string),
+			renaming:  make(map[string]bool),
+		}
+		x.rooms[r.jid] = r
+	}
+	x.mu.Unlock()
+
+	x.wmu.Lock()
+	connected := x.stream != nil
+	x.wmu.Unlock()
+
+	if connected {
+		x.join(r)
+	}
+}
+
+// RemoveRoom leaves a room
+func (x *XMPP) RemoveRoom(jid string) error {
+	x.mu.Lock()
+	r, ok := x.rooms[bare(jid)]
+	delete(x.rooms, bare(jid))
+	x.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return x.write(el("presence", "", "to", r.jid+"/"+r.nick, "type", "unavailable"))
+}
+
+// join sends our presence to a room
+func (x *XMPP) join(r *room) error {
+	x.mu.Lock()
+	mx := el("x", NS_MUC)
+	switch {
+	case !r.last.IsZero():
+		mx.add(el("history", "", "since", r.last.UTC().Format(time.RFC3339)))
+	case x.History >= 0:
+		mx.add(el("history", "", "maxstanzas", strconv.Itoa(x.History)))
+	}
+	if r.password != "" {
+		mx.add(el("password", "").text(r.password))
+	}
+	to := r.jid + "/" + r.nick
+	x.mu.Unlock()
+
+	return x.write(el("presence", "", "to", to).add(mx))
+}
+
+// rejoin every room, after a new session started
+func (x *XMPP) rejoin() {
+	x.mu.Lock()
+	var rs []*room
+	for _, r := range x.rooms {
+		r.joined = false
+		r.occupants = make(map[string]string)
+		r.renaming = make(map[string]bool)
+		rs = append(rs, r)
+	}
+	x.mu.Unlock()
+
+	for _, r := range rs {
+		x.join(r)
+	}
+}
+
+// findRoom returns the room with the JID given, if we are in it
+func (x *XMPP) findRoom(jid string) *room {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.rooms[bare(jid)]
+}
+
+// describe a room
+func (r *room) room() adapter.Room {
+	name := localpart(r.jid)
+	if name == "" {
+		name = r.jid
+	}
+
+	return adapter.Room{ID: r.jid, Name: name}
+}
+
+// occupant describes the occupant of a room with the nick given
+func (x *XMPP) occupant(r *room, nick string) adapter.User {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	u := adapter.User{ID: r.jid + "/" + nick, Name: nick}
+	if real := r.occupants[nick]; real != "" {
+		u.Account = bare(real)
+		u.Mask = real
+	}
+
+	return u
+}
+
+// presence handles presence from rooms, and subscription requests
+func (x *XMPP) presence(n *node) {
+	from := n.attr("from")
+	typ := n.attr("type")
+
+	r := x.findRoom(from)
+	if r == nil {
+		// Let anyone subscribe to our presence, so they can message us
+		if typ == "subscribe" {
+			x.write(el("presence", "", "to", bare(from), "type", "subscribed"))
+		}
+		return
+	}
+
+	nick := resourcepart(from)
+	xu := n.child("x", NS_MUC_USER)
+	codes := make(map[string]bool)
+	for _, s := range xu.children("status") {
+		codes[s.attr("code")] = true
+	}
+	item := xu.child("item", "")
+
+	x.mu.Lock()
+	self := codes[MUC_SELF_PRESENCE] || nick == r.nick
+	x.mu.Unlock()
+
+	if typ == "error" {
+		x.joinFailed(r, nick, n)
+		return
+	}
+
+	user := x.occupant(r, nick)
+	if item != nil && item.attr("jid") != "" {
+		user.Account, user.Mask = bare(item.attr("jid")), item.attr("jid")
+	}
+
+	if typ == "unavailable" {
+		ms := &adapter.Membership{
+			Adapter: x.Name(),
+			Kind:    adapter.Leave,
+			Room:    r.room(),
+			User:    user,
+			Time:    time.Now(),
+		}
+		if s := n.child("status", ""); s != nil {
+			ms.Reason = s.Text
+		}
+
+		x.mu.Lock()
+		delete(r.occupants, nick)
+		switch {
+		case codes[MUC_NICK_CHANGED]:
+			ms.Kind = adapter.Rename
+			ms.NewName = item.attr("nick")
+			r.renaming[ms.NewName] = true
+			if self {
+				r.nick = ms.NewName
+			}
+		case codes[MUC_KICKED] || codes[MUC_BANNED]:
+			ms.Kind = adapter.Kick
+			if a := item.child("actor", ""); a != nil {
+				ms.Actor = &adapter.User{ID: r.jid + "/" + a.attr("nick"), Name: a.attr("nick")}
+			}
+			if rs := item.child("reason", ""); rs != nil {
+				ms.Reason = rs.Text
+			}
+		}
+
+		joined := r.joined
+		if self && ms.Kind != adapter.Rename {
+			r.joined = false
+		}
+		x.mu.Unlock()
+
+		if joined {
+			x.dispatch(ms)
+		}
+		return
+	}
+
+	x.mu.Lock()
+	_, known := r.occupants[nick]
+	r.occupants[nick] = user.Mask
+	renamed := r.renaming[nick]
+	delete(r.renaming, nick)
+
+	// Occupants are sent before our own presence when we join, and are
+	// already there
+	join := r.joined && !known && !renamed
+	if self && !r.joined {
+		r.joined, join = true, true
+		logger.Log.Infof("Joined XMPP room %s as %s", r.jid, nick)
+	}
+	x.mu.Unlock()
+
+	if join {
+		x.dispatch(&adapter.Membership{
+			Adapter: x.Name(),
+			Kind:    adapter.Join,
+			Room:    r.room(),
+			User:    user,
+			Time:    time.Now(),
+		})
+	}
+}
+
+// joinFailed handles an error joining a room. If our nick is taken, we try
+// another
+func (x *XMPP) joinFailed(r *room, nick string, n *node) {
+	cond := n.child("error", "").condition(NS_STANZAS)
+
+	x.mu.Lock()
+	retry := !r.joined && cond == "conflict" && nick == r.nick
+	if retry {
+		r.nick += "_"
+	}
+	x.mu.Unlock()
+
+	if retry {
+		x.join(r)
+		return
+	}
+
+	logger.Log.Warningf("Could not join XMPP room %s: %s", r.jid, cond)
+}
+
+// kick an occupant from a room
+func (x *XMPP) kick(roomJID, nick, reason string) error {
+	item := el("item", "", "nick", nick, "role", "none")
+	if reason != "" {
+		item.add(el("reason", "").text(reason))
+	}
+
+	return x.write(el("iq", "", "type", "set", "id", x.nextID(), "to", bare(roomJID)).
+		add(el("query", NS_MUC_ADM).add(item)))
+}
+
+// invite a user to a room
+func (x *XMPP) invite(roomJID, jid string) error {
+	return x.write(el("message", "", "to", bare(roomJID), "id", x.nextID()).
+		add(el("x", NS_MUC_USER).add(el("invite", "", "to", bare(jid)))))
+}
+
+// rename ourselves, in every room
+func (x *XMPP) rename(nick string) error {
+	x.mu.Lock()
+	x.Nick = nick
+	var tos []string
+	for _, r := range x.rooms {
+		if r.joined {
+			tos = append(tos, r.jid+"/"+nick)
+		}
+	}
+	x.mu.Unlock()
+
+	for _, to := range tos {
+		if err := x.write(el("presence", "", "to", to)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
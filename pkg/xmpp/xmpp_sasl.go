@@ -0,0 +1,194 @@
+package xmpp
+
+// SASL
+//
+// The client authenticates with SCRAM (SHA-256, or SHA-1) if the server
+// offers it, and with PLAIN otherwise. PLAIN sends the password, so it is
+// only used over TLS, unless plaintext connections are allowed.
+//
+// See also: https://xmpp.org/rfcs/rfc6120.html#sasl
+// See also: https://tools.ietf.org/html/rfc5802
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SASL mechanisms
+const (
+	SASL_SCRAM_SHA256 = "SCRAM-SHA-256"
+	SASL_SCRAM_SHA1   = "SCRAM-SHA-1"
+	SASL_PLAIN        = "PLAIN"
+)
+
+// ErrNoMechanism is returned when the server offers no SASL mechanism we can
+// use
+var ErrNoMechanism = errors.New("The XMPP server offers no usable SASL mechanism")
+
+// AuthError is returned when the server refuses our credentials. Reconnecting
+// will not help
+type AuthError struct {
+	Condition string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("XMPP authentication failed: %s", e.Condition)
+}
+
+// authenticate with the best of the mechanisms the server offers
+func (x *XMPP) authenticate(s *stream, mechs []string) error {
+	offered := make(map[string]bool)
+	for _, m := range mechs {
+		offered[m] = true
+	}
+
+	_, secure := s.conn.(*tls.Conn)
+	user := localpart(x.JID)
+
+	switch {
+	case offered[SASL_SCRAM_SHA256]:
+		return x.scram(s, SASL_SCRAM_SHA256, sha256.New, user)
+	case offered[SASL_SCRAM_SHA1]:
+		return x.scram(s, SASL_SCRAM_SHA1, sha1.New, user)
+	case offered[SASL_PLAIN] && (secure || x.AllowPlaintext):
+		msg := "\x00" + user + "\x00" + x.Password
+		if err := s.send(el("auth", NS_SASL, "mechanism", SASL_PLAIN).
+			text(base64.StdEncoding.EncodeToString([]byte(msg)))); err != nil {
+			return err
+		}
+
+		_, err := saslResult(s)
+		return err
+	}
+
+	return ErrNoMechanism
+}
+
+// saslResult reads the server's next SASL element. A challenge is returned,
+// decoded; success is returned as nil, with its data
+func saslResult(s *stream) ([]byte, error) {
+	r, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(r.Text))
+
+	switch r.XMLName.Local {
+	case "success", "challenge":
+		return data, nil
+	case "failure":
+		return nil, &AuthError{Condition: r.condition(NS_SASL)}
+	}
+
+	return nil, fmt.Errorf("Unexpected <%s> during XMPP authentication", r.XMLName.Local)
+}
+
+// scram authenticates with a SCRAM mechanism
+func (x *XMPP) scram(s *stream, mech string, h func() hash.Hash, user string) error {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	cnonce := base64.RawStdEncoding.EncodeToString(b)
+
+	user = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+	first := "n=" + user + ",r=" + cnonce
+	if err := s.send(el("auth", NS_SASL, "mechanism", mech).
+		text(base64.StdEncoding.EncodeToString([]byte("n,," + first)))); err != nil {
+		return err
+	}
+
+	challenge, err := saslResult(s)
+	if err != nil {
+		return err
+	}
+
+	attrs := scramAttrs(string(challenge))
+	nonce, salt64 := attrs["r"], attrs["s"]
+	iter, _ := strconv.Atoi(attrs["i"])
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if !strings.HasPrefix(nonce, cnonce) || err != nil || iter < 1 {
+		return &AuthError{Condition: "invalid-challenge"}
+	}
+
+	salted := pbkdf2(h, []byte(x.Password), salt, iter)
+	clientKey := hmacSum(h, salted, []byte("Client Key"))
+	stored := h()
+	stored.Write(clientKey)
+
+	final := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	auth := first + "," + string(challenge) + "," + final
+
+	proof := hmacSum(h, stored.Sum(nil), []byte(auth))
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	final += ",p=" + base64.StdEncoding.EncodeToString(proof)
+
+	if err := s.send(el("response", NS_SASL).
+		text(base64.StdEncoding.EncodeToString([]byte(final)))); err != nil {
+		return err
+	}
+
+	result, err := saslResult(s)
+	if err != nil {
+		return err
+	}
+
+	serverKey := hmacSum(h, salted, []byte("Server Key"))
+	signature := base64.StdEncoding.EncodeToString(hmacSum(h, serverKey, []byte(auth)))
+	if scramAttrs(string(result))["v"] != signature {
+		return &AuthError{Condition: "invalid-server-signature"}
+	}
+
+	return nil
+}
+
+// scramAttrs parses the attributes of a SCRAM message
+func scramAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) > 2 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+
+	return attrs
+}
+
+func hmacSum(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives a key from password, with a single block of output, as
+// SCRAM's Hi() function
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	out := append([]byte(nil), u...)
+	for n := 1; n < iter; n++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range out {
+			out[i] ^= u[i]
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,184 @@
+package xmpp
+
+// Stream management
+//
+// With XEP-0198, both sides count the stanzas they have handled, and ask each
+// other for acknowledgements (<r/>, answered with <a h='count'/>). Stanzas we
+// sent are kept until the server acknowledges them. When the connection is
+// lost, the stream is resumed with the count of stanzas we handled, and the
+// server answers with its own, so that each side sends again only what the
+// other missed.
+//
+// See also: https://xmpp.org/extensions/xep-0198.html
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/enmand/quarid-go/pkg/logger"
+)
+
+// streamManagement is the state of XEP-0198 stream management
+type streamManagement struct {
+	// Whether we asked for stream management, after which the stanzas we
+	// send are counted, and whether the server enabled it, after which the
+	// stanzas we handle are
+	enabled   bool
+	confirmed bool
+
+	// The stream's ID, if it can be resumed
+	id string
+
+	// How many stanzas we have handled, and sent
+	in  uint32
+	out uint32
+
+	// The stanzas we sent that were not acknowledged yet
+	unacked []smStanza
+}
+
+type smStanza struct {
+	seq  uint32
+	data string
+}
+
+// resumable reports whether the stream can be resumed
+func (sm *streamManagement) resumable() bool {
+	return sm.enabled && sm.id != ""
+}
+
+// sent counts a stanza we sent
+func (sm *streamManagement) sent(data string) {
+	if !sm.enabled {
+		return
+	}
+
+	sm.out++
+	sm.unacked = append(sm.unacked, smStanza{seq: sm.out, data: data})
+}
+
+// ack drops the stanzas the server has handled, up to h
+func (sm *streamManagement) ack(h uint32) {
+	n := 0
+	for n < len(sm.unacked) && int32(sm.unacked[n].seq-h) <= 0 {
+		n++
+	}
+
+	sm.unacked = sm.unacked[n:]
+}
+
+// pending returns the stanzas to send again on a resumed stream
+func (sm *streamManagement) pending() []string {
+	var ps []string
+	for _, s := range sm.unacked {
+		ps = append(ps, s.data)
+	}
+
+	return ps
+}
+
+// failed ends stream management, when the stream could not be resumed. The
+// messages the server did not acknowledge are returned, to send again
+func (sm *streamManagement) failed() []string {
+	var ps []string
+	for _, s := range sm.unacked {
+		if strings.HasPrefix(s.data, "<message") {
+			ps = append(ps, s.data)
+		}
+	}
+
+	*sm = streamManagement{}
+	return ps
+}
+
+// handled counts a stanza we handled
+func (x *XMPP) handled() {
+	x.wmu.Lock()
+	defer x.wmu.Unlock()
+
+	if x.sm.confirmed {
+		x.sm.in++
+	}
+}
+
+// enable stream management on the new stream s. The server counts the
+// stanzas we send from <enable/> on, and so do we. x.wmu must be held
+func (x *XMPP) enable(s *stream) error {
+	if err := s.send(el("enable", NS_SM, "resume", "true")); err != nil {
+		return err
+	}
+
+	x.sm.enabled = true
+	return nil
+}
+
+// request an acknowledgement from the server
+func (x *XMPP) request() {
+	x.wmu.Lock()
+	defer x.wmu.Unlock()
+
+	if x.stream != nil {
+		x.stream.send(el("r", NS_SM))
+	}
+}
+
+// streamManagement handles stream management elements from the server
+func (x *XMPP) streamManagement(n *node) {
+	x.wmu.Lock()
+	defer x.wmu.Unlock()
+
+	switch n.XMLName.Local {
+	case "enabled":
+		// We have been counting since <enable/>, and start counting what we
+		// handle now
+		x.sm.confirmed = true
+		if r := n.attr("resume"); r == "true" || r == "1" {
+			x.sm.id = n.attr("id")
+		}
+	case "failed":
+		logger.Log.Warningf("XMPP stream management failed: %s", n.condition(NS_STANZAS))
+		x.sm = streamManagement{}
+	case "r":
+		if x.stream != nil {
+			x.stream.send(el("a", NS_SM, "h", strconv.FormatUint(uint64(x.sm.in), 10)))
+		}
+	case "a":
+		if h, err := strconv.ParseUint(n.attr("h"), 10, 32); err == nil {
+			x.sm.ack(uint32(h))
+		}
+	}
+}
+
+// resume the previous stream, if it can be. It returns true if it was
+func (x *XMPP) resume(s *stream) (bool, error) {
+	x.wmu.Lock()
+	resumable, id, in := x.sm.resumable(), x.sm.id, x.sm.in
+	x.wmu.Unlock()
+
+	if !resumable {
+		return false, nil
+	}
+
+	err := s.send(el("resume", NS_SM, "previd", id, "h", strconv.FormatUint(uint64(in), 10)))
+	if err != nil {
+		return false, err
+	}
+
+	r, err := s.next()
+	if err != nil {
+		return false, err
+	}
+
+	if r.XMLName.Local != "resumed" {
+		logger.Log.Infof("Could not resume the XMPP stream: %s", r.condition(NS_STANZAS))
+		return false, nil
+	}
+
+	if h, err := strconv.ParseUint(r.attr("h"), 10, 32); err == nil {
+		x.wmu.Lock()
+		x.sm.ack(uint32(h))
+		x.wmu.Unlock()
+	}
+
+	return true, nil
+}
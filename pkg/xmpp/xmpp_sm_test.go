@@ -0,0 +1,161 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+const timeout = 2 * time.Second
+
+// testServer is a scripted XMPP server, for one client
+type testServer struct {
+	t    *testing.T
+	ln   net.Listener
+	conn net.Conn
+	dec  *xml.Decoder
+}
+
+func newTestServer(t *testing.T) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testServer{t: t, ln: ln}
+}
+
+func (s *testServer) accept() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	s.conn, s.dec = conn, xml.NewDecoder(conn)
+}
+
+// expect the client's next element to be name
+func (s *testServer) expect(name string) *node {
+	for {
+		tok, err := s.dec.Token()
+		if err != nil {
+			s.t.Fatalf("Expected <%s>, but got %s", name, err)
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		n := &node{}
+		if err := s.dec.DecodeElement(n, &se); err != nil {
+			s.t.Fatal(err)
+		}
+		if n.XMLName.Local != name {
+			s.t.Fatalf("Expected <%s>, but got <%s>", name, n.XMLName.Local)
+		}
+
+		return n
+	}
+}
+
+func (s *testServer) send(format string, args ...interface{}) {
+	if _, err := fmt.Fprintf(s.conn, format, args...); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// open answers the client opening a stream, with the features given
+func (s *testServer) open(features string) {
+	for {
+		tok, err := s.dec.Token()
+		if err != nil {
+			s.t.Fatalf("Expected a stream, but got %s", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "stream" {
+			break
+		}
+	}
+
+	s.send("<stream:stream from='example.com' xmlns='%s' xmlns:stream='%s' version='1.0'>"+
+		"<stream:features>%s</stream:features>", NS_CLIENT, NS_STREAM, features)
+}
+
+func (s *testServer) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.ln.Close()
+}
+
+func TestStreamManagementNewSession(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	x := New("quarid@example.com", "secret")
+	x.Server = s.ln.Addr().String()
+	x.AllowPlaintext = true
+
+	// The previous stream had a message the server did not acknowledge
+	x.sm = streamManagement{
+		enabled:   true,
+		confirmed: true,
+		id:        "old",
+		in:        5,
+		out:       2,
+		unacked:   []smStanza{{seq: 2, data: "<message to='alice@example.com'><body>hi</body></message>"}},
+	}
+
+	connected := make(chan error, 1)
+	go func() { connected <- x.connect() }()
+
+	s.accept()
+	s.open("<mechanisms xmlns='" + NS_SASL + "'><mechanism>PLAIN</mechanism></mechanisms>")
+	s.expect("auth")
+	s.send("<success xmlns='%s'/>", NS_SASL)
+
+	s.open("<bind xmlns='" + NS_BIND + "'/><sm xmlns='" + NS_SM + "'/>")
+	if r := s.expect("resume"); r.attr("previd") != "old" || r.attr("h") != "5" {
+		t.Fatalf("Expected to resume old at 5, but got %s at %s", r.attr("previd"), r.attr("h"))
+	}
+	s.send("<failed xmlns='%s'><item-not-found xmlns='%s'/></failed>", NS_SM, NS_STANZAS)
+
+	s.expect("iq")
+	s.send("<iq type='result' id='bind'><bind xmlns='%s'><jid>quarid@example.com/quarid</jid></bind></iq>", NS_BIND)
+
+	// The server counts from <enable/>: our presence, and the message
+	// being sent again
+	s.expect("enable")
+	s.expect("presence")
+	s.expect("message")
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Expected to connect")
+	}
+
+	x.handled()
+	if x.sm.out != 2 || len(x.sm.unacked) != 2 || x.sm.in != 0 {
+		t.Fatalf("Expected 2 stanzas sent and none handled, but got %d (%d unacked) and %d",
+			x.sm.out, len(x.sm.unacked), x.sm.in)
+	}
+
+	x.streamManagement(el("enabled", NS_SM, "id", "new", "resume", "true"))
+	x.handled()
+	if x.sm.id != "new" || x.sm.out != 2 || x.sm.in != 1 {
+		t.Fatalf("Expected new, with 2 stanzas sent and 1 handled, but got %s with %d and %d",
+			x.sm.id, x.sm.out, x.sm.in)
+	}
+
+	x.streamManagement(el("a", NS_SM, "h", "2"))
+	if len(x.sm.unacked) != 0 {
+		t.Fatalf("Expected every stanza to be acknowledged, but %d are not", len(x.sm.unacked))
+	}
+}
@@ -0,0 +1,491 @@
+package xmpp
+
+// Streams
+//
+// An XMPP connection is a pair of XML streams. Each top-level element of the
+// stream (a stanza, or a negotiation element) is read into a node tree, and
+// nodes are built and written for the elements we send. Before stanzas are
+// exchanged, the stream is negotiated: STARTTLS, SASL authentication, and
+// resource binding, reopening the stream after each of the first two.
+//
+// See also: https://xmpp.org/rfcs/rfc6120.html
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespaces
+const (
+	NS_CLIENT   = "jabber:client"
+	NS_STREAM   = "http://etherx.jabber.org/streams"
+	NS_TLS      = "urn:ietf:params:xml:ns:xmpp-tls"
+	NS_SASL     = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NS_BIND     = "urn:ietf:params:xml:ns:xmpp-bind"
+	NS_SM       = "urn:xmpp:sm:3"
+	NS_PING     = "urn:xmpp:ping"
+	NS_STANZAS  = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	NS_DELAY    = "urn:xmpp:delay"
+	NS_MUC      = "http://jabber.org/protocol/muc"
+	NS_MUC_USER = "http://jabber.org/protocol/muc#user"
+	NS_MUC_ADM  = "http://jabber.org/protocol/muc#admin"
+	NS_SID      = "urn:xmpp:sid:0"
+	NS_REPLY    = "urn:xmpp:reply:0"
+	NS_FALLBACK = "urn:xmpp:fallback:0"
+	NS_REACT    = "urn:xmpp:reactions:0"
+	NS_CORRECT  = "urn:xmpp:message-correct:0"
+)
+
+// ErrNoTLS is returned when the server does not offer STARTTLS, and
+// plaintext connections are not allowed
+var ErrNoTLS = errors.New("The XMPP server does not offer TLS")
+
+// StreamError is a stream error from the server, after which the stream is
+// closed
+type StreamError struct {
+	Condition string
+	Text      string
+}
+
+func (e *StreamError) Error() string {
+	if e.Text != "" {
+		return fmt.Sprintf("XMPP stream error %s: %s", e.Condition, e.Text)
+	}
+
+	return fmt.Sprintf("XMPP stream error %s", e.Condition)
+}
+
+// node is an XML element, and its children
+type node struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []*node    `xml:",any"`
+	Text    string     `xml:",chardata"`
+}
+
+// el builds an element, in the namespace ns (or the parent's, if ""), with
+// attributes given as name and value pairs
+func el(name, ns string, attrs ...string) *node {
+	n := &node{XMLName: xml.Name{Space: ns, Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if attrs[i+1] != "" {
+			n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+		}
+	}
+
+	return n
+}
+
+// add children to n
+func (n *node) add(children ...*node) *node {
+	for _, c := range children {
+		if c != nil {
+			n.Nodes = append(n.Nodes, c)
+		}
+	}
+
+	return n
+}
+
+// text sets the text of n
+func (n *node) text(s string) *node {
+	n.Text = s
+	return n
+}
+
+// attr returns the value of the attribute name
+func (n *node) attr(name string) string {
+	if n == nil {
+		return ""
+	}
+
+	for _, a := range n.Attrs {
+		if a.Name.Local == name && a.Name.Space != "xmlns" {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// child returns the first child with the name, in the namespace ns (or any
+// namespace, if ""), or nil
+func (n *node) child(name, ns string) *node {
+	if n == nil {
+		return nil
+	}
+
+	for _, c := range n.Nodes {
+		if c.XMLName.Local == name && (ns == "" || c.XMLName.Space == ns) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// children returns the children with the name, in any namespace
+func (n *node) children(name string) []*node {
+	if n == nil {
+		return nil
+	}
+
+	var cs []*node
+	for _, c := range n.Nodes {
+		if c.XMLName.Local == name {
+			cs = append(cs, c)
+		}
+	}
+
+	return cs
+}
+
+// condition is the name of the first child in the namespace ns, such as the
+// condition of an error
+func (n *node) condition(ns string) string {
+	if n == nil {
+		return ""
+	}
+
+	for _, c := range n.Nodes {
+		if c.XMLName.Space == ns && c.XMLName.Local != "text" {
+			return c.XMLName.Local
+		}
+	}
+
+	return ""
+}
+
+// String serializes n as XML
+func (n *node) String() string {
+	var b bytes.Buffer
+	n.write(&b, NS_CLIENT)
+	return b.String()
+}
+
+func (n *node) write(b *bytes.Buffer, parent string) {
+	b.WriteString("<" + n.XMLName.Local)
+	if n.XMLName.Space != "" && n.XMLName.Space != parent {
+		b.WriteString(` xmlns="` + escape(n.XMLName.Space) + `"`)
+		parent = n.XMLName.Space
+	}
+	for _, a := range n.Attrs {
+		b.WriteString(" " + a.Name.Local + `="` + escape(a.Value) + `"`)
+	}
+
+	if len(n.Nodes) == 0 && n.Text == "" {
+		b.WriteString("/>")
+		return
+	}
+
+	b.WriteString(">")
+	b.WriteString(escape(n.Text))
+	for _, c := range n.Nodes {
+		c.write(b, parent)
+	}
+	b.WriteString("</" + n.XMLName.Local + ">")
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// stream is a negotiated XML stream with the server
+type stream struct {
+	conn net.Conn
+	dec  *xml.Decoder
+
+	// Whether the server offers stream management
+	sm bool
+}
+
+// open the stream to the server's domain, and read its features
+func (s *stream) open(domain string) (*node, error) {
+	s.dec = xml.NewDecoder(s.conn)
+
+	_, err := fmt.Fprintf(s.conn,
+		"<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>",
+		escape(domain), NS_CLIENT, NS_STREAM,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, err := s.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if se, ok := t.(xml.StartElement); ok {
+			if se.Name.Space != NS_STREAM || se.Name.Local != "stream" {
+				return nil, fmt.Errorf("Expected an XMPP stream, but got <%s>", se.Name.Local)
+			}
+			break
+		}
+	}
+
+	f, err := s.next()
+	if err != nil {
+		return nil, err
+	}
+	if f.XMLName.Local != "features" {
+		return nil, fmt.Errorf("Expected XMPP stream features, but got <%s>", f.XMLName.Local)
+	}
+
+	return f, nil
+}
+
+// next reads the next top-level element from the stream
+func (s *stream) next() (*node, error) {
+	for {
+		t, err := s.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			n := &node{}
+			if err := s.dec.DecodeElement(n, &t); err != nil {
+				return nil, err
+			}
+
+			if n.XMLName.Space == NS_STREAM && n.XMLName.Local == "error" {
+				e := &StreamError{Condition: n.condition("urn:ietf:params:xml:ns:xmpp-streams")}
+				if t := n.child("text", ""); t != nil {
+					e.Text = t.Text
+				}
+				return nil, e
+			}
+
+			return n, nil
+		case xml.EndElement:
+			return nil, io.EOF
+		}
+	}
+}
+
+// send a negotiation element, which is not counted as a stanza
+func (s *stream) send(n *node) error {
+	_, err := io.WriteString(s.conn, n.String())
+	return err
+}
+
+// negotiate the stream: STARTTLS, authentication, and resource binding. If
+// the previous session can be resumed, it is, and resumed is true. Stream
+// management is enabled on a new session once it is ours to write to
+func (x *XMPP) negotiate(conn net.Conn) (s *stream, resumed bool, err error) {
+	domain := domainpart(x.JID)
+	s = &stream{conn: conn}
+
+	f, err := s.open(domain)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if _, secure := conn.(*tls.Conn); !secure {
+		if f.child("starttls", NS_TLS) == nil {
+			if !x.AllowPlaintext {
+				return nil, false, ErrNoTLS
+			}
+		} else {
+			if err := s.send(el("starttls", NS_TLS)); err != nil {
+				return nil, false, err
+			}
+			r, err := s.next()
+			if err != nil {
+				return nil, false, err
+			}
+			if r.XMLName.Local != "proceed" {
+				return nil, false, fmt.Errorf("The XMPP server refused STARTTLS")
+			}
+
+			tc := tls.Client(conn, x.tlsConfig())
+			if err := tc.Handshake(); err != nil {
+				return nil, false, fmt.Errorf("Could not start TLS: %s", err)
+			}
+			s.conn = tc
+
+			if f, err = s.open(domain); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	var mechs []string
+	if m := f.child("mechanisms", NS_SASL); m != nil {
+		for _, c := range m.children("mechanism") {
+			mechs = append(mechs, c.Text)
+		}
+	}
+	if err := x.authenticate(s, mechs); err != nil {
+		return nil, false, err
+	}
+
+	if f, err = s.open(domain); err != nil {
+		return nil, false, err
+	}
+
+	s.sm = f.child("sm", NS_SM) != nil
+	if s.sm {
+		if ok, err := x.resume(s); err != nil {
+			return nil, false, err
+		} else if ok {
+			return s, true, nil
+		}
+	}
+
+	if err := x.bind(s); err != nil {
+		return nil, false, err
+	}
+
+	return s, false, nil
+}
+
+// bind a resource, and learn our full JID
+func (x *XMPP) bind(s *stream) error {
+	iq := el("iq", "", "type", "set", "id", "bind").add(
+		el("bind", NS_BIND).add(el("resource", "").text(x.Resource)),
+	)
+	if err := s.send(iq); err != nil {
+		return err
+	}
+
+	for {
+		r, err := s.next()
+		if err != nil {
+			return err
+		}
+		if r.XMLName.Local != "iq" || r.attr("id") != "bind" {
+			continue
+		}
+
+		if r.attr("type") != "result" {
+			return fmt.Errorf("Could not bind an XMPP resource: %s", r.child("error", "").condition(NS_STANZAS))
+		}
+
+		if j := r.child("bind", NS_BIND).child("jid", ""); j != nil {
+			x.mu.Lock()
+			x.full = j.Text
+			x.mu.Unlock()
+		}
+		return nil
+	}
+}
+
+// dial the server: the configured address, or the domain's SRV records, or
+// the domain itself
+func (x *XMPP) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: DIAL_TIMEOUT}
+
+	var addrs []string
+	if x.Server != "" {
+		addrs = []string{x.Server}
+	} else {
+		domain := domainpart(x.JID)
+		service := "xmpp-client"
+		if x.DirectTLS {
+			service = "xmpps-client"
+		}
+		if _, srvs, err := net.LookupSRV(service, "tcp", domain); err == nil {
+			for _, s := range srvs {
+				addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port))))
+			}
+		}
+
+		port := "5222"
+		if x.DirectTLS {
+			port = "5223"
+		}
+		addrs = append(addrs, net.JoinHostPort(domain, port))
+	}
+
+	var err error
+	for _, a := range addrs {
+		var c net.Conn
+		if x.DirectTLS {
+			c, err = tls.DialWithDialer(d, "tcp", a, x.tlsConfig())
+		} else {
+			c, err = d.Dial("tcp", a)
+		}
+		if err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not connect to XMPP server: %s", err)
+}
+
+func (x *XMPP) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         domainpart(x.JID),
+		InsecureSkipVerify: !x.TLSVerify,
+	}
+}
+
+// delay is when a stanza was originally sent, if it was delayed (such as
+// room history)
+func delay(n *node) (time.Time, bool) {
+	d := n.child("delay", NS_DELAY)
+	if d == nil {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339, d.attr("stamp"))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// JIDs
+
+// bare returns the JID without its resource
+func bare(jid string) string {
+	if n := strings.IndexByte(jid, '/'); n >= 0 {
+		return jid[:n]
+	}
+
+	return jid
+}
+
+// resourcepart returns the resource of the JID, or ""
+func resourcepart(jid string) string {
+	if n := strings.IndexByte(jid, '/'); n >= 0 {
+		return jid[n+1:]
+	}
+
+	return ""
+}
+
+// localpart returns the local part of the JID, or ""
+func localpart(jid string) string {
+	jid = bare(jid)
+	if n := strings.IndexByte(jid, '@'); n >= 0 {
+		return jid[:n]
+	}
+
+	return ""
+}
+
+// domainpart returns the domain of the JID
+func domainpart(jid string) string {
+	jid = bare(jid)
+	if n := strings.IndexByte(jid, '@'); n >= 0 {
+		return jid[n+1:]
+	}
+
+	return jid
+}
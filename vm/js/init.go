@@ -2,6 +2,7 @@ package js
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/enmand/quarid-go/vm"
 	"github.com/robertkrimen/otto"
@@ -11,8 +12,14 @@ import (
 const _modpath = "__modpath_%s___jsvm"
 
 type jsvm struct {
+	// Otto is not safe to use from more than one goroutine at a time
+	mu sync.Mutex
+
 	vm      *otto.Otto
 	modules map[string]interface{}
+
+	// The module.exports of each script that has been run
+	exports map[string]*otto.Object
 }
 
 // NewVM returns a new Otto-based JavaScript virtual machine
@@ -31,6 +38,9 @@ func (v *jsvm) Type() string {
 }
 
 func (v *jsvm) LoadScript(path string, source string) (interface{}, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
 	if _, ok := v.modules[path]; ok {
 		return nil, fmt.Errorf("Plugin named %s already exists", path)
 	}
@@ -45,15 +55,31 @@ func (v *jsvm) LoadScript(path string, source string) (interface{}, error) {
 }
 
 func (v *jsvm) Run(path string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
 	module := v.modules[path]
 
 	v.vm.Set(_modpath, path)
 
+	// Scripts export their functions with CommonJS-style module.exports
+	m, err := v.vm.Object(`({exports: {}})`)
+	if err != nil {
+		return "", fmt.Errorf("Could not create module for %s: %s", path, err)
+	}
+	exports, _ := m.Get("exports")
+	v.vm.Set("module", m)
+	v.vm.Set("exports", exports)
+
 	val, err := v.vm.Run(module.(*otto.Script))
 	if err != nil {
 		return "", fmt.Errorf("Could not run plugin %s: %s", val, err)
 	}
 
+	if exports, err := m.Get("exports"); err == nil && exports.IsObject() {
+		v.exports[path] = exports.Object()
+	}
+
 	ret, err := val.ToString()
 	if err != nil {
 		return "", fmt.Errorf("Could not convert return to response: %s", err)
@@ -62,8 +88,60 @@ func (v *jsvm) Run(path string) (string, error) {
 	return ret, nil
 }
 
+func (v *jsvm) Call(path string, fn string, args ...interface{}) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	exports, ok := v.exports[path]
+	if !ok {
+		return "", vm.ErrNotExported
+	}
+
+	f, err := exports.Get(fn)
+	if err != nil || !f.IsFunction() {
+		return "", vm.ErrNotExported
+	}
+
+	// Go values (such as maps) are converted in this VM's runtime, which
+	// otto cannot do for them when calling
+	vals := make([]interface{}, len(args))
+	for i, a := range args {
+		if vals[i], err = v.vm.ToValue(a); err != nil {
+			return "", fmt.Errorf("Could not convert argument for %s in plugin %s: %s", fn, path, err)
+		}
+	}
+
+	val, err := f.Call(exports.Value(), vals...)
+	if err != nil {
+		return "", fmt.Errorf("Could not call %s in plugin %s: %s", fn, path, err)
+	}
+
+	if val.IsUndefined() || val.IsNull() {
+		return "", nil
+	}
+
+	ret, err := val.ToString()
+	if err != nil {
+		return "", fmt.Errorf("Could not convert return to response: %s", err)
+	}
+
+	return ret, nil
+}
+
+func (v *jsvm) Set(name string, value interface{}) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.vm.Set(name, value); err != nil {
+		return fmt.Errorf("Could not set %s: %s", name, err)
+	}
+
+	return nil
+}
+
 func (v *jsvm) initialize() error {
 	v.modules = make(map[string]interface{})
+	v.exports = make(map[string]*otto.Object)
 
 	v.vm.Set("require", RequireFunc)
 
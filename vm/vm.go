@@ -1,5 +1,7 @@
 package vm
 
+import "errors"
+
 const (
 	// JS is the JavaScript VM
 	JS = "js"
@@ -20,6 +22,9 @@ const (
 	HASKELL = "haskell"
 )
 
+// ErrNotExported is returned when calling a function a script did not export
+var ErrNotExported = errors.New("Function is not exported")
+
 // A VM is a language-based virtual machine for running loading, and
 // running code
 type VM interface {
@@ -29,5 +34,12 @@ type VM interface {
 	// Run a previously loaded script in the VM
 	Run(name string) (string, error)
 
+	// Call a function exported by a previously run script, and return its
+	// result. If the script does not export fn, ErrNotExported is returned
+	Call(name string, fn string, args ...interface{}) (string, error)
+
+	// Set a global in the VM, such as a Go function scripts may call
+	Set(name string, value interface{}) error
+
 	Type() string
 }